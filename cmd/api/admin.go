@@ -0,0 +1,161 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/webhooks"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type StatusChange struct {
+	Status string    `json:"status"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+type RoleChange struct {
+	Role string `json:"role"`
+}
+
+// SetUserStatus lets an admin suspend, deactivate, delete or restore an account
+func (app *application) SetUserStatus(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid user id"))
+		return
+	}
+
+	var data StatusChange
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding status change"))
+		app.log(r).Warn("decode error", "err", err)
+		return
+	}
+
+	if data.Status == models.StatusSuspended && data.Reason == "" {
+		app.errorJSON(w, errors.New("a reason is required to suspend an account"))
+		return
+	}
+
+	if !data.Until.IsZero() && data.Until.Before(time.Now()) {
+		app.errorJSON(w, errors.New("suspension expiry must be in the future"))
+		return
+	}
+
+	app.changeUserStatus(w, r, id, data)
+}
+
+// DeactivateAccount lets users deactivate their own account
+func (app *application) DeactivateAccount(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	app.changeUserStatus(w, r, user.ID, StatusChange{
+		Status: models.StatusDeactivated,
+		Reason: "deactivated by user",
+	})
+}
+
+func (app *application) changeUserStatus(w http.ResponseWriter, r *http.Request, id int, data StatusChange) {
+	metadata := map[string]interface{}{
+		"to":     data.Status,
+		"reason": data.Reason,
+	}
+	if !data.Until.IsZero() {
+		metadata["until"] = data.Until
+	}
+
+	event := map[string]interface{}{"user": webhooks.UserData(models.User{ID: id}), "to": data.Status, "reason": data.Reason}
+	if !data.Until.IsZero() {
+		event["until"] = data.Until
+	}
+
+	from, err := app.db.DB.SetUserStatus(r.Context(), id, data.Status, data.Reason, data.Until,
+		app.outboxEvent(r, webhooks.StatusEvent(data.Status), event)...)
+	metadata["from"] = from
+	if err != nil {
+		app.audit(r, "user.status_change", id, outcomeFailure, metadata)
+		switch {
+		case errors.Is(err, repository.ErrNoRecord):
+			app.errorJSON(w, errors.New("no user with this id"), http.StatusNotFound)
+		case errors.Is(err, repository.ErrInvalidTransition):
+			app.errorJSON(w, errors.New("cannot change account from "+from+" to "+data.Status), http.StatusConflict)
+		default:
+			app.log(r).Error("error updating account status", "err", err)
+			app.errorJSON(w, errors.New("error updating account status"))
+		}
+		return
+	}
+	app.audit(r, "user.status_change", id, outcomeSuccess, metadata)
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "Account is now " + data.Status,
+		UserID:  id,
+	}
+	err = app.writeJSON(w, http.StatusOK, resp, "response")
+	if err != nil {
+		app.log(r).Error("error writing json", "err", err)
+		app.errorJSON(w, errors.New("error writing json"))
+	}
+}
+
+// SetUserRole lets an admin grant or revoke roles
+func (app *application) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid user id"))
+		return
+	}
+
+	var data RoleChange
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding role change"))
+		app.log(r).Warn("decode error", "err", err)
+		return
+	}
+
+	if data.Role != models.RoleUser && data.Role != models.RoleAdmin {
+		app.errorJSON(w, errors.New("unknown role "+data.Role))
+		return
+	}
+
+	from, err := app.db.DB.SetUserRole(r.Context(), id, data.Role)
+	metadata := map[string]interface{}{"from": from, "to": data.Role}
+	if errors.Is(err, repository.ErrNoRecord) {
+		app.audit(r, "user.role_change", id, outcomeFailure, metadata)
+		app.errorJSON(w, errors.New("no user with this id"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.log(r).Error("error updating role", "err", err)
+		app.audit(r, "user.role_change", id, outcomeFailure, metadata)
+		app.errorJSON(w, errors.New("error updating role"))
+		return
+	}
+	app.audit(r, "user.role_change", id, outcomeSuccess, metadata)
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "Role is now " + data.Role,
+		UserID:  id,
+	}
+	err = app.writeJSON(w, http.StatusOK, resp, "response")
+	if err != nil {
+		app.log(r).Error("error writing json", "err", err)
+		app.errorJSON(w, errors.New("error writing json"))
+	}
+}
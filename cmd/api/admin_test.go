@@ -0,0 +1,69 @@
+package main
+
+import (
+	"auth/api/models"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// eventType matches an outbox payload holding a webhook event of the type
+type eventType string
+
+func (t eventType) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	var event struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(b, &event) == nil && event.Type == string(t)
+}
+
+func TestSetUserStatusEvent(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		want string
+	}{
+		{models.StatusActive, models.StatusSuspended, models.EventUserStatusChanged},
+		{models.StatusActive, models.StatusDeactivated, models.EventUserStatusChanged},
+		{models.StatusDeleted, models.StatusActive, models.EventUserStatusChanged},
+		{models.StatusActive, models.StatusDeleted, models.EventUserDeleted},
+		{models.StatusDeactivated, models.StatusDeleted, models.EventUserDeleted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			app, mock := newTestApp(t)
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`select status, erased_at is not null from users`).WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"status", "erased"}).AddRow(tt.from, false))
+			mock.ExpectExec(`update\s+users`).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO outbox`).
+				WithArgs(models.OutboxEvent, testTenant.ID, eventType(tt.want), 0, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			expectAudit(mock, "user.status_change", outcomeSuccess)
+
+			body := `{"status":"` + tt.to + `","reason":"by the book"}`
+			r := httptest.NewRequest(http.MethodPut, "/v1/admin/users/7/status", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			app.SetUserStatus(w, withParams(withTenant(r, testTenant), "id", "7"))
+
+			if w.Code != http.StatusOK {
+				t.Errorf("got status %d: %s", w.Code, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
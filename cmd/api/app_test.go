@@ -0,0 +1,107 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/tokens"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/julienschmidt/httprouter"
+)
+
+var testTenant = models.Tenant{ID: 1, Slug: "acme", Name: "Acme", CreatedAt: time.Now()}
+
+func TestMain(m *testing.M) {
+	logging.SetDefault(logging.New(ioutil.Discard, logging.LevelError))
+	os.Exit(m.Run())
+}
+
+// newTestApp returns an application on a mocked database. Queries run in the
+// order they are expected in.
+func newTestApp(t *testing.T) (*application, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	app := &application{
+		logger: logging.Default(),
+		db:     repository.NewRepo(db),
+		keys:   tokens.NewKeys("a-test-secret-of-at-least-32-bytes", nil),
+	}
+	return app, mock
+}
+
+// withTenant returns the request as resolveTenant passes it on
+func withTenant(r *http.Request, tenant models.Tenant) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tenantContextKey, tenant))
+}
+
+// withParams returns the request as the router passes it on, with the path
+// parameters given as name, value pairs
+func withParams(r *http.Request, nameValues ...string) *http.Request {
+	var params httprouter.Params
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		params = append(params, httprouter.Param{Key: nameValues[i], Value: nameValues[i+1]})
+	}
+	return r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, params))
+}
+
+// expectAudit expects InsertAuditEvent to record the action in testTenant
+func expectAudit(mock sqlmock.Sqlmock, action, outcome string) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`select hash from audit_events`).WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+	mock.ExpectQuery(`nextval`).WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(1))
+	mock.ExpectExec(`INSERT INTO audit_events`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), int64(testTenant.ID), sqlmock.AnyArg(), sqlmock.AnyArg(), action, outcome,
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+// expectTenant expects the tenant to be looked up by its slug
+func expectTenant(mock sqlmock.Sqlmock, tenant models.Tenant) {
+	mock.ExpectQuery(`FROM tenants where slug`).WithArgs(tenant.Slug).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "name", "host", "created_at"}).
+			AddRow(tenant.ID, tenant.Slug, tenant.Name, tenant.Host, tenant.CreatedAt))
+}
+
+// expectUserByID expects GetUserById to find the user
+func expectUserByID(mock sqlmock.Sqlmock, u models.User) {
+	mock.ExpectQuery(`FROM users where id`).WithArgs(u.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "name", "email", "username", "role", "status",
+			"status_reason", "suspended_until", "created_at", "updated_at", "phone", "phone_verified_at", "sms_mfa"}).
+			AddRow(u.ID, u.TenantID, u.Name, u.Email, u.UserName, u.Role, u.Status,
+				u.StatusReason, nil, u.CreatedAt, u.UpdatedAt, u.Phone, nil, u.SMSMFA))
+}
+
+// expectSession expects a session of the user to be created
+func expectSession(mock sqlmock.Sqlmock, userID int) {
+	mock.ExpectExec(`INSERT INTO sessions`).
+		WithArgs(sqlmock.AnyArg(), userID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectGetSession expects GetSession to find the session
+func expectGetSession(mock sqlmock.Sqlmock, s models.Session) {
+	var actorID interface{}
+	if s.ActorID != 0 {
+		actorID = s.ActorID
+	}
+	mock.ExpectQuery(`FROM sessions where id`).WithArgs(s.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "device", "user_agent", "ip", "created_at",
+			"last_seen_at", "expires_at", "revoked_at", "actor_id"}).
+			AddRow(s.ID, s.UserID, s.Device, s.UserAgent, s.IP, s.CreatedAt, s.LastSeenAt, s.ExpiresAt, nil, actorID))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"auth/api/models"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Audit outcomes
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+// outcome is the audit outcome of an error
+func outcome(err error) string {
+	if err != nil {
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+// audit records a security relevant action in the audit trail. subjectID is the
+// user the action was taken on, zero when it is not known.
+func (app *application) audit(r *http.Request, action string, subjectID int, outcome string, metadata map[string]interface{}) {
+	event := models.AuditEvent{
+		OccurredAt: time.Now(),
+		TenantID:   tenantFromContext(r).ID,
+		SubjectID:  subjectID,
+		Action:     action,
+		Outcome:    outcome,
+		IP:         clientIP(r),
+		UserAgent:  r.UserAgent(),
+		Metadata:   metadata,
+	}
+	if actor, ok := userFromContext(r); ok {
+		event.ActorID = actor.ID
+	}
+	// what an admin does as a user is theirs
+	if adminID, ok := actorFromContext(r); ok {
+		if event.Metadata == nil {
+			event.Metadata = map[string]interface{}{}
+		}
+		event.Metadata["impersonating"] = event.ActorID
+		event.ActorID = adminID
+	}
+
+	if err := app.db.DB.InsertAuditEvent(r.Context(), event); err != nil {
+		// never lose an event, fall back to the log
+		app.log(r).Error("audit event not stored", "err", err,
+			"action", action, "actor", event.ActorID, "subject", subjectID, "outcome", outcome, "ip", event.IP)
+	}
+}
+
+// AuditEvents lets admins query the audit trail. Results are newest first,
+// pass the returned nextBefore value as before to get the next page.
+func (app *application) AuditEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var filter models.AuditFilter
+	var err error
+
+	ints := map[string]*int{
+		"actor":   &filter.ActorID,
+		"subject": &filter.SubjectID,
+		"limit":   &filter.Limit,
+	}
+	for name, dst := range ints {
+		if v := q.Get(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				app.errorJSON(w, errors.New("invalid "+name+" parameter"))
+				return
+			}
+		}
+	}
+
+	if v := q.Get("before"); v != "" {
+		if filter.Before, err = strconv.ParseInt(v, 10, 64); err != nil {
+			app.errorJSON(w, errors.New("invalid before parameter"))
+			return
+		}
+	}
+
+	times := map[string]*time.Time{
+		"from": &filter.From,
+		"to":   &filter.To,
+	}
+	for name, dst := range times {
+		if v := q.Get(name); v != "" {
+			if *dst, err = time.Parse(time.RFC3339, v); err != nil {
+				app.errorJSON(w, errors.New("invalid "+name+" parameter, use RFC 3339"))
+				return
+			}
+		}
+	}
+
+	filter.TenantID = tenantFromContext(r).ID
+	filter.Action = q.Get("action")
+	filter.Outcome = q.Get("outcome")
+	filter.IP = q.Get("ip")
+
+	events, err := app.db.DB.AuditEvents(r.Context(), filter)
+	if err != nil {
+		app.log(r).Error("error querying audit events", "err", err)
+		app.errorJSON(w, errors.New("error querying audit events"))
+		return
+	}
+
+	type auditPage struct {
+		Events     []models.AuditEvent `json:"events"`
+		NextBefore int64               `json:"nextBefore,omitempty"`
+	}
+
+	page := auditPage{Events: events}
+	if len(events) > 0 {
+		page.NextBefore = events[len(events)-1].ID
+	}
+
+	err = app.writeJSON(w, http.StatusOK, page, "audit")
+	if err != nil {
+		app.log(r).Error("error writing json", "err", err)
+		app.errorJSON(w, errors.New("error writing json"))
+	}
+}
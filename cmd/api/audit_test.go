@@ -0,0 +1,92 @@
+package main
+
+import (
+	"auth/api/models"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAuditEventsQuery(t *testing.T) {
+	app, mock := newTestApp(t)
+	now := time.Now()
+
+	// the tenant comes from the request, never from the query
+	mock.ExpectQuery(`FROM audit_events WHERE \(tenant_id = \$1 .*\) AND action = \$2 AND id < \$3 ORDER BY id DESC LIMIT \$4`).
+		WithArgs(testTenant.ID, "auth.signin", int64(40), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurred_at", "tenant_id", "actor_id", "subject_id", "action",
+			"outcome", "ip", "user_agent", "metadata", "prev_hash", "hash"}).
+			AddRow(39, now, testTenant.ID, 7, 7, "auth.signin", outcomeSuccess, "", "", []byte("{}"), "h38", "h39").
+			AddRow(31, now, testTenant.ID, 8, 8, "auth.signin", outcomeFailure, "", "", []byte("{}"), "h30", "h31"))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/admin/audit-events?action=auth.signin&before=40&limit=2&tenant=2", nil)
+	w := httptest.NewRecorder()
+	app.AuditEvents(w, withTenant(r, testTenant))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Audit struct {
+			Events     []models.AuditEvent `json:"events"`
+			NextBefore int64               `json:"nextBefore"`
+		} `json:"audit"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Audit.Events) != 2 || resp.Audit.NextBefore != 31 {
+		t.Errorf("got %+v", resp.Audit)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditEventsBadQuery(t *testing.T) {
+	for _, query := range []string{"actor=ada", "limit=-", "before=x", "from=yesterday", "to=2024-03-01"} {
+		app, mock := newTestApp(t)
+
+		r := httptest.NewRequest(http.MethodGet, "/v1/admin/audit-events?"+query, nil)
+		w := httptest.NewRecorder()
+		app.AuditEvents(w, withTenant(r, testTenant))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+}
+
+func TestAuditImpersonation(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`select hash from audit_events`).WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+	mock.ExpectQuery(`nextval`).WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(1))
+	// the admin is the actor, the user they act as is in the metadata
+	mock.ExpectExec(`INSERT INTO audit_events`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), int64(testTenant.ID), int64(1), int64(7), "user.phone_removed",
+			outcomeSuccess, "192.0.2.1", "test", []byte(`{"impersonating":7}`), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	r := httptest.NewRequest(http.MethodDelete, "/v1/me/phone", nil)
+	r.RemoteAddr = "192.0.2.1:4000"
+	r.Header.Set("User-Agent", "test")
+	ctx := context.WithValue(r.Context(), userContextKey, models.User{ID: 7})
+	ctx = context.WithValue(ctx, actorContextKey, 1)
+	app.audit(withTenant(r.WithContext(ctx), testTenant), "user.phone_removed", 7, outcomeSuccess, nil)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
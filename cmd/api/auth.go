@@ -2,24 +2,21 @@ package main
 
 import (
 	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/webhooks"
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"log"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"github.com/pascaldekloe/jwt"
 	"github.com/teris-io/shortid"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func hashPassword(pw string) string {
-	hashedPW, _ := bcrypt.GenerateFromPassword([]byte(pw), 12)
+func hashPassword(ctx context.Context, pw string) string {
+	hashedPW, _ := repository.HashPassword(ctx, pw)
 
-	fmt.Println(string(hashedPW))
 	return string(hashedPW)
 }
 
@@ -31,6 +28,7 @@ type ForgotPassword struct {
 type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Device   string `json:"device"`
 }
 
 type Signup struct {
@@ -48,54 +46,61 @@ func (app *application) Register(w http.ResponseWriter, r *http.Request) {
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		app.errorJSON(w, errors.New("error registering"))
-		app.logger.Print("decode error", err)
+		app.log(r).Warn("decode error", "err", err)
 		return
 	}
 
 	if data.Name == "" {
 		app.errorJSON(w, errors.New("name field is empty"))
-		app.logger.Println("name fields are required")
+		app.log(r).Debug("register rejected", "reason", "name is required")
 		return
 	}
 
 	if data.Email == "" {
 		app.errorJSON(w, errors.New("email is required"))
-		app.logger.Println("email is required")
+		app.log(r).Debug("register rejected", "reason", "email is required")
 		return
 	}
 
 	if data.UserName == "" {
 		app.errorJSON(w, errors.New("username is required"))
-		app.logger.Println("username is required")
+		app.log(r).Debug("register rejected", "reason", "username is required")
 		return
 	}
 	if data.Password == "" || len(data.Password) < 6 {
 		app.errorJSON(w, errors.New("password is required and should be at least six characters"))
-		app.logger.Println("password is required and should be 6 characters")
+		app.log(r).Debug("register rejected", "reason", "password too short")
 		return
 	}
 	if data.Password != data.PassWordConfirm {
 		app.errorJSON(w, errors.New("passwords do not match"))
-		app.logger.Println("passwords do not match")
+		app.log(r).Debug("register rejected", "reason", "passwords do not match")
 		return
 	}
 
 	user := models.User{
+		TenantID: tenantFromContext(r).ID,
 		Name:     data.Name,
 		Email:    data.Email,
 		Password: data.Password,
 		UserName: data.UserName,
 	}
 
-	i, err := app.db.DB.InsertUser(user)
+	user.Role = models.RoleUser // the column default
+	registered := app.outboxEvent(r, models.EventUserRegistered, map[string]interface{}{"user": webhooks.UserData(user), "method": "password"})
+
+	i, err := app.db.DB.InsertUser(r.Context(), user, registered...)
 	user.ID = i
-	log.Println(i)
 	if err != nil {
-		app.logger.Print(err)
+		app.log(r).Error("error registering user", "err", err)
+		app.audit(r, "auth.register", 0, outcomeFailure, nil)
+		registrations.Inc(outcomeFailure)
 
 		app.errorJSON(w, err)
 		return
 	}
+	app.audit(r, "auth.register", user.ID, outcomeSuccess, nil)
+	registrations.Inc(outcomeSuccess)
 
 	userId := int(user.ID)
 	userJson := jsonResp{
@@ -105,7 +110,7 @@ func (app *application) Register(w http.ResponseWriter, r *http.Request) {
 	}
 	err = app.writeJSON(w, http.StatusCreated, userJson, "newUser")
 	if err != nil {
-		app.logger.Print(err)
+		app.log(r).Error("error writing json", "err", err)
 		app.errorJSON(w, errors.New("error writing json"))
 		return
 	}
@@ -126,38 +131,83 @@ func (app *application) Signin(w http.ResponseWriter, r *http.Request) {
 	pw := creds.Password
 	userName := creds.Username
 
-	id, userPW, err := app.db.DB.Authenticate(userName, pw)
+	user, method, err := app.authenticate(r, userName, pw)
 
-	if err != nil {
+	if errors.Is(err, repository.ErrSuspendedAccount) {
+		app.audit(r, "auth.signin", 0, outcomeFailure, map[string]interface{}{"method": method, "reason": "suspended"})
+		signins.Inc(outcomeFailure, "suspended")
+		app.errorJSON(w, errors.New("unauthorized, account is suspended"), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, repository.ErrInactiveAccount) {
+		app.audit(r, "auth.signin", 0, outcomeFailure, map[string]interface{}{"method": method, "reason": "inactive"})
+		signins.Inc(outcomeFailure, "inactive")
+		app.errorJSON(w, errors.New("unauthorized, account is not active"), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errEmailTaken) {
+		app.audit(r, "auth.signin", 0, outcomeFailure, map[string]interface{}{"method": authenticatorLDAP, "reason": err.Error()})
+		signins.Inc(outcomeFailure, "no_account")
+		app.errorJSON(w, errEmailTaken, http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, repository.ErrInvalidCredentials) {
+		app.audit(r, "auth.signin", 0, outcomeFailure, map[string]interface{}{"reason": "invalid credentials"})
+		signins.Inc(outcomeFailure, "invalid_credentials")
 		app.errorJSON(w, errors.New("unauthorized, check your login details"), http.StatusForbidden)
 		return
 	}
-	var user models.User
-	user.ID = id
-	user.Password = userPW
-	err = bcrypt.CompareHashAndPassword([]byte(userPW), ([]byte(creds.Password)))
 	if err != nil {
-		app.errorJSON(w, errors.New("Unauthorized"))
+		signins.Inc(outcomeFailure, "error")
+		app.errorJSON(w, errors.New("error signing in, try again later"), http.StatusServiceUnavailable)
 		return
 	}
+	id := user.ID
 
-	//create JWT
-	var claims jwt.Claims
-	claims.Subject = fmt.Sprint(id)
-	claims.Issued = jwt.NewNumericTime(time.Now())
-	claims.NotBefore = jwt.NewNumericTime(time.Now())
-	claims.Expires = jwt.NewNumericTime(time.Now().Add(time.Hour * 24))
-	claims.Issuer = "mydomain.com"
-	claims.Audiences = []string{"mydomain.com"}
+	if app.challengeSecondFactor(w, r, id) {
+		return
+	}
 
-	//create token
-	jwtBytes, err := claims.HMACSign(jwt.HS256, []byte(app.config.jwt.secret))
+	//create session and JWT
+	session, err := app.startSession(r, id, creds.Device)
 	if err != nil {
+		app.log(r).Error("error signing in", "err", err)
+		signins.Inc(outcomeFailure, "error")
 		app.errorJSON(w, errors.New("error signing in"))
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, string(jwtBytes), "token")
+	app.audit(r, "auth.signin", id, outcomeSuccess, map[string]interface{}{"method": method})
+	signins.Inc(outcomeSuccess, "")
+	app.writeSession(w, session)
+}
+
+// Signout ends the current session
+func (app *application) Signout(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	err := app.db.DB.RevokeSession(r.Context(), user.ID, sessionFromContext(r))
+	if err != nil && !errors.Is(err, repository.ErrNoRecord) {
+		app.log(r).Error("error signing out", "err", err)
+		app.errorJSON(w, errors.New("error signing out"))
+		return
+	}
+	app.audit(r, "auth.signout", user.ID, outcomeSuccess, nil)
+
+	if app.config.session.mode == sessionModeCookie {
+		app.clearSessionCookies(w)
+	}
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "Signed out",
+		UserID:  user.ID,
+	}
+	app.writeJSON(w, http.StatusOK, resp, "response")
 }
 
 func (app *application) StatusHandler(w http.ResponseWriter, r *http.Request) {
@@ -166,13 +216,19 @@ func (app *application) StatusHandler(w http.ResponseWriter, r *http.Request) {
 		Environment: app.config.env,
 		Version:     version,
 	}
+	status := http.StatusOK
+
+	if _, ok := app.runChecks(r.Context()); !ok || app.stopping() {
+		currentStatus.Status = "Unhealthy"
+		status = http.StatusServiceUnavailable
+	}
 
 	json, err := json.MarshalIndent(currentStatus, "", "\t")
 	if err != nil {
-		app.logger.Println(err)
+		app.log(r).Error("error writing status json", "err", err)
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	w.Write(json)
 }
 
@@ -181,7 +237,7 @@ func (app *application) SecuredRoute(w http.ResponseWriter, r *http.Request) {
 
 	// id, err := strconv.Atoi(params.ByName("id"))
 	// if err != nil {
-	// 	app.logger.Print(errors.New("error getting id from params"))
+	// 	app.log(r).Warn("error getting id from params", "err", err)
 	// 	app.errorJSON(w, err)
 	// 	return
 	// }
@@ -194,7 +250,7 @@ func (app *application) SecuredRoute(w http.ResponseWriter, r *http.Request) {
 
 	err := app.writeJSON(w, http.StatusOK, ok, "products")
 	if err != nil {
-		app.logger.Print(errors.New("error creating products json"))
+		app.log(r).Error("error creating products json", "err", err)
 		app.errorJSON(w, err)
 		return
 	}
@@ -206,12 +262,11 @@ func (app *application) OpenRoute(w http.ResponseWriter, r *http.Request) {
 
 	id, err := strconv.Atoi(params.ByName("id"))
 	if err != nil {
-		app.logger.Print(errors.New("error getting id from params"))
+		app.log(r).Warn("error getting id from params", "err", err)
 		app.errorJSON(w, err)
 		return
 	}
 
-	app.logger.Println(id)
 	ok := jsonResp{
 		OK:      true,
 		Message: "Open route, Anyone can see!!",
@@ -221,7 +276,7 @@ func (app *application) OpenRoute(w http.ResponseWriter, r *http.Request) {
 
 	err = app.writeJSON(w, http.StatusOK, ok, "response")
 	if err != nil {
-		app.logger.Print(errors.New("error creating response json"))
+		app.log(r).Error("error creating response json", "err", err)
 		app.errorJSON(w, err)
 		return
 	}
@@ -232,57 +287,69 @@ func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 	var data ForgotPassword
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		app.errorJSON(w, errors.New("error posting forgot password credentials"))
-		app.logger.Print("decode error", err)
+		app.log(r).Warn("decode error", "err", err)
 		return
 	}
-	log.Println(data.Email)
 	var u models.User
 
 	u.Email = data.Email
-	user, err := app.db.DB.GetUserByEmail(u.Email)
+	user, err := app.db.DB.GetUserByEmail(r.Context(), tenantFromContext(r).ID, u.Email)
 	if err != nil {
-		app.logger.Print(err)
+		app.log(r).Error("no user with this email", "err", err)
+		app.audit(r, "auth.forgot_password", user.ID, outcomeFailure, nil)
+		resetRequests.Inc(outcomeFailure)
 		app.errorJSON(w, errors.New("no user with this email"), http.StatusForbidden)
 		return
 
 	}
 	resetCode, err := shortid.Generate()
 	if err != nil {
-		app.logger.Print(err)
+		app.log(r).Error("error generating password reset code", "err", err)
 		app.errorJSON(w, errors.New("error generating password reset code"))
 		return
 
 	}
-	app.logger.Println("Reset code: ", resetCode)
 	user.Email = data.Email
 	user.PasswordResetCode = resetCode
-	app.logger.Println("DB Reset code: ", user.PasswordResetCode)
 
-	err = app.db.DB.AddResetPasswordCodeToUser(user)
+	// sent by the outbox dispatcher once the code is stored, the gateway being
+	// down only delays it
+	email, err := outboxEmail(user.TenantID, models.ForgotPasswordEmailPayload{
+		Source:            emailSource,
+		Destination:       user.Email,
+		PasswordResetCode: user.PasswordResetCode,
+	})
 	if err != nil {
-		app.logger.Print(err)
-		app.errorJSON(w, errors.New("error adding password reset code to the DB"))
+		app.log(r).Error("error encoding password reset email", "err", err)
+		app.errorJSON(w, errors.New("error sending password reset email"))
 		return
-
 	}
 
-	//prepare to send email
+	err = app.db.DB.AddResetPasswordCodeToUser(r.Context(), user, email)
+	if err != nil {
+		app.log(r).Error("error adding password reset code to the DB", "err", err)
+		app.errorJSON(w, errors.New("error adding password reset code to the DB"))
+		return
 
-	params := models.ForgotPasswordEmailPayload{
-		Source:            "darinmcodingprojects@gmail.com",
-		Destination:       user.Email,
-		PasswordResetCode: user.PasswordResetCode,
 	}
+	app.audit(r, "auth.forgot_password", user.ID, outcomeSuccess, nil)
+	resetRequests.Inc(outcomeSuccess)
 
-	app.SendEmail(w, params)
-
+	resp := jsonResp{
+		OK:      true,
+		Message: "email queued",
+	}
+	err = app.writeJSON(w, http.StatusOK, resp, "response")
+	if err != nil {
+		app.errorJSON(w, errors.New("could not send forgot email response json"))
+	}
 }
 
 func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	var data ForgotPassword
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		app.errorJSON(w, errors.New("error posting forgot password credentials"))
-		app.logger.Print("decode error", err)
+		app.log(r).Warn("decode error", "err", err)
 		return
 	}
 
@@ -290,43 +357,44 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	email := data.Email
 	newPassword := data.NewPassword
 
-	password := []byte(newPassword)
-
-	u, err := app.db.DB.GetUserByEmail(data.Email)
+	u, err := app.db.DB.GetUserByEmail(r.Context(), tenantFromContext(r).ID, data.Email)
 	if err != nil {
-		app.logger.Print(err)
+		app.log(r).Error("no user with this email", "err", err)
+		app.audit(r, "auth.reset_password", u.ID, outcomeFailure, nil)
 		app.errorJSON(w, errors.New("no user with this email"), http.StatusForbidden)
 		return
 
 	}
 
 	if u.PasswordResetCode != resetCode {
-		app.logger.Println("Invalid reset password code ", resetCode)
-		app.logger.Println("DB reset code", u.PasswordResetCode)
+		app.log(r).Warn("invalid reset password code", "user_id", u.ID)
+		app.audit(r, "auth.reset_password", u.ID, outcomeFailure, map[string]interface{}{"reason": "invalid reset code"})
 		app.errorJSON(w, errors.New("invalid reset password code"), http.StatusForbidden)
 		return
 	}
 	// Create a bcrypt hash of the plain-text password.
-	hashPassword, err := bcrypt.GenerateFromPassword(password, 12)
+	hashPassword, err := repository.HashPassword(r.Context(), newPassword)
 
 	if err != nil {
 		app.errorJSON(w, errors.New("error hashing password"))
-		app.logger.Print("Hash PW error", err)
+		app.log(r).Error("error hashing password", "err", err)
 		return
 	}
 	var user models.User
+	user.TenantID = u.TenantID
 	user.Email = email
 	user.Password = string(hashPassword)
 	user.PasswordResetCode = resetCode
 
-	err = app.db.DB.UpdateUserPassword(user)
+	err = app.db.DB.UpdateUserPassword(r.Context(), user,
+		app.outboxEvent(r, models.EventUserPasswordChanged, map[string]interface{}{"user": webhooks.UserData(u), "method": "reset"})...)
 	if err != nil {
 		app.errorJSON(w, errors.New("error updating password in DB"))
-		app.logger.Print("Save PW in DB error", err)
+		app.log(r).Error("error updating password in DB", "err", err)
 		return
 	}
 
-	app.logger.Println("reset code: ", resetCode, "\npassword: ", newPassword, "\nEmail: ", email)
+	app.audit(r, "auth.reset_password", u.ID, outcomeSuccess, nil)
 
 	respJson := jsonResp{
 		OK:      true,
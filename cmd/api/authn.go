@@ -0,0 +1,98 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/repository"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Authenticators that can check a username and password
+const (
+	authenticatorLocal = "local"
+	authenticatorLDAP  = "ldap"
+)
+
+// authenticator checks a username and password for the request's tenant
+type authenticator interface {
+	name() string
+	// authenticate returns the local user the credentials belong to.
+	// repository.ErrInvalidCredentials hands them on to the next authenticator.
+	authenticate(r *http.Request, username, password string) (models.User, error)
+}
+
+// newAuthenticators builds the chain in the configured order
+func (app *application) newAuthenticators() []authenticator {
+	var chain []authenticator
+	for _, name := range app.config.authenticators {
+		switch name {
+		case authenticatorLocal:
+			chain = append(chain, localAuthenticator{app: app})
+		case authenticatorLDAP:
+			chain = append(chain, newLDAPAuthenticator(app))
+		}
+	}
+	return chain
+}
+
+// authenticate asks each authenticator in turn and returns the first user one
+// vouches for, with the authenticator's name. A password that is right but
+// belongs to a suspended or inactive account ends the chain. An authenticator
+// that cannot be reached is skipped, and its error returned when no other
+// authenticator knows the user, so an outage is not reported as a bad password.
+func (app *application) authenticate(r *http.Request, username, password string) (models.User, string, error) {
+	err := repository.ErrInvalidCredentials
+	for _, a := range app.authenticators {
+		user, authErr := a.authenticate(r, username, password)
+		switch {
+		case authErr == nil:
+			return user, a.name(), nil
+		case errors.Is(authErr, repository.ErrInvalidCredentials):
+		case errors.Is(authErr, repository.ErrSuspendedAccount), errors.Is(authErr, repository.ErrInactiveAccount):
+			return models.User{}, a.name(), authErr
+		default:
+			app.log(r).Error("authenticator failed", "authenticator", a.name(), "err", authErr)
+			err = authErr
+		}
+	}
+	return models.User{}, "", err
+}
+
+// localAuthenticator checks the bcrypt hash stored with the user
+type localAuthenticator struct {
+	app *application
+}
+
+func (localAuthenticator) name() string {
+	return authenticatorLocal
+}
+
+func (a localAuthenticator) authenticate(r *http.Request, username, password string) (models.User, error) {
+	id, _, err := a.app.db.DB.Authenticate(r.Context(), tenantFromContext(r).ID, username, password)
+	if err != nil {
+		return models.User{}, err
+	}
+	return a.app.db.DB.GetUserById(r.Context(), id)
+}
+
+// validAuthenticatorConfig checks the authenticator list and the settings of
+// the authenticators in it
+func validAuthenticatorConfig(c config) error {
+	if len(c.authenticators) == 0 {
+		return errors.New("authenticators must name at least one of local and ldap")
+	}
+
+	seen := map[string]bool{}
+	for _, name := range c.authenticators {
+		if (name != authenticatorLocal && name != authenticatorLDAP) || seen[name] {
+			return fmt.Errorf("authenticators may only contain local and ldap, each once, got %q", name)
+		}
+		seen[name] = true
+	}
+
+	if seen[authenticatorLDAP] {
+		return validLDAPConfig(c)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"auth/api/directory/directorytest"
+	"auth/api/models"
+	"auth/api/repository"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	ldapServiceDN = "cn=svc,dc=example,dc=com"
+	ldapAdminsDN  = "cn=admins,ou=groups,dc=example,dc=com"
+	ldapAliceUUID = "0f7a3c1e-0000-4000-8000-000000000001"
+)
+
+// newChainTestApp returns an application checking passwords with the
+// authenticators in order, the directory at url being the ldap one
+func newChainTestApp(t *testing.T, url string, authenticators ...string) (*application, sqlmock.Sqlmock) {
+	t.Helper()
+
+	app, mock := newTestApp(t)
+	app.config.authenticators = authenticators
+	c := &app.config.ldap
+	c.url = url
+	c.bindDN = ldapServiceDN
+	c.bindPassword = "svc-pass"
+	c.baseDN = "dc=example,dc=com"
+	c.userFilter = "(&(objectClass=person)(uid=%s))"
+	c.idAttribute = "entryUUID"
+	c.usernameAttribute = "uid"
+	c.nameAttribute = "cn"
+	c.emailAttribute = "mail"
+	c.groupAttribute = "memberOf"
+	c.adminGroups = []string{"admins"}
+	app.authenticators = app.newAuthenticators()
+
+	return app, mock
+}
+
+// newTestLDAP starts a directory where alice is an admin
+func newTestLDAP(t *testing.T) *directorytest.Server {
+	t.Helper()
+
+	s, err := directorytest.NewServer(
+		directorytest.Entry{DN: ldapServiceDN, Password: "svc-pass"},
+		directorytest.Entry{
+			DN:       "uid=alice,ou=people,dc=example,dc=com",
+			Password: "ldap-pass",
+			Attributes: map[string][]string{
+				"objectClass": {"person"},
+				"uid":         {"alice"},
+				"entryUUID":   {ldapAliceUUID},
+				"cn":          {"Alice Liddell"},
+				"mail":        {"alice@corp.example.com"},
+				"memberOf":    {ldapAdminsDN},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// expectLocalPassword expects the local authenticator to look the user up
+// and find the password
+func expectLocalPassword(t *testing.T, mock sqlmock.Sqlmock, username string, u models.User, password string) {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(`id, password, status, suspended_until`).WithArgs(testTenant.ID, username).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password", "status", "suspended_until"}).
+			AddRow(u.ID, string(hash), u.Status, nil))
+}
+
+// expectNoLocalUser expects the local authenticator not to know the user
+func expectNoLocalUser(mock sqlmock.Sqlmock, username string) {
+	mock.ExpectQuery(`id, password, status, suspended_until`).WithArgs(testTenant.ID, username).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password", "status", "suspended_until"}))
+}
+
+func signinRequest() *http.Request {
+	return withTenant(httptest.NewRequest(http.MethodPost, "/v1/signin", nil), testTenant)
+}
+
+func TestAuthenticateChain(t *testing.T) {
+	local := models.User{
+		ID: 5, TenantID: testTenant.ID, Name: "Bob", Email: "bob@example.com", UserName: "bob",
+		Role: models.RoleUser, Status: models.StatusActive, CreatedAt: time.Now(), UpdatedAt: time.Now(),
+	}
+
+	t.Run("falls back to local users", func(t *testing.T) {
+		s := newTestLDAP(t)
+		app, mock := newChainTestApp(t, s.URL(), authenticatorLDAP, authenticatorLocal)
+
+		expectLocalPassword(t, mock, "bob", local, "local-pass")
+		expectUserByID(mock, local)
+
+		user, by, err := app.authenticate(signinRequest(), "bob", "local-pass")
+		if err != nil || user.ID != local.ID || by != authenticatorLocal {
+			t.Errorf("got user %d by %q, %v; want %d by local", user.ID, by, err, local.ID)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("wrong password everywhere", func(t *testing.T) {
+		s := newTestLDAP(t)
+		app, mock := newChainTestApp(t, s.URL(), authenticatorLDAP, authenticatorLocal)
+
+		expectLocalPassword(t, mock, "alice", local, "local-pass")
+
+		_, _, err := app.authenticate(signinRequest(), "alice", "wrong")
+		if !errors.Is(err, repository.ErrInvalidCredentials) {
+			t.Errorf("got %v, want ErrInvalidCredentials", err)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("directory down, local user", func(t *testing.T) {
+		s := newTestLDAP(t)
+		url := s.URL()
+		s.Close()
+		app, mock := newChainTestApp(t, url, authenticatorLDAP, authenticatorLocal)
+
+		expectLocalPassword(t, mock, "bob", local, "local-pass")
+		expectUserByID(mock, local)
+
+		user, by, err := app.authenticate(signinRequest(), "bob", "local-pass")
+		if err != nil || user.ID != local.ID || by != authenticatorLocal {
+			t.Errorf("got user %d by %q, %v; want %d by local", user.ID, by, err, local.ID)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("directory down, directory user", func(t *testing.T) {
+		s := newTestLDAP(t)
+		url := s.URL()
+		s.Close()
+		app, mock := newChainTestApp(t, url, authenticatorLDAP, authenticatorLocal)
+
+		expectNoLocalUser(mock, "alice")
+
+		// an outage is not a wrong password
+		_, _, err := app.authenticate(signinRequest(), "alice", "ldap-pass")
+		if err == nil || errors.Is(err, repository.ErrInvalidCredentials) {
+			t.Errorf("got %v, want the directory error", err)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("suspended local user ends the chain", func(t *testing.T) {
+		s := newTestLDAP(t)
+		app, mock := newChainTestApp(t, s.URL(), authenticatorLocal, authenticatorLDAP)
+
+		suspended := local
+		suspended.Status = models.StatusSuspended
+		expectLocalPassword(t, mock, "bob", suspended, "local-pass")
+
+		_, by, err := app.authenticate(signinRequest(), "bob", "local-pass")
+		if !errors.Is(err, repository.ErrSuspendedAccount) || by != authenticatorLocal {
+			t.Errorf("got %v by %q, want ErrSuspendedAccount by local", err, by)
+		}
+		if n := len(s.Filters()); n != 0 {
+			t.Errorf("directory searched %d times after the chain ended", n)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	identityColumns := []string{"id", "tenant_id", "user_id", "provider", "subject", "email", "created_at", "last_login_at"}
+
+	t.Run("first sign-in provisions an admin", func(t *testing.T) {
+		s := newTestLDAP(t)
+		app, mock := newChainTestApp(t, s.URL(), authenticatorLDAP)
+		provisioned := models.User{
+			ID: 9, TenantID: testTenant.ID, Name: "Alice Liddell", Email: "alice@corp.example.com", UserName: "alice",
+			Role: models.RoleAdmin, Status: models.StatusActive, CreatedAt: time.Now(), UpdatedAt: time.Now(),
+		}
+
+		mock.ExpectQuery(`FROM identities`).WithArgs(testTenant.ID, ldapProvider, ldapAliceUUID).
+			WillReturnRows(sqlmock.NewRows(identityColumns))
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO users`).
+			WithArgs(testTenant.ID, "Alice Liddell", "alice@corp.example.com", "alice", models.RoleAdmin, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(provisioned.ID))
+		mock.ExpectQuery(`INSERT INTO identities`).
+			WithArgs(testTenant.ID, provisioned.ID, ldapProvider, ldapAliceUUID, "alice@corp.example.com", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+		mock.ExpectExec(`INSERT INTO outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		expectAudit(mock, "auth.register", outcomeSuccess)
+		expectUserByID(mock, provisioned)
+
+		user, _, err := app.authenticate(signinRequest(), "alice", "ldap-pass")
+		if err != nil || user.ID != provisioned.ID || user.Role != models.RoleAdmin {
+			t.Errorf("got user %d with role %q, %v; want %d with role admin", user.ID, user.Role, err, provisioned.ID)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("later sign-ins sync attributes and role", func(t *testing.T) {
+		s := newTestLDAP(t)
+		app, mock := newChainTestApp(t, s.URL(), authenticatorLDAP)
+		linked := models.User{
+			ID: 9, TenantID: testTenant.ID, Name: "Alice", Email: "alice@old.example.com", UserName: "alice",
+			Role: models.RoleUser, Status: models.StatusActive, CreatedAt: time.Now(), UpdatedAt: time.Now(),
+		}
+
+		mock.ExpectQuery(`FROM identities`).WithArgs(testTenant.ID, ldapProvider, ldapAliceUUID).
+			WillReturnRows(sqlmock.NewRows(identityColumns).
+				AddRow(4, testTenant.ID, linked.ID, ldapProvider, ldapAliceUUID, linked.Email, time.Now(), nil))
+		mock.ExpectExec(`update identities set last_login_at`).WithArgs(sqlmock.AnyArg(), "alice@corp.example.com", 4).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectUserByID(mock, linked)
+		mock.ExpectExec(`update users set name`).
+			WithArgs("Alice Liddell", "alice@corp.example.com", sqlmock.AnyArg(), linked.ID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(`returning old.role`).WithArgs(models.RoleAdmin, sqlmock.AnyArg(), linked.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(models.RoleUser))
+		expectAudit(mock, "user.role_change", outcomeSuccess)
+
+		user, _, err := app.authenticate(signinRequest(), "alice", "ldap-pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Name != "Alice Liddell" || user.Email != "alice@corp.example.com" || user.Role != models.RoleAdmin {
+			t.Errorf("got %q <%s> with role %q, want the directory's name, email and admin", user.Name, user.Email, user.Role)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("other tenants are refused", func(t *testing.T) {
+		s := newTestLDAP(t)
+		app, mock := newChainTestApp(t, s.URL(), authenticatorLDAP)
+		app.config.ldap.tenants = []string{"other"}
+
+		_, _, err := app.authenticate(signinRequest(), "alice", "ldap-pass")
+		if !errors.Is(err, repository.ErrInvalidCredentials) {
+			t.Errorf("got %v, want ErrInvalidCredentials", err)
+		}
+		if n := len(s.Filters()); n != 0 {
+			t.Errorf("directory searched %d times for a tenant it does not serve", n)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
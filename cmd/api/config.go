@@ -0,0 +1,261 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/tracing"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is put in front of every environment variable we read
+const envPrefix = "AUTH_"
+
+// configFile is the path given with -config
+var configFile string
+
+// loadConfig fills cfg from, in increasing priority, the flag defaults, a YAML
+// file, environment variables and command line flags.
+//
+// Every setting is named after its flag. The file uses the flag name as key
+// (jwt-secret: ...) and the environment uses it upper cased with an AUTH_ prefix
+// (AUTH_JWT_SECRET). Adding a -file suffix to a key or _FILE to a variable reads
+// the value from that file instead, for secrets mounted into the container.
+func loadConfig(args []string) error {
+	getFlags()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if configFile == "" {
+		configFile = os.Getenv(envPrefix + "CONFIG")
+	}
+	if configFile != "" {
+		if err := applyConfigFile(configFile, explicit); err != nil {
+			return err
+		}
+	}
+
+	if err := applyEnv(explicit); err != nil {
+		return err
+	}
+
+	return cfg.validate()
+}
+
+// applyConfigFile sets every flag found in the YAML file that was not given on the command line
+func applyConfigFile(path string, explicit map[string]bool) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{}
+	if err = yaml.Unmarshal(raw, &values); err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+
+	// sorted so errors come out the same every run
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name, value := key, configValue(values[key])
+
+		if strings.HasSuffix(key, "-file") && flag.Lookup(key) == nil {
+			name = strings.TrimSuffix(key, "-file")
+			if value, err = readSecretFile(value); err != nil {
+				return fmt.Errorf("config file %s: %s: %v", path, key, err)
+			}
+		}
+
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("config file %s: unknown setting %q", path, key)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err = flag.Set(name, value); err != nil {
+			return fmt.Errorf("config file %s: %s: %v", path, key, err)
+		}
+	}
+
+	return nil
+}
+
+// applyEnv sets every flag with an AUTH_ environment variable that was not given on the command line
+func applyEnv(explicit map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+
+		env := envName(f.Name)
+		value, ok := os.LookupEnv(env)
+		if path, isFile := os.LookupEnv(env + "_FILE"); isFile {
+			env += "_FILE"
+			if value, err = readSecretFile(path); err != nil {
+				err = fmt.Errorf("%s: %v", env, err)
+				return
+			}
+			ok = true
+		}
+
+		if ok {
+			if setErr := flag.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %v", env, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// envName turns a flag name into its environment variable, jwt-secret becomes AUTH_JWT_SECRET
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// configValue turns a YAML value into the string form its flag parses, lists become comma separated
+func configValue(v interface{}) string {
+	if list, ok := v.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// readSecretFile reads a mounted secret, dropping the trailing newline editors add
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// validate checks the final configuration before anything starts
+func (c config) validate() error {
+	switch c.env {
+	case "dev", "staging", "prod":
+	default:
+		return fmt.Errorf("env must be dev, staging or prod, got %q", c.env)
+	}
+
+	if _, err := logging.ParseLevel(c.logLevel); err != nil {
+		return err
+	}
+
+	if c.port <= 0 || c.port > 65535 {
+		return fmt.Errorf("port %d is out of range", c.port)
+	}
+
+	if c.db.dsn == "" {
+		return errors.New("dsn is required")
+	}
+
+	if c.jwt.secret == "" {
+		return errors.New("jwt-secret is required")
+	}
+	if len(c.jwt.secret) < 32 {
+		return errors.New("jwt-secret must be at least 32 characters")
+	}
+	for _, p := range c.jwt.previousSecrets {
+		if len(p) < 32 {
+			return errors.New("every jwt-previous-secrets entry must be at least 32 characters")
+		}
+	}
+
+	if c.audit.key == "" {
+		return errors.New("audit-key is required")
+	}
+
+	if u, err := url.Parse(c.mailer.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("mailer-url must be an http or https URL, got %q", c.mailer.url)
+	}
+
+	if c.magicLink.ttl <= 0 || c.magicLink.ttl > time.Hour {
+		return errors.New("magic-link-ttl must be positive and at most an hour")
+	}
+
+	if c.metrics.addr != "" {
+		if _, _, err := net.SplitHostPort(c.metrics.addr); err != nil {
+			return fmt.Errorf("metrics-addr must be host:port, got %q", c.metrics.addr)
+		}
+	}
+
+	if c.shutdown.delay < 0 || c.shutdown.timeout <= 0 {
+		return errors.New("shutdown-delay must not be negative and shutdown-timeout must be positive")
+	}
+
+	switch c.trace.exporter {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	default:
+		return fmt.Errorf("trace-exporter must be none, stdout or otlp, got %q", c.trace.exporter)
+	}
+
+	if c.trace.sampleRatio < 0 || c.trace.sampleRatio > 1 {
+		return fmt.Errorf("trace-sample-ratio must be between 0 and 1, got %g", c.trace.sampleRatio)
+	}
+
+	if err := validTenantConfig(c); err != nil {
+		return err
+	}
+
+	if err := validAuthenticatorConfig(c); err != nil {
+		return err
+	}
+
+	if err := validOIDCConfig(c); err != nil {
+		return err
+	}
+
+	if err := validSAMLConfig(c); err != nil {
+		return err
+	}
+
+	if err := validOAuthConfig(c); err != nil {
+		return err
+	}
+
+	if err := validSMSConfig(c); err != nil {
+		return err
+	}
+
+	if err := validOutboxConfig(c); err != nil {
+		return err
+	}
+
+	if err := validWebhookConfig(c); err != nil {
+		return err
+	}
+
+	if err := validSessionConfig(c); err != nil {
+		return err
+	}
+
+	return validCORSConfig(c)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"auth/api/tokens"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Session modes
+const (
+	sessionModeToken  = "token"
+	sessionModeCookie = "cookie"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// sameSiteModes maps the -cookie-samesite flag to cookie settings
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// csrfToken derives the CSRF token of a session. Tying it to the session means
+// a token planted by another site or subdomain never matches.
+func csrfToken(secret []byte, sessionID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("csrf:" + sessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken checks a CSRF token against the current and previous JWT
+// secrets, so cookie sessions survive a key rotation
+func (app *application) validCSRFToken(sessionID, token string) bool {
+	for _, secret := range append([][]byte{app.keys.Current}, app.keys.Previous...) {
+		if hmac.Equal([]byte(token), []byte(csrfToken(secret, sessionID))) {
+			return true
+		}
+	}
+	return false
+}
+
+// setSessionCookies stores the session token in an HttpOnly cookie and the CSRF
+// token in a cookie scripts can read. It returns the CSRF token.
+func (app *application) setSessionCookies(w http.ResponseWriter, s signedSession) string {
+	csrf := csrfToken(app.keys.Current, s.ID)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     app.config.session.cookieName,
+		Value:    string(s.Token),
+		Path:     "/",
+		Domain:   app.config.session.cookieDomain,
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Secure:   app.config.session.cookieSecure,
+		SameSite: sameSiteModes[app.config.session.sameSite],
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrf,
+		Path:     "/",
+		Domain:   app.config.session.cookieDomain,
+		Expires:  s.Expires,
+		Secure:   app.config.session.cookieSecure,
+		SameSite: sameSiteModes[app.config.session.sameSite],
+	})
+
+	return csrf
+}
+
+// clearSessionCookies removes the session cookies from the browser
+func (app *application) clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{app.config.session.cookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			Domain:   app.config.session.cookieDomain,
+			Expires:  time.Unix(0, 0),
+			MaxAge:   -1,
+			HttpOnly: name != csrfCookieName,
+			Secure:   app.config.session.cookieSecure,
+			SameSite: sameSiteModes[app.config.session.sameSite],
+		})
+	}
+}
+
+// checkCookie is checkToken for browsers, the token is read from the session cookie.
+// Scripts have no cookies, so a personal access token in the Authorization
+// header is accepted too, and so is an impersonation token, which is only ever
+// handed out in a body.
+func (app *application) checkCookie(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Cookie")
+		w.Header().Add("Vary", "Authorization")
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if tokens.IsPersonal(token) {
+			app.servePersonal(w, r, next, token)
+			return
+		}
+		if token != "" && tokens.IsImpersonation([]byte(token)) {
+			app.serveAuthorized(w, r, next, token)
+			return
+		}
+
+		cookie, err := r.Cookie(app.config.session.cookieName)
+		if err != nil || cookie.Value == "" {
+			tokenFailures.Inc("missing")
+			app.errorJSON(w, errors.New("unauthorized, no session cookie"), http.StatusUnauthorized)
+			return
+		}
+
+		app.serveAuthorized(w, r, next, cookie.Value)
+	})
+}
+
+// csrfProtect makes state changing requests prove they came from our own pages by
+// echoing the CSRF token in a header. It must run after checkCookie. Requests
+// made with a personal access or impersonation token carry no cookies a
+// browser could be tricked into sending, so they need no CSRF token.
+func (app *application) csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := personalTokenFromContext(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if tokens.IsImpersonation([]byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get(csrfHeader)
+		cookie, err := r.Cookie(csrfCookieName)
+
+		if err != nil || header == "" ||
+			!hmac.Equal([]byte(header), []byte(cookie.Value)) ||
+			!app.validCSRFToken(sessionFromContext(r), header) {
+			tokenFailures.Inc("csrf")
+			app.errorJSON(w, errors.New("forbidden, missing or invalid CSRF token"), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validSessionConfig checks the session flags make sense together
+func validSessionConfig(c config) error {
+	switch c.session.mode {
+	case sessionModeToken, sessionModeCookie:
+	default:
+		return errors.New("session mode must be token or cookie")
+	}
+
+	if _, ok := sameSiteModes[c.session.sameSite]; !ok {
+		return errors.New("cookie samesite must be lax, strict or none")
+	}
+
+	if c.session.sameSite == "none" && !c.session.cookieSecure {
+		return errors.New("samesite none cookies must be secure")
+	}
+
+	return nil
+}
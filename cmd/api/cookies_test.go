@@ -0,0 +1,107 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/tokens"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidCSRFToken(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.keys = tokens.NewKeys("the-current-secret-of-32-bytes-or-more", []string{"an-old-secret-of-at-least-32-bytes"})
+
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{"current key", csrfToken(app.keys.Current, "session-1"), true},
+		{"previous key", csrfToken(app.keys.Previous[0], "session-1"), true},
+		{"retired key", csrfToken([]byte("a-retired-secret-of-at-least-32-bytes"), "session-1"), false},
+		{"other session", csrfToken(app.keys.Current, "session-2"), false},
+		{"empty", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := app.validCSRFToken("session-1", tt.token); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCSRFProtect(t *testing.T) {
+	app, _ := newTestApp(t)
+	valid := csrfToken(app.keys.Current, "session-1")
+	impersonation, err := tokens.Sign(app.keys, tokens.Grant{
+		UserID: 7, Tenant: testTenant.Slug, SessionID: "session-2", Expires: time.Now().Add(time.Hour), ActorID: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := tokens.Sign(app.keys, tokens.Grant{
+		UserID: 7, Tenant: testTenant.Slug, SessionID: "session-1", Expires: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		cookie string
+		// authorization is the bearer token sent, if any
+		authorization string
+		personal      bool
+		want          int
+	}{
+		{name: "header matches cookie", method: http.MethodPost, header: valid, cookie: valid, want: http.StatusOK},
+		{name: "safe method", method: http.MethodGet, want: http.StatusOK},
+		{name: "no header", method: http.MethodPost, cookie: valid, want: http.StatusForbidden},
+		{name: "no cookie", method: http.MethodDelete, header: valid, want: http.StatusForbidden},
+		{name: "header differs from cookie", method: http.MethodPut, header: valid, cookie: valid + "x", want: http.StatusForbidden},
+		{
+			name:   "planted token of another session",
+			method: http.MethodPost,
+			header: csrfToken(app.keys.Current, "session-9"),
+			cookie: csrfToken(app.keys.Current, "session-9"),
+			want:   http.StatusForbidden,
+		},
+		{name: "personal access token", method: http.MethodPost, personal: true, want: http.StatusOK},
+		{name: "impersonation token", method: http.MethodPost, authorization: string(impersonation), want: http.StatusOK},
+		// a session token in the header does not stand in for the CSRF token
+		{name: "session token", method: http.MethodPost, authorization: string(session), want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/users/7", nil)
+			r = r.WithContext(context.WithValue(r.Context(), sessionContextKey, "session-1"))
+			if tt.personal {
+				r = r.WithContext(context.WithValue(r.Context(), tokenContextKey, models.PersonalAccessToken{ID: 3}))
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeader, tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+			}
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.authorization)
+			}
+
+			w := httptest.NewRecorder()
+			app.csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// allowedOrigin reports whether the origin matches the CORS allowlist.
+// Entries may use * as a wildcard, e.g. https://*.example.com, and a lone * allows any origin.
+func (app *application) allowedOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	for _, pattern := range app.config.cors.origins {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// enableCORS lets allowed origins read our responses
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if app.allowedOrigin(origin) {
+			// always echo the origin, browsers refuse * together with credentials
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if app.config.cors.credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Expose-Headers", csrfHeader)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers CORS preflight requests, the router calls it for every OPTIONS
+// request to a known path after setting the Allow header
+func (app *application) preflight(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Access-Control-Request-Method") == "" {
+		// a plain OPTIONS request, the Allow header says it all
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	if !app.allowedOrigin(r.Header.Get("Origin")) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(app.config.cors.methods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(app.config.cors.headers, ", "))
+	if app.config.cors.maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(app.config.cors.maxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// validCORSConfig refuses policies that would let any site act as a signed in user
+func validCORSConfig(c config) error {
+	for _, origin := range c.cors.origins {
+		if origin == "*" && c.cors.credentials {
+			return errors.New("cors origin * can't be combined with cors credentials")
+		}
+		if _, err := path.Match(origin, ""); err != nil {
+			return fmt.Errorf("bad cors origin pattern %q: %v", origin, err)
+		}
+		if c.cors.credentials && isPattern(origin) && !isSubdomainPattern(origin) {
+			return fmt.Errorf("cors origin %q can't be combined with cors credentials, only subdomain wildcards like https://*.example.com can", origin)
+		}
+	}
+	return nil
+}
+
+// isPattern reports whether an origin uses any path.Match wildcard
+func isPattern(origin string) bool {
+	return strings.ContainsAny(origin, `*?[\`)
+}
+
+// isSubdomainPattern accepts origins whose only wildcard is a leading *. in
+// front of a fixed host with a fixed scheme, e.g. https://*.example.com
+func isSubdomainPattern(origin string) bool {
+	for _, scheme := range []string{"https://", "http://"} {
+		if host := strings.TrimPrefix(origin, scheme+"*."); host != origin {
+			// the fixed part must name a domain, not just a top level domain
+			return !isPattern(host) && strings.Contains(strings.TrimSuffix(host, "."), ".")
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAllowedOrigin(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.config.cors.origins = []string{"https://app.example.com", "https://*.example.org"}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.EXAMPLE.COM", true},
+		{"https://admin.example.org", true},
+		{"https://a.b.example.org", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+		{"https://evil.com", false},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"null", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := app.allowedOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowedOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestEnableCORS(t *testing.T) {
+	tests := []struct {
+		name        string
+		origin      string
+		credentials bool
+		wantOrigin  string
+		wantCreds   string
+	}{
+		{name: "allowed", origin: "https://app.example.com", wantOrigin: "https://app.example.com"},
+		{name: "allowed with credentials", origin: "https://app.example.com", credentials: true,
+			wantOrigin: "https://app.example.com", wantCreds: "true"},
+		{name: "not allowed", origin: "https://evil.com", credentials: true},
+		{name: "no origin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApp(t)
+			app.config.cors.origins = []string{"https://app.example.com"}
+			app.config.cors.credentials = tt.credentials
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/secure", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			app.enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, tt.wantOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.wantCreds {
+				t.Errorf("got Access-Control-Allow-Credentials %q, want %q", got, tt.wantCreds)
+			}
+			if got := w.Header().Get("Vary"); got != "Origin" {
+				t.Errorf("got Vary %q, want Origin", got)
+			}
+		})
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.config.cors.origins = []string{"https://app.example.com"}
+	app.config.cors.methods = []string{"GET", "POST"}
+	app.config.cors.headers = []string{"Content-Type", "Authorization"}
+	app.config.cors.maxAge = 10 * time.Minute
+
+	tests := []struct {
+		name        string
+		origin      string
+		method      string
+		want        int
+		wantMethods string
+	}{
+		{name: "allowed origin", origin: "https://app.example.com", method: "POST", want: http.StatusNoContent, wantMethods: "GET, POST"},
+		{name: "other origin", origin: "https://evil.com", method: "POST", want: http.StatusForbidden},
+		{name: "plain OPTIONS", want: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodOptions, "/v1/signin", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.method != "" {
+				r.Header.Set("Access-Control-Request-Method", tt.method)
+			}
+			w := httptest.NewRecorder()
+			app.preflight(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("got Access-Control-Allow-Methods %q, want %q", got, tt.wantMethods)
+			}
+			if tt.wantMethods != "" {
+				if got := w.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type, Authorization" {
+					t.Errorf("got Access-Control-Allow-Headers %q", got)
+				}
+				if got := w.Header().Get("Access-Control-Max-Age"); got != "600" {
+					t.Errorf("got Access-Control-Max-Age %q, want 600", got)
+				}
+			}
+		})
+	}
+}
+
+func TestValidCORSConfig(t *testing.T) {
+	tests := []struct {
+		origin      string
+		credentials bool
+		wantErr     bool
+	}{
+		{origin: "*"},
+		{origin: "https://*"},
+		{origin: "https://app.example.com", credentials: true},
+		{origin: "https://*.example.com", credentials: true},
+		{origin: "http://*.localhost.test", credentials: true},
+		{origin: "*", credentials: true, wantErr: true},
+		{origin: "https://*", credentials: true, wantErr: true},
+		{origin: "*://app.example.com", credentials: true, wantErr: true},
+		{origin: "https://*.com", credentials: true, wantErr: true},
+		{origin: "https://app*.example.com", credentials: true, wantErr: true},
+		{origin: "https://*.example.*", credentials: true, wantErr: true},
+		{origin: "https://*.*.example.com", credentials: true, wantErr: true},
+		{origin: "https://ap?.example.com", credentials: true, wantErr: true},
+		{origin: "https://[a-z].example.com", credentials: true, wantErr: true},
+		{origin: "https://[a-z.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var c config
+		c.cors.origins = []string{tt.origin}
+		c.cors.credentials = tt.credentials
+		if err := validCORSConfig(c); (err != nil) != tt.wantErr {
+			t.Errorf("%q with credentials %v: got %v, want error %v", tt.origin, tt.credentials, err, tt.wantErr)
+		}
+	}
+}
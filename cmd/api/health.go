@@ -0,0 +1,150 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/tokens"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds every readiness check
+const checkTimeout = 2 * time.Second
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+	// optional checks are reported but do not fail readiness
+	optional bool
+}
+
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// healthChecks are the dependencies a replica needs to serve sign-ins. The
+// email gateway is optional: emails wait in the outbox while it is down.
+func (app *application) healthChecks() []healthCheck {
+	return []healthCheck{
+		{name: "database", check: app.db.DB.Ping},
+		{name: "signing_keys", check: app.checkSigningKeys},
+		{name: "mailer", check: app.checkMailer, optional: true},
+	}
+}
+
+// runChecks runs every health check at once and reports whether all but the
+// optional ones passed.
+// Errors are logged rather than returned, probes may be reachable by anyone.
+func (app *application) runChecks(ctx context.Context) (map[string]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	checks := app.healthChecks()
+	results := make(map[string]string, len(checks))
+	healthy := true
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+			result := "ok"
+			err := c.check(ctx)
+			if err != nil {
+				result = "failing"
+				logging.FromContext(ctx).Warn("health check failed", "check", c.name, "err", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[c.name] = result
+			if err != nil && !c.optional {
+				healthy = false
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return results, healthy
+}
+
+// checkSigningKeys signs and verifies a throwaway token and audit message so a
+// bad key is found before users are issued tokens that cannot be checked
+func (app *application) checkSigningKeys(ctx context.Context) error {
+	token, err := app.issueToken(tokens.Grant{
+		Tenant:    tokens.DefaultTenant,
+		SessionID: "readyz",
+		Expires:   time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		return errors.New("jwt signing failed")
+	}
+	if _, _, err = tokens.Check(app.keys, token); err != nil {
+		return errors.New("jwt verification failed")
+	}
+
+	if len(app.auditKey) != ed25519.PrivateKeySize {
+		return errors.New("audit key missing")
+	}
+	msg := []byte("readyz")
+	pub := app.auditKey.Public().(ed25519.PublicKey)
+	if !ed25519.Verify(pub, msg, ed25519.Sign(app.auditKey, msg)) {
+		return errors.New("audit key does not verify")
+	}
+
+	return nil
+}
+
+// checkMailer checks that the email gateway accepts connections
+func (app *application) checkMailer(ctx context.Context) error {
+	u, err := url.Parse(app.config.mailer.url)
+	if err != nil {
+		return err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return errors.New("email gateway unreachable")
+	}
+	return conn.Close()
+}
+
+// Livez reports that the process is up and serving, it checks no dependencies
+// so a slow database never gets the pod restarted
+func (app *application) Livez(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, healthReport{Status: "alive"}, "health")
+}
+
+// Readyz reports whether this replica should get traffic. It fails while
+// shutting down and whenever a required dependency check fails.
+func (app *application) Readyz(w http.ResponseWriter, r *http.Request) {
+	if app.stopping() {
+		app.writeJSON(w, http.StatusServiceUnavailable, healthReport{Status: "shutting down"}, "health")
+		return
+	}
+
+	checks, ok := app.runChecks(r.Context())
+	if !ok {
+		app.writeJSON(w, http.StatusServiceUnavailable, healthReport{Status: "not ready", Checks: checks}, "health")
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, healthReport{Status: "ready", Checks: checks}, "health")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyzMailer(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	tests := []struct {
+		name   string
+		mailer string
+		want   string
+	}{
+		{name: "gateway up", mailer: "http://" + up.Addr().String() + "/send", want: "ok"},
+		// emails wait in the outbox, the replica still serves sign-ins
+		{name: "gateway down", mailer: "http://" + down.Addr().String() + "/send", want: "failing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApp(t)
+			app.config.mailer.url = tt.mailer
+			if _, app.auditKey, err = ed25519.GenerateKey(nil); err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			app.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("readyz answered %d, want 200", w.Code)
+			}
+
+			var resp struct {
+				Health healthReport `json:"health"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Health.Checks["mailer"]; got != tt.want {
+				t.Errorf("mailer check is %q, want %q", got, tt.want)
+			}
+			if got := resp.Health.Checks["database"]; got != "ok" {
+				t.Errorf("database check is %q, want ok", got)
+			}
+		})
+	}
+}
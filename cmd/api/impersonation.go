@@ -0,0 +1,133 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/tokens"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// impersonationLifetime is how long a session started by impersonation and its token stay valid
+const impersonationLifetime = 15 * time.Minute
+
+// maxImpersonationReason caps the reason stored in the audit trail
+const maxImpersonationReason = 500
+
+// ImpersonationRequest says why an admin needs to act as a user
+type ImpersonationRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Impersonate gives an admin a short-lived token to act as a user of their
+// tenant, for support. The token names the admin in an act claim (RFC 8693),
+// which introspection reports too, so services can refuse sensitive operations
+// to it; here it cannot reach the routes managing the account. Admins cannot
+// be impersonated, and the token stops working once the admin could not
+// start it anymore.
+func (app *application) Impersonate(w http.ResponseWriter, r *http.Request) {
+	admin, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid user id"))
+		return
+	}
+
+	var data ImpersonationRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding impersonation request"))
+		return
+	}
+	data.Reason = strings.TrimSpace(data.Reason)
+	if data.Reason == "" || len(data.Reason) > maxImpersonationReason {
+		app.errorJSON(w, errors.New("reason is required and should be at most 500 characters"))
+		return
+	}
+
+	user, err := app.db.DB.GetUserById(r.Context(), id)
+	if err != nil {
+		app.errorJSON(w, errors.New("no user with this id"), http.StatusNotFound)
+		return
+	}
+
+	metadata := map[string]interface{}{"reason": data.Reason}
+	switch {
+	case user.ID == admin.ID:
+		app.errorJSON(w, errors.New("cannot impersonate yourself"))
+		return
+	case user.Role == models.RoleAdmin:
+		metadata["refused"] = "admin"
+		app.audit(r, "user.impersonate", id, outcomeFailure, metadata)
+		app.errorJSON(w, errors.New("admins cannot be impersonated"), http.StatusForbidden)
+		return
+	case repository.CheckAccountStatus(user) != nil:
+		app.errorJSON(w, errors.New("account is not active"), http.StatusConflict)
+		return
+	}
+
+	s, err := app.startImpersonation(r, user.ID, admin.ID)
+	metadata["session"] = s.ID
+	metadata["expires"] = s.Expires
+	app.audit(r, "user.impersonate", id, outcome(err), metadata)
+	if err != nil {
+		app.log(r).Error("error starting impersonation", "err", err)
+		app.errorJSON(w, errors.New("error starting impersonation"), http.StatusInternalServerError)
+		return
+	}
+
+	type impersonationResp struct {
+		Token     string    `json:"token"`
+		UserID    int       `json:"userId"`
+		ActorID   int       `json:"actorId"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	resp := impersonationResp{
+		Token:     string(s.Token),
+		UserID:    user.ID,
+		ActorID:   admin.ID,
+		ExpiresAt: s.Expires,
+	}
+	app.writeJSON(w, http.StatusCreated, resp, "impersonation")
+}
+
+// startImpersonation records a session of the user that the admin acts in and
+// returns a signed token for it
+func (app *application) startImpersonation(r *http.Request, userID, actorID int) (signedSession, error) {
+	s := signedSession{
+		UserID:  userID,
+		Expires: time.Now().Add(impersonationLifetime),
+	}
+
+	var err error
+	s.ID, err = app.db.DB.CreateSession(r.Context(), models.Session{
+		UserID:    userID,
+		Device:    "impersonation",
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		ExpiresAt: s.Expires,
+		ActorID:   actorID,
+	})
+	if err != nil {
+		return s, err
+	}
+
+	s.Token, err = app.issueToken(tokens.Grant{
+		UserID:    userID,
+		Tenant:    tenantFromContext(r).Slug,
+		SessionID: s.ID,
+		Expires:   s.Expires,
+		ActorID:   actorID,
+	})
+	return s, err
+}
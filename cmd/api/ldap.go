@@ -0,0 +1,236 @@
+package main
+
+import (
+	"auth/api/directory"
+	"auth/api/models"
+	"auth/api/oidc"
+	"auth/api/repository"
+	"auth/api/tracing"
+	"auth/api/webhooks"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ldapProvider names directory accounts in the identities table
+const ldapProvider = "ldap"
+
+// ldapAuthenticator checks passwords against the directory and signs them in
+// as the local user linked to the directory entry. The user is created on
+// their first sign-in and gets the entry's name, email and, when admin groups
+// are configured, role on every one after.
+type ldapAuthenticator struct {
+	app    *application
+	client *directory.Client
+}
+
+func newLDAPAuthenticator(app *application) ldapAuthenticator {
+	c := app.config.ldap
+	return ldapAuthenticator{
+		app: app,
+		client: directory.New(directory.Config{
+			URL:                c.url,
+			StartTLS:           c.startTLS,
+			InsecureSkipVerify: c.insecureSkipVerify,
+			BindDN:             c.bindDN,
+			BindPassword:       c.bindPassword,
+			BaseDN:             c.baseDN,
+			UserFilter:         c.userFilter,
+			IDAttribute:        c.idAttribute,
+			UsernameAttribute:  c.usernameAttribute,
+			NameAttribute:      c.nameAttribute,
+			EmailAttribute:     c.emailAttribute,
+			GroupAttribute:     c.groupAttribute,
+		}),
+	}
+}
+
+func (ldapAuthenticator) name() string {
+	return authenticatorLDAP
+}
+
+func (a ldapAuthenticator) authenticate(r *http.Request, username, password string) (models.User, error) {
+	if !a.allowsTenant(tenantFromContext(r).Slug) {
+		return models.User{}, repository.ErrInvalidCredentials
+	}
+
+	ctx, span := tracing.Start(r.Context(), "directory.authenticate")
+	entry, err := a.client.Authenticate(ctx, username, password)
+	if err != nil && !errors.Is(err, directory.ErrInvalidCredentials) {
+		tracing.RecordError(ctx, err)
+	}
+	span.End()
+	if errors.Is(err, directory.ErrInvalidCredentials) {
+		return models.User{}, repository.ErrInvalidCredentials
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+
+	user, err := a.directoryUser(r, entry)
+	if err != nil {
+		return models.User{}, err
+	}
+	return user, repository.CheckAccountStatus(user)
+}
+
+// allowsTenant reports whether directory users may sign in to the tenant
+func (a ldapAuthenticator) allowsTenant(slug string) bool {
+	tenants := a.app.config.ldap.tenants
+	if len(tenants) == 0 {
+		return true
+	}
+	for _, t := range tenants {
+		if t == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// role returns the role the entry's groups give, admin when any of them is
+// one of -ldap-admin-groups
+func (a ldapAuthenticator) role(entry directory.Entry) string {
+	for _, dn := range entry.Groups {
+		name := directory.GroupName(dn)
+		for _, g := range a.app.config.ldap.adminGroups {
+			if strings.EqualFold(g, name) || strings.EqualFold(g, dn) {
+				return models.RoleAdmin
+			}
+		}
+	}
+	return models.RoleUser
+}
+
+// directoryUser returns the local user linked to a directory entry, creating
+// one on the first sign-in, and brings it in line with the entry
+func (a ldapAuthenticator) directoryUser(r *http.Request, entry directory.Entry) (models.User, error) {
+	app := a.app
+	ctx := r.Context()
+	tenant := tenantFromContext(r)
+	syncRoles := len(app.config.ldap.adminGroups) > 0
+
+	if entry.Email == "" {
+		return models.User{}, fmt.Errorf("directory entry %s has no %s attribute", entry.DN, app.config.ldap.emailAttribute)
+	}
+	if entry.Name == "" {
+		entry.Name = entry.Username
+	}
+
+	linked, err := app.db.DB.GetIdentity(ctx, tenant.ID, ldapProvider, entry.ID)
+	if errors.Is(err, repository.ErrNoRecord) {
+		return a.provision(r, entry)
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if err = app.db.DB.TouchIdentity(ctx, linked.ID, entry.Email); err != nil {
+		app.log(r).Error("error touching identity", "err", err)
+	}
+	user, err := app.db.DB.GetUserById(ctx, linked.UserID)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if user.Name != entry.Name || user.Email != entry.Email {
+		err = app.db.DB.SyncUserAttributes(ctx, user.ID, entry.Name, entry.Email)
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			app.log(r).Warn("directory email belongs to another user, not synced", "user", user.ID)
+		} else if err != nil {
+			return models.User{}, err
+		} else {
+			user.Name, user.Email = entry.Name, entry.Email
+		}
+	}
+
+	if role := a.role(entry); syncRoles && role != user.Role {
+		from, err := app.db.DB.SetUserRole(ctx, user.ID, role)
+		app.audit(r, "user.role_change", user.ID, outcome(err), map[string]interface{}{"from": from, "to": role, "via": ldapProvider})
+		if err != nil {
+			return models.User{}, err
+		}
+		user.Role = role
+	}
+
+	return user, nil
+}
+
+// provision creates the local user for a directory entry signing in for the first time
+func (a ldapAuthenticator) provision(r *http.Request, entry directory.Entry) (models.User, error) {
+	app := a.app
+	ctx := r.Context()
+	tenant := tenantFromContext(r)
+
+	user := models.User{
+		TenantID: tenant.ID,
+		Name:     entry.Name,
+		Email:    entry.Email,
+		UserName: entry.Username,
+		Role:     a.role(entry),
+	}
+	identity := models.Identity{TenantID: tenant.ID, Provider: ldapProvider, Subject: entry.ID, Email: entry.Email}
+
+	var err error
+	user.ID, err = app.db.DB.ProvisionUser(ctx, user, identity,
+		app.outboxEvent(r, models.EventUserRegistered, map[string]interface{}{"user": webhooks.UserData(user), "method": ldapProvider})...)
+	if errors.Is(err, repository.ErrDuplicateUsername) {
+		// a local user has the name, the directory user still signs in with it
+		suffix, _ := oidc.NewVerifier()
+		user.UserName = user.UserName + "-" + strings.ToLower(suffix[:6])
+		user.ID, err = app.db.DB.ProvisionUser(ctx, user, identity,
+			app.outboxEvent(r, models.EventUserRegistered, map[string]interface{}{"user": webhooks.UserData(user), "method": ldapProvider})...)
+	}
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		return models.User{}, fmt.Errorf("directory entry %s: %w", entry.DN, errEmailTaken)
+	}
+	app.audit(r, "auth.register", user.ID, outcome(err), map[string]interface{}{"method": ldapProvider})
+	if err != nil {
+		registrations.Inc(outcomeFailure)
+		return models.User{}, err
+	}
+	registrations.Inc(outcomeSuccess)
+
+	return app.db.DB.GetUserById(ctx, user.ID)
+}
+
+// validLDAPConfig checks the directory flags
+func validLDAPConfig(c config) error {
+	u, err := url.Parse(c.ldap.url)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return fmt.Errorf("ldap-url must be an ldap or ldaps URL, got %q", c.ldap.url)
+	}
+	if u.Scheme == "ldaps" && c.ldap.startTLS {
+		return errors.New("ldap-starttls cannot be used with an ldaps URL")
+	}
+	if c.env == "prod" && ((u.Scheme == "ldap" && !c.ldap.startTLS) || c.ldap.insecureSkipVerify) {
+		return errors.New("refusing to send directory passwords without verified TLS in prod, use ldaps or ldap-starttls")
+	}
+
+	if c.ldap.baseDN == "" {
+		return errors.New("ldap-base-dn is required")
+	}
+	if !strings.Contains(c.ldap.userFilter, "%s") || !strings.HasPrefix(c.ldap.userFilter, "(") {
+		return fmt.Errorf("ldap-user-filter must be an LDAP filter with %%s for the username, got %q", c.ldap.userFilter)
+	}
+	if c.ldap.bindDN != "" && c.ldap.bindPassword == "" {
+		return errors.New("ldap-bind-password is required with ldap-bind-dn")
+	}
+
+	attributes := []struct{ flag, value string }{
+		{"ldap-id-attribute", c.ldap.idAttribute},
+		{"ldap-username-attribute", c.ldap.usernameAttribute},
+		{"ldap-name-attribute", c.ldap.nameAttribute},
+		{"ldap-email-attribute", c.ldap.emailAttribute},
+		{"ldap-group-attribute", c.ldap.groupAttribute},
+	}
+	for _, a := range attributes {
+		if a.value == "" {
+			return fmt.Errorf("%s cannot be empty", a.flag)
+		}
+	}
+
+	return nil
+}
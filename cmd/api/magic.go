@@ -0,0 +1,199 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/tokens"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// magicLinkInterval is how long a user waits between sign-in links, so the
+// endpoint cannot be used to flood someone's inbox
+const magicLinkInterval = time.Minute
+
+// emailSource is the sender of the emails we ask the gateway to send
+const emailSource = "darinmcodingprojects@gmail.com"
+
+type MagicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+type MagicLinkExchange struct {
+	Token  string `json:"token"`
+	Device string `json:"device"`
+}
+
+// parseMagicLinkURL reads the -magic-link-url page, nil when empty
+func parseMagicLinkURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Fragment != "" {
+		return nil, fmt.Errorf("magic-link-url must be an http or https URL without a fragment, got %q", s)
+	}
+	return u, nil
+}
+
+// RequestMagicLink emails a sign-in link to the account with the email. The
+// answer is the same whether or not there is such an account, and the link is
+// sent after answering so the response time does not tell either.
+func (app *application) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var data MagicLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error requesting sign-in link"))
+		app.log(r).Warn("decode error", "err", err)
+		return
+	}
+
+	if data.Email == "" {
+		app.errorJSON(w, errors.New("email is required"))
+		return
+	}
+
+	// the clone keeps the headers audit reads once this handler has returned
+	req := r.Clone(r.Context())
+	app.background(r.Context(), func(ctx context.Context) {
+		app.sendMagicLink(req.WithContext(ctx), data.Email)
+	})
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "If an account uses this email, a sign-in link is on its way",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp, "response")
+}
+
+// sendMagicLink stores a new sign-in link for the user together with the email
+// carrying it. The token goes in the URL fragment, which browsers never send
+// to a server, so it stays out of access logs and Referer headers and a mail
+// scanner opening the page cannot use it. The page spends it by posting it to
+// the callback.
+func (app *application) sendMagicLink(r *http.Request, email string) {
+	ctx := r.Context()
+
+	user, err := app.db.DB.GetUserByEmail(ctx, tenantFromContext(r).ID, email)
+	if err != nil {
+		app.log(r).Debug("no sign-in link sent", "reason", "unknown email")
+		app.audit(r, "auth.magic_link", 0, outcomeFailure, map[string]interface{}{"reason": "unknown email"})
+		return
+	}
+
+	if err = repository.CheckAccountStatus(user); err != nil {
+		app.audit(r, "auth.magic_link", user.ID, outcomeFailure, map[string]interface{}{"reason": "inactive"})
+		return
+	}
+
+	sent, err := app.db.DB.MagicLinkSentSince(ctx, user.ID, time.Now().Add(-magicLinkInterval))
+	if err != nil {
+		return
+	}
+	if sent {
+		app.audit(r, "auth.magic_link", user.ID, outcomeFailure, map[string]interface{}{"reason": "too soon"})
+		return
+	}
+
+	token, hash, err := tokens.NewLink(app.keys)
+	if err != nil {
+		app.log(r).Error("error generating sign-in link", "err", err)
+		return
+	}
+
+	expires := time.Now().Add(app.config.magicLink.ttl)
+	link := *app.config.magicLink.url
+	link.Fragment = "token=" + token
+
+	msg, err := outboxEmail(user.TenantID, models.MagicLinkEmailPayload{
+		Source:      emailSource,
+		Destination: user.Email,
+		MagicLink:   link.String(),
+		ExpiresAt:   expires,
+	})
+	if err != nil {
+		app.log(r).Error("error encoding sign-in link email", "err", err)
+		return
+	}
+
+	if err = app.db.DB.InsertMagicLink(ctx, user.ID, hash, expires, msg); err != nil {
+		app.audit(r, "auth.magic_link", user.ID, outcomeFailure, map[string]interface{}{"reason": "error"})
+		return
+	}
+	app.audit(r, "auth.magic_link", user.ID, outcomeSuccess, nil)
+}
+
+// MagicLinkCallback exchanges the token of a sign-in link for a session, the
+// same as Signin gives. Only JSON bodies are accepted: a prefetched link never
+// posts, and another site's form cannot send JSON without a CORS preflight.
+func (app *application) MagicLinkCallback(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		app.errorJSON(w, errors.New("content type must be application/json"), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var data MagicLinkExchange
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("Unauthorized"))
+		return
+	}
+
+	invalid := func(reason string, userID int) {
+		app.audit(r, "auth.signin", userID, outcomeFailure, map[string]interface{}{"method": "magic_link", "reason": reason})
+		signins.Inc(outcomeFailure, "invalid_link")
+		app.errorJSON(w, errors.New("unauthorized, sign-in link is invalid, used or expired"), http.StatusForbidden)
+	}
+
+	hash, err := tokens.CheckLink(app.keys, data.Token)
+	if err != nil {
+		invalid("bad signature", 0)
+		return
+	}
+
+	// a link of another tenant is left unused for the tenant it was sent by
+	userID, err := app.db.DB.UseMagicLink(r.Context(), tenantFromContext(r).ID, hash, clientIP(r))
+	if errors.Is(err, repository.ErrNoRecord) {
+		invalid("unknown, used, expired or other tenant's link", 0)
+		return
+	}
+	if err != nil {
+		signins.Inc(outcomeFailure, "error")
+		app.errorJSON(w, errors.New("error signing in"))
+		return
+	}
+
+	user, err := app.db.DB.GetUserById(r.Context(), userID)
+	if err != nil {
+		signins.Inc(outcomeFailure, "error")
+		app.errorJSON(w, errors.New("error signing in"))
+		return
+	}
+
+	if err = repository.CheckAccountStatus(user); err != nil {
+		app.audit(r, "auth.signin", user.ID, outcomeFailure, map[string]interface{}{"method": "magic_link", "reason": "inactive"})
+		signins.Inc(outcomeFailure, "inactive")
+		app.errorJSON(w, errors.New("unauthorized, account is not active"), http.StatusForbidden)
+		return
+	}
+
+	if app.challengeSecondFactor(w, r, user.ID) {
+		return
+	}
+
+	session, err := app.startSession(r, user.ID, data.Device)
+	if err != nil {
+		app.log(r).Error("error signing in", "err", err)
+		signins.Inc(outcomeFailure, "error")
+		app.errorJSON(w, errors.New("error signing in"))
+		return
+	}
+
+	app.audit(r, "auth.signin", user.ID, outcomeSuccess, map[string]interface{}{"method": "magic_link"})
+	signins.Inc(outcomeSuccess, "")
+	app.writeSession(w, session)
+}
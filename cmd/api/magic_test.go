@@ -0,0 +1,107 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/tokens"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseMagicLinkURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "", want: ""},
+		{raw: "https://app.example.com/signin/finish", want: "https://app.example.com/signin/finish"},
+		{raw: "http://localhost:3000/magic?lang=en", want: "http://localhost:3000/magic?lang=en"},
+		{raw: "https://app.example.com/signin#token=", wantErr: true},
+		{raw: "ftp://app.example.com/signin", wantErr: true},
+		{raw: "/signin/finish", wantErr: true},
+		{raw: "https://app.example.com/%zz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		u, err := parseMagicLinkURL(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMagicLinkURL(%q) error %v, want error %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseMagicLinkURL(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestMagicLinkCallback(t *testing.T) {
+	user := models.User{
+		ID: 7, TenantID: testTenant.ID, Name: "Bob", Email: "bob@example.com", UserName: "bob",
+		Role: models.RoleUser, Status: models.StatusActive, CreatedAt: time.Now(), UpdatedAt: time.Now(),
+	}
+
+	tests := []struct {
+		name string
+		// forged links are refused before the database is asked
+		forged bool
+		// spent is whether UseMagicLink finds an unused link of the tenant
+		spent bool
+		want  int
+	}{
+		{name: "valid link", spent: true, want: http.StatusOK},
+		{name: "used, expired or other tenant's link", want: http.StatusForbidden},
+		{name: "forged link", forged: true, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+
+			token, hash, err := tokens.NewLink(app.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.forged {
+				token, _, _ = tokens.NewLink(tokens.NewKeys("another-secret-of-at-least-32-bytes", nil))
+			} else {
+				rows := sqlmock.NewRows([]string{"user_id"})
+				if tt.spent {
+					rows.AddRow(user.ID)
+				}
+				// the tenant is part of the statement spending the link
+				mock.ExpectQuery(`update magic_links`).
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), hash, testTenant.ID).
+					WillReturnRows(rows)
+			}
+			if tt.spent {
+				expectUserByID(mock, user)
+				expectUserByID(mock, user)
+				expectSession(mock, user.ID)
+				expectAudit(mock, "auth.signin", outcomeSuccess)
+			} else {
+				expectAudit(mock, "auth.signin", outcomeFailure)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/signin/magic-link/callback", strings.NewReader(`{"token":"`+token+`"}`))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			app.MagicLinkCallback(w, withTenant(r, testTenant))
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -1,29 +1,134 @@
 package main
 
 import (
+	"auth/api/logging"
+	"auth/api/oidc"
 	"auth/api/repository"
+	"auth/api/sms"
+	"auth/api/tokens"
+	"auth/api/tracing"
+	"auth/api/webhooks"
 	"context"
+	"crypto/ed25519"
 	"database/sql"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/crewjam/saml"
 	_ "github.com/lib/pq"
 )
 
 const version = "1.0.0"
 
 type config struct {
-	port int
-	env  string
-	db   struct {
-		dsn string
+	port     int
+	env      string
+	logLevel string
+	db       struct {
+		dsn         string
+		autoMigrate bool
 	}
 	jwt struct {
-		secret string
+		secret          string
+		previousSecrets []string
+	}
+	audit struct {
+		key                string
+		checkpointInterval time.Duration
+	}
+	cors struct {
+		origins     []string
+		methods     []string
+		headers     []string
+		credentials bool
+		maxAge      time.Duration
+	}
+	session struct {
+		mode         string
+		cookieName   string
+		cookieDomain string
+		cookieSecure bool
+		sameSite     string
+	}
+	tenant struct {
+		sources  []string
+		fallback string
+	}
+	mailer struct {
+		url string
+	}
+	magicLink struct {
+		// url is nil when magic links are off
+		url *url.URL
+		ttl time.Duration
+	}
+	oidc struct {
+		providers    []oidcProvider
+		callbackBase string
+		returnURL    string
+	}
+	authenticators []string
+	ldap           struct {
+		url                string
+		startTLS           bool
+		insecureSkipVerify bool
+		bindDN             string
+		bindPassword       string
+		baseDN             string
+		userFilter         string
+		idAttribute        string
+		usernameAttribute  string
+		nameAttribute      string
+		emailAttribute     string
+		groupAttribute     string
+		adminGroups        []string
+		tenants            []string
+	}
+	oauth struct {
+		clients []oauthClient
+	}
+	saml struct {
+		baseURL  string
+		loginURL string
+		cert     string
+		key      string
+	}
+	outbox struct {
+		interval    time.Duration
+		maxAttempts int
+	}
+	webhooks struct {
+		interval     time.Duration
+		timeout      time.Duration
+		maxAttempts  int
+		allowPrivate bool
+	}
+	sms struct {
+		backend        string
+		file           string
+		url            string
+		token          string
+		defaultCountry string
+	}
+	shutdown struct {
+		delay   time.Duration
+		timeout time.Duration
+	}
+	trace struct {
+		exporter     string
+		otlpEndpoint string
+		otlpInsecure bool
+		sampleRatio  float64
+	}
+	metrics struct {
+		// addr is empty when metrics are not served
+		addr string
 	}
 }
 
@@ -34,33 +139,103 @@ type AppStatus struct {
 }
 
 type application struct {
-	config config
-	logger *log.Logger
-	db     repository.Repo
+	config   config
+	logger   *logging.Logger
+	db       repository.Repo
+	auditKey ed25519.PrivateKey
+	keys     tokens.Keys
+	sms      sms.SMSSender
+	oidc     map[string]*oidc.Provider
+	webhooks *webhooks.Sender
+	// saml is the identity provider, nil when no signing key is configured
+	saml *saml.IdentityProvider
+	// authenticators check passwords in order, see authenticate
+	authenticators []authenticator
+	// shuttingDown is set to 1 once a shutdown signal arrives, see ready
+	shuttingDown int32
+	// wg tracks background tasks serve waits for on shutdown
+	wg sync.WaitGroup
 }
 
 var cfg config
 
 func main() {
 
-	log.Println("Starting Go Auth Server")
-	getFlags()
-	flag.Parse()
+	logger := logging.Default()
+	logger.Info("starting Go Auth Server", "version", version)
 
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	if err := loadConfig(os.Args[1:]); err != nil {
+		logger.Fatal("invalid config", "err", err)
+	}
+
+	level, _ := logging.ParseLevel(cfg.logLevel)
+	logger = logging.New(os.Stdout, level).With("env", cfg.env)
+	logging.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.trace.exporter,
+		Endpoint:    cfg.trace.otlpEndpoint,
+		Insecure:    cfg.trace.otlpInsecure,
+		SampleRatio: cfg.trace.sampleRatio,
+		Service:     "goauth",
+		Version:     version,
+	})
+	if err != nil {
+		logger.Fatal("error setting up tracing", "err", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("error flushing traces", "err", err)
+		}
+	}()
 
 	db, err := openDB(cfg)
 	if err != nil {
-		log.Println(err)
-		logger.Fatal(err)
+		logger.Fatal("error connecting to the database", "err", err)
 	}
 	defer db.Close()
 
+	auditKey, err := repository.ParseAuditKey(cfg.audit.key)
+	if err != nil {
+		logger.Fatal("invalid audit key", "err", err)
+	}
+
 	app := &application{
-		config: cfg,
-		logger: logger,
-		db:     repository.NewRepo(db),
+		config:   cfg,
+		logger:   logger,
+		db:       repository.NewRepo(db),
+		auditKey: auditKey,
+		keys:     tokens.NewKeys(cfg.jwt.secret, cfg.jwt.previousSecrets),
+		sms:      newSMSSender(cfg, logger),
+		oidc:     newOIDCProviders(cfg),
+		webhooks: webhooks.NewSender(cfg.webhooks.timeout, cfg.webhooks.allowPrivate),
 	}
+	app.authenticators = app.newAuthenticators()
+	app.saml = app.newSAMLIdP()
+
+	switch flag.Arg(0) {
+	case "verify-audit":
+		os.Exit(app.verifyAudit())
+	case "migrate":
+		os.Exit(app.migrate(db, flag.Args()[1:]))
+	}
+
+	if cfg.db.autoMigrate {
+		if err = app.autoMigrate(db); err != nil {
+			logger.Fatal("error migrating the database", "err", err)
+		}
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	go app.runAuditCheckpoints(ctx, cfg.audit.checkpointInterval)
+	go app.runOutboxDispatcher(ctx)
+	go app.runWebhookDispatcher(ctx)
+	app.registerDBMetrics()
+	go app.serveMetrics(ctx)
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.port),
@@ -68,12 +243,11 @@ func main() {
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		ErrorLog:     log.New(logger.Writer(logging.LevelError), "", 0),
 	}
 
-	logger.Println("Starting Server on port", cfg.port)
-	err = srv.ListenAndServe()
-	if err != nil {
-		log.Println(err)
+	if err = app.serve(srv); err != nil {
+		logger.Error("server stopped", "err", err)
 	}
 }
 
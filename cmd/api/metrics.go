@@ -0,0 +1,193 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/metrics"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec(
+		"http_requests_total",
+		"HTTP requests handled, by route, method and status.",
+		"route", "method", "status",
+	)
+	httpDuration = metrics.NewHistogramVec(
+		"http_request_duration_seconds",
+		"Time taken to answer HTTP requests, by route and method.",
+		metrics.DefBuckets,
+		"route", "method",
+	)
+	signins = metrics.NewCounterVec(
+		"auth_signins_total",
+		"Sign-in attempts by outcome and reason.",
+		"outcome", "reason",
+	)
+	registrations = metrics.NewCounterVec(
+		"auth_registrations_total",
+		"Registration attempts by outcome.",
+		"outcome",
+	)
+	resetRequests = metrics.NewCounterVec(
+		"auth_password_reset_requests_total",
+		"Forgot password requests by outcome.",
+		"outcome",
+	)
+	otpSends = metrics.NewCounterVec(
+		"auth_otp_sent_total",
+		"One-time passcodes sent to phones, by purpose, channel and outcome.",
+		"purpose", "channel", "outcome",
+	)
+	outboxMessages = metrics.NewCounterVec(
+		"auth_outbox_messages_total",
+		"Outbox send attempts by kind and outcome: sent, retry or dead.",
+		"kind", "outcome",
+	)
+	webhookDeliveries = metrics.NewCounterVec(
+		"auth_webhook_deliveries_total",
+		"Webhook delivery attempts by event and outcome: delivered, retry or dead.",
+		"event", "outcome",
+	)
+	tokenFailures = metrics.NewCounterVec(
+		"auth_token_validation_failures_total",
+		"Requests to secured routes refused, by cause.",
+		"cause",
+	)
+)
+
+// registerDBMetrics exposes the connection pool statistics of the repository
+func (app *application) registerDBMetrics() {
+	stats := app.db.DB.PoolStats
+
+	metrics.NewGaugeFunc("db_max_open_connections", "Maximum number of open connections to the database.", func() float64 {
+		return float64(stats().MaxOpenConnections)
+	})
+	metrics.NewGaugeFunc("db_open_connections", "Established connections, in use and idle.", func() float64 {
+		return float64(stats().OpenConnections)
+	})
+	metrics.NewGaugeFunc("db_in_use_connections", "Connections currently in use.", func() float64 {
+		return float64(stats().InUse)
+	})
+	metrics.NewGaugeFunc("db_idle_connections", "Idle connections.", func() float64 {
+		return float64(stats().Idle)
+	})
+	metrics.NewCounterFunc("db_wait_count_total", "Connections waited for.", func() float64 {
+		return float64(stats().WaitCount)
+	})
+	metrics.NewCounterFunc("db_wait_duration_seconds_total", "Time blocked waiting for a connection.", func() float64 {
+		return stats().WaitDuration.Seconds()
+	})
+	metrics.NewCounterFunc("db_max_idle_closed_total", "Connections closed because of the idle limit.", func() float64 {
+		return float64(stats().MaxIdleClosed)
+	})
+	metrics.NewCounterFunc("db_max_idle_time_closed_total", "Connections closed because of the idle time limit.", func() float64 {
+		return float64(stats().MaxIdleTimeClosed)
+	})
+	metrics.NewCounterFunc("db_max_lifetime_closed_total", "Connections closed because of the lifetime limit.", func() float64 {
+		return float64(stats().MaxLifetimeClosed)
+	})
+}
+
+// serveMetrics serves /metrics on its own listener until ctx is done. The
+// metrics tell how the service is used, so they stay off the public port.
+func (app *application) serveMetrics(ctx context.Context) {
+	if app.config.metrics.addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default.Handler())
+	srv := &http.Server{
+		Addr:         app.config.metrics.addr,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		ErrorLog:     log.New(app.logger.Writer(logging.LevelError), "", 0),
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	app.logger.Info("serving metrics", "addr", app.config.metrics.addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		app.logger.Error("metrics server stopped", "err", err)
+	}
+}
+
+// instrument counts and times every request by the route pattern it matched
+func (app *application) instrument(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		route := routePattern(router, r)
+		httpRequests.Inc(route, r.Method, strconv.Itoa(rec.status))
+		httpDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+// patternRouter registers every handler together with the pattern it is
+// registered under, which routePattern asks it for
+type patternRouter struct {
+	*httprouter.Router
+}
+
+// Handler registers a handler for requests matching the pattern
+func (pr patternRouter) Handler(method, pattern string, handler http.Handler) {
+	pr.Router.Handler(method, pattern, withRoute(pattern, handler))
+}
+
+// HandlerFunc registers a handler function for requests matching the pattern
+func (pr patternRouter) HandlerFunc(method, pattern string, handler http.HandlerFunc) {
+	pr.Handler(method, pattern, handler)
+}
+
+// routeProbe asks a handler the pattern it was registered under
+type routeProbe struct {
+	pattern string
+}
+
+// withRoute answers route probes with the pattern and serves every other request
+func withRoute(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probe, ok := r.Context().Value(routeProbeKey).(*routeProbe); ok {
+			probe.pattern = pattern
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routePattern returns the pattern of the route a request matched, so
+// /v1/admin/users/7/status is counted as /v1/admin/users/:id/status. The
+// router finds the handler and the handler tells its pattern.
+func routePattern(router *httprouter.Router, r *http.Request) string {
+	method := r.Method
+	if method == http.MethodOptions {
+		// preflights are answered for any route registered with another method
+		method = r.Header.Get("Access-Control-Request-Method")
+	}
+
+	handle, params, _ := router.Lookup(method, r.URL.Path)
+	if handle == nil {
+		return "unmatched"
+	}
+
+	probe := &routeProbe{}
+	handle(nil, r.WithContext(context.WithValue(r.Context(), routeProbeKey, probe)), params)
+	if probe.pattern == "" {
+		// registered without its pattern
+		return "unmatched"
+	}
+	return probe.pattern
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"auth/api/metrics"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRoutePattern(t *testing.T) {
+	router := patternRouter{httprouter.New()}
+	served := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ })
+	router.Handler(http.MethodGet, "/v1/me/sessions", handler)
+	router.Handler(http.MethodDelete, "/v1/me/sessions/:id", handler)
+	router.Handler(http.MethodPut, "/v1/admin/users/:id/status", handler)
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/:provider/callback", handler)
+	router.GET("/v1/unnamed", func(http.ResponseWriter, *http.Request, httprouter.Params) {})
+
+	tests := []struct {
+		method string
+		path   string
+		// preflight is the method a preflight asks for
+		preflight string
+		want      string
+	}{
+		{method: http.MethodGet, path: "/v1/me/sessions", want: "/v1/me/sessions"},
+		{method: http.MethodDelete, path: "/v1/me/sessions/3f9a", want: "/v1/me/sessions/:id"},
+		// a parameter equal to a fixed segment of the path
+		{method: http.MethodDelete, path: "/v1/me/sessions/sessions", want: "/v1/me/sessions/:id"},
+		{method: http.MethodPut, path: "/v1/admin/users/status/status", want: "/v1/admin/users/:id/status"},
+		{method: http.MethodGet, path: "/v1/oidc/v1/callback", want: "/v1/oidc/:provider/callback"},
+		{method: http.MethodOptions, path: "/v1/admin/users/7/status", preflight: http.MethodPut, want: "/v1/admin/users/:id/status"},
+		{method: http.MethodOptions, path: "/v1/admin/users/7/status", want: "unmatched"},
+		{method: http.MethodPost, path: "/v1/me/sessions", want: "unmatched"},
+		{method: http.MethodGet, path: "/v1/nowhere", want: "unmatched"},
+		{method: http.MethodGet, path: "/v1/unnamed", want: "unmatched"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.preflight != "" {
+			r.Header.Set("Access-Control-Request-Method", tt.preflight)
+		}
+		if got := routePattern(router.Router, r); got != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+	if served != 0 {
+		t.Errorf("asking for the pattern served %d requests", served)
+	}
+}
+
+func TestMetricsRouteLabel(t *testing.T) {
+	app, _ := newTestApp(t)
+	routes := app.routes()
+
+	// no tenant is configured, the request is refused but still counted
+	routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/v1/me/sessions/sessions", nil))
+
+	w := httptest.NewRecorder()
+	metrics.Default.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+
+	want := `http_requests_total{method="DELETE",route="/v1/me/sessions/:id"`
+	if !strings.Contains(string(body), want) {
+		t.Errorf("metrics do not count %s:\n%s", want, body)
+	}
+	if !strings.Contains(string(body), "go_goroutines") {
+		t.Error("metrics do not include the Go runtime")
+	}
+
+	// and they are not served to the public
+	w = httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("the API answered /metrics with %d", w.Code)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	app, _ := newTestApp(t)
+	app.config.metrics.addr = addr
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		app.serveMetrics(ctx)
+		close(done)
+	}()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get("http://" + addr + "/metrics"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+
+	if resp, err = http.Get("http://" + addr + "/v1/secure"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("the metrics listener answered /v1/secure with %d", resp.StatusCode)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the metrics server did not stop")
+	}
+}
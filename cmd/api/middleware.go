@@ -1,23 +1,31 @@
 package main
 
 import (
+	"auth/api/logging"
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/tokens"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"log"
 	"net/http"
-	"strconv"
+	"regexp"
 	"strings"
 	"time"
-
-	"github.com/pascaldekloe/jwt"
 )
 
-func (app *application) enableCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		next.ServeHTTP(w, r)
-	})
-}
+type contextKey string
+
+const (
+	userContextKey       = contextKey("user")
+	sessionContextKey    = contextKey("session")
+	tenantContextKey     = contextKey("tenant")
+	tenantPathContextKey = contextKey("tenant-path")
+	tokenContextKey      = contextKey("personal-token")
+	actorContextKey      = contextKey("actor")
+	routeProbeKey        = contextKey("route-probe")
+)
 
 func (app *application) checkToken(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -25,7 +33,8 @@ func (app *application) checkToken(next http.Handler) http.Handler {
 		authHeader := r.Header.Get("Authorization")
 
 		if authHeader == "" {
-			app.logger.Println("No Auth Header")
+			app.log(r).Debug("no auth header")
+			tokenFailures.Inc("missing")
 			app.errorJSON(w, errors.New("invalid auth header"))
 			return
 		}
@@ -33,43 +42,225 @@ func (app *application) checkToken(next http.Handler) http.Handler {
 		headerParts := strings.Split(authHeader, " ")
 
 		if len(headerParts) != 2 {
+			tokenFailures.Inc("malformed")
 			app.errorJSON(w, errors.New("invalid auth header"))
 			return
 		}
 
 		if headerParts[0] != "Bearer" {
+			tokenFailures.Inc("malformed")
 			app.errorJSON(w, errors.New("unauthorized, no bearer"))
 			return
 		}
 
-		token := headerParts[1]
-		claims, err := jwt.HMACCheck([]byte(token), []byte(app.config.jwt.secret))
-		if err != nil {
-			app.errorJSON(w, errors.New("unauthorized, failed HMAC check"), http.StatusForbidden)
-			return
-		}
-		if !claims.Valid(time.Now()) {
-			app.errorJSON(w, errors.New("unauthorized, invalid token"), http.StatusForbidden)
-			return
+		app.serveAuthorized(w, r, next, headerParts[1])
+	})
+}
+
+// serveAuthorized validates the token and passes the request on with the user and session in its context
+func (app *application) serveAuthorized(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	if tokens.IsPersonal(token) {
+		app.servePersonal(w, r, next, token)
+		return
+	}
+
+	user, session, err := app.validateToken(r.Context(), token)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	if err = app.db.DB.TouchSession(r.Context(), session.ID); err != nil {
+		app.log(r).Error("error touching session", "err", err)
+	}
+
+	logger := app.log(r).With("user_id", user.ID)
+	if session.ActorID != 0 {
+		logger = logger.With("actor_id", session.ActorID)
+	}
+	ctx := logging.NewContext(r.Context(), logger)
+	ctx = context.WithValue(ctx, userContextKey, user)
+	ctx = context.WithValue(ctx, sessionContextKey, session.ID)
+	if session.ActorID != 0 {
+		ctx = context.WithValue(ctx, actorContextKey, session.ActorID)
+	}
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// validateToken checks a token we issued and returns the user and session it belongs to.
+// The returned error is safe to show to the caller.
+func (app *application) validateToken(ctx context.Context, token string) (models.User, models.Session, error) {
+	var user models.User
+	var session models.Session
+
+	_, grant, err := tokens.Check(app.keys, []byte(token))
+	switch err {
+	case nil:
+	case tokens.ErrSignature:
+		tokenFailures.Inc("signature")
+		return user, session, errors.New("unauthorized, failed HMAC check")
+	case tokens.ErrExpired:
+		tokenFailures.Inc("expired")
+		return user, session, errors.New("unauthorized, invalid token")
+	case tokens.ErrAudience:
+		tokenFailures.Inc("audience")
+		return user, session, errors.New("unauthorized, token invalid audience")
+	case tokens.ErrIssuer:
+		tokenFailures.Inc("issuer")
+		return user, session, errors.New("unauthorized, token invalid domain")
+	case tokens.ErrActor:
+		tokenFailures.Inc("actor")
+		return user, session, errors.New("unauthorized")
+	default:
+		tokenFailures.Inc("subject")
+		return user, session, errors.New("unauthorized")
+	}
+
+	tenant, _ := ctx.Value(tenantContextKey).(models.Tenant)
+	if grant.Tenant != tenant.Slug {
+		tokenFailures.Inc("tenant")
+		return user, session, errors.New("unauthorized, token is for another tenant")
+	}
+
+	user, err = app.db.DB.GetUserById(ctx, grant.UserID)
+	if err != nil {
+		tokenFailures.Inc("user")
+		return user, session, errors.New("unauthorized")
+	}
+
+	if user.TenantID != tenant.ID {
+		tokenFailures.Inc("tenant")
+		return user, session, errors.New("unauthorized, token is for another tenant")
+	}
+
+	if err = repository.CheckAccountStatus(user); err != nil {
+		tokenFailures.Inc("inactive")
+		return user, session, errors.New("unauthorized, account is not active")
+	}
+
+	session, err = app.db.DB.GetSession(ctx, grant.SessionID)
+	if err != nil || session.UserID != user.ID || session.ActorID != grant.ActorID {
+		tokenFailures.Inc("session")
+		return user, session, errors.New("unauthorized, unknown session")
+	}
+
+	if !session.RevokedAt.IsZero() || time.Now().After(session.ExpiresAt) {
+		tokenFailures.Inc("session_ended")
+		return user, session, errors.New("unauthorized, session has ended")
+	}
+
+	// the admin must still be allowed to act as the user
+	if session.ActorID != 0 {
+		actor, err := app.db.DB.GetUserById(ctx, session.ActorID)
+		if err != nil || repository.CheckImpersonation(actor, user) != nil {
+			tokenFailures.Inc("actor")
+			return user, session, errors.New("unauthorized, impersonation is no longer allowed")
 		}
+	}
+
+	return user, session, nil
+}
 
-		if !claims.AcceptAudience("mydomain.com") {
-			app.errorJSON(w, errors.New("unauthorized, token invalid audience"), http.StatusForbidden)
+// requireAdmin only lets users with the admin role through, it must run after checkToken
+func (app *application) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userFromContext(r)
+		if !ok || user.Role != models.RoleAdmin {
+			app.errorJSON(w, errors.New("forbidden, admin access required"), http.StatusForbidden)
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		if claims.Issuer != "mydomain.com" {
-			app.errorJSON(w, errors.New("unauthorized, token invalid domain"), http.StatusForbidden)
+// refuseImpersonation keeps impersonation sessions away from routes that manage
+// the account, its credentials or its data. It must run after checkToken.
+func (app *application) refuseImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := actorFromContext(r); ok {
+			app.errorJSON(w, errors.New("forbidden while impersonating"), http.StatusForbidden)
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		userID, err := strconv.ParseInt(claims.Subject, 10, 64)
-		if err != nil {
-			app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
-			return
+// actorFromContext returns the id of the admin acting as the user when the
+// request was made with an impersonation token
+func actorFromContext(r *http.Request) (int, bool) {
+	id, ok := r.Context().Value(actorContextKey).(int)
+	return id, ok
+}
+
+// sessionFromContext returns the id of the session the request was made with
+func sessionFromContext(r *http.Request) string {
+	id, _ := r.Context().Value(sessionContextKey).(string)
+	return id
+}
+
+// userFromContext returns the user checkToken stored on the request
+func userFromContext(r *http.Request) (models.User, bool) {
+	user, ok := r.Context().Value(userContextKey).(models.User)
+	return user, ok
+}
+
+// requestIDHeader carries the id tying log lines to a request
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID accepts ids from callers only when they are short and printable
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID reuses the caller's X-Request-ID or makes one up, echoes it back and
+// gives every log line written for the request the id
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
 		}
+		w.Header().Set(requestIDHeader, id)
 
-		log.Println("Valid user: ", userID)
-		next.ServeHTTP(w, r)
+		ctx := logging.NewContext(r.Context(), app.logger.With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// logRequests writes one line per finished request
+func (app *application) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		app.log(r).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"ip", clientIP(r),
+		)
 	})
 }
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// log returns the logger for the request, carrying its request id
+func (app *application) log(r *http.Request) *logging.Logger {
+	return logging.FromContext(r.Context())
+}
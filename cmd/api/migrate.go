@@ -0,0 +1,110 @@
+package main
+
+import (
+	"auth/api/db/migrations"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// migrateTimeout bounds a migrate run, including waiting for another replica's lock
+const migrateTimeout = 10 * time.Minute
+
+const migrateUsage = "usage: goauth migrate up | down [N] | status | version"
+
+// newMigrator returns a migrator that logs through the app logger
+func (app *application) newMigrator(db *sql.DB) *migrations.Migrator {
+	return &migrations.Migrator{
+		DB: db,
+		Logf: func(format string, args ...interface{}) {
+			app.logger.Info(fmt.Sprintf(format, args...))
+		},
+	}
+}
+
+// migrate runs the migrate subcommand and returns the exit code
+func (app *application) migrate(db *sql.DB, args []string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	m := app.newMigrator(db)
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error migrating up:", err)
+			return 1
+		}
+		fmt.Printf("applied %d migrations\n", n)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				fmt.Fprintln(os.Stderr, migrateUsage)
+				return 2
+			}
+		}
+		n, err := m.Down(ctx, steps)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error migrating down:", err)
+			return 1
+		}
+		fmt.Printf("reverted %d migrations\n", n)
+
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading migration status:", err)
+			return 1
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%06d  %-8s %s\n", s.Version, state, s.Name)
+		}
+
+	case "version":
+		v, dirty, err := m.Version(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading schema version:", err)
+			return 1
+		}
+		if dirty {
+			fmt.Printf("%d (dirty)\n", v)
+			return 1
+		}
+		fmt.Println(v)
+
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	return 0
+}
+
+// autoMigrate brings the schema up to date before the server starts
+func (app *application) autoMigrate(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	n, err := app.newMigrator(db).Up(ctx)
+	if err != nil {
+		return err
+	}
+	app.logger.Info("schema up to date", "applied", n)
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/tokens"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// minClientSecret is the shortest client secret accepted
+const minClientSecret = 32
+
+// Token type hints, see RFC 7009
+const (
+	tokenTypeAccess  = "access_token"
+	tokenTypeRefresh = "refresh_token"
+)
+
+// personalTokenClient is the client_id introspection gives personal access tokens
+const personalTokenClient = "personal-access-token"
+
+// oauthClient is a resource server or gateway as listed in the -oauth-clients file
+type oauthClient struct {
+	ID         string `yaml:"id"`
+	Secret     string `yaml:"secret"`
+	SecretFile string `yaml:"secret-file"`
+	// Tenants whose tokens the client may see, all when empty
+	Tenants []string `yaml:"tenants"`
+}
+
+// Introspection is what /oauth/introspect says about a token, see RFC 7662.
+// Inactive tokens only have active set.
+type Introspection struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Expires   int64    `json:"exp,omitempty"`
+	Issued    int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audiences []string `json:"aud,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+	Tenant    string   `json:"tenant,omitempty"`
+	// Actor is the admin acting as the subject of an impersonation token,
+	// see RFC 8693 section 4.1
+	Actor *actorClaim `json:"act,omitempty"`
+}
+
+// actorClaim names who acts as the subject of a token
+type actorClaim struct {
+	Subject string `json:"sub"`
+}
+
+// loadOAuthClients reads the clients file
+func loadOAuthClients(path string) ([]oauthClient, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []oauthClient
+	if err = yaml.Unmarshal(raw, &clients); err != nil {
+		return nil, fmt.Errorf("oauth clients file %s: %v", path, err)
+	}
+
+	for i, c := range clients {
+		if c.SecretFile != "" {
+			if clients[i].Secret, err = readSecretFile(c.SecretFile); err != nil {
+				return nil, fmt.Errorf("oauth client %s: %v", c.ID, err)
+			}
+		}
+	}
+	return clients, nil
+}
+
+// validOAuthConfig checks the client list
+func validOAuthConfig(c config) error {
+	seen := map[string]bool{}
+	for _, client := range c.oauth.clients {
+		if client.ID == "" || seen[client.ID] || strings.ContainsAny(client.ID, ": ") {
+			return fmt.Errorf("oauth client ids must be unique and have no colons or spaces, got %q", client.ID)
+		}
+		seen[client.ID] = true
+
+		if len(client.Secret) < minClientSecret {
+			return fmt.Errorf("oauth client %s: secret must be at least %d characters", client.ID, minClientSecret)
+		}
+	}
+	return nil
+}
+
+// allowsTenant reports whether the client may see tokens of the tenant
+func (c oauthClient) allowsTenant(slug string) bool {
+	if len(c.Tenants) == 0 {
+		return true
+	}
+	for _, t := range c.Tenants {
+		if t == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateClient checks the client credentials, sent with HTTP Basic or
+// as client_id and client_secret form fields. The request form must be parsed.
+func (app *application) authenticateClient(r *http.Request) (oauthClient, bool) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	// hashed so the comparison takes as long whatever the secret's length
+	given := sha256.Sum256([]byte(secret))
+	for _, c := range app.config.oauth.clients {
+		want := sha256.Sum256([]byte(c.Secret))
+		if c.ID == id && hmac.Equal(given[:], want[:]) {
+			return c, true
+		}
+	}
+	return oauthClient{}, false
+}
+
+// oauthRequest parses the form of an introspection or revocation request and
+// authenticates the client, answering the caller itself when either fails
+func (app *application) oauthRequest(w http.ResponseWriter, r *http.Request) (oauthClient, string, bool) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("token") == "" {
+		writeOAuthJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return oauthClient{}, "", false
+	}
+
+	client, ok := app.authenticateClient(r)
+	if !ok {
+		app.log(r).Warn("oauth client authentication failed", "client", r.PostForm.Get("client_id"))
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return oauthClient{}, "", false
+	}
+
+	return client, r.PostForm.Get("token"), true
+}
+
+// writeOAuthJSON writes an unwrapped JSON answer that must not be cached, as
+// the RFCs ask for
+func writeOAuthJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// inspectedToken is a token that passed the checks checkToken makes
+type inspectedToken struct {
+	user    models.User
+	tenant  models.Tenant
+	session models.Session
+	pat     models.PersonalAccessToken
+	claims  Introspection
+}
+
+// inspectToken validates a session or personal access token of any tenant with
+// the checks checkToken makes. The tenant is read from the token first, the
+// validation then makes sure it was not lied about.
+func (app *application) inspectToken(ctx context.Context, token string) (inspectedToken, error) {
+	var t inspectedToken
+
+	if tokens.IsPersonal(token) {
+		pat, err := app.db.DB.GetPersonalAccessToken(ctx, tokens.HashPersonal(token))
+		if err != nil {
+			return t, err
+		}
+		owner, err := app.db.DB.GetUserById(ctx, pat.UserID)
+		if err != nil {
+			return t, err
+		}
+		if t.tenant, err = app.db.DB.GetTenant(ctx, owner.TenantID); err != nil {
+			return t, err
+		}
+
+		ctx = context.WithValue(ctx, tenantContextKey, t.tenant)
+		if t.user, t.pat, err = app.validatePersonalToken(ctx, token); err != nil {
+			return t, err
+		}
+
+		t.claims = Introspection{
+			Scope:    strings.Join(t.pat.Scopes, " "),
+			ClientID: personalTokenClient,
+			Issued:   t.pat.CreatedAt.Unix(),
+			Issuer:   tokens.Issuer,
+		}
+		if !t.pat.ExpiresAt.IsZero() {
+			t.claims.Expires = t.pat.ExpiresAt.Unix()
+		}
+		return t, nil
+	}
+
+	claims, err := tokens.Decode([]byte(token))
+	if err != nil {
+		return t, err
+	}
+	slug, ok := claims.String(tokens.TenantClaim)
+	if !ok {
+		slug = tokens.DefaultTenant
+	}
+	if t.tenant, err = app.db.DB.GetTenantBySlug(ctx, slug); err != nil {
+		return t, err
+	}
+
+	ctx = context.WithValue(ctx, tenantContextKey, t.tenant)
+	if t.user, t.session, err = app.validateToken(ctx, token); err != nil {
+		return t, err
+	}
+
+	scopes := []string{models.ScopeRead, models.ScopeWrite}
+	if t.user.Role == models.RoleAdmin {
+		scopes = append(scopes, models.ScopeAdmin)
+	}
+	t.claims = Introspection{
+		Scope:     strings.Join(scopes, " "),
+		ClientID:  tokens.Audience,
+		Audiences: claims.Audiences,
+		Issuer:    claims.Issuer,
+		ID:        claims.ID,
+	}
+	if claims.Expires != nil {
+		t.claims.Expires = claims.Expires.Time().Unix()
+	}
+	if claims.Issued != nil {
+		t.claims.Issued = claims.Issued.Time().Unix()
+	}
+	if claims.NotBefore != nil {
+		t.claims.NotBefore = claims.NotBefore.Time().Unix()
+	}
+	if t.session.ActorID != 0 {
+		t.claims.Actor = &actorClaim{Subject: strconv.Itoa(t.session.ActorID)}
+	}
+	return t, nil
+}
+
+// Introspect tells an authenticated client whether a token is active and
+// what it grants, see RFC 7662. Tokens of tenants the client may not see are
+// reported inactive.
+func (app *application) Introspect(w http.ResponseWriter, r *http.Request) {
+	client, token, ok := app.oauthRequest(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := app.inspectToken(r.Context(), token)
+	if err != nil || !client.allowsTenant(t.tenant.Slug) {
+		writeOAuthJSON(w, http.StatusOK, Introspection{Active: false})
+		return
+	}
+
+	answer := t.claims
+	answer.Active = true
+	answer.TokenType = tokenTypeAccess
+	answer.Subject = strconv.Itoa(t.user.ID)
+	answer.Username = t.user.UserName
+	answer.Tenant = t.tenant.Slug
+	writeOAuthJSON(w, http.StatusOK, answer)
+}
+
+// RevokeToken ends the session of a token or revokes a personal access token
+// for an authenticated client, see RFC 7009. Sessions are all the refresh a
+// token gets, so refresh_token hints are treated like access_token ones. The
+// answer is the same whether or not the token was valid.
+func (app *application) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	client, token, ok := app.oauthRequest(w, r)
+	if !ok {
+		return
+	}
+
+	switch hint := r.PostForm.Get("token_type_hint"); hint {
+	case "", tokenTypeAccess, tokenTypeRefresh:
+	default:
+		writeOAuthJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_token_type"})
+		return
+	}
+
+	t, err := app.inspectToken(r.Context(), token)
+	if err != nil || !client.allowsTenant(t.tenant.Slug) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// the event belongs to the token's tenant, the route has none
+	r = r.WithContext(context.WithValue(r.Context(), tenantContextKey, t.tenant))
+	metadata := map[string]interface{}{"via": "oauth", "client": client.ID}
+	if t.pat.ID != 0 {
+		metadata["token"] = t.pat.ID
+		err = app.db.DB.RevokePersonalAccessToken(r.Context(), t.user.ID, t.pat.ID)
+	} else {
+		metadata["session"] = t.session.ID
+		err = app.db.DB.RevokeSession(r.Context(), t.user.ID, t.session.ID)
+	}
+	app.audit(r, "token.revoke", t.user.ID, outcome(err), metadata)
+	if err != nil {
+		app.log(r).Error("error revoking token", "err", err)
+		writeOAuthJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "temporarily_unavailable"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
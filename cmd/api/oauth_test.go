@@ -0,0 +1,346 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/tokens"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const (
+	gatewaySecret = "gateway-secret-of-at-least-32-characters"
+	globexSecret  = "globex-secret-of-at-least-32-characters"
+)
+
+// newOAuthTestApp returns an application with a gateway client seeing every
+// tenant and one only seeing globex
+func newOAuthTestApp(t *testing.T) (*application, sqlmock.Sqlmock) {
+	t.Helper()
+	app, mock := newTestApp(t)
+	app.config.oauth.clients = []oauthClient{
+		{ID: "gateway", Secret: gatewaySecret},
+		{ID: "globex-api", Secret: globexSecret, Tenants: []string{"globex"}},
+	}
+	return app, mock
+}
+
+// oauthPost returns a form post from the client, authenticated with HTTP Basic
+func oauthPost(path, client, secret string, form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(client, secret)
+	return r
+}
+
+// expectSessionToken expects validateToken to accept a session of the user,
+// which an admin acts in when actor is set
+func expectSessionToken(mock sqlmock.Sqlmock, user models.User, sessionID string, actor *models.User) {
+	expectTenant(mock, testTenant)
+	expectUserByID(mock, user)
+	s := models.Session{ID: sessionID, UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if actor != nil {
+		s.ActorID = actor.ID
+	}
+	expectGetSession(mock, s)
+	if actor != nil {
+		expectUserByID(mock, *actor)
+	}
+}
+
+// expectPersonalTokenOwner expects inspectToken to find a personal access
+// token and its tenant, and validatePersonalToken to accept it
+func expectPersonalTokenOwner(mock sqlmock.Sqlmock, token string, pat models.PersonalAccessToken, owner models.User) {
+	expectPersonalToken(mock, token, pat)
+	expectUserByID(mock, owner)
+	mock.ExpectQuery(`FROM tenants where id`).WithArgs(owner.TenantID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "name", "host", "created_at"}).
+			AddRow(testTenant.ID, testTenant.Slug, testTenant.Name, testTenant.Host, testTenant.CreatedAt))
+	expectPersonalToken(mock, token, pat)
+	expectUserByID(mock, owner)
+}
+
+func TestOAuthClientAuthentication(t *testing.T) {
+	// a token that is not one, answered without a lookup
+	form := url.Values{"token": {"not-a-token"}}
+	withSecret := func(id, secret string) url.Values {
+		return url.Values{"token": {"not-a-token"}, "client_id": {id}, "client_secret": {secret}}
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"basic", oauthPost("/oauth/introspect", "gateway", gatewaySecret, form), http.StatusOK},
+		{"basic with a wrong secret", oauthPost("/oauth/introspect", "gateway", globexSecret, form), http.StatusUnauthorized},
+		{"basic with an unknown client", oauthPost("/oauth/introspect", "nobody", gatewaySecret, form), http.StatusUnauthorized},
+		{"form", oauthPost("/oauth/introspect", "", "", withSecret("gateway", gatewaySecret)), http.StatusOK},
+		{"form with a wrong secret", oauthPost("/oauth/introspect", "", "", withSecret("gateway", "")), http.StatusUnauthorized},
+		{"form with another client's secret", oauthPost("/oauth/introspect", "", "", withSecret("globex-api", gatewaySecret)), http.StatusUnauthorized},
+		{"no token", oauthPost("/oauth/introspect", "gateway", gatewaySecret, url.Values{}), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newOAuthTestApp(t)
+			// form credentials go without the Authorization header
+			if tt.r.PostFormValue("client_id") != "" {
+				tt.r.Header.Del("Authorization")
+			}
+
+			w := httptest.NewRecorder()
+			app.Introspect(w, tt.r)
+
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusUnauthorized {
+				if w.Header().Get("WWW-Authenticate") == "" || !strings.Contains(w.Body.String(), `"invalid_client"`) {
+					t.Errorf("got %v: %s", w.Header(), w.Body)
+				}
+			}
+			if w.Header().Get("Cache-Control") != "no-store" {
+				t.Error("the answer may be cached")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIntrospectSessionToken(t *testing.T) {
+	user := models.User{ID: 7, TenantID: testTenant.ID, UserName: "ada", Role: models.RoleUser, Status: models.StatusActive}
+	admin := models.User{ID: 2, TenantID: testTenant.ID, UserName: "root", Role: models.RoleAdmin, Status: models.StatusActive}
+
+	tests := []struct {
+		name    string
+		user    models.User
+		actor   *models.User
+		scope   string
+		wantAct string
+	}{
+		{name: "user", user: user, scope: "read write"},
+		{name: "admin", user: admin, scope: "read write admin"},
+		{name: "impersonation", user: user, actor: &admin, scope: "read write", wantAct: "2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newOAuthTestApp(t)
+			grant := tokens.Grant{UserID: tt.user.ID, Tenant: testTenant.Slug, SessionID: "s1", Expires: time.Now().Add(time.Hour)}
+			if tt.actor != nil {
+				grant.ActorID = tt.actor.ID
+			}
+			token, err := tokens.Sign(app.keys, grant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectSessionToken(mock, tt.user, "s1", tt.actor)
+
+			w := httptest.NewRecorder()
+			app.Introspect(w, oauthPost("/oauth/introspect", "gateway", gatewaySecret, url.Values{"token": {string(token)}}))
+
+			var got Introspection
+			if err = json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !got.Active || got.TokenType != tokenTypeAccess || got.ClientID != tokens.Audience || got.Scope != tt.scope {
+				t.Errorf("got %+v", got)
+			}
+			if got.Subject != strconv.Itoa(tt.user.ID) || got.Username != tt.user.UserName || got.Tenant != testTenant.Slug || got.ID != "s1" {
+				t.Errorf("got %+v", got)
+			}
+			if got.Expires != grant.Expires.Unix() || got.Issuer != tokens.Issuer || len(got.Audiences) == 0 {
+				t.Errorf("got %+v", got)
+			}
+			switch {
+			case tt.wantAct == "" && got.Actor != nil:
+				t.Errorf("got actor %+v", got.Actor)
+			case tt.wantAct != "" && (got.Actor == nil || got.Actor.Subject != tt.wantAct):
+				t.Errorf("got actor %+v, want %s", got.Actor, tt.wantAct)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIntrospectPersonalToken(t *testing.T) {
+	app, mock := newOAuthTestApp(t)
+	token, _, _, err := tokens.NewPersonal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := models.User{ID: 7, TenantID: testTenant.ID, UserName: "ada", Role: models.RoleAdmin, Status: models.StatusActive}
+	expires := time.Now().Add(24 * time.Hour)
+	expectPersonalTokenOwner(mock, token, models.PersonalAccessToken{ID: 3, UserID: 7, Scopes: []string{models.ScopeRead}, ExpiresAt: expires}, owner)
+
+	w := httptest.NewRecorder()
+	app.Introspect(w, oauthPost("/oauth/introspect", "gateway", gatewaySecret, url.Values{"token": {token}}))
+
+	var got Introspection
+	if err = json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	// the token's scopes, not the owner's role
+	if !got.Active || got.ClientID != personalTokenClient || got.Scope != models.ScopeRead || got.TokenType != tokenTypeAccess {
+		t.Errorf("got %+v", got)
+	}
+	if got.Subject != "7" || got.Tenant != testTenant.Slug || got.Expires != expires.Unix() || got.Issuer != tokens.Issuer {
+		t.Errorf("got %+v", got)
+	}
+	if got.ID != "" || got.Actor != nil || len(got.Audiences) != 0 {
+		t.Errorf("a personal access token has JWT claims: %+v", got)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIntrospectInactive(t *testing.T) {
+	user := models.User{ID: 7, TenantID: testTenant.ID, Role: models.RoleUser, Status: models.StatusActive}
+
+	t.Run("revoked personal token", func(t *testing.T) {
+		app, mock := newOAuthTestApp(t)
+		token, _, _, err := tokens.NewPersonal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pat := models.PersonalAccessToken{ID: 3, UserID: 7, Scopes: []string{models.ScopeRead}, RevokedAt: time.Now()}
+		expectPersonalToken(mock, token, pat)
+		expectUserByID(mock, user)
+		mock.ExpectQuery(`FROM tenants where id`).WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "name", "host", "created_at"}).
+			AddRow(testTenant.ID, testTenant.Slug, testTenant.Name, "", testTenant.CreatedAt))
+		expectPersonalToken(mock, token, pat)
+
+		w := httptest.NewRecorder()
+		app.Introspect(w, oauthPost("/oauth/introspect", "gateway", gatewaySecret, url.Values{"token": {token}}))
+		if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"active":false}` {
+			t.Errorf("got %d: %s", w.Code, w.Body)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("tenant the client may not see", func(t *testing.T) {
+		app, mock := newOAuthTestApp(t)
+		token, err := tokens.Sign(app.keys, tokens.Grant{UserID: 7, Tenant: testTenant.Slug, SessionID: "s1", Expires: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSessionToken(mock, user, "s1", nil)
+
+		w := httptest.NewRecorder()
+		app.Introspect(w, oauthPost("/oauth/introspect", "globex-api", globexSecret, url.Values{"token": {string(token)}}))
+		if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"active":false}` {
+			t.Errorf("got %d: %s", w.Code, w.Body)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRevokeToken(t *testing.T) {
+	user := models.User{ID: 7, TenantID: testTenant.ID, Role: models.RoleUser, Status: models.StatusActive}
+
+	t.Run("session", func(t *testing.T) {
+		app, mock := newOAuthTestApp(t)
+		token, err := tokens.Sign(app.keys, tokens.Grant{UserID: 7, Tenant: testTenant.Slug, SessionID: "s1", Expires: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSessionToken(mock, user, "s1", nil)
+		mock.ExpectExec(`update sessions set revoked_at = \$1\s+where id = \$2 and user_id = \$3`).
+			WithArgs(sqlmock.AnyArg(), "s1", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+		// recorded in the token's tenant
+		expectAudit(mock, "token.revoke", outcomeSuccess)
+
+		w := httptest.NewRecorder()
+		app.RevokeToken(w, oauthPost("/oauth/revoke", "gateway", gatewaySecret,
+			url.Values{"token": {string(token)}, "token_type_hint": {tokenTypeRefresh}}))
+		if w.Code != http.StatusOK {
+			t.Errorf("got %d: %s", w.Code, w.Body)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("personal token", func(t *testing.T) {
+		app, mock := newOAuthTestApp(t)
+		token, _, _, err := tokens.NewPersonal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectPersonalTokenOwner(mock, token, models.PersonalAccessToken{ID: 3, UserID: 7, Scopes: []string{models.ScopeRead}}, user)
+		mock.ExpectExec(`update personal_access_tokens set revoked_at = \$1\s+where id = \$2 and user_id = \$3`).
+			WithArgs(sqlmock.AnyArg(), 3, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectAudit(mock, "token.revoke", outcomeSuccess)
+
+		w := httptest.NewRecorder()
+		app.RevokeToken(w, oauthPost("/oauth/revoke", "gateway", gatewaySecret,
+			url.Values{"token": {token}, "token_type_hint": {tokenTypeAccess}}))
+		if w.Code != http.StatusOK {
+			t.Errorf("got %d: %s", w.Code, w.Body)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		app, mock := newOAuthTestApp(t)
+		w := httptest.NewRecorder()
+		app.RevokeToken(w, oauthPost("/oauth/revoke", "gateway", gatewaySecret, url.Values{"token": {"not-a-token"}}))
+		if w.Code != http.StatusOK || w.Body.Len() != 0 {
+			t.Errorf("got %d: %s", w.Code, w.Body)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("tenant the client may not see", func(t *testing.T) {
+		app, mock := newOAuthTestApp(t)
+		token, err := tokens.Sign(app.keys, tokens.Grant{UserID: 7, Tenant: testTenant.Slug, SessionID: "s1", Expires: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// checked, and left alone
+		expectSessionToken(mock, user, "s1", nil)
+
+		w := httptest.NewRecorder()
+		app.RevokeToken(w, oauthPost("/oauth/revoke", "globex-api", globexSecret, url.Values{"token": {string(token)}}))
+		if w.Code != http.StatusOK {
+			t.Errorf("got %d: %s", w.Code, w.Body)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("bad hint", func(t *testing.T) {
+		app, mock := newOAuthTestApp(t)
+		w := httptest.NewRecorder()
+		app.RevokeToken(w, oauthPost("/oauth/revoke", "gateway", gatewaySecret,
+			url.Values{"token": {"anything"}, "token_type_hint": {"id_token"}}))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"unsupported_token_type"`) {
+			t.Errorf("got %d: %s", w.Code, w.Body)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
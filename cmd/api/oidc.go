@@ -0,0 +1,417 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/models"
+	"auth/api/oidc"
+	"auth/api/repository"
+	"auth/api/tokens"
+	"auth/api/tracing"
+	"auth/api/webhooks"
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// oidcFlowCookie keeps the state of a sign-in while the user is at the provider
+	oidcFlowCookie = "oidc_flow"
+	// oidcFlowLifetime is how long the user has to sign in at the provider
+	oidcFlowLifetime = 10 * time.Minute
+)
+
+// validProviderName keeps provider names usable in paths
+var validProviderName = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+var (
+	errNoLinkedUser = errors.New("no account is linked to this identity")
+	errEmailTaken   = errors.New("an account with this email already exists, sign in to it first")
+)
+
+// oidcProvider is an upstream provider as listed in the -oidc-providers file
+type oidcProvider struct {
+	Name             string   `yaml:"name"`
+	Issuer           string   `yaml:"issuer"`
+	ClientID         string   `yaml:"client-id"`
+	ClientSecret     string   `yaml:"client-secret"`
+	ClientSecretFile string   `yaml:"client-secret-file"`
+	Scopes           []string `yaml:"scopes"`
+	// Provision creates users signing in for the first time
+	Provision bool `yaml:"provision"`
+	// LinkByEmail links a first sign-in to the user with the same verified email.
+	// Only turn it on for providers trusted to verify emails.
+	LinkByEmail bool   `yaml:"link-by-email"`
+	Role        string `yaml:"role"`
+	// Tenants the provider may sign in to, all when empty
+	Tenants []string `yaml:"tenants"`
+	// SatisfiesMFA skips the SMS passcode after signing in with the provider,
+	// for providers that enforce their own second factor
+	SatisfiesMFA bool `yaml:"satisfies-mfa"`
+}
+
+// loadOIDCProviders reads the providers file
+func loadOIDCProviders(path string) ([]oidcProvider, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers []oidcProvider
+	if err = yaml.Unmarshal(raw, &providers); err != nil {
+		return nil, fmt.Errorf("oidc providers file %s: %v", path, err)
+	}
+
+	for i, p := range providers {
+		if p.ClientSecretFile != "" {
+			if providers[i].ClientSecret, err = readSecretFile(p.ClientSecretFile); err != nil {
+				return nil, fmt.Errorf("oidc provider %s: %v", p.Name, err)
+			}
+		}
+		if p.Role == "" {
+			providers[i].Role = models.RoleUser
+		}
+	}
+	return providers, nil
+}
+
+// validOIDCConfig checks the provider list and callback URL
+func validOIDCConfig(c config) error {
+	if len(c.oidc.providers) == 0 {
+		return nil
+	}
+
+	if u, err := url.Parse(c.oidc.callbackBase); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("oidc-callback-base must be the public http or https URL of this server, got %q", c.oidc.callbackBase)
+	}
+	if c.oidc.returnURL != "" {
+		if u, err := url.Parse(c.oidc.returnURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("oidc-return-url must be an http or https URL, got %q", c.oidc.returnURL)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, p := range c.oidc.providers {
+		if !validProviderName.MatchString(p.Name) || seen[p.Name] || p.Name == ldapProvider {
+			return fmt.Errorf("oidc provider names must be unique, not ldap, and lower case letters, digits and dashes, got %q", p.Name)
+		}
+		seen[p.Name] = true
+
+		u, err := url.Parse(p.Issuer)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && c.env == "dev")) {
+			return fmt.Errorf("oidc provider %s: issuer must be an https URL, got %q", p.Name, p.Issuer)
+		}
+		if p.ClientID == "" || p.ClientSecret == "" {
+			return fmt.Errorf("oidc provider %s: client-id and a client secret are required", p.Name)
+		}
+		if p.Role != models.RoleUser && p.Role != models.RoleAdmin {
+			return fmt.Errorf("oidc provider %s: role must be user or admin, got %q", p.Name, p.Role)
+		}
+	}
+
+	return nil
+}
+
+// newOIDCProviders sets up a client for every configured provider
+func newOIDCProviders(c config) map[string]*oidc.Provider {
+	client := &http.Client{Timeout: 10 * time.Second}
+	providers := map[string]*oidc.Provider{}
+
+	for _, p := range c.oidc.providers {
+		providers[p.Name] = oidc.New(oidc.Config{
+			Issuer:       p.Issuer,
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			RedirectURL:  strings.TrimSuffix(c.oidc.callbackBase, "/") + "/v1/oidc/" + p.Name + "/callback",
+			Scopes:       p.Scopes,
+		}, client)
+	}
+	return providers
+}
+
+// providerConfig returns the configured provider with the name
+func (app *application) providerConfig(name string) (oidcProvider, bool) {
+	for _, p := range app.config.oidc.providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return oidcProvider{}, false
+}
+
+// allowsTenant reports whether the provider may sign in to the tenant
+func (p oidcProvider) allowsTenant(slug string) bool {
+	if len(p.Tenants) == 0 {
+		return true
+	}
+	for _, t := range p.Tenants {
+		if t == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// OIDCLogin sends the browser to the provider to sign in. The state, nonce
+// and PKCE verifier go with it in a signed cookie, which binds the callback to
+// the browser that started the sign-in.
+func (app *application) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("provider")
+	p, ok := app.providerConfig(name)
+	tenant := tenantFromContext(r)
+	if !ok || !p.allowsTenant(tenant.Slug) {
+		app.errorJSON(w, errors.New("unknown identity provider"), http.StatusNotFound)
+		return
+	}
+
+	flow := tokens.Flow{Provider: name, Tenant: tenant.Slug, Expires: time.Now().Add(oidcFlowLifetime)}
+	var err error
+	for _, v := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		if *v, err = oidc.NewVerifier(); err != nil {
+			app.log(r).Error("error generating sign-in state", "err", err)
+			app.errorJSON(w, errors.New("error starting sign-in"), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ctx, span := tracing.Start(r.Context(), "oidc.discover")
+	authURL, err := app.oidc[name].AuthCodeURL(ctx, flow.State, flow.Nonce, flow.Verifier)
+	if err != nil {
+		tracing.RecordError(ctx, err)
+	}
+	span.End()
+	if err != nil {
+		app.log(r).Error("error reaching identity provider", "err", err, "provider", name)
+		app.errorJSON(w, errors.New("identity provider unavailable"), http.StatusBadGateway)
+		return
+	}
+
+	token, err := tokens.SignFlow(app.keys, flow)
+	if err != nil {
+		app.log(r).Error("error signing sign-in state", "err", err)
+		app.errorJSON(w, errors.New("error starting sign-in"), http.StatusInternalServerError)
+		return
+	}
+
+	// lax so the cookie comes along when the provider redirects back
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    string(token),
+		Path:     "/v1/oidc/",
+		Expires:  flow.Expires,
+		HttpOnly: true,
+		Secure:   app.config.session.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback finishes a sign-in at a provider: it checks the browser is the
+// one that started it, trades the code for an ID token, validates it and signs
+// the linked user in, creating or linking one as the provider allows. The
+// tenant comes from the sign-in state, as every tenant shares the callback URL.
+func (app *application) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("provider")
+	p, ok := app.providerConfig(name)
+	if !ok {
+		app.errorJSON(w, errors.New("unknown identity provider"), http.StatusNotFound)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcFlowCookie, Path: "/v1/oidc/", MaxAge: -1, HttpOnly: true, Secure: app.config.session.cookieSecure})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		app.audit(r, "auth.signin", 0, outcomeFailure, map[string]interface{}{"method": "oidc", "provider": name, "reason": e})
+		signins.Inc(outcomeFailure, "provider_refused")
+		app.errorJSON(w, errors.New("sign-in was cancelled or refused by the identity provider"), http.StatusForbidden)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcFlowCookie)
+	var flow tokens.Flow
+	if err == nil {
+		flow, err = tokens.CheckFlow(app.keys, []byte(cookie.Value))
+	}
+	if err != nil || flow.Provider != name || !hmac.Equal([]byte(flow.State), []byte(q.Get("state"))) {
+		signins.Inc(outcomeFailure, "bad_state")
+		app.errorJSON(w, errors.New("sign-in expired or was started in another browser, try again"), http.StatusForbidden)
+		return
+	}
+
+	tenant, err := app.db.DB.GetTenantBySlug(r.Context(), flow.Tenant)
+	if err != nil || !p.allowsTenant(tenant.Slug) {
+		app.errorJSON(w, errors.New("unknown tenant"), http.StatusNotFound)
+		return
+	}
+	ctx := context.WithValue(r.Context(), tenantContextKey, tenant)
+	ctx = logging.NewContext(ctx, app.log(r).With("tenant", tenant.Slug, "provider", name))
+	r = r.WithContext(ctx)
+
+	provider := app.oidc[name]
+	ctx, span := tracing.Start(ctx, "oidc.exchange")
+	identity, err := func() (oidc.Identity, error) {
+		idToken, err := provider.Exchange(ctx, q.Get("code"), flow.Verifier)
+		if err != nil {
+			return oidc.Identity{}, err
+		}
+		return provider.Verify(ctx, idToken, flow.Nonce)
+	}()
+	if err != nil {
+		tracing.RecordError(ctx, err)
+	}
+	span.End()
+	if err != nil {
+		app.log(r).Warn("federated sign-in refused", "err", err)
+		app.audit(r, "auth.signin", 0, outcomeFailure, map[string]interface{}{"method": "oidc", "provider": name, "reason": "invalid id token"})
+		signins.Inc(outcomeFailure, "invalid_id_token")
+		app.errorJSON(w, errors.New("unauthorized, the identity provider's answer could not be verified"), http.StatusForbidden)
+		return
+	}
+
+	user, err := app.federatedUser(r, p, identity)
+	switch {
+	case errors.Is(err, errNoLinkedUser), errors.Is(err, errEmailTaken):
+		app.audit(r, "auth.signin", 0, outcomeFailure, map[string]interface{}{"method": "oidc", "provider": name, "reason": err.Error()})
+		signins.Inc(outcomeFailure, "no_account")
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	case err != nil:
+		app.log(r).Error("error finding federated user", "err", err)
+		signins.Inc(outcomeFailure, "error")
+		app.errorJSON(w, errors.New("error signing in"), http.StatusInternalServerError)
+		return
+	}
+
+	if err = repository.CheckAccountStatus(user); err != nil {
+		app.audit(r, "auth.signin", user.ID, outcomeFailure, map[string]interface{}{"method": "oidc", "provider": name, "reason": "inactive"})
+		signins.Inc(outcomeFailure, "inactive")
+		app.errorJSON(w, errors.New("unauthorized, account is not active"), http.StatusForbidden)
+		return
+	}
+
+	if !p.SatisfiesMFA && app.challengeSecondFactorWith(w, r, user.ID, func(c otpChallenge) { app.redirectChallenge(w, r, c) }) {
+		return
+	}
+
+	session, err := app.startSession(r, user.ID, "")
+	if err != nil {
+		app.log(r).Error("error signing in", "err", err)
+		signins.Inc(outcomeFailure, "error")
+		app.errorJSON(w, errors.New("error signing in"))
+		return
+	}
+
+	app.audit(r, "auth.signin", user.ID, outcomeSuccess, map[string]interface{}{"method": "oidc", "provider": name})
+	signins.Inc(outcomeSuccess, "")
+	app.redirectSession(w, r, session)
+}
+
+// federatedUser returns the user a provider account signs in as, linking or
+// creating one on its first sign-in when the provider allows
+func (app *application) federatedUser(r *http.Request, p oidcProvider, id oidc.Identity) (models.User, error) {
+	ctx := r.Context()
+	tenant := tenantFromContext(r)
+
+	linked, err := app.db.DB.GetIdentity(ctx, tenant.ID, p.Name, id.Subject)
+	if err == nil {
+		if err = app.db.DB.TouchIdentity(ctx, linked.ID, id.Email); err != nil {
+			app.log(r).Error("error touching identity", "err", err)
+		}
+		return app.db.DB.GetUserById(ctx, linked.UserID)
+	}
+	if !errors.Is(err, repository.ErrNoRecord) {
+		return models.User{}, err
+	}
+
+	identity := models.Identity{TenantID: tenant.ID, Provider: p.Name, Subject: id.Subject, Email: id.Email}
+
+	if p.LinkByEmail && id.EmailVerified && id.Email != "" {
+		user, err := app.db.DB.GetUserByEmail(ctx, tenant.ID, id.Email)
+		if err == nil {
+			identity.UserID = user.ID
+			_, err = app.db.DB.InsertIdentity(ctx, identity)
+			app.audit(r, "identity.link", user.ID, outcome(err), map[string]interface{}{"provider": p.Name})
+			return user, err
+		}
+	}
+
+	if !p.Provision || id.Email == "" {
+		return models.User{}, errNoLinkedUser
+	}
+
+	user := models.User{
+		TenantID: tenant.ID,
+		Name:     id.Name,
+		Email:    id.Email,
+		UserName: id.Username,
+		Role:     p.Role,
+	}
+	if user.Name == "" {
+		user.Name = id.Email
+	}
+	if user.UserName == "" {
+		user.UserName = id.Email
+	}
+
+	user.ID, err = app.db.DB.ProvisionUser(ctx, user, identity,
+		app.outboxEvent(r, models.EventUserRegistered, map[string]interface{}{"user": webhooks.UserData(user), "method": "oidc", "provider": p.Name})...)
+	if errors.Is(err, repository.ErrDuplicateUsername) {
+		// the name is someone else's here, the subject makes it unique
+		suffix, _ := oidc.NewVerifier()
+		user.UserName = user.UserName + "-" + strings.ToLower(suffix[:6])
+		user.ID, err = app.db.DB.ProvisionUser(ctx, user, identity,
+			app.outboxEvent(r, models.EventUserRegistered, map[string]interface{}{"user": webhooks.UserData(user), "method": "oidc", "provider": p.Name})...)
+	}
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		return models.User{}, errEmailTaken
+	}
+	app.audit(r, "auth.register", user.ID, outcome(err), map[string]interface{}{"method": "oidc", "provider": p.Name})
+	if err != nil {
+		registrations.Inc(outcomeFailure)
+		return models.User{}, err
+	}
+	registrations.Inc(outcomeSuccess)
+
+	return app.db.DB.GetUserById(ctx, user.ID)
+}
+
+// redirectSession hands a session from a browser sign-in back to the app at
+// -oidc-return-url: in cookies, or in the URL fragment in token mode. Without
+// a return URL it answers like Signin.
+func (app *application) redirectSession(w http.ResponseWriter, r *http.Request, s signedSession) {
+	if app.config.oidc.returnURL == "" {
+		app.writeSession(w, s)
+		return
+	}
+
+	u, _ := url.Parse(app.config.oidc.returnURL)
+	if app.config.session.mode == sessionModeCookie {
+		app.setSessionCookies(w, s)
+	} else {
+		u.Fragment = "token=" + string(s.Token)
+	}
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// redirectChallenge ends a provider sign-in that needs an SMS passcode. The
+// app finishes it with POST /v1/signin/otp.
+func (app *application) redirectChallenge(w http.ResponseWriter, r *http.Request, c otpChallenge) {
+	if app.config.oidc.returnURL == "" {
+		app.writeJSON(w, http.StatusOK, c, "mfa")
+		return
+	}
+
+	u, _ := url.Parse(app.config.oidc.returnURL)
+	u.Fragment = "mfa=" + c.Challenge
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/oidc/oidctest"
+	"auth/api/tokens"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+var oidcUser = oidctest.User{Subject: "alice-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+
+// newOIDCTestApp returns an application signing in with the provider named
+// test, which is run in process
+func newOIDCTestApp(t *testing.T, p oidcProvider) (*application, sqlmock.Sqlmock, *oidctest.Provider) {
+	t.Helper()
+
+	idp, err := oidctest.NewProvider("client-1", "secret-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+
+	app, mock := newTestApp(t)
+	p.Name = "test"
+	p.Issuer = idp.Issuer()
+	p.ClientID = idp.ClientID
+	p.ClientSecret = idp.ClientSecret
+	if p.Role == "" {
+		p.Role = models.RoleUser
+	}
+	app.config.oidc.providers = []oidcProvider{p}
+	app.config.oidc.callbackBase = "https://auth.example.com"
+	app.oidc = newOIDCProviders(app.config)
+
+	return app, mock, idp
+}
+
+// startOIDCSignIn plays the browser: it starts a sign-in, signs in at the
+// provider and returns the callback request the provider sends it back with
+func startOIDCSignIn(t *testing.T, app *application, idp *oidctest.Provider) *http.Request {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/oidc/test/login", nil)
+	w := httptest.NewRecorder()
+	app.OIDCLogin(w, withParams(withTenant(r, testTenant), "provider", "test"))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login answered %d: %s", w.Code, w.Body)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcFlowCookie {
+		t.Fatalf("login set cookies %v, want the flow cookie", cookies)
+	}
+
+	client := idp.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("provider answered %d", resp.StatusCode)
+	}
+
+	cb := httptest.NewRequest(http.MethodGet, resp.Header.Get("Location"), nil)
+	cb.AddCookie(cookies[0])
+	return withParams(cb, "provider", "test")
+}
+
+func TestOIDCCallback(t *testing.T) {
+	existing := models.User{
+		ID: 7, TenantID: testTenant.ID, Name: "Alice A.", Email: oidcUser.Email, UserName: "alice",
+		Role: models.RoleUser, Status: models.StatusActive, CreatedAt: time.Now(), UpdatedAt: time.Now(),
+	}
+	provisioned := models.User{
+		ID: 9, TenantID: testTenant.ID, Name: oidcUser.Name, Email: oidcUser.Email, UserName: oidcUser.Email,
+		Role: models.RoleUser, Status: models.StatusActive, CreatedAt: time.Now(), UpdatedAt: time.Now(),
+	}
+	identityColumns := []string{"id", "tenant_id", "user_id", "provider", "subject", "email", "created_at", "last_login_at"}
+
+	noIdentity := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(`FROM identities`).WithArgs(testTenant.ID, "test", oidcUser.Subject).
+			WillReturnRows(sqlmock.NewRows(identityColumns))
+	}
+	userByEmail := func(mock sqlmock.Sqlmock, u models.User) {
+		mock.ExpectQuery(`FROM users where tenant_id = \$1 and email`).WithArgs(testTenant.ID, u.Email).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "name", "email", "username", "role", "status",
+				"suspended_until", "created_at", "updated_at", "password_reset_code"}).
+				AddRow(u.ID, u.TenantID, u.Name, u.Email, u.UserName, u.Role, u.Status, nil, u.CreatedAt, u.UpdatedAt, ""))
+	}
+
+	tests := []struct {
+		name     string
+		provider oidcProvider
+		user     oidctest.User
+		expect   func(sqlmock.Sqlmock)
+		status   int
+		// userID is who is signed in, when the status is 200
+		userID int
+	}{
+		{
+			name: "linked identity",
+			user: oidcUser,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM identities`).WithArgs(testTenant.ID, "test", oidcUser.Subject).
+					WillReturnRows(sqlmock.NewRows(identityColumns).
+						AddRow(3, testTenant.ID, existing.ID, "test", oidcUser.Subject, oidcUser.Email, time.Now(), nil))
+				mock.ExpectExec(`update identities set last_login_at`).WithArgs(sqlmock.AnyArg(), oidcUser.Email, 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectUserByID(mock, existing)
+				// the second factor check finds no SMS MFA
+				expectUserByID(mock, existing)
+				expectSession(mock, existing.ID)
+				expectAudit(mock, "auth.signin", outcomeSuccess)
+			},
+			status: http.StatusOK,
+			userID: existing.ID,
+		},
+		{
+			name:     "link by verified email",
+			provider: oidcProvider{LinkByEmail: true, Provision: true},
+			user:     oidcUser,
+			expect: func(mock sqlmock.Sqlmock) {
+				noIdentity(mock)
+				userByEmail(mock, existing)
+				mock.ExpectQuery(`INSERT INTO identities`).
+					WithArgs(testTenant.ID, existing.ID, "test", oidcUser.Subject, oidcUser.Email, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				expectAudit(mock, "identity.link", outcomeSuccess)
+				expectUserByID(mock, existing)
+				expectSession(mock, existing.ID)
+				expectAudit(mock, "auth.signin", outcomeSuccess)
+			},
+			status: http.StatusOK,
+			userID: existing.ID,
+		},
+		{
+			name:     "unverified email is not linked",
+			provider: oidcProvider{LinkByEmail: true, Provision: true},
+			user:     oidctest.User{Subject: oidcUser.Subject, Email: oidcUser.Email, Name: oidcUser.Name},
+			expect: func(mock sqlmock.Sqlmock) {
+				noIdentity(mock)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO users`).
+					WillReturnError(&pq.Error{Code: "23505", Constraint: "users_tenant_email_key"})
+				mock.ExpectRollback()
+				expectAudit(mock, "auth.signin", outcomeFailure)
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name:     "just in time provisioning",
+			provider: oidcProvider{Provision: true},
+			user:     oidcUser,
+			expect: func(mock sqlmock.Sqlmock) {
+				noIdentity(mock)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO users`).
+					WithArgs(testTenant.ID, oidcUser.Name, oidcUser.Email, oidcUser.Email, models.RoleUser, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(provisioned.ID))
+				mock.ExpectQuery(`INSERT INTO identities`).
+					WithArgs(testTenant.ID, provisioned.ID, "test", oidcUser.Subject, oidcUser.Email, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+				mock.ExpectExec(`INSERT INTO outbox`).
+					WithArgs(models.OutboxEvent, testTenant.ID, sqlmock.AnyArg(), provisioned.ID, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				expectAudit(mock, "auth.register", outcomeSuccess)
+				expectUserByID(mock, provisioned)
+				expectUserByID(mock, provisioned)
+				expectSession(mock, provisioned.ID)
+				expectAudit(mock, "auth.signin", outcomeSuccess)
+			},
+			status: http.StatusOK,
+			userID: provisioned.ID,
+		},
+		{
+			name:     "taken username gets a suffix",
+			provider: oidcProvider{Provision: true},
+			user:     oidcUser,
+			expect: func(mock sqlmock.Sqlmock) {
+				noIdentity(mock)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO users`).
+					WillReturnError(&pq.Error{Code: "23505", Constraint: "users_tenant_username_key"})
+				mock.ExpectRollback()
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO users`).
+					WithArgs(testTenant.ID, oidcUser.Name, oidcUser.Email, sqlmock.AnyArg(), models.RoleUser, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(provisioned.ID))
+				mock.ExpectQuery(`INSERT INTO identities`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+				mock.ExpectExec(`INSERT INTO outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				expectAudit(mock, "auth.register", outcomeSuccess)
+				expectUserByID(mock, provisioned)
+				expectUserByID(mock, provisioned)
+				expectSession(mock, provisioned.ID)
+				expectAudit(mock, "auth.signin", outcomeSuccess)
+			},
+			status: http.StatusOK,
+			userID: provisioned.ID,
+		},
+		{
+			name:     "email taken without linking",
+			provider: oidcProvider{Provision: true},
+			user:     oidcUser,
+			expect: func(mock sqlmock.Sqlmock) {
+				noIdentity(mock)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO users`).
+					WillReturnError(&pq.Error{Code: "23505", Constraint: "users_tenant_email_key"})
+				mock.ExpectRollback()
+				expectAudit(mock, "auth.signin", outcomeFailure)
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name: "no account and no provisioning",
+			user: oidcUser,
+			expect: func(mock sqlmock.Sqlmock) {
+				noIdentity(mock)
+				expectAudit(mock, "auth.signin", outcomeFailure)
+			},
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock, idp := newOIDCTestApp(t, tt.provider)
+			idp.SetUser(tt.user)
+			r := startOIDCSignIn(t, app, idp)
+
+			expectTenant(mock, testTenant)
+			tt.expect(mock)
+
+			w := httptest.NewRecorder()
+			app.OIDCCallback(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("callback answered %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Token string `json:"token"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			_, grant, err := tokens.Check(app.keys, []byte(resp.Token))
+			if err != nil {
+				t.Fatalf("token does not check: %v", err)
+			}
+			if grant.UserID != tt.userID || grant.Tenant != testTenant.Slug {
+				t.Errorf("signed in as user %d of %q, want %d of %q", grant.UserID, grant.Tenant, tt.userID, testTenant.Slug)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackSecondFactor(t *testing.T) {
+	user := models.User{
+		ID: 7, TenantID: testTenant.ID, Name: "Alice A.", Email: oidcUser.Email, UserName: "alice",
+		Role: models.RoleUser, Status: models.StatusActive, Phone: "+15551234567", SMSMFA: true,
+	}
+
+	tests := []struct {
+		name      string
+		provider  oidcProvider
+		returnURL string
+		status    int
+	}{
+		{name: "answered with JSON", status: http.StatusOK},
+		{name: "sent to the return URL", returnURL: "https://app.example.com/signed-in", status: http.StatusSeeOther},
+		{name: "provider satisfies MFA", provider: oidcProvider{SatisfiesMFA: true}, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock, idp := newOIDCTestApp(t, tt.provider)
+			app.config.oidc.returnURL = tt.returnURL
+			sender := &recordingSender{}
+			app.sms = sender
+			idp.SetUser(oidcUser)
+			r := startOIDCSignIn(t, app, idp)
+
+			expectTenant(mock, testTenant)
+			mock.ExpectQuery(`FROM identities`).WithArgs(testTenant.ID, "test", oidcUser.Subject).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "user_id", "provider", "subject", "email", "created_at", "last_login_at"}).
+					AddRow(3, testTenant.ID, user.ID, "test", oidcUser.Subject, oidcUser.Email, time.Now(), nil))
+			mock.ExpectExec(`update identities set last_login_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+			expectUserByID(mock, user)
+			if tt.provider.SatisfiesMFA {
+				expectSession(mock, user.ID)
+				expectAudit(mock, "auth.signin", outcomeSuccess)
+			} else {
+				expectUserByID(mock, user)
+				mock.ExpectQuery(`SELECT count\(\*\) FROM otp_codes`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectQuery(`SELECT count\(\*\) FROM otp_codes`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec(`INSERT INTO otp_codes`).WillReturnResult(sqlmock.NewResult(1, 1))
+				expectAudit(mock, "auth.mfa_challenge", outcomeSuccess)
+			}
+
+			w := httptest.NewRecorder()
+			app.OIDCCallback(w, r)
+			app.wg.Wait()
+			if w.Code != tt.status {
+				t.Fatalf("callback answered %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+
+			var resp struct {
+				Token string       `json:"token"`
+				MFA   otpChallenge `json:"mfa"`
+			}
+			if tt.returnURL != "" {
+				loc := w.Header().Get("Location")
+				if !strings.HasPrefix(loc, tt.returnURL+"#mfa=") || strings.Contains(loc, "token=") {
+					t.Errorf("sent to %s, want the challenge in the fragment", loc)
+				}
+			} else if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.provider.SatisfiesMFA {
+				if resp.Token == "" || len(sender.sent) != 0 {
+					t.Errorf("got no session, or a passcode was sent: %s", w.Body)
+				}
+				return
+			}
+			if resp.Token != "" {
+				t.Error("a session was started before the second factor")
+			}
+			if tt.returnURL == "" && (!resp.MFA.Required || resp.MFA.Challenge == "") {
+				t.Errorf("got challenge %+v", resp.MFA)
+			}
+			if len(sender.sent) != 1 || sender.sent[0].To != user.Phone {
+				t.Errorf("sent %+v", sender.sent)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRefusesOtherBrowser(t *testing.T) {
+	app, mock, idp := newOIDCTestApp(t, oidcProvider{Provision: true})
+	idp.SetUser(oidcUser)
+
+	r := startOIDCSignIn(t, app, idp)
+	q := r.URL.Query()
+	q.Set("state", "forged")
+	r.URL.RawQuery = q.Encode()
+
+	w := httptest.NewRecorder()
+	app.OIDCCallback(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("callback answered %d, want 403", w.Code)
+	}
+	if n := idp.Exchanges(); n != 0 {
+		t.Errorf("code exchanged %d times with a forged state", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
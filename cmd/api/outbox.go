@@ -0,0 +1,180 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/webhooks"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// outboxBatch is how many messages the dispatcher claims and sends at once
+	outboxBatch = 10
+	// outboxFirstRetry is the wait before the first retry, doubled for each one after
+	outboxFirstRetry = 5 * time.Second
+	// outboxMaxRetry caps the wait between retries
+	outboxMaxRetry = 10 * time.Minute
+)
+
+// outboxEvent returns the message queueing a webhook event for the request's
+// tenant, to be written with the change it reports. An event that cannot be
+// made is logged and left out rather than failing the change.
+func (app *application) outboxEvent(r *http.Request, eventType string, data map[string]interface{}) []models.OutboxMessage {
+	tenant := tenantFromContext(r)
+
+	event, err := webhooks.NewEvent(eventType, tenant.Slug, data)
+	if err != nil {
+		app.log(r).Error("error making webhook event", "err", err)
+		return nil
+	}
+	msg, err := event.Outbox(tenant.ID)
+	if err != nil {
+		app.log(r).Error("error encoding webhook event", "err", err)
+		return nil
+	}
+	return []models.OutboxMessage{msg}
+}
+
+// outboxEmail returns the message posting an email payload to the gateway
+func outboxEmail(tenantID int, email interface{}) (models.OutboxMessage, error) {
+	payload, err := json.Marshal(email)
+	if err != nil {
+		return models.OutboxMessage{}, err
+	}
+	return models.OutboxMessage{Kind: models.OutboxEmail, TenantID: tenantID, Payload: payload}, nil
+}
+
+// runOutboxDispatcher sends due outbox messages on every tick until ctx ends
+func (app *application) runOutboxDispatcher(ctx context.Context) {
+	ticker := time.NewTicker(app.config.outbox.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// keep going while there is a backlog
+		for !app.stopping() && app.dispatchOutbox(ctx) == outboxBatch {
+		}
+	}
+}
+
+// dispatchOutbox sends one batch of due messages and returns its size
+func (app *application) dispatchOutbox(ctx context.Context) int {
+	// held long enough for the email gateway to answer
+	due, err := app.db.DB.ClaimOutbox(ctx, outboxBatch, mailerTimeout+time.Minute)
+	if err != nil {
+		app.logger.Error("error claiming outbox messages", "err", err)
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, msg := range due {
+		wg.Add(1)
+		go func(msg models.OutboxMessage) {
+			defer wg.Done()
+			app.sendOutbox(ctx, msg)
+		}(msg)
+	}
+	wg.Wait()
+
+	return len(due)
+}
+
+// sendOutbox posts an email to the gateway or fans an event out to webhook
+// deliveries, then records how it went, scheduling a retry with exponential
+// backoff or, after the last attempt, marking it dead
+func (app *application) sendOutbox(ctx context.Context, msg models.OutboxMessage) {
+	var err error
+	switch msg.Kind {
+	case models.OutboxEmail:
+		err = app.postEmail(ctx, msg.Payload)
+	case models.OutboxEvent:
+		// marks the message sent itself, with the deliveries
+		_, err = app.db.DB.ForwardOutboxEvent(ctx, msg.ID)
+		if err == nil {
+			outboxMessages.Inc(msg.Kind, "sent")
+			return
+		}
+		// another replica forwarded it after our lease ran out
+		if errors.Is(err, repository.ErrNoRecord) {
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown outbox message kind %q", msg.Kind)
+	}
+
+	var attemptErr string
+	var next time.Time
+	result := "sent"
+	if err != nil {
+		attemptErr = err.Error()
+		result = models.DeliveryDead
+		if attempts := msg.Attempts + 1; attempts < app.config.outbox.maxAttempts {
+			next = time.Now().Add(outboxBackoff(attempts))
+			result = "retry"
+		}
+		app.logger.Warn("outbox message not sent", "message", msg.ID, "kind", msg.Kind,
+			"attempt", msg.Attempts+1, "dead", next.IsZero(), "err", err)
+	}
+	outboxMessages.Inc(msg.Kind, result)
+
+	// an email that will not be sent again has no use for its link or code
+	var payload []byte
+	if msg.Kind == models.OutboxEmail && result != "retry" {
+		payload = scrubEmail(msg.Payload)
+	}
+
+	// recorded even when the server is stopping, or the lease has to run out first
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = app.db.DB.RecordOutboxAttempt(ctx, msg.ID, attemptErr, next, payload); err != nil {
+		app.logger.Error("error recording outbox attempt", "message", msg.ID, "err", err)
+	}
+}
+
+// scrubEmail returns the part of an email payload kept once it is sent or
+// dead: who it was for, without the sign-in link or reset code it carried
+func scrubEmail(payload []byte) []byte {
+	var kept struct {
+		Source      string `json:"source"`
+		Destination string `json:"destination"`
+	}
+	// what cannot be read cannot be trusted to be free of secrets either
+	json.Unmarshal(payload, &kept)
+	scrubbed, _ := json.Marshal(kept)
+	return scrubbed
+}
+
+// outboxBackoff returns how long to wait before retrying a message that failed
+// attempts times: 5s, 10s, 20s, ... up to 10m
+func outboxBackoff(attempts int) time.Duration {
+	wait := outboxFirstRetry
+	for i := 1; i < attempts && wait < outboxMaxRetry; i++ {
+		wait *= 2
+	}
+	if wait > outboxMaxRetry {
+		wait = outboxMaxRetry
+	}
+	return wait
+}
+
+// validOutboxConfig checks the dispatcher flags
+func validOutboxConfig(c config) error {
+	if c.outbox.interval <= 0 {
+		return errors.New("outbox-interval must be positive")
+	}
+	if c.outbox.maxAttempts < 1 {
+		return fmt.Errorf("outbox-max-attempts must be at least 1, got %d", c.outbox.maxAttempts)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"auth/api/models"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// scrubbedPayload matches a payload stored in place of an email's that still
+// names the destination but has lost the secret
+type scrubbedPayload struct {
+	destination, secret string
+}
+
+func (p scrubbedPayload) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	if !ok || strings.Contains(s, p.secret) {
+		return false
+	}
+	var kept struct {
+		Destination string `json:"destination"`
+	}
+	return json.Unmarshal([]byte(s), &kept) == nil && kept.Destination == p.destination
+}
+
+func TestSendOutboxScrubsEmail(t *testing.T) {
+	const token = "Q2hhbmdlIG1lIHRvIGEgcmVhbCBzaWduZWQgbGluayB0.b2tlbiB0aGF0IHRoZSBhcHAgd291bGQgc2VuZCBvdXQ"
+	magicLink, err := outboxEmail(testTenant.ID, models.MagicLinkEmailPayload{
+		Source:      emailSource,
+		Destination: "ada@example.com",
+		MagicLink:   "https://app.example.com/signin#token=" + token,
+		ExpiresAt:   time.Now().Add(15 * time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset, err := outboxEmail(testTenant.ID, models.ForgotPasswordEmailPayload{
+		Source:            emailSource,
+		Destination:       "ada@example.com",
+		PasswordResetCode: "Xk3pQ9Lm",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		msg      models.OutboxMessage
+		secret   string
+		attempts int
+		gateway  int
+		// stored is what the payload is replaced with, nil to keep it
+		stored interface{}
+	}{
+		{name: "sent magic link", msg: magicLink, secret: token, gateway: http.StatusOK,
+			stored: scrubbedPayload{"ada@example.com", token}},
+		{name: "sent reset code", msg: reset, secret: "Xk3pQ9Lm", gateway: http.StatusAccepted,
+			stored: scrubbedPayload{"ada@example.com", "Xk3pQ9Lm"}},
+		// still needed for the retry
+		{name: "retried", msg: magicLink, secret: token, gateway: http.StatusBadGateway, stored: nil},
+		{name: "dead", msg: magicLink, secret: token, attempts: 4, gateway: http.StatusBadGateway,
+			stored: scrubbedPayload{"ada@example.com", token}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var posted string
+			gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body json.RawMessage
+				json.NewDecoder(r.Body).Decode(&body)
+				posted = string(body)
+				w.WriteHeader(tt.gateway)
+			}))
+			defer gateway.Close()
+
+			app, mock := newTestApp(t)
+			app.config.mailer.url = gateway.URL
+			app.config.outbox.maxAttempts = 5
+
+			msg := tt.msg
+			msg.ID, msg.Attempts = 11, tt.attempts
+			mock.ExpectExec(`update outbox set.*payload = coalesce\(\$6::jsonb, payload\)\s+where id = \$1`).
+				WithArgs(int64(11), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), tt.stored).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			app.sendOutbox(context.Background(), msg)
+
+			// the gateway got the whole email
+			if !strings.Contains(posted, tt.secret) {
+				t.Errorf("the gateway got %s", posted)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
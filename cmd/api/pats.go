@@ -0,0 +1,255 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/tokens"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxPersonalTokenName keeps token names to something a list can show
+const maxPersonalTokenName = 100
+
+type NewPersonalToken struct {
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// servePersonal validates a personal access token and passes the request on
+// with the user and token in its context. There is no session.
+func (app *application) servePersonal(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	user, pat, err := app.validatePersonalToken(r.Context(), token)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	if err = app.db.DB.TouchPersonalAccessToken(r.Context(), pat.ID, clientIP(r)); err != nil {
+		app.log(r).Error("error touching personal access token", "err", err)
+	}
+
+	ctx := logging.NewContext(r.Context(), app.log(r).With("user_id", user.ID, "token_id", pat.ID))
+	ctx = context.WithValue(ctx, userContextKey, user)
+	ctx = context.WithValue(ctx, tokenContextKey, pat)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// validatePersonalToken looks a personal access token up by its hash and
+// returns the user it belongs to. The returned error is safe to show to the caller.
+func (app *application) validatePersonalToken(ctx context.Context, token string) (models.User, models.PersonalAccessToken, error) {
+	var user models.User
+
+	pat, err := app.db.DB.GetPersonalAccessToken(ctx, tokens.HashPersonal(token))
+	if err != nil {
+		tokenFailures.Inc("pat_unknown")
+		return user, pat, errors.New("unauthorized, unknown token")
+	}
+
+	if !pat.RevokedAt.IsZero() {
+		tokenFailures.Inc("pat_revoked")
+		return user, pat, errors.New("unauthorized, token has been revoked")
+	}
+
+	if !pat.ExpiresAt.IsZero() && time.Now().After(pat.ExpiresAt) {
+		tokenFailures.Inc("pat_expired")
+		return user, pat, errors.New("unauthorized, token has expired")
+	}
+
+	user, err = app.db.DB.GetUserById(ctx, pat.UserID)
+	if err != nil {
+		tokenFailures.Inc("user")
+		return user, pat, errors.New("unauthorized")
+	}
+
+	tenant, _ := ctx.Value(tenantContextKey).(models.Tenant)
+	if user.TenantID != tenant.ID {
+		tokenFailures.Inc("tenant")
+		return user, pat, errors.New("unauthorized, token is for another tenant")
+	}
+
+	if err = repository.CheckAccountStatus(user); err != nil {
+		tokenFailures.Inc("inactive")
+		return user, pat, errors.New("unauthorized, account is not active")
+	}
+
+	return user, pat, nil
+}
+
+// personalTokenFromContext returns the personal access token the request was made with
+func personalTokenFromContext(r *http.Request) (models.PersonalAccessToken, bool) {
+	pat, ok := r.Context().Value(tokenContextKey).(models.PersonalAccessToken)
+	return pat, ok
+}
+
+// requireScope lets requests made with a personal access token through only
+// when the token has the scope. Sessions may do anything their user may.
+func (app *application) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if pat, ok := personalTokenFromContext(r); ok && !pat.HasScope(scope) {
+				tokenFailures.Inc("pat_scope")
+				app.errorJSON(w, errors.New("forbidden, token lacks the "+scope+" scope"), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireSession refuses personal access tokens, for routes that manage the
+// session itself or hand out new credentials
+func (app *application) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := personalTokenFromContext(r); ok {
+			app.errorJSON(w, errors.New("forbidden, sign in to do this"), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CreatePersonalToken makes a personal access token for the user. The token is
+// only ever in this response, what is stored is its hash.
+func (app *application) CreatePersonalToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	var data NewPersonalToken
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding token"))
+		app.log(r).Warn("decode error", "err", err)
+		return
+	}
+
+	if data.Name == "" || len(data.Name) > maxPersonalTokenName {
+		app.errorJSON(w, errors.New("a name of at most 100 characters is required"))
+		return
+	}
+
+	if len(data.Scopes) == 0 {
+		app.errorJSON(w, errors.New("at least one scope is required"))
+		return
+	}
+	for _, s := range data.Scopes {
+		switch s {
+		case models.ScopeRead, models.ScopeWrite:
+		case models.ScopeAdmin:
+			if user.Role != models.RoleAdmin {
+				app.errorJSON(w, errors.New("only admins may create tokens with the admin scope"), http.StatusForbidden)
+				return
+			}
+		default:
+			app.errorJSON(w, errors.New("scopes may only be read, write and admin"))
+			return
+		}
+	}
+
+	if !data.ExpiresAt.IsZero() && data.ExpiresAt.Before(time.Now()) {
+		app.errorJSON(w, errors.New("token expiry must be in the future"))
+		return
+	}
+
+	token, hash, prefix, err := tokens.NewPersonal()
+	if err != nil {
+		app.log(r).Error("error generating token", "err", err)
+		app.errorJSON(w, errors.New("error creating token"), http.StatusInternalServerError)
+		return
+	}
+
+	pat := models.PersonalAccessToken{
+		UserID:    user.ID,
+		Name:      data.Name,
+		Prefix:    prefix,
+		Scopes:    data.Scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: data.ExpiresAt,
+	}
+	metadata := map[string]interface{}{"name": data.Name, "scopes": data.Scopes, "prefix": prefix}
+
+	pat.ID, err = app.db.DB.InsertPersonalAccessToken(r.Context(), pat, hash)
+	if err != nil {
+		app.log(r).Error("error storing token", "err", err)
+		app.audit(r, "token.create", user.ID, outcomeFailure, metadata)
+		app.errorJSON(w, errors.New("error creating token"), http.StatusInternalServerError)
+		return
+	}
+	metadata["token"] = pat.ID
+	app.audit(r, "token.create", user.ID, outcomeSuccess, metadata)
+
+	resp := struct {
+		models.PersonalAccessToken
+		Token string `json:"token"`
+	}{pat, token}
+	app.writeJSON(w, http.StatusCreated, resp, "token")
+}
+
+// MyPersonalTokens lists the user's tokens that have not been revoked
+func (app *application) MyPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	list, err := app.db.DB.UserPersonalAccessTokens(r.Context(), user.ID)
+	if err != nil {
+		app.log(r).Error("error getting tokens", "err", err)
+		app.errorJSON(w, errors.New("error getting tokens"))
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, list, "tokens")
+	if err != nil {
+		app.log(r).Error("error writing json", "err", err)
+		app.errorJSON(w, errors.New("error writing json"))
+	}
+}
+
+// RevokePersonalToken revokes one of the user's tokens
+func (app *application) RevokePersonalToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid token id"))
+		return
+	}
+	metadata := map[string]interface{}{"token": id}
+
+	err = app.db.DB.RevokePersonalAccessToken(r.Context(), user.ID, id)
+	if errors.Is(err, repository.ErrNoRecord) {
+		app.audit(r, "token.revoke", user.ID, outcomeFailure, metadata)
+		app.errorJSON(w, errors.New("no active token with this id"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.log(r).Error("error revoking token", "err", err)
+		app.audit(r, "token.revoke", user.ID, outcomeFailure, metadata)
+		app.errorJSON(w, errors.New("error revoking token"))
+		return
+	}
+	app.audit(r, "token.revoke", user.ID, outcomeSuccess, metadata)
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "Token revoked",
+		UserID:  user.ID,
+	}
+	app.writeJSON(w, http.StatusOK, resp, "response")
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/tokens"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectPersonalToken expects GetPersonalAccessToken to find the token
+func expectPersonalToken(mock sqlmock.Sqlmock, token string, pat models.PersonalAccessToken) {
+	var expiresAt, revokedAt interface{}
+	if !pat.ExpiresAt.IsZero() {
+		expiresAt = pat.ExpiresAt
+	}
+	if !pat.RevokedAt.IsZero() {
+		revokedAt = pat.RevokedAt
+	}
+	mock.ExpectQuery(`FROM personal_access_tokens where token_hash = \$1`).WithArgs(tokens.HashPersonal(token)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "scopes", "created_at", "expires_at",
+			"last_used_at", "last_used_ip", "revoked_at"}).
+			AddRow(pat.ID, pat.UserID, pat.Name, pat.Prefix, "{"+strings.Join(pat.Scopes, ",")+"}", time.Now(), expiresAt,
+				nil, "", revokedAt))
+}
+
+// withPersonalToken returns the request as servePersonal passes it on
+func withPersonalToken(r *http.Request, user models.User, pat models.PersonalAccessToken) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	ctx = context.WithValue(ctx, tokenContextKey, pat)
+	return withTenant(r.WithContext(ctx), testTenant)
+}
+
+func TestValidatePersonalToken(t *testing.T) {
+	token, _, _, err := tokens.NewPersonal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := models.User{ID: 7, TenantID: testTenant.ID, Role: models.RoleUser, Status: models.StatusActive}
+	pat := models.PersonalAccessToken{ID: 3, UserID: 7, Name: "ci", Scopes: []string{models.ScopeRead}}
+
+	tests := []struct {
+		name string
+		pat  models.PersonalAccessToken
+		// user is nil when the token is refused before the owner is looked up
+		user    *models.User
+		unknown bool
+		wantErr string
+	}{
+		{name: "valid", pat: pat, user: &active},
+		{name: "unknown", unknown: true, wantErr: "unauthorized, unknown token"},
+		{name: "revoked", pat: models.PersonalAccessToken{ID: 3, UserID: 7, RevokedAt: time.Now().Add(-time.Minute)},
+			wantErr: "unauthorized, token has been revoked"},
+		{name: "expired", pat: models.PersonalAccessToken{ID: 3, UserID: 7, ExpiresAt: time.Now().Add(-time.Minute)},
+			wantErr: "unauthorized, token has expired"},
+		{name: "another tenant", pat: pat, user: &models.User{ID: 7, TenantID: 2, Status: models.StatusActive},
+			wantErr: "unauthorized, token is for another tenant"},
+		{name: "suspended owner", pat: pat, user: &models.User{ID: 7, TenantID: testTenant.ID, Status: models.StatusSuspended},
+			wantErr: "unauthorized, account is not active"},
+		{name: "deleted owner", pat: pat, user: &models.User{ID: 7, TenantID: testTenant.ID, Status: models.StatusDeleted},
+			wantErr: "unauthorized, account is not active"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			if tt.unknown {
+				mock.ExpectQuery(`FROM personal_access_tokens`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			} else {
+				expectPersonalToken(mock, token, tt.pat)
+			}
+			if tt.user != nil {
+				expectUserByID(mock, *tt.user)
+			}
+
+			ctx := context.WithValue(context.Background(), tenantContextKey, testTenant)
+			user, got, err := app.validatePersonalToken(ctx, token)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got %v", err)
+			case tt.wantErr == "" && (user.ID != 7 || got.ID != 3 || !got.HasScope(models.ScopeRead)):
+				t.Errorf("got user %+v and token %+v", user, got)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("got %v, want %q", err, tt.wantErr)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestServePersonal(t *testing.T) {
+	app, mock := newTestApp(t)
+	token, _, _, err := tokens.NewPersonal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := models.User{ID: 7, TenantID: testTenant.ID, Role: models.RoleUser, Status: models.StatusActive}
+
+	expectPersonalToken(mock, token, models.PersonalAccessToken{ID: 3, UserID: 7, Scopes: []string{models.ScopeRead}})
+	expectUserByID(mock, user)
+	mock.ExpectExec(`update personal_access_tokens set last_used_at`).
+		WithArgs(sqlmock.AnyArg(), "192.0.2.1", 3, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var gotUser models.User
+	var gotToken models.PersonalAccessToken
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, _ = userFromContext(r)
+		gotToken, _ = personalTokenFromContext(r)
+		if _, ok := r.Context().Value(sessionContextKey).(string); ok {
+			t.Error("a personal access token has a session")
+		}
+	})
+
+	r := withTenant(httptest.NewRequest(http.MethodGet, "/v1/me", nil), testTenant)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	app.checkToken(next).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || gotUser.ID != 7 || gotToken.ID != 3 {
+		t.Errorf("got status %d, user %d, token %d", w.Code, gotUser.ID, gotToken.ID)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	app, _ := newTestApp(t)
+	user := models.User{ID: 7, Role: models.RoleAdmin}
+
+	tests := []struct {
+		name  string
+		scope string
+		r     *http.Request
+		want  int
+	}{
+		{"token with the scope", models.ScopeWrite,
+			withPersonalToken(httptest.NewRequest(http.MethodPut, "/v1/me", nil), user, models.PersonalAccessToken{Scopes: []string{models.ScopeRead, models.ScopeWrite}}),
+			http.StatusOK},
+		{"token without the scope", models.ScopeWrite,
+			withPersonalToken(httptest.NewRequest(http.MethodPut, "/v1/me", nil), user, models.PersonalAccessToken{Scopes: []string{models.ScopeRead}}),
+			http.StatusForbidden},
+		// admin does not imply the others
+		{"admin token without read", models.ScopeRead,
+			withPersonalToken(httptest.NewRequest(http.MethodGet, "/v1/me", nil), user, models.PersonalAccessToken{Scopes: []string{models.ScopeAdmin}}),
+			http.StatusForbidden},
+		{"session", models.ScopeAdmin, withSession(httptest.NewRequest(http.MethodGet, "/v1/admin/users", nil), user, "s1"), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			served := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true })
+
+			w := httptest.NewRecorder()
+			app.requireScope(tt.scope)(next).ServeHTTP(w, tt.r)
+
+			if w.Code != tt.want || served != (tt.want == http.StatusOK) {
+				t.Errorf("got status %d, served %v", w.Code, served)
+			}
+		})
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	app, _ := newTestApp(t)
+	user := models.User{ID: 7, Role: models.RoleUser}
+	served := 0
+	handler := app.requireSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ }))
+
+	w := httptest.NewRecorder()
+	r := withPersonalToken(httptest.NewRequest(http.MethodPost, "/v1/me/tokens", nil), user,
+		models.PersonalAccessToken{Scopes: []string{models.ScopeRead, models.ScopeWrite, models.ScopeAdmin}})
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || served != 0 {
+		t.Errorf("a personal access token got status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, withSession(httptest.NewRequest(http.MethodPost, "/v1/me/tokens", nil), user, "s1"))
+	if w.Code != http.StatusOK || served != 1 {
+		t.Errorf("a session got status %d", w.Code)
+	}
+}
+
+func TestCreatePersonalToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		role   string
+		body   string
+		stored bool
+		want   int
+	}{
+		{name: "read and write", role: models.RoleUser, body: `{"name":"ci","scopes":["read","write"]}`, stored: true, want: http.StatusCreated},
+		{name: "admin scope by an admin", role: models.RoleAdmin, body: `{"name":"ops","scopes":["admin"]}`, stored: true, want: http.StatusCreated},
+		{name: "admin scope by a user", role: models.RoleUser, body: `{"name":"ops","scopes":["read","admin"]}`, want: http.StatusForbidden},
+		{name: "unknown scope", role: models.RoleAdmin, body: `{"name":"ops","scopes":["everything"]}`, want: http.StatusBadRequest},
+		{name: "no scopes", role: models.RoleUser, body: `{"name":"ci","scopes":[]}`, want: http.StatusBadRequest},
+		{name: "expired", role: models.RoleUser, body: `{"name":"ci","scopes":["read"],"expiresAt":"2020-01-01T00:00:00Z"}`, want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			if tt.stored {
+				mock.ExpectQuery(`INSERT INTO personal_access_tokens`).
+					WithArgs(7, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), nil).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				expectAudit(mock, "token.create", outcomeSuccess)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/me/tokens", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			app.CreatePersonalToken(w, withSession(r, models.User{ID: 7, TenantID: testTenant.ID, Role: tt.role}, "s1"))
+
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.stored {
+				var resp struct {
+					Token struct {
+						ID     int    `json:"id"`
+						Prefix string `json:"prefix"`
+						Token  string `json:"token"`
+					} `json:"token"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Token.ID != 3 || !tokens.IsPersonal(resp.Token.Token) || !strings.HasPrefix(resp.Token.Token, resp.Token.Prefix) {
+					t.Errorf("got %+v", resp.Token)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
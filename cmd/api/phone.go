@@ -0,0 +1,470 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/sms"
+	"auth/api/tokens"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SMS backends
+const (
+	smsBackendLog  = "log"
+	smsBackendFile = "file"
+	smsBackendHTTP = "http"
+)
+
+const (
+	// otpLifetime is how long a passcode can be entered
+	otpLifetime = 5 * time.Minute
+	// otpMaxAttempts is how many codes may be tried against one challenge
+	otpMaxAttempts = 5
+	// otpResendInterval is how long a number waits between codes
+	otpResendInterval = 30 * time.Second
+	// otpHourlyLimit is how many codes a number is sent in an hour
+	otpHourlyLimit = 5
+)
+
+// errOTPRateLimited too many codes asked for a number error
+var errOTPRateLimited = errors.New("too many codes asked for this number, try again later")
+
+type PhoneChange struct {
+	Phone   string `json:"phone"`
+	Channel string `json:"channel"`
+}
+
+type PasscodeEntry struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+	Device    string `json:"device"`
+}
+
+type MFAChange struct {
+	Enabled bool `json:"enabled"`
+}
+
+// otpChallenge tells the client a code is on its way and what to send it back with
+type otpChallenge struct {
+	Required  bool      `json:"required,omitempty"`
+	Challenge string    `json:"challenge"`
+	SentTo    string    `json:"sentTo"`
+	Channel   string    `json:"channel"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// newSMSSender returns the configured SMS backend
+func newSMSSender(c config, logger *logging.Logger) sms.SMSSender {
+	switch c.sms.backend {
+	case smsBackendFile:
+		return &sms.FileSender{Path: c.sms.file}
+	case smsBackendHTTP:
+		return sms.NewHTTPSender(c.sms.url, c.sms.token)
+	default:
+		return sms.LogSender{Logger: logger}
+	}
+}
+
+// validSMSConfig checks the SMS flags
+func validSMSConfig(c config) error {
+	switch c.sms.backend {
+	case smsBackendLog:
+	case smsBackendFile:
+		if c.sms.file == "" {
+			return errors.New("sms-file is required with the file SMS backend")
+		}
+	case smsBackendHTTP:
+		if u, err := url.Parse(c.sms.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("sms-url must be an http or https URL, got %q", c.sms.url)
+		}
+	default:
+		return fmt.Errorf("sms-backend must be log, file or http, got %q", c.sms.backend)
+	}
+
+	if c.sms.defaultCountry != "" {
+		if _, err := sms.Normalize("+"+c.sms.defaultCountry+"00000000", ""); err != nil || len(c.sms.defaultCountry) > 3 {
+			return fmt.Errorf("sms-default-country must be a calling code such as 1 or 44, got %q", c.sms.defaultCountry)
+		}
+	}
+
+	return nil
+}
+
+// validChannel fills in the default channel and checks it
+func validChannel(channel string) (string, error) {
+	switch channel {
+	case "":
+		return sms.ChannelSMS, nil
+	case sms.ChannelSMS, sms.ChannelVoice:
+		return channel, nil
+	}
+	return "", errors.New("channel must be sms or voice")
+}
+
+// sendOTP stores a new passcode for the phone and sends it. userID is 0 when
+// no account uses the number: the code is stored so rate limits and answers
+// are the same, but never sent. Sending happens after the caller has answered
+// so response times do not tell either.
+func (app *application) sendOTP(r *http.Request, userID int, phone, purpose, channel string) (otpChallenge, error) {
+	ctx := r.Context()
+	now := time.Now()
+
+	recent, err := app.db.DB.OTPsSentSince(ctx, phone, now.Add(-otpResendInterval))
+	if err != nil {
+		return otpChallenge{}, err
+	}
+	hourly, err := app.db.DB.OTPsSentSince(ctx, phone, now.Add(-time.Hour))
+	if err != nil {
+		return otpChallenge{}, err
+	}
+	if recent > 0 || hourly >= otpHourlyLimit {
+		return otpChallenge{}, errOTPRateLimited
+	}
+
+	challenge, challengeHash, err := tokens.NewChallenge(app.keys)
+	if err != nil {
+		return otpChallenge{}, err
+	}
+	code, err := tokens.NewCode()
+	if err != nil {
+		return otpChallenge{}, err
+	}
+
+	o := models.OTPChallenge{
+		UserID:    userID,
+		Phone:     phone,
+		Purpose:   purpose,
+		Channel:   channel,
+		ExpiresAt: now.Add(otpLifetime),
+	}
+	if err = app.db.DB.InsertOTP(ctx, o, challengeHash, tokens.HashCode(challenge, code)); err != nil {
+		return otpChallenge{}, err
+	}
+
+	if userID != 0 {
+		app.background(ctx, func(ctx context.Context) {
+			err := app.sms.Send(ctx, sms.Message{To: phone, Channel: channel, Body: otpMessage(channel, code)})
+			if err != nil {
+				logging.FromContext(ctx).Error("error sending passcode", "err", err, "purpose", purpose, "channel", channel)
+				otpSends.Inc(purpose, channel, outcomeFailure)
+				return
+			}
+			otpSends.Inc(purpose, channel, outcomeSuccess)
+		})
+	}
+
+	return otpChallenge{
+		Challenge: challenge,
+		SentTo:    sms.Mask(phone),
+		Channel:   channel,
+		ExpiresAt: o.ExpiresAt,
+	}, nil
+}
+
+// otpMessage is what the user reads or hears. Digits are read out one by one
+// on a call.
+func otpMessage(channel, code string) string {
+	if channel == sms.ChannelVoice {
+		return "Your verification code is " + strings.Join(strings.Split(code, ""), ", ") + "."
+	}
+	return fmt.Sprintf("Your verification code is %s. It expires in %d minutes.", code, int(otpLifetime.Minutes()))
+}
+
+// useOTP checks an entered passcode against its challenge. The returned error
+// is safe to show to the caller.
+func (app *application) useOTP(ctx context.Context, data PasscodeEntry, purposes ...string) (models.OTPChallenge, error) {
+	challengeHash, err := tokens.CheckChallenge(app.keys, data.Challenge)
+	if err != nil {
+		return models.OTPChallenge{}, errors.New("code expired or used up, ask for a new one")
+	}
+
+	o, err := app.db.DB.UseOTP(ctx, challengeHash, tokens.HashCode(data.Challenge, data.Code), purposes, otpMaxAttempts)
+	switch {
+	case errors.Is(err, repository.ErrWrongCode):
+		return o, errors.New("wrong code")
+	case err != nil:
+		return o, errors.New("code expired or used up, ask for a new one")
+	}
+	return o, nil
+}
+
+// writeOTPError answers a failed sendOTP
+func (app *application) writeOTPError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errOTPRateLimited) {
+		app.errorJSON(w, err, http.StatusTooManyRequests)
+		return
+	}
+	app.log(r).Error("error creating passcode", "err", err)
+	app.errorJSON(w, errors.New("error sending code"), http.StatusInternalServerError)
+}
+
+// StartPhoneVerification texts a code to a number the user wants to add. The
+// number is only stored once the code comes back.
+func (app *application) StartPhoneVerification(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	var data PhoneChange
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding phone number"))
+		return
+	}
+
+	phone, err := sms.Normalize(data.Phone, app.config.sms.defaultCountry)
+	if err != nil {
+		app.errorJSON(w, errors.New("phone number must be in international format, like +15551234567"))
+		return
+	}
+	channel, err := validChannel(data.Channel)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	challenge, err := app.sendOTP(r, user.ID, phone, models.OTPVerifyPhone, channel)
+	if err != nil {
+		app.writeOTPError(w, r, err)
+		return
+	}
+	app.audit(r, "phone.verify_start", user.ID, outcomeSuccess, map[string]interface{}{"phone": challenge.SentTo, "channel": channel})
+
+	app.writeJSON(w, http.StatusAccepted, challenge, "challenge")
+}
+
+// VerifyPhone stores the number a code was sent to once the user enters it
+func (app *application) VerifyPhone(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	var data PasscodeEntry
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding code"))
+		return
+	}
+
+	o, err := app.useOTP(r.Context(), data, models.OTPVerifyPhone)
+	if err == nil && o.UserID != user.ID {
+		err = errors.New("code expired or used up, ask for a new one")
+	}
+	if err != nil {
+		app.audit(r, "phone.verify", user.ID, outcomeFailure, map[string]interface{}{"reason": err.Error()})
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	err = app.db.DB.SetUserPhone(r.Context(), user.ID, o.Phone)
+	if errors.Is(err, repository.ErrDuplicatePhone) {
+		app.audit(r, "phone.verify", user.ID, outcomeFailure, map[string]interface{}{"reason": "number in use"})
+		app.errorJSON(w, errors.New("this number is used by another account"), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, errors.New("error storing phone number"))
+		return
+	}
+	app.audit(r, "phone.verify", user.ID, outcomeSuccess, map[string]interface{}{"phone": sms.Mask(o.Phone)})
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "Phone number verified",
+		UserID:  user.ID,
+	}
+	app.writeJSON(w, http.StatusOK, resp, "response")
+}
+
+// RemovePhone forgets the user's phone number and turns SMS MFA off
+func (app *application) RemovePhone(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	if err := app.db.DB.ClearUserPhone(r.Context(), user.ID); err != nil {
+		app.audit(r, "phone.remove", user.ID, outcomeFailure, nil)
+		app.errorJSON(w, errors.New("error removing phone number"))
+		return
+	}
+	app.audit(r, "phone.remove", user.ID, outcomeSuccess, nil)
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "Phone number removed",
+		UserID:  user.ID,
+	}
+	app.writeJSON(w, http.StatusOK, resp, "response")
+}
+
+// SetSMSMFA turns asking for a texted code after the password on or off
+func (app *application) SetSMSMFA(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	var data MFAChange
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding MFA change"))
+		return
+	}
+
+	action := "mfa.sms_disable"
+	if data.Enabled {
+		action = "mfa.sms_enable"
+	}
+
+	err := app.db.DB.SetSMSMFA(r.Context(), user.ID, data.Enabled)
+	if errors.Is(err, repository.ErrNoRecord) {
+		app.audit(r, action, user.ID, outcomeFailure, map[string]interface{}{"reason": "no verified phone"})
+		app.errorJSON(w, errors.New("verify a phone number first"))
+		return
+	}
+	if err != nil {
+		app.audit(r, action, user.ID, outcomeFailure, nil)
+		app.errorJSON(w, errors.New("error changing MFA"))
+		return
+	}
+	app.audit(r, action, user.ID, outcomeSuccess, nil)
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "SMS MFA updated",
+		UserID:  user.ID,
+	}
+	app.writeJSON(w, http.StatusOK, resp, "response")
+}
+
+// RequestPhoneSignin texts a sign-in code to a verified number. The answer is
+// the same whether or not an account uses the number.
+func (app *application) RequestPhoneSignin(w http.ResponseWriter, r *http.Request) {
+	var data PhoneChange
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding phone number"))
+		return
+	}
+
+	phone, err := sms.Normalize(data.Phone, app.config.sms.defaultCountry)
+	if err != nil {
+		app.errorJSON(w, errors.New("phone number must be in international format, like +15551234567"))
+		return
+	}
+	channel, err := validChannel(data.Channel)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var userID int
+	user, err := app.db.DB.GetUserByPhone(r.Context(), tenantFromContext(r).ID, phone)
+	if err == nil && repository.CheckAccountStatus(user) == nil {
+		userID = user.ID
+	}
+
+	challenge, err := app.sendOTP(r, userID, phone, models.OTPLogin, channel)
+	if err != nil {
+		app.writeOTPError(w, r, err)
+		return
+	}
+	app.audit(r, "auth.otp_request", userID, outcomeSuccess, map[string]interface{}{"phone": challenge.SentTo, "channel": channel})
+
+	app.writeJSON(w, http.StatusAccepted, challenge, "challenge")
+}
+
+// challengeSecondFactor texts a code to users with SMS MFA once their first
+// factor checked out, and answers with the challenge instead of a session. It
+// reports whether it answered.
+func (app *application) challengeSecondFactor(w http.ResponseWriter, r *http.Request, userID int) bool {
+	return app.challengeSecondFactorWith(w, r, userID, func(challenge otpChallenge) {
+		app.writeJSON(w, http.StatusOK, challenge, "mfa")
+	})
+}
+
+// challengeSecondFactorWith is challengeSecondFactor handing the challenge to
+// answer, for sign-ins that do not end in a JSON response
+func (app *application) challengeSecondFactorWith(w http.ResponseWriter, r *http.Request, userID int, answer func(otpChallenge)) bool {
+	user, err := app.db.DB.GetUserById(r.Context(), userID)
+	if err != nil {
+		signins.Inc(outcomeFailure, "error")
+		app.errorJSON(w, errors.New("error signing in"))
+		return true
+	}
+	if !user.SMSMFA || user.Phone == "" {
+		return false
+	}
+
+	challenge, err := app.sendOTP(r, user.ID, user.Phone, models.OTPMFA, sms.ChannelSMS)
+	if err != nil {
+		app.audit(r, "auth.mfa_challenge", user.ID, outcomeFailure, nil)
+		app.writeOTPError(w, r, err)
+		return true
+	}
+	app.audit(r, "auth.mfa_challenge", user.ID, outcomeSuccess, map[string]interface{}{"phone": challenge.SentTo})
+
+	challenge.Required = true
+	answer(challenge)
+	return true
+}
+
+// SigninWithPasscode exchanges a texted code for a session, either to sign in
+// by phone or as the second step of Signin for users with SMS MFA
+func (app *application) SigninWithPasscode(w http.ResponseWriter, r *http.Request) {
+	var data PasscodeEntry
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("Unauthorized"))
+		return
+	}
+
+	o, err := app.useOTP(r.Context(), data, models.OTPLogin, models.OTPMFA)
+	if err != nil {
+		app.audit(r, "auth.signin", o.UserID, outcomeFailure, map[string]interface{}{"method": "sms_otp", "reason": err.Error()})
+		signins.Inc(outcomeFailure, "invalid_code")
+		app.errorJSON(w, errors.New("unauthorized, "+err.Error()), http.StatusForbidden)
+		return
+	}
+
+	// the number may have been removed or the account closed since the code was sent
+	user, err := app.db.DB.GetUserById(r.Context(), o.UserID)
+	if err != nil || user.TenantID != tenantFromContext(r).ID || user.Phone != o.Phone {
+		app.audit(r, "auth.signin", o.UserID, outcomeFailure, map[string]interface{}{"method": "sms_otp", "reason": "phone changed"})
+		signins.Inc(outcomeFailure, "invalid_code")
+		app.errorJSON(w, errors.New("unauthorized, code expired or used up, ask for a new one"), http.StatusForbidden)
+		return
+	}
+	if err = repository.CheckAccountStatus(user); err != nil {
+		app.audit(r, "auth.signin", user.ID, outcomeFailure, map[string]interface{}{"method": "sms_otp", "reason": "inactive"})
+		signins.Inc(outcomeFailure, "inactive")
+		app.errorJSON(w, errors.New("unauthorized, account is not active"), http.StatusForbidden)
+		return
+	}
+
+	session, err := app.startSession(r, user.ID, data.Device)
+	if err != nil {
+		app.log(r).Error("error signing in", "err", err)
+		signins.Inc(outcomeFailure, "error")
+		app.errorJSON(w, errors.New("error signing in"))
+		return
+	}
+
+	method := "sms_otp"
+	if o.Purpose == models.OTPMFA {
+		method = "password+sms_otp"
+	}
+	app.audit(r, "auth.signin", user.ID, outcomeSuccess, map[string]interface{}{"method": method})
+	signins.Inc(outcomeSuccess, "")
+	app.writeSession(w, session)
+}
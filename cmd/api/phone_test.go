@@ -0,0 +1,85 @@
+package main
+
+import (
+	"auth/api/sms"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// recordingSender keeps the messages it is asked to send
+type recordingSender struct {
+	mu   sync.Mutex
+	sent []sms.Message
+}
+
+func (s *recordingSender) Send(ctx context.Context, m sms.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+func TestSendOTPRateLimit(t *testing.T) {
+	const phone = "+15551234567"
+
+	tests := []struct {
+		name string
+		// codes sent to the number in the last 30 seconds and hour
+		recent, hourly int
+		userID         int
+		wantErr        error
+		wantSent       int
+	}{
+		{name: "first code", userID: 7, wantSent: 1},
+		{name: "under the hourly limit", hourly: otpHourlyLimit - 1, userID: 7, wantSent: 1},
+		{name: "no account, stored but not sent", userID: 0},
+		{name: "resent too soon", recent: 1, hourly: 1, userID: 7, wantErr: errOTPRateLimited},
+		{name: "hourly limit", hourly: otpHourlyLimit, userID: 7, wantErr: errOTPRateLimited},
+		{name: "hourly limit without an account", hourly: otpHourlyLimit, wantErr: errOTPRateLimited},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			sender := &recordingSender{}
+			app.sms = sender
+
+			count := `SELECT count\(\*\) FROM otp_codes where phone`
+			mock.ExpectQuery(count).WithArgs(phone, sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.recent))
+			mock.ExpectQuery(count).WithArgs(phone, sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.hourly))
+			if tt.wantErr == nil {
+				mock.ExpectExec(`INSERT INTO otp_codes`).WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			r := withTenant(httptest.NewRequest(http.MethodPost, "/v1/signin/phone", nil), testTenant)
+			challenge, err := app.sendOTP(r, tt.userID, phone, "signin", sms.ChannelSMS)
+			app.wg.Wait()
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (challenge.Challenge == "" || challenge.SentTo != sms.Mask(phone)) {
+				t.Errorf("got challenge %+v", challenge)
+			}
+			if len(sender.sent) != tt.wantSent {
+				t.Errorf("sent %d messages, want %d", len(sender.sent), tt.wantSent)
+			}
+			for _, m := range sender.sent {
+				if m.To != phone || m.Channel != sms.ChannelSMS {
+					t.Errorf("sent %+v", m)
+				}
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
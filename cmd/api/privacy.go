@@ -0,0 +1,125 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/webhooks"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type EraseRequest struct {
+	Password string `json:"password"`
+}
+
+// ExportMyData lets users download everything stored about them
+func (app *application) ExportMyData(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+	app.exportUser(w, r, user.ID)
+}
+
+// ExportUserData lets an admin export a user's data on their behalf
+func (app *application) ExportUserData(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid user id"))
+		return
+	}
+	app.exportUser(w, r, id)
+}
+
+func (app *application) exportUser(w http.ResponseWriter, r *http.Request, id int) {
+	export, err := app.db.DB.ExportUser(r.Context(), id)
+	if errors.Is(err, repository.ErrNoRecord) {
+		app.errorJSON(w, errors.New("no user with this id"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.log(r).Error("error exporting user data", "err", err)
+		app.audit(r, "user.export", id, outcomeFailure, nil)
+		app.errorJSON(w, errors.New("error exporting user data"))
+		return
+	}
+	app.audit(r, "user.export", id, outcomeSuccess, nil)
+
+	archive, err := json.MarshalIndent(export, "", "\t")
+	if err != nil {
+		app.log(r).Error("error writing json", "err", err)
+		app.errorJSON(w, errors.New("error writing json"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"user-%d-export.json\"", id))
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive)
+}
+
+// EraseMyAccount lets users erase their own personal data after confirming their password
+func (app *application) EraseMyAccount(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	var data EraseRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding erase request"))
+		return
+	}
+
+	if confirmed, _, err := app.authenticate(r, user.UserName, data.Password); err != nil || confirmed.ID != user.ID {
+		app.audit(r, "user.erase", user.ID, outcomeFailure, map[string]interface{}{"reason": "password check failed"})
+		app.errorJSON(w, errors.New("unauthorized, check your password"), http.StatusForbidden)
+		return
+	}
+
+	app.eraseUser(w, r, user.ID)
+}
+
+// EraseUser lets an admin erase a user's personal data
+func (app *application) EraseUser(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid user id"))
+		return
+	}
+	app.eraseUser(w, r, id)
+}
+
+func (app *application) eraseUser(w http.ResponseWriter, r *http.Request, id int) {
+	err := app.db.DB.EraseUser(r.Context(), id,
+		app.outboxEvent(r, models.EventUserDeleted, map[string]interface{}{"user": webhooks.UserData(models.User{ID: id})})...)
+	if errors.Is(err, repository.ErrNoRecord) {
+		app.errorJSON(w, errors.New("no user with this id or already erased"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.log(r).Error("error erasing user data", "err", err)
+		app.audit(r, "user.erase", id, outcomeFailure, nil)
+		app.errorJSON(w, errors.New("error erasing user data"))
+		return
+	}
+	app.audit(r, "user.erase", id, outcomeSuccess, nil)
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "Personal data erased",
+		UserID:  id,
+	}
+	app.writeJSON(w, http.StatusOK, resp, "response")
+}
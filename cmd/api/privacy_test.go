@@ -0,0 +1,78 @@
+package main
+
+import (
+	"auth/api/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestExportUserData(t *testing.T) {
+	app, mock := newTestApp(t)
+	user := models.User{ID: 7, TenantID: testTenant.ID, Name: "Ada", Email: "ada@example.com", UserName: "ada",
+		Role: models.RoleUser, Status: models.StatusActive}
+	now := time.Now()
+
+	expectUserByID(mock, user)
+	mock.ExpectQuery(`FROM sessions where user_id`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "device", "user_agent", "ip", "created_at",
+			"last_seen_at", "expires_at", "revoked_at", "actor_id"}).
+			AddRow("s1", 7, "Firefox on Linux", "Mozilla/5.0", "192.0.2.1", now, now, now.Add(time.Hour), nil, nil))
+	mock.ExpectQuery(`FROM identities where user_id`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "user_id", "provider", "subject", "email",
+			"created_at", "last_login_at"}).
+			AddRow(1, testTenant.ID, 7, "google", "g-123", "ada@example.com", now, now))
+	auditColumns := []string{"id", "occurred_at", "tenant_id", "actor_id", "subject_id", "action", "outcome",
+		"ip", "user_agent", "metadata", "prev_hash", "hash"}
+	mock.ExpectQuery(`FROM audit_events`).WithArgs(7, "auth.signin%").
+		WillReturnRows(sqlmock.NewRows(auditColumns).
+			AddRow(1, now, testTenant.ID, 7, 7, "auth.signin", outcomeSuccess, "192.0.2.1", "", []byte("{}"), "", "h1"))
+	mock.ExpectQuery(`FROM audit_events`).WithArgs(7, "%").
+		WillReturnRows(sqlmock.NewRows(auditColumns).
+			AddRow(1, now, testTenant.ID, 7, 7, "auth.signin", outcomeSuccess, "192.0.2.1", "", []byte("{}"), "", "h1").
+			AddRow(2, now, testTenant.ID, 1, 7, "user.status_change", outcomeSuccess, "", "", []byte("{}"), "h1", "h2"))
+	expectAudit(mock, "user.export", outcomeSuccess)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/admin/users/7/export", nil)
+	w := httptest.NewRecorder()
+	app.ExportUserData(w, withParams(withTenant(r, testTenant), "id", "7"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="user-7-export.json"`; got != want {
+		t.Errorf("got Content-Disposition %q, want %q", got, want)
+	}
+
+	var export models.UserExport
+	if err := json.NewDecoder(w.Body).Decode(&export); err != nil {
+		t.Fatal(err)
+	}
+	if export.Profile.Email != user.Email || len(export.Sessions) != 1 || len(export.Identities) != 1 ||
+		len(export.LoginHistory) != 1 || len(export.AuditEvents) != 2 {
+		t.Errorf("export is missing data: %+v", export)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExportUserDataUnknownUser(t *testing.T) {
+	app, mock := newTestApp(t)
+	mock.ExpectQuery(`FROM users where id`).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/admin/users/7/export", nil)
+	w := httptest.NewRecorder()
+	app.ExportUserData(w, withParams(withTenant(r, testTenant), "id", "7"))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
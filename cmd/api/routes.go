@@ -1,6 +1,7 @@
 package main
 
 import (
+	"auth/api/models"
 	"context"
 	"net/http"
 
@@ -16,20 +17,89 @@ func (app *application) wrapMiddleware(next http.Handler) httprouter.Handle {
 }
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
-	secure := alice.New(app.checkToken)
+	router := patternRouter{httprouter.New()}
+	router.GlobalOPTIONS = http.HandlerFunc(app.preflight)
+	tenant := alice.New(app.resolveTenant)
+	secure := tenant.Append(app.checkToken)
+	if app.config.session.mode == sessionModeCookie {
+		secure = tenant.Append(app.checkCookie, app.csrfProtect)
+	}
 	router.HandlerFunc(http.MethodGet, "/status", app.StatusHandler)
+	router.HandlerFunc(http.MethodGet, "/livez", app.Livez)
+	router.HandlerFunc(http.MethodGet, "/readyz", app.Readyz)
 	router.HandlerFunc(http.MethodGet, "/v1/open-route/:id", app.OpenRoute)
+	if len(app.config.oauth.clients) > 0 {
+		router.HandlerFunc(http.MethodPost, "/oauth/introspect", app.Introspect)
+		router.HandlerFunc(http.MethodPost, "/oauth/revoke", app.RevokeToken)
+	}
 
 	//Forget password
-	router.HandlerFunc(http.MethodPost, "/v1/forgot-password", app.ForgotPassword)
-	router.HandlerFunc(http.MethodPost, "/v1/reset-password", app.ResetPassword)
+	router.Handler(http.MethodPost, "/v1/forgot-password", tenant.ThenFunc(app.ForgotPassword))
+	router.Handler(http.MethodPost, "/v1/reset-password", tenant.ThenFunc(app.ResetPassword))
 
 	//signin
-	router.HandlerFunc(http.MethodPost, "/v1/signin", app.Signin)
-	router.HandlerFunc(http.MethodPost, "/v1/register", app.Register)
+	router.Handler(http.MethodPost, "/v1/signin", tenant.ThenFunc(app.Signin))
+	router.Handler(http.MethodPost, "/v1/register", tenant.ThenFunc(app.Register))
+	router.Handler(http.MethodPost, "/v1/signin/phone", tenant.ThenFunc(app.RequestPhoneSignin))
+	router.Handler(http.MethodPost, "/v1/signin/otp", tenant.ThenFunc(app.SigninWithPasscode))
+	router.Handler(http.MethodGet, "/v1/oidc/:provider/login", tenant.ThenFunc(app.OIDCLogin))
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/:provider/callback", app.OIDCCallback)
+	if app.config.magicLink.url != nil {
+		router.Handler(http.MethodPost, "/v1/signin/magic-link", tenant.ThenFunc(app.RequestMagicLink))
+		router.Handler(http.MethodPost, "/v1/signin/magic-link/callback", tenant.ThenFunc(app.MagicLinkCallback))
+	}
+	if app.saml != nil {
+		router.Handler(http.MethodGet, "/v1/saml/metadata", tenant.ThenFunc(app.SAMLMetadata))
+		router.Handler(http.MethodGet, "/v1/saml/sso", tenant.ThenFunc(app.SAMLSSO))
+		router.Handler(http.MethodPost, "/v1/saml/sso", tenant.ThenFunc(app.SAMLSSO))
+		router.Handler(http.MethodGet, "/v1/saml/launch/:id", tenant.ThenFunc(app.SAMLLaunch))
+		router.Handler(http.MethodPost, "/v1/saml/launch/:id", tenant.ThenFunc(app.SAMLLaunch))
+	}
+	//Personal access tokens only reach routes their scopes allow, and never
+	//the ones that manage the session or create credentials
+	read := secure.Append(app.requireScope(models.ScopeRead))
+	write := secure.Append(app.requireScope(models.ScopeWrite))
+	sessionOnly := secure.Append(app.requireSession)
+	//Admins impersonating a user cannot manage the account, its credentials
+	//or its data
+	readOwn := read.Append(app.refuseImpersonation)
+	writeOwn := write.Append(app.refuseImpersonation)
+	sessionOwn := sessionOnly.Append(app.refuseImpersonation)
+	router.Handler(http.MethodPost, "/v1/signout", sessionOnly.ThenFunc(app.Signout))
 	//Secure route
-	router.GET("/v1/secure", app.wrapMiddleware(secure.ThenFunc(app.SecuredRoute)))
+	router.GET("/v1/secure", app.wrapMiddleware(withRoute("/v1/secure", read.ThenFunc(app.SecuredRoute))))
+	router.Handler(http.MethodPost, "/v1/me/deactivate", writeOwn.ThenFunc(app.DeactivateAccount))
+	router.Handler(http.MethodGet, "/v1/me/export", readOwn.ThenFunc(app.ExportMyData))
+	router.Handler(http.MethodPost, "/v1/me/erase", writeOwn.ThenFunc(app.EraseMyAccount))
+	router.Handler(http.MethodGet, "/v1/me/sessions", read.ThenFunc(app.MySessions))
+	router.Handler(http.MethodDelete, "/v1/me/sessions", sessionOwn.ThenFunc(app.RevokeOtherSessions))
+	router.Handler(http.MethodDelete, "/v1/me/sessions/:id", writeOwn.ThenFunc(app.RevokeSession))
+	router.Handler(http.MethodPut, "/v1/me/phone", sessionOwn.ThenFunc(app.StartPhoneVerification))
+	router.Handler(http.MethodPost, "/v1/me/phone/verify", sessionOwn.ThenFunc(app.VerifyPhone))
+	router.Handler(http.MethodDelete, "/v1/me/phone", sessionOwn.ThenFunc(app.RemovePhone))
+	router.Handler(http.MethodPut, "/v1/me/mfa/sms", sessionOwn.ThenFunc(app.SetSMSMFA))
+	router.Handler(http.MethodPost, "/v1/me/tokens", sessionOwn.ThenFunc(app.CreatePersonalToken))
+	router.Handler(http.MethodGet, "/v1/me/tokens", sessionOwn.ThenFunc(app.MyPersonalTokens))
+	router.Handler(http.MethodDelete, "/v1/me/tokens/:id", sessionOwn.ThenFunc(app.RevokePersonalToken))
+
+	//Admin routes
+	admin := secure.Append(app.requireScope(models.ScopeAdmin), app.requireAdmin)
+	adminUser := admin.Append(app.requireTenantUser)
+	router.Handler(http.MethodPut, "/v1/admin/users/:id/status", adminUser.ThenFunc(app.SetUserStatus))
+	router.Handler(http.MethodGet, "/v1/admin/users/:id/export", adminUser.ThenFunc(app.ExportUserData))
+	router.Handler(http.MethodPost, "/v1/admin/users/:id/erase", adminUser.ThenFunc(app.EraseUser))
+	router.Handler(http.MethodPut, "/v1/admin/users/:id/role", adminUser.ThenFunc(app.SetUserRole))
+	router.Handler(http.MethodPost, "/v1/admin/users/:id/impersonate", adminUser.Append(app.requireSession, app.refuseImpersonation).ThenFunc(app.Impersonate))
+	router.Handler(http.MethodGet, "/v1/admin/audit-events", admin.ThenFunc(app.AuditEvents))
+	router.Handler(http.MethodPost, "/v1/admin/saml/service-providers", admin.ThenFunc(app.RegisterServiceProvider))
+	router.Handler(http.MethodGet, "/v1/admin/saml/service-providers", admin.ThenFunc(app.ServiceProviders))
+	router.Handler(http.MethodDelete, "/v1/admin/saml/service-providers/:id", admin.ThenFunc(app.DeleteServiceProvider))
+
+	router.Handler(http.MethodPost, "/v1/admin/webhooks", admin.ThenFunc(app.CreateWebhook))
+	router.Handler(http.MethodGet, "/v1/admin/webhooks", admin.ThenFunc(app.Webhooks))
+	router.Handler(http.MethodDelete, "/v1/admin/webhooks/:id", admin.ThenFunc(app.DeleteWebhook))
+	router.Handler(http.MethodGet, "/v1/admin/webhook-deliveries", admin.ThenFunc(app.WebhookDeliveries))
+	router.Handler(http.MethodPost, "/v1/admin/webhook-deliveries/:id/replay", admin.ThenFunc(app.ReplayWebhookDelivery))
 
-	return app.enableCORS(router)
+	return alice.New(app.requestID, app.tenantPath, app.traceRequests(router.Router), app.logRequests, app.enableCORS).Then(app.instrument(router.Router, router))
 }
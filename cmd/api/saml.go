@@ -0,0 +1,498 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/models"
+	"auth/api/repository"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/julienschmidt/httprouter"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// samlAssertionLifetime is how long an SP has to accept an assertion
+const samlAssertionLifetime = 5 * time.Minute
+
+// samlUserFields are the user fields attributes can carry
+var samlUserFields = map[string]func(models.User, models.Tenant) string{
+	"id":       func(u models.User, _ models.Tenant) string { return strconv.Itoa(u.ID) },
+	"username": func(u models.User, _ models.Tenant) string { return u.UserName },
+	"email":    func(u models.User, _ models.Tenant) string { return u.Email },
+	"name":     func(u models.User, _ models.Tenant) string { return u.Name },
+	"role":     func(u models.User, _ models.Tenant) string { return u.Role },
+	"tenant":   func(_ models.User, t models.Tenant) string { return t.Slug },
+}
+
+// defaultSAMLAttributes are sent to service providers registered without a mapping
+var defaultSAMLAttributes = map[string]string{
+	"email": "email",
+	"name":  "name",
+	"uid":   "username",
+	"role":  "role",
+}
+
+// ServiceProviderRequest registers a SAML service provider
+type ServiceProviderRequest struct {
+	Name string `json:"name"`
+	// Metadata is the SP's EntityDescriptor XML
+	Metadata     string            `json:"metadata"`
+	NameIDFormat string            `json:"nameIdFormat"`
+	Attributes   map[string]string `json:"attributes"`
+}
+
+// parseSAMLKeyPair reads the PEM encoded signing certificate and RSA key
+func parseSAMLKeyPair(c config) (*rsa.PrivateKey, *x509.Certificate, error) {
+	certBlock, _ := pem.Decode([]byte(c.saml.cert))
+	if certBlock == nil {
+		return nil, nil, errors.New("saml-cert must be a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("saml-cert: %v", err)
+	}
+
+	keyBlock, _ := pem.Decode([]byte(c.saml.key))
+	if keyBlock == nil {
+		return nil, nil, errors.New("saml-key must be a PEM private key")
+	}
+	var key *rsa.PrivateKey
+	if key, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes); err != nil {
+		parsed, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("saml-key: %v", err)
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, nil, errors.New("saml-key must be an RSA key")
+		}
+	}
+
+	if pub, ok := cert.PublicKey.(*rsa.PublicKey); !ok || pub.N.Cmp(key.N) != 0 {
+		return nil, nil, errors.New("saml-key does not belong to saml-cert")
+	}
+	return key, cert, nil
+}
+
+// validSAMLConfig checks the identity provider flags
+func validSAMLConfig(c config) error {
+	if c.saml.cert == "" && c.saml.key == "" {
+		return nil
+	}
+	if _, _, err := parseSAMLKeyPair(c); err != nil {
+		return err
+	}
+
+	if u, err := url.Parse(c.saml.baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("saml-base-url must be the public http or https URL of this server, got %q", c.saml.baseURL)
+	}
+	if u, err := url.Parse(c.saml.loginURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("saml-login-url must be an http or https URL, got %q", c.saml.loginURL)
+	}
+
+	return nil
+}
+
+// newSAMLIdP sets up the identity provider, nil when no signing key is configured
+func (app *application) newSAMLIdP() *saml.IdentityProvider {
+	if app.config.saml.cert == "" {
+		return nil
+	}
+	key, cert, _ := parseSAMLKeyPair(app.config)
+
+	return &saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             cert,
+		Logger:                  log.New(app.logger.Writer(logging.LevelWarn), "saml: ", 0),
+		ServiceProviderProvider: samlServiceProviders{app: app},
+		SessionProvider:         samlSessions{app: app},
+		AssertionMaker:          samlAssertions{app: app},
+		SignatureMethod:         dsig.RSASHA256SignatureMethod,
+	}
+}
+
+// samlIdP returns the identity provider as seen by the request's tenant. A
+// tenant named in the path is its own identity provider, with its own entity
+// id and URLs.
+func (app *application) samlIdP(r *http.Request) *saml.IdentityProvider {
+	idp := *app.saml
+	base := app.samlBaseURL(r)
+	metadataURL, _ := url.Parse(base + "/v1/saml/metadata")
+	ssoURL, _ := url.Parse(base + "/v1/saml/sso")
+	idp.MetadataURL, idp.SSOURL = *metadataURL, *ssoURL
+	return &idp
+}
+
+// samlBaseURL is -saml-base-url followed by the tenant path the request came in on
+func (app *application) samlBaseURL(r *http.Request) string {
+	base := strings.TrimSuffix(app.config.saml.baseURL, "/")
+	if slug, ok := r.Context().Value(tenantPathContextKey).(string); ok {
+		base += tenantPathPrefix + slug
+	}
+	return base
+}
+
+// SAMLMetadata publishes the identity provider's metadata for SPs to import
+func (app *application) SAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	app.samlIdP(r).ServeMetadata(w, r)
+}
+
+// SAMLSSO answers an SP's authentication request, by redirect or POST binding
+func (app *application) SAMLSSO(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	app.samlIdP(r).ServeSSO(w, r)
+}
+
+// SAMLLaunch signs the user in to a registered SP without the SP asking,
+// for app launchers. A RelayState parameter is passed on to the SP.
+func (app *application) SAMLLaunch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("unknown service provider"), http.StatusNotFound)
+		return
+	}
+	sp, err := app.db.DB.GetServiceProviderByID(r.Context(), tenantFromContext(r).ID, id)
+	if err != nil {
+		app.errorJSON(w, errors.New("unknown service provider"), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	app.samlIdP(r).ServeIDPInitiated(w, r, sp.EntityID, r.FormValue("RelayState"))
+}
+
+// samlServiceProviders finds SPs among those registered with the request's tenant
+type samlServiceProviders struct {
+	app *application
+}
+
+func (p samlServiceProviders) GetServiceProvider(r *http.Request, entityID string) (*saml.EntityDescriptor, error) {
+	sp, err := p.app.db.DB.GetServiceProvider(r.Context(), tenantFromContext(r).ID, entityID)
+	if errors.Is(err, repository.ErrNoRecord) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata saml.EntityDescriptor
+	if err = xml.Unmarshal([]byte(sp.Metadata), &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// samlSessions signs users in for SAML requests. A browser with a session
+// cookie, or a sign-in page posting a session token, is signed in already.
+// Otherwise the browser goes to -saml-login-url, which posts the username and
+// password back here, checked like /v1/signin.
+type samlSessions struct {
+	app *application
+}
+
+func (s samlSessions) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	app := s.app
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil
+	}
+
+	user, sessionID, errCode := app.samlUser(w, r)
+	if errCode != "" {
+		app.samlLogin(w, r, req, errCode)
+		return nil
+	}
+
+	// the assertion maker reads the user from the request
+	req.HTTPRequest = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+
+	return &saml.Session{
+		ID:         sessionID,
+		CreateTime: time.Now(),
+		ExpireTime: time.Now().Add(tokenLifetime),
+		Index:      sessionID,
+		UserName:   user.UserName,
+		UserEmail:  user.Email,
+	}
+}
+
+// samlUser returns the user signing in and their session, or the error code
+// the sign-in page is sent. Without credentials the code is "login".
+func (app *application) samlUser(w http.ResponseWriter, r *http.Request) (models.User, string, string) {
+	var token string
+	if cookie, err := r.Cookie(app.config.session.cookieName); err == nil && app.config.session.mode == sessionModeCookie {
+		token = cookie.Value
+	}
+	if t := r.PostForm.Get("token"); t != "" {
+		token = t
+	}
+	if token != "" {
+		user, session, err := app.validateToken(r.Context(), token)
+		switch {
+		case err == nil && session.ActorID != 0:
+			// an admin acting as the user cannot sign them in to other apps
+			app.audit(r, "auth.signin", user.ID, outcomeFailure, map[string]interface{}{"via": "saml", "reason": "impersonation", "actor": session.ActorID})
+			signins.Inc(outcomeFailure, "impersonation")
+			return models.User{}, "", "impersonation"
+		case err == nil:
+			return user, session.ID, ""
+		}
+	}
+
+	username, password := r.PostForm.Get("username"), r.PostForm.Get("password")
+	if username == "" || password == "" {
+		return models.User{}, "", "login"
+	}
+
+	user, method, err := app.authenticate(r, username, password)
+	switch {
+	case errors.Is(err, repository.ErrSuspendedAccount), errors.Is(err, repository.ErrInactiveAccount):
+		app.audit(r, "auth.signin", 0, outcomeFailure, map[string]interface{}{"method": method, "via": "saml", "reason": "inactive"})
+		signins.Inc(outcomeFailure, "inactive")
+		return models.User{}, "", "account_inactive"
+	case errors.Is(err, repository.ErrInvalidCredentials):
+		app.audit(r, "auth.signin", 0, outcomeFailure, map[string]interface{}{"via": "saml", "reason": "invalid credentials"})
+		signins.Inc(outcomeFailure, "invalid_credentials")
+		return models.User{}, "", "invalid_credentials"
+	case err != nil:
+		signins.Inc(outcomeFailure, "error")
+		return models.User{}, "", "unavailable"
+	}
+
+	// the passcode step needs the JSON sign-in, after which the page posts the token
+	if user.SMSMFA && user.Phone != "" {
+		return models.User{}, "", "mfa_required"
+	}
+
+	session, err := app.startSession(r, user.ID, "saml")
+	if err != nil {
+		app.log(r).Error("error signing in", "err", err)
+		signins.Inc(outcomeFailure, "error")
+		return models.User{}, "", "unavailable"
+	}
+	if app.config.session.mode == sessionModeCookie {
+		app.setSessionCookies(w, session)
+	}
+
+	app.audit(r, "auth.signin", user.ID, outcomeSuccess, map[string]interface{}{"method": method, "via": "saml"})
+	signins.Inc(outcomeSuccess, "")
+	return user, session.ID, ""
+}
+
+// samlLogin sends the browser to the sign-in page. The page posts the
+// credentials with SAMLRequest and RelayState to action.
+func (app *application) samlLogin(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest, errCode string) {
+	u, _ := url.Parse(app.config.saml.loginURL)
+	q := u.Query()
+	q.Set("action", app.samlBaseURL(r)+r.URL.Path)
+	if len(req.RequestBuffer) > 0 {
+		q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(req.RequestBuffer))
+	}
+	if req.RelayState != "" {
+		q.Set("RelayState", req.RelayState)
+	}
+	if errCode != "login" {
+		q.Set("error", errCode)
+	}
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// samlAssertions sends each SP the NameID and attributes it was registered with
+type samlAssertions struct {
+	app *application
+}
+
+func (a samlAssertions) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	app := a.app
+	r := req.HTTPRequest
+	user, _ := userFromContext(r)
+	tenant := tenantFromContext(r)
+
+	sp, err := app.db.DB.GetServiceProvider(r.Context(), tenant.ID, req.ServiceProviderMetadata.EntityID)
+	if err != nil {
+		return err
+	}
+
+	if err = (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		return err
+	}
+
+	// the default maker times assertions with the package wide MaxIssueDelay,
+	// they get our own lifetime instead
+	expires := req.Now.Add(samlAssertionLifetime)
+	req.Assertion.Conditions.NotOnOrAfter = expires
+	for _, c := range req.Assertion.Subject.SubjectConfirmations {
+		if c.SubjectConfirmationData != nil {
+			c.SubjectConfirmationData.NotOnOrAfter = expires
+		}
+	}
+
+	nameID := req.Assertion.Subject.NameID
+	switch sp.NameIDFormat {
+	case models.NameIDEmail:
+		nameID.Format, nameID.Value = string(saml.EmailAddressNameIDFormat), user.Email
+	case models.NameIDUsername:
+		nameID.Format, nameID.Value = string(saml.UnspecifiedNameIDFormat), user.UserName
+	default:
+		nameID.Format, nameID.Value = string(saml.PersistentNameIDFormat), strconv.Itoa(user.ID)
+	}
+
+	mapping := sp.Attributes
+	if len(mapping) == 0 {
+		mapping = defaultSAMLAttributes
+	}
+	names := make([]string, 0, len(mapping))
+	for name := range mapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attributes := []saml.Attribute{}
+	for _, name := range names {
+		format := "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+		if strings.HasPrefix(name, "urn:") {
+			format = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+		}
+		attributes = append(attributes, saml.Attribute{
+			Name:       name,
+			NameFormat: format,
+			Values:     []saml.AttributeValue{{Type: "xs:string", Value: samlUserFields[mapping[name]](user, tenant)}},
+		})
+	}
+	req.Assertion.AttributeStatements = []saml.AttributeStatement{{Attributes: attributes}}
+
+	app.audit(r, "saml.assertion", user.ID, outcomeSuccess, map[string]interface{}{"sp": sp.EntityID, "session": session.ID})
+	return nil
+}
+
+// RegisterServiceProvider lets an admin register an SP with their tenant from its metadata
+func (app *application) RegisterServiceProvider(w http.ResponseWriter, r *http.Request) {
+	var data ServiceProviderRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding service provider"))
+		return
+	}
+
+	sp := models.ServiceProvider{
+		TenantID:     tenantFromContext(r).ID,
+		Name:         strings.TrimSpace(data.Name),
+		Metadata:     data.Metadata,
+		NameIDFormat: data.NameIDFormat,
+		Attributes:   data.Attributes,
+	}
+	if sp.NameIDFormat == "" {
+		sp.NameIDFormat = models.NameIDPersistent
+	}
+	if sp.Attributes == nil {
+		sp.Attributes = map[string]string{}
+	}
+
+	var err error
+	if sp.EntityID, err = app.validServiceProvider(sp); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	sp.ID, err = app.db.DB.InsertServiceProvider(r.Context(), sp)
+	if errors.Is(err, repository.ErrDuplicateEntityID) {
+		app.errorJSON(w, errors.New("a service provider with this entity id is already registered"), http.StatusConflict)
+		return
+	}
+	app.audit(r, "saml.sp_register", 0, outcome(err), map[string]interface{}{"sp": sp.EntityID})
+	if err != nil {
+		app.log(r).Error("error registering service provider", "err", err)
+		app.errorJSON(w, errors.New("error registering service provider"), http.StatusInternalServerError)
+		return
+	}
+
+	sp.CreatedAt = time.Now()
+	app.writeJSON(w, http.StatusCreated, sp, "serviceProvider")
+}
+
+// validServiceProvider checks a registration and returns the SP's entity id
+func (app *application) validServiceProvider(sp models.ServiceProvider) (string, error) {
+	if sp.Name == "" {
+		return "", errors.New("name is required")
+	}
+	switch sp.NameIDFormat {
+	case models.NameIDPersistent, models.NameIDEmail, models.NameIDUsername:
+	default:
+		return "", errors.New("nameIdFormat must be persistent, email or username")
+	}
+	for name, field := range sp.Attributes {
+		if _, ok := samlUserFields[field]; !ok || name == "" {
+			return "", fmt.Errorf("attribute %q must map to one of id, username, email, name, role and tenant", name)
+		}
+	}
+
+	var metadata saml.EntityDescriptor
+	if err := xml.Unmarshal([]byte(sp.Metadata), &metadata); err != nil || metadata.EntityID == "" {
+		return "", errors.New("metadata must be an EntityDescriptor with an entityID")
+	}
+	for _, d := range metadata.SPSSODescriptors {
+		for _, acs := range d.AssertionConsumerServices {
+			u, err := url.Parse(acs.Location)
+			if acs.Binding != saml.HTTPPostBinding || err != nil || u.Host == "" {
+				continue
+			}
+			if u.Scheme == "https" || (u.Scheme == "http" && app.config.env == "dev") {
+				return metadata.EntityID, nil
+			}
+		}
+	}
+	return "", errors.New("metadata must have an https assertion consumer service with the HTTP-POST binding")
+}
+
+// ServiceProviders lists the SPs registered with the admin's tenant
+func (app *application) ServiceProviders(w http.ResponseWriter, r *http.Request) {
+	list, err := app.db.DB.TenantServiceProviders(r.Context(), tenantFromContext(r).ID)
+	if err != nil {
+		app.errorJSON(w, errors.New("error listing service providers"), http.StatusInternalServerError)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, list, "serviceProviders")
+}
+
+// DeleteServiceProvider removes an SP from the admin's tenant
+func (app *application) DeleteServiceProvider(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid service provider id"))
+		return
+	}
+
+	tenant := tenantFromContext(r)
+	sp, err := app.db.DB.GetServiceProviderByID(r.Context(), tenant.ID, id)
+	if err == nil {
+		err = app.db.DB.DeleteServiceProvider(r.Context(), tenant.ID, id)
+	}
+	if errors.Is(err, repository.ErrNoRecord) {
+		app.errorJSON(w, errors.New("no service provider with this id"), http.StatusNotFound)
+		return
+	}
+	app.audit(r, "saml.sp_delete", 0, outcome(err), map[string]interface{}{"sp": sp.EntityID})
+	if err != nil {
+		app.errorJSON(w, errors.New("error deleting service provider"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResp{OK: true, Message: "Service provider deleted"}, "response")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/tokens"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/crewjam/saml"
+)
+
+// setSAMLKeyPair configures the application with a new signing key pair
+func setSAMLKeyPair(t *testing.T, app *application) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.config.saml.cert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	app.config.saml.key = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func TestSAMLUserToken(t *testing.T) {
+	user := models.User{
+		ID: 7, TenantID: testTenant.ID, Name: "Alice", Email: "alice@example.com", UserName: "alice",
+		Role: models.RoleUser, Status: models.StatusActive,
+	}
+	admin := models.User{
+		ID: 2, TenantID: testTenant.ID, Name: "Root", Email: "root@example.com", UserName: "root",
+		Role: models.RoleAdmin, Status: models.StatusActive,
+	}
+
+	tests := []struct {
+		name    string
+		actorID int
+		// the session signed in with and the error code for the sign-in page
+		wantSession string
+		wantCode    string
+	}{
+		{name: "session token", wantSession: "s-1"},
+		{name: "impersonation token", actorID: admin.ID, wantCode: "impersonation"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			expires := time.Now().Add(time.Hour)
+			token, err := tokens.Sign(app.keys, tokens.Grant{
+				UserID:    user.ID,
+				Tenant:    testTenant.Slug,
+				SessionID: "s-1",
+				Expires:   expires,
+				ActorID:   tt.actorID,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectUserByID(mock, user)
+			expectGetSession(mock, models.Session{ID: "s-1", UserID: user.ID, ExpiresAt: expires, ActorID: tt.actorID})
+			if tt.actorID != 0 {
+				expectUserByID(mock, admin)
+				expectAudit(mock, "auth.signin", outcomeFailure)
+			}
+
+			form := url.Values{"token": {string(token)}}
+			r := httptest.NewRequest(http.MethodPost, "/v1/saml/sso", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r = withTenant(r, testTenant)
+			if err = r.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, session, code := app.samlUser(httptest.NewRecorder(), r)
+			if session != tt.wantSession || code != tt.wantCode {
+				t.Errorf("got session %q and code %q, want %q and %q", session, code, tt.wantSession, tt.wantCode)
+			}
+			if tt.wantCode == "" && got.ID != user.ID {
+				t.Errorf("signed in as %d, want %d", got.ID, user.ID)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSAMLAssertionLifetime(t *testing.T) {
+	app, mock := newTestApp(t)
+	setSAMLKeyPair(t, app)
+	maxIssueDelay := saml.MaxIssueDelay
+	app.saml = app.newSAMLIdP()
+	if saml.MaxIssueDelay != maxIssueDelay {
+		t.Errorf("saml.MaxIssueDelay changed to %v", saml.MaxIssueDelay)
+	}
+
+	user := models.User{ID: 7, TenantID: testTenant.ID, Email: "alice@example.com", UserName: "alice", Role: models.RoleUser}
+	spEntityID := "https://sp.example.com/metadata"
+	mock.ExpectQuery(`FROM saml_service_providers`).WithArgs(testTenant.ID, spEntityID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "entity_id", "name", "metadata", "name_id_format", "attributes", "created_at"}).
+			AddRow(3, testTenant.ID, spEntityID, "Wiki", "", models.NameIDEmail, []byte("{}"), time.Now()))
+	expectAudit(mock, "saml.assertion", outcomeSuccess)
+
+	r := withTenant(httptest.NewRequest(http.MethodPost, "/v1/saml/sso", nil), testTenant)
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	now := time.Now()
+	req := &saml.IdpAuthnRequest{
+		IDP:                     app.saml,
+		HTTPRequest:             r,
+		Request:                 saml.AuthnRequest{ID: "id-1", IssueInstant: now},
+		ServiceProviderMetadata: &saml.EntityDescriptor{EntityID: spEntityID},
+		SPSSODescriptor:         &saml.SPSSODescriptor{},
+		ACSEndpoint:             &saml.IndexedEndpoint{Location: "https://sp.example.com/acs"},
+		Now:                     now,
+	}
+
+	err := samlAssertions{app: app}.MakeAssertion(req, &saml.Session{ID: "s-1", CreateTime: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := now.Add(samlAssertionLifetime)
+	if got := req.Assertion.Conditions.NotOnOrAfter; !got.Equal(want) {
+		t.Errorf("conditions end at %v, want %v", got, want)
+	}
+	for _, c := range req.Assertion.Subject.SubjectConfirmations {
+		if got := c.SubjectConfirmationData.NotOnOrAfter; !got.Equal(want) {
+			t.Errorf("subject confirmation ends at %v, want %v", got, want)
+		}
+	}
+	if nameID := req.Assertion.Subject.NameID; nameID.Value != user.Email {
+		t.Errorf("name id %q, want the email", nameID.Value)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
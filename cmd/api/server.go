@@ -0,0 +1,77 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/tracing"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serve runs the server until SIGINT or SIGTERM, then drains it. Readiness
+// flips first and the listener stays open for the shutdown delay so load
+// balancers stop routing here before new connections are refused. In-flight
+// requests then get the shutdown timeout to finish.
+func (app *application) serve(srv *http.Server) error {
+	shutdownErr := make(chan error, 1)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-quit
+
+		atomic.StoreInt32(&app.shuttingDown, 1)
+		app.logger.Info("shutting down server", "signal", sig.String(), "delay", app.config.shutdown.delay.String())
+		time.Sleep(app.config.shutdown.delay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdown.timeout)
+		defer cancel()
+
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
+	app.logger.Info("starting server", "port", app.config.port)
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	if err = <-shutdownErr; err != nil {
+		return err
+	}
+
+	app.logger.Info("waiting for background tasks")
+	app.wg.Wait()
+
+	app.logger.Info("server stopped")
+	return nil
+}
+
+// background runs fn outside the request that started it. serve waits for
+// it on shutdown, and a panic is logged rather than taking the server down.
+func (app *application) background(ctx context.Context, fn func(ctx context.Context)) {
+	ctx = logging.NewContext(tracing.Detach(ctx), logging.FromContext(ctx))
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				logging.FromContext(ctx).Error("background task panicked", "err", fmt.Sprint(err))
+			}
+		}()
+
+		fn(ctx)
+	}()
+}
+
+// stopping reports whether a shutdown has begun
+func (app *application) stopping() bool {
+	return atomic.LoadInt32(&app.shuttingDown) == 1
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"auth/api/repository"
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// MySessions lists where the user is signed in
+func (app *application) MySessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	sessions, err := app.db.DB.UserSessions(r.Context(), user.ID, false)
+	if err != nil {
+		app.log(r).Error("error getting sessions", "err", err)
+		app.errorJSON(w, errors.New("error getting sessions"))
+		return
+	}
+
+	current := sessionFromContext(r)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+
+	err = app.writeJSON(w, http.StatusOK, sessions, "sessions")
+	if err != nil {
+		app.log(r).Error("error writing json", "err", err)
+		app.errorJSON(w, errors.New("error writing json"))
+	}
+}
+
+// RevokeSession signs the user out of one of their sessions
+func (app *application) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	metadata := map[string]interface{}{"session": id}
+
+	err := app.db.DB.RevokeSession(r.Context(), user.ID, id)
+	if errors.Is(err, repository.ErrNoRecord) {
+		app.audit(r, "session.revoke", user.ID, outcomeFailure, metadata)
+		app.errorJSON(w, errors.New("no active session with this id"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.log(r).Error("error revoking session", "err", err)
+		app.audit(r, "session.revoke", user.ID, outcomeFailure, metadata)
+		app.errorJSON(w, errors.New("error revoking session"))
+		return
+	}
+	app.audit(r, "session.revoke", user.ID, outcomeSuccess, metadata)
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "Session revoked",
+		UserID:  user.ID,
+	}
+	app.writeJSON(w, http.StatusOK, resp, "response")
+}
+
+// RevokeOtherSessions signs the user out everywhere except the current session
+func (app *application) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r)
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusForbidden)
+		return
+	}
+
+	n, err := app.db.DB.RevokeOtherSessions(r.Context(), user.ID, sessionFromContext(r))
+	if err != nil {
+		app.log(r).Error("error revoking sessions", "err", err)
+		app.audit(r, "session.revoke_others", user.ID, outcomeFailure, nil)
+		app.errorJSON(w, errors.New("error revoking sessions"))
+		return
+	}
+	app.audit(r, "session.revoke_others", user.ID, outcomeSuccess, map[string]interface{}{"revoked": n})
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "Other sessions revoked",
+		UserID:  user.ID,
+	}
+	app.writeJSON(w, http.StatusOK, resp, "response")
+}
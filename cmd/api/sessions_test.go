@@ -0,0 +1,157 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/tokens"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// withSession returns the request as checkToken passes it on for the user's session
+func withSession(r *http.Request, user models.User, sessionID string) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	ctx = context.WithValue(ctx, sessionContextKey, sessionID)
+	return withTenant(r.WithContext(ctx), testTenant)
+}
+
+func TestMySessions(t *testing.T) {
+	app, mock := newTestApp(t)
+	now := time.Now()
+
+	mock.ExpectQuery(`FROM sessions where user_id = \$1 and revoked_at is null and expires_at > now\(\) order by created_at desc`).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "device", "user_agent", "ip", "created_at",
+			"last_seen_at", "expires_at", "revoked_at", "actor_id"}).
+			AddRow("s2", 7, "Safari on iPhone", "", "", now, now, now.Add(time.Hour), nil, nil).
+			AddRow("s1", 7, "Firefox on Linux", "", "", now, now, now.Add(time.Hour), nil, nil))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/me/sessions", nil)
+	w := httptest.NewRecorder()
+	app.MySessions(w, withSession(r, models.User{ID: 7}, "s1"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Sessions []models.Session `json:"sessions"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Sessions) != 2 || resp.Sessions[0].Current || !resp.Sessions[1].Current {
+		t.Errorf("the current session is not marked: %+v", resp.Sessions)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	tests := []struct {
+		name string
+		// revoked is how many sessions of the user the update revoked
+		revoked int64
+		want    int
+		outcome string
+	}{
+		{"own session", 1, http.StatusOK, outcomeSuccess},
+		{"someone else's or already revoked", 0, http.StatusNotFound, outcomeFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+
+			mock.ExpectExec(`update sessions set revoked_at = \$1\s+where id = \$2 and user_id = \$3 and revoked_at is null`).
+				WithArgs(sqlmock.AnyArg(), "s2", 7).
+				WillReturnResult(sqlmock.NewResult(0, tt.revoked))
+			expectAudit(mock, "session.revoke", tt.outcome)
+
+			r := httptest.NewRequest(http.MethodDelete, "/v1/me/sessions/s2", nil)
+			w := httptest.NewRecorder()
+			app.RevokeSession(w, withParams(withSession(r, models.User{ID: 7}, "s1"), "id", "s2"))
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	mock.ExpectExec(`update sessions set revoked_at = \$1\s+where user_id = \$2 and id <> \$3 and revoked_at is null`).
+		WithArgs(sqlmock.AnyArg(), 7, "s1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	expectAudit(mock, "session.revoke_others", outcomeSuccess)
+
+	r := httptest.NewRequest(http.MethodDelete, "/v1/me/sessions", nil)
+	w := httptest.NewRecorder()
+	app.RevokeOtherSessions(w, withSession(r, models.User{ID: 7}, "s1"))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d: %s", w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateTokenSession(t *testing.T) {
+	user := models.User{ID: 7, TenantID: testTenant.ID, Role: models.RoleUser, Status: models.StatusActive}
+	active := models.Session{ID: "s1", UserID: 7, ExpiresAt: time.Now().Add(time.Hour)}
+
+	tests := []struct {
+		name    string
+		session models.Session
+		revoked bool
+		wantErr bool
+	}{
+		{name: "active", session: active},
+		{name: "revoked", session: active, revoked: true, wantErr: true},
+		{name: "expired", session: models.Session{ID: "s1", UserID: 7, ExpiresAt: time.Now().Add(-time.Minute)}, wantErr: true},
+		{name: "another user's", session: models.Session{ID: "s1", UserID: 8, ExpiresAt: active.ExpiresAt}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			token, err := tokens.Sign(app.keys, tokens.Grant{
+				UserID: 7, Tenant: testTenant.Slug, SessionID: "s1", Expires: time.Now().Add(time.Hour),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectUserByID(mock, user)
+			var revokedAt interface{}
+			if tt.revoked {
+				revokedAt = time.Now()
+			}
+			s := tt.session
+			mock.ExpectQuery(`FROM sessions where id`).WithArgs("s1").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "device", "user_agent", "ip", "created_at",
+					"last_seen_at", "expires_at", "revoked_at", "actor_id"}).
+					AddRow(s.ID, s.UserID, "", "", "", s.CreatedAt, s.LastSeenAt, s.ExpiresAt, revokedAt, nil))
+
+			ctx := context.WithValue(context.Background(), tenantContextKey, testTenant)
+			_, _, err = app.validateToken(ctx, string(token))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/models"
+	"auth/api/repository"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Places a tenant can be named in, tried in the configured order
+const (
+	tenantSourceHost   = "host"
+	tenantSourceHeader = "header"
+	tenantSourcePath   = "path"
+)
+
+// tenantHeader names the tenant by slug
+const tenantHeader = "X-Tenant"
+
+// tenantPathPrefix starts paths naming the tenant, as in /t/acme/v1/signin
+const tenantPathPrefix = "/t/"
+
+// tenantPath strips a /t/<slug> prefix before routing so every route also
+// works under a tenant path. The slug is kept for resolveTenant.
+func (app *application) tenantPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.tenantSource(tenantSourcePath) || !strings.HasPrefix(r.URL.Path, tenantPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rest := strings.TrimPrefix(r.URL.Path, tenantPathPrefix)
+		i := strings.IndexByte(rest, '/')
+		if i <= 0 {
+			app.errorJSON(w, errors.New("not found"), http.StatusNotFound)
+			return
+		}
+
+		r2 := r.Clone(context.WithValue(r.Context(), tenantPathContextKey, rest[:i]))
+		r2.URL.Path = rest[i:]
+		r2.URL.RawPath = ""
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// tenantSource reports whether tenants may be named in the source
+func (app *application) tenantSource(source string) bool {
+	for _, s := range app.config.tenant.sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveTenant finds the tenant a request is for and stores it on the request.
+// A tenant named but not found is refused rather than falling back, so a typo
+// never signs users into the default tenant.
+func (app *application) resolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := app.lookupTenant(r)
+		if errors.Is(err, repository.ErrNoRecord) {
+			app.errorJSON(w, errors.New("unknown tenant"), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			app.log(r).Error("error resolving tenant", "err", err)
+			app.errorJSON(w, errors.New("error resolving tenant"), http.StatusInternalServerError)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tenantContextKey, tenant)
+		ctx = logging.NewContext(ctx, app.log(r).With("tenant", tenant.Slug))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (app *application) lookupTenant(r *http.Request) (models.Tenant, error) {
+	for _, source := range app.config.tenant.sources {
+		switch source {
+		case tenantSourcePath:
+			if slug, ok := r.Context().Value(tenantPathContextKey).(string); ok {
+				return app.db.DB.GetTenantBySlug(r.Context(), slug)
+			}
+		case tenantSourceHeader:
+			if slug := r.Header.Get(tenantHeader); slug != "" {
+				return app.db.DB.GetTenantBySlug(r.Context(), slug)
+			}
+		case tenantSourceHost:
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+			tenant, err := app.db.DB.GetTenantByHost(r.Context(), strings.ToLower(host))
+			if !errors.Is(err, repository.ErrNoRecord) {
+				return tenant, err
+			}
+		}
+	}
+
+	if app.config.tenant.fallback == "" {
+		return models.Tenant{}, repository.ErrNoRecord
+	}
+	return app.db.DB.GetTenantBySlug(r.Context(), app.config.tenant.fallback)
+}
+
+// tenantFromContext returns the tenant resolveTenant stored on the request
+func tenantFromContext(r *http.Request) models.Tenant {
+	tenant, _ := r.Context().Value(tenantContextKey).(models.Tenant)
+	return tenant
+}
+
+// requireTenantUser keeps admins to the users of their own tenant. It must run
+// after checkToken on routes with an :id parameter, and answers as if users of
+// other tenants did not exist.
+func (app *application) requireTenantUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+		if err != nil {
+			app.errorJSON(w, errors.New("invalid user id"))
+			return
+		}
+
+		user, err := app.db.DB.GetUserById(r.Context(), id)
+		if err != nil || user.TenantID != tenantFromContext(r).ID {
+			app.errorJSON(w, errors.New("no user with this id"), http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validTenantConfig checks the tenant flags
+func validTenantConfig(c config) error {
+	for _, s := range c.tenant.sources {
+		switch s {
+		case tenantSourceHost, tenantSourceHeader, tenantSourcePath:
+		default:
+			return fmt.Errorf("tenant-sources may only contain host, header and path, got %q", s)
+		}
+	}
+
+	if len(c.tenant.sources) == 0 && c.tenant.fallback == "" {
+		return errors.New("default-tenant is required when tenant-sources is empty")
+	}
+
+	return nil
+}
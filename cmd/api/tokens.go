@@ -0,0 +1,75 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/tokens"
+	"net/http"
+	"time"
+)
+
+// tokenLifetime is how long a signed in session and its token stay valid
+const tokenLifetime = time.Hour * 24
+
+// signedSession is a new session with the token that proves it
+type signedSession struct {
+	ID      string
+	UserID  int
+	Token   []byte
+	Expires time.Time
+}
+
+// startSession records a session for the user and returns a signed token for it
+func (app *application) startSession(r *http.Request, userID int, device string) (signedSession, error) {
+	if device == "" {
+		device = r.UserAgent()
+	}
+
+	s := signedSession{
+		UserID:  userID,
+		Expires: time.Now().Add(tokenLifetime),
+	}
+
+	var err error
+	s.ID, err = app.db.DB.CreateSession(r.Context(), models.Session{
+		UserID:    userID,
+		Device:    device,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		ExpiresAt: s.Expires,
+	})
+	if err != nil {
+		return s, err
+	}
+
+	s.Token, err = app.issueToken(tokens.Grant{
+		UserID:    userID,
+		Tenant:    tenantFromContext(r).Slug,
+		SessionID: s.ID,
+		Expires:   s.Expires,
+	})
+	return s, err
+}
+
+// writeSession hands a new session to the client, either as a token in the body
+// or as cookies depending on the session mode
+func (app *application) writeSession(w http.ResponseWriter, s signedSession) {
+	if app.config.session.mode != sessionModeCookie {
+		app.writeJSON(w, http.StatusOK, string(s.Token), "token")
+		return
+	}
+
+	csrf := app.setSessionCookies(w, s)
+	w.Header().Set(csrfHeader, csrf)
+
+	resp := jsonResp{
+		OK:      true,
+		Message: "Signed in",
+		UserID:  s.UserID,
+	}
+	app.writeJSON(w, http.StatusOK, resp, "response")
+}
+
+// issueToken signs a JWT for the user tied to a session
+func (app *application) issueToken(g tokens.Grant) ([]byte, error) {
+	return tokens.Sign(app.keys, g)
+}
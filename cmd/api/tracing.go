@@ -0,0 +1,48 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/tracing"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceRequests starts a server span for every request, continuing the trace
+// of a caller that sent a W3C traceparent header. The span is named after the
+// matched route once the handler has run, and its trace id is added to the
+// request logger.
+func (app *application) traceRequests(router *httprouter.Router) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracing.Extract(r.Context(), r.Header)
+			ctx, span := tracing.StartKind(ctx, "HTTP "+r.Method, trace.SpanKindServer,
+				semconv.HTTPMethodKey.String(r.Method),
+				semconv.HTTPTargetKey.String(r.URL.Path),
+				semconv.HTTPClientIPKey.String(clientIP(r)),
+				semconv.HTTPUserAgentKey.String(r.UserAgent()),
+			)
+			defer span.End()
+
+			if id := tracing.TraceID(ctx); id != "" {
+				ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("trace_id", id))
+			}
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			route := routePattern(router, r)
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPStatusCodeKey.Int(rec.status),
+			)
+			if rec.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rec.status))
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"auth/api/tracing"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceparent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+// recordSpans installs a tracer provider keeping every ended span
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	if _, err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracing.ExporterNone}); err != nil {
+		t.Fatal(err)
+	}
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return rec
+}
+
+func TestTraceRequests(t *testing.T) {
+	rec := recordSpans(t)
+	app, _ := newTestApp(t)
+
+	var handlerTrace string
+	router := patternRouter{httprouter.New()}
+	router.HandlerFunc(http.MethodDelete, "/v1/me/sessions/:id", func(w http.ResponseWriter, r *http.Request) {
+		handlerTrace = tracing.TraceID(r.Context())
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	r := httptest.NewRequest(http.MethodDelete, "/v1/me/sessions/s1", nil)
+	r.Header.Set("traceparent", testTraceparent)
+	app.traceRequests(router.Router)(router).ServeHTTP(httptest.NewRecorder(), r)
+
+	ended := rec.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d spans", len(ended))
+	}
+	span := ended[0]
+	if span.Name() != "DELETE /v1/me/sessions/:id" || span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("got %s span %q", span.SpanKind(), span.Name())
+	}
+	if got := span.SpanContext().TraceID().String(); got != testTraceID || handlerTrace != testTraceID {
+		t.Errorf("the caller's trace is not continued: span %s, handler %s", got, handlerTrace)
+	}
+	if !span.Parent().IsRemote() {
+		t.Error("the span is not a child of the caller's span")
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("a 500 left the span %v", span.Status().Code)
+	}
+
+	attrs := map[string]string{}
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs[string(semconv.HTTPRouteKey)] != "/v1/me/sessions/:id" || attrs[string(semconv.HTTPStatusCodeKey)] != "500" {
+		t.Errorf("got attributes %v", attrs)
+	}
+}
+
+func TestTraceRequestsNewTrace(t *testing.T) {
+	rec := recordSpans(t)
+	app, _ := newTestApp(t)
+	router := patternRouter{httprouter.New()}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/nowhere", nil)
+	app.traceRequests(router.Router)(router).ServeHTTP(httptest.NewRecorder(), r)
+
+	ended := rec.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d spans", len(ended))
+	}
+	if ended[0].Parent().IsValid() || ended[0].Name() != "GET unmatched" {
+		t.Errorf("got span %q with parent %v", ended[0].Name(), ended[0].Parent())
+	}
+	if ended[0].Status().Code == codes.Error {
+		t.Error("a 404 marked the span failed")
+	}
+}
+
+func TestPostEmailTraceparent(t *testing.T) {
+	rec := recordSpans(t)
+
+	var got string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("traceparent")
+	}))
+	defer gateway.Close()
+
+	app, _ := newTestApp(t)
+	app.config.mailer.url = gateway.URL
+
+	ctx, span := tracing.Start(context.Background(), "outbox.send")
+	if err := app.postEmail(ctx, map[string]string{"destination": "ada@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	ended := rec.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("got %d spans", len(ended))
+	}
+	client := ended[0]
+	if client.Name() != "HTTP POST email gateway" || client.SpanKind() != trace.SpanKindClient {
+		t.Errorf("got %s span %q", client.SpanKind(), client.Name())
+	}
+	if client.Parent().SpanID() != span.SpanContext().SpanID() {
+		t.Error("the gateway call is not a child of the caller's span")
+	}
+	want := "00-" + client.SpanContext().TraceID().String() + "-" + client.SpanContext().SpanID().String()
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("the gateway got traceparent %q, want %s-..", got, want)
+	}
+}
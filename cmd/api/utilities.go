@@ -1,12 +1,19 @@
 package main
 
 import (
-	"auth/api/models"
+	"auth/api/logging"
+	"auth/api/tracing"
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type jsonResp struct {
@@ -46,62 +53,70 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 	app.writeJSON(w, statusCode, theError, "error")
 }
 
-func (app *application) SendEmail(w http.ResponseWriter, emailReq models.ForgotPasswordEmailPayload) {
-	// var msg EmailForm
-	// err := json.NewDecoder(r.Body).Decode(&msg)
-	// if err != nil {
-	// 	app.errorJSON(w, errors.New("error getting form data"))
-	// 	return
-	// }
-
-	// log.Println(msg)
-	// email := EmailForm{
-	// 	FirstName: msg.FirstName,
-	// 	LastName:  msg.LastName,
-	// 	Email:     msg.Email,
-	// 	Message:   msg.Message,
-	// }
+// clientIP returns the address of the caller without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// mailerTimeout is how long the email gateway has to answer
+const mailerTimeout = 10 * time.Second
+
+var mailerClient = &http.Client{Timeout: mailerTimeout}
+
+// postEmail hands an email to the gateway at -mailer-url, it is an error
+// unless the gateway answers 2xx
+func (app *application) postEmail(ctx context.Context, emailReq interface{}) error {
+	logger := logging.FromContext(ctx)
 
 	postBody, err := json.Marshal(emailReq)
 	if err != nil {
-		app.logger.Println("Error marshalling json")
-		return
+		logger.Error("error marshalling email json", "err", err)
+		return err
 	}
 	responseBody := bytes.NewBuffer(postBody)
 	//Leverage Go's HTTP Post function to make request
 	//resp, err := http.Post("http://localhost:7000/gateway/email/reset-password", "application/json", responseBody)
 
 	//A possible test email Test route if using an email service
-	resp, err := http.Post("http://localhost:7000/email/test", "application/json", responseBody)
+	ctx, span := tracing.StartKind(ctx, "HTTP POST email gateway", trace.SpanKindClient,
+		semconv.HTTPMethodKey.String(http.MethodPost),
+		semconv.HTTPURLKey.String(app.config.mailer.url),
+	)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, app.config.mailer.url, responseBody)
+	if err != nil {
+		logger.Error("error creating email gateway request", "err", err)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := mailerClient.Do(req)
 
 	//Handle Error
 	if err != nil {
-		app.logger.Println("Reset API has encountered an error or does not exist: ", err)
-		app.errorJSON(w, err, http.StatusNotFound)
-		return
+		tracing.RecordError(ctx, err)
+		logger.Error("reset API has encountered an error or does not exist", "err", err)
+		return err
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
 	//Read the response body
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		app.logger.Println(err)
-	}
-	sb := string(body)
-	app.logger.Print(sb)
-
-	type jsonResponse struct {
-		OK      bool   `json:"ok"`
-		Message string `json:"message"`
+		logger.Error("error reading email gateway response", "err", err)
 	}
+	logger.Debug("email gateway response", "status", resp.StatusCode, "body", string(body))
 
-	emailResp := jsonResponse{
-		OK:      true,
-		Message: "email sent",
-	}
-
-	err = app.writeJSON(w, http.StatusOK, emailResp, "response")
-	if err != nil {
-		app.errorJSON(w, errors.New("could not send forgot email response json"))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("email gateway answered %s", resp.Status)
+		tracing.RecordError(ctx, err)
+		return err
 	}
-
+	return nil
 }
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/webhooks"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// webhookBatch is how many deliveries the dispatcher claims and sends at once
+const webhookBatch = 10
+
+// WebhookRequest subscribes an endpoint to events
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// runWebhookDispatcher sends due deliveries on every tick until ctx ends
+func (app *application) runWebhookDispatcher(ctx context.Context) {
+	ticker := time.NewTicker(app.config.webhooks.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// keep going while there is a backlog
+		for !app.stopping() && app.dispatchWebhooks(ctx) == webhookBatch {
+		}
+	}
+}
+
+// dispatchWebhooks sends one batch of due deliveries and returns its size
+func (app *application) dispatchWebhooks(ctx context.Context) int {
+	// held long enough for the slowest endpoint to answer
+	lease := app.config.webhooks.timeout + time.Minute
+	due, err := app.db.DB.ClaimWebhookDeliveries(ctx, webhookBatch, lease)
+	if err != nil {
+		app.logger.Error("error claiming webhook deliveries", "err", err)
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range due {
+		wg.Add(1)
+		go func(d models.WebhookDelivery) {
+			defer wg.Done()
+			app.deliverWebhook(ctx, d)
+		}(d)
+	}
+	wg.Wait()
+
+	return len(due)
+}
+
+// deliverWebhook sends a delivery and records how it went, scheduling a retry
+// with exponential backoff or, after the last attempt, marking it dead
+func (app *application) deliverWebhook(ctx context.Context, d models.WebhookDelivery) {
+	status, err := app.webhooks.Send(ctx, d.URL, d.Secret, d.EventID, d.Payload)
+
+	var attemptErr string
+	var next time.Time
+	if err != nil {
+		attemptErr = err.Error()
+		if attempts := d.Attempts + 1; attempts < app.config.webhooks.maxAttempts {
+			next = time.Now().Add(webhooks.Backoff(attempts))
+		}
+		app.logger.Warn("webhook delivery failed", "delivery", d.ID, "endpoint", d.EndpointID,
+			"event", d.Event, "attempt", d.Attempts+1, "dead", next.IsZero(), "err", err)
+	}
+	webhookDeliveries.Inc(d.Event, deliveryOutcome(err, next))
+
+	// recorded even when the server is stopping, or the lease has to run out first
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = app.db.DB.RecordWebhookAttempt(ctx, d.ID, status, attemptErr, next); err != nil {
+		app.logger.Error("error recording webhook attempt", "delivery", d.ID, "err", err)
+	}
+}
+
+// deliveryOutcome labels an attempt for the deliveries metric
+func deliveryOutcome(err error, next time.Time) string {
+	switch {
+	case err == nil:
+		return models.DeliveryDelivered
+	case next.IsZero():
+		return models.DeliveryDead
+	default:
+		return "retry"
+	}
+}
+
+// CreateWebhook subscribes an endpoint of the admin's tenant to events. The
+// signing secret is only ever in this response.
+func (app *application) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var data WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		app.errorJSON(w, errors.New("error decoding webhook"))
+		return
+	}
+
+	endpoint := models.WebhookEndpoint{
+		TenantID: tenantFromContext(r).ID,
+		URL:      data.URL,
+	}
+
+	var err error
+	if endpoint.Events, err = app.validWebhook(data); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if endpoint.Secret, err = webhooks.NewSecret(); err != nil {
+		app.log(r).Error("error making webhook secret", "err", err)
+		app.errorJSON(w, errors.New("error creating webhook"), http.StatusInternalServerError)
+		return
+	}
+
+	endpoint.ID, err = app.db.DB.InsertWebhookEndpoint(r.Context(), endpoint)
+	app.audit(r, "webhook.create", 0, outcome(err), map[string]interface{}{"url": endpoint.URL, "events": endpoint.Events})
+	if err != nil {
+		app.log(r).Error("error creating webhook", "err", err)
+		app.errorJSON(w, errors.New("error creating webhook"), http.StatusInternalServerError)
+		return
+	}
+
+	endpoint.CreatedAt = time.Now()
+	app.writeJSON(w, http.StatusCreated, endpoint, "webhook")
+}
+
+// validWebhook checks a subscription and returns its events without duplicates
+func (app *application) validWebhook(data WebhookRequest) ([]string, error) {
+	u, err := url.Parse(data.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && app.config.env == "dev")) {
+		return nil, errors.New("url must be an https URL")
+	}
+	if len(data.Events) == 0 {
+		return nil, errors.New("events must name at least one event")
+	}
+
+	var events []string
+	seen := map[string]bool{}
+	for _, e := range data.Events {
+		if !validWebhookEvent(e) {
+			return nil, fmt.Errorf("unknown event %q", e)
+		}
+		if !seen[e] {
+			seen[e] = true
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func validWebhookEvent(event string) bool {
+	for _, e := range models.WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhooks lists the endpoints of the admin's tenant
+func (app *application) Webhooks(w http.ResponseWriter, r *http.Request) {
+	list, err := app.db.DB.TenantWebhookEndpoints(r.Context(), tenantFromContext(r).ID)
+	if err != nil {
+		app.errorJSON(w, errors.New("error listing webhooks"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, list, "webhooks")
+}
+
+// DeleteWebhook unsubscribes an endpoint of the admin's tenant, undelivered
+// events are dropped with its delivery log
+func (app *application) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid webhook id"))
+		return
+	}
+
+	err = app.db.DB.DeleteWebhookEndpoint(r.Context(), tenantFromContext(r).ID, id)
+	if errors.Is(err, repository.ErrNoRecord) {
+		app.errorJSON(w, errors.New("no webhook with this id"), http.StatusNotFound)
+		return
+	}
+	app.audit(r, "webhook.delete", 0, outcome(err), map[string]interface{}{"webhook": id})
+	if err != nil {
+		app.errorJSON(w, errors.New("error deleting webhook"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResp{OK: true, Message: "Webhook deleted"}, "response")
+}
+
+// WebhookDeliveries lets admins query the delivery log of their tenant. Results
+// are newest first, pass the returned nextBefore value as before to get the
+// next page.
+func (app *application) WebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var filter models.WebhookDeliveryFilter
+	var err error
+
+	ints := map[string]*int{
+		"webhook": &filter.EndpointID,
+		"limit":   &filter.Limit,
+	}
+	for name, dst := range ints {
+		if v := q.Get(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				app.errorJSON(w, errors.New("invalid "+name+" parameter"))
+				return
+			}
+		}
+	}
+
+	if v := q.Get("before"); v != "" {
+		if filter.Before, err = strconv.ParseInt(v, 10, 64); err != nil {
+			app.errorJSON(w, errors.New("invalid before parameter"))
+			return
+		}
+	}
+
+	filter.TenantID = tenantFromContext(r).ID
+	filter.Event = q.Get("event")
+	filter.Status = q.Get("status")
+
+	deliveries, err := app.db.DB.WebhookDeliveries(r.Context(), filter)
+	if err != nil {
+		app.log(r).Error("error querying webhook deliveries", "err", err)
+		app.errorJSON(w, errors.New("error querying webhook deliveries"))
+		return
+	}
+
+	type deliveryPage struct {
+		Deliveries []models.WebhookDelivery `json:"deliveries"`
+		NextBefore int64                    `json:"nextBefore,omitempty"`
+	}
+
+	page := deliveryPage{Deliveries: deliveries}
+	if len(deliveries) > 0 {
+		page.NextBefore = deliveries[len(deliveries)-1].ID
+	}
+
+	err = app.writeJSON(w, http.StatusOK, page, "deliveries")
+	if err != nil {
+		app.log(r).Error("error writing json", "err", err)
+		app.errorJSON(w, errors.New("error writing json"))
+	}
+}
+
+// ReplayWebhookDelivery sends a delivery of the admin's tenant again, as a new
+// delivery with the same event id and payload
+func (app *application) ReplayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("id"), 10, 64)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid delivery id"))
+		return
+	}
+
+	replay, err := app.db.DB.ReplayWebhookDelivery(r.Context(), tenantFromContext(r).ID, id)
+	if errors.Is(err, repository.ErrNoRecord) {
+		app.errorJSON(w, errors.New("no delivery with this id"), http.StatusNotFound)
+		return
+	}
+	app.audit(r, "webhook.replay", 0, outcome(err), map[string]interface{}{"delivery": id, "replay": replay})
+	if err != nil {
+		app.errorJSON(w, errors.New("error replaying delivery"), http.StatusInternalServerError)
+		return
+	}
+
+	type replayResp struct {
+		OK       bool  `json:"ok"`
+		Delivery int64 `json:"delivery"`
+	}
+	app.writeJSON(w, http.StatusAccepted, replayResp{OK: true, Delivery: replay}, "response")
+}
+
+// validWebhookConfig checks the dispatcher flags
+func validWebhookConfig(c config) error {
+	if c.webhooks.interval <= 0 || c.webhooks.timeout <= 0 {
+		return errors.New("webhook-interval and webhook-timeout must be positive")
+	}
+	if c.webhooks.maxAttempts < 1 {
+		return fmt.Errorf("webhook-max-attempts must be at least 1, got %d", c.webhooks.maxAttempts)
+	}
+	return nil
+}
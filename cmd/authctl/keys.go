@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// rotateKeys prints a new JWT secret, with the current one moved to the
+// previous secrets so tokens issued before the rotation keep working until
+// they expire. Only the last two earlier secrets are kept.
+func (c *ctl) rotateKeys(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	if len(c.keys.Current) == 0 {
+		return errors.New("no current secret, set -jwt-secret or AUTH_JWT_SECRET")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	previous := []string{string(c.keys.Current)}
+	for _, p := range c.keys.Previous {
+		if len(previous) == 2 {
+			break
+		}
+		previous = append(previous, string(p))
+	}
+
+	result := map[string]interface{}{
+		"jwt-secret":           hex.EncodeToString(b),
+		"jwt-previous-secrets": previous,
+	}
+	err := c.print(result, []string{"SETTING", "VALUE"}, [][]string{
+		{"jwt-secret", hex.EncodeToString(b)},
+		{"jwt-previous-secrets", strings.Join(previous, ",")},
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "set both on every replica, then drop the oldest previous secret once its tokens have expired")
+	return nil
+}
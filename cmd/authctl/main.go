@@ -0,0 +1,254 @@
+// Command authctl runs admin operations against the auth database directly,
+// for when there is no admin to use the HTTP API yet or the API is down.
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/tokens"
+	"auth/api/webhooks"
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+const usage = `usage: authctl [flags] <command> [command flags]
+
+commands:
+  tenants list
+  tenants create -slug S -name N [-host H]
+  users list
+  users create -name N -email E -username U [-password P] [-role user|admin] [-tenant S]
+  users passwd -id ID [-password P] [-keep-sessions]
+  users role -id ID -role user|admin
+  users suspend -id ID -reason R [-until 2006-01-02T15:04:05Z07:00 | -for 72h]
+  users restore -id ID [-reason R]
+  keys rotate
+  tokens issue -user ID [-ttl 1h] [-device D]
+  tokens decode TOKEN
+  tokens verify TOKEN
+
+Passwords not given with -password are read from the first line of stdin.
+
+flags:
+`
+
+// errUsage makes main print the usage and exit with 2
+var errUsage = errors.New("usage")
+
+// ctl is what every command needs
+type ctl struct {
+	dsn    string
+	keys   tokens.Keys
+	output string
+	out    io.Writer
+	in     io.Reader
+	db     repository.Repo
+	conn   *sql.DB
+}
+
+func main() {
+	c := &ctl{out: os.Stdout, in: os.Stdin}
+
+	var secret string
+	flag.StringVar(&c.dsn, "dsn", os.Getenv("AUTH_DSN"), "Postgres connection string, defaults to AUTH_DSN")
+	flag.StringVar(&secret, "jwt-secret", os.Getenv("AUTH_JWT_SECRET"), "JWT secret, defaults to AUTH_JWT_SECRET")
+	previous := flag.String("jwt-previous-secrets", os.Getenv("AUTH_JWT_PREVIOUS_SECRETS"), "Comma separated earlier JWT secrets, defaults to AUTH_JWT_PREVIOUS_SECRETS")
+	flag.StringVar(&c.output, "output", "table", "Output format: table or json")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	c.keys = tokens.NewKeys(secret, splitList(*previous))
+
+	// repository logs go to stderr, leaving stdout to the command output
+	logging.SetDefault(logging.New(os.Stderr, logging.LevelError))
+
+	err := c.run(flag.Args())
+	if c.conn != nil {
+		c.conn.Close()
+	}
+
+	switch {
+	case errors.Is(err, errUsage):
+		flag.Usage()
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "authctl:", err)
+		os.Exit(1)
+	}
+}
+
+func (c *ctl) run(args []string) error {
+	if c.output != "table" && c.output != "json" {
+		return fmt.Errorf("output must be table or json, got %q", c.output)
+	}
+	if len(args) < 2 {
+		return errUsage
+	}
+
+	commands := map[string]func([]string) error{
+		"tenants list":   c.listTenants,
+		"tenants create": c.createTenant,
+		"users list":     c.listUsers,
+		"users create":   c.createUser,
+		"users passwd":   c.setPassword,
+		"users role":     c.setRole,
+		"users suspend":  c.suspendUser,
+		"users restore":  c.restoreUser,
+		"keys rotate":    c.rotateKeys,
+		"tokens issue":   c.issueToken,
+		"tokens decode":  c.decodeToken,
+		"tokens verify":  c.verifyToken,
+	}
+
+	cmd, ok := commands[args[0]+" "+args[1]]
+	if !ok {
+		return errUsage
+	}
+	return cmd(args[2:])
+}
+
+// openDB connects on first use so commands that need no database work without one
+func (c *ctl) openDB() error {
+	if c.conn != nil {
+		return nil
+	}
+	if c.dsn == "" {
+		return errors.New("no database, set -dsn or AUTH_DSN")
+	}
+
+	db, err := sql.Open("postgres", c.dsn)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return err
+	}
+
+	c.conn = db
+	c.db = repository.NewRepo(db)
+	return nil
+}
+
+// audit records an operator action in the audit trail, authctl has no actor
+func (c *ctl) audit(ctx context.Context, action string, subjectID int, err error, metadata map[string]interface{}) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadata["via"] = "authctl"
+
+	event := models.AuditEvent{
+		OccurredAt: time.Now(),
+		SubjectID:  subjectID,
+		Action:     action,
+		Outcome:    outcome,
+		UserAgent:  "authctl",
+		Metadata:   metadata,
+	}
+	// the event belongs to the tenant of the user acted on
+	if subjectID != 0 {
+		if u, lookupErr := c.db.DB.GetUserById(ctx, subjectID); lookupErr == nil {
+			event.TenantID = u.TenantID
+		}
+	}
+	if auditErr := c.db.DB.InsertAuditEvent(ctx, event); auditErr != nil {
+		fmt.Fprintln(os.Stderr, "authctl: audit event not stored:", auditErr)
+	}
+}
+
+// outboxEvent returns the message queueing an event for the endpoints of a
+// tenant, to be written with the change it reports as the API does
+func (c *ctl) outboxEvent(ctx context.Context, tenantID int, eventType string, data map[string]interface{}) []models.OutboxMessage {
+	msg, err := func() (models.OutboxMessage, error) {
+		t, err := c.db.DB.GetTenant(ctx, tenantID)
+		if err != nil {
+			return models.OutboxMessage{}, err
+		}
+		event, err := webhooks.NewEvent(eventType, t.Slug, data)
+		if err != nil {
+			return models.OutboxMessage{}, err
+		}
+		return event.Outbox(t.ID)
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "authctl: webhook event not queued:", err)
+		return nil
+	}
+	return []models.OutboxMessage{msg}
+}
+
+// print writes v as indented JSON, or as a table with one row per entry of rows
+func (c *ctl) print(v interface{}, header []string, rows [][]string) error {
+	if c.output == "json" {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "\t")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// readPassword returns the flag value or the first line of stdin
+func (c *ctl) readPassword(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+
+	line, err := bufio.NewReader(c.in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("no password given on -password or stdin")
+	}
+	return password, nil
+}
+
+// formatTime renders a time for tables, blank when unset
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// splitList splits a comma separated flag value, ignoring blanks
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
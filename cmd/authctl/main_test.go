@@ -0,0 +1,162 @@
+package main
+
+import (
+	"auth/api/logging"
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/tokens"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testSecret = "a-test-secret-of-at-least-32-bytes"
+
+var testTenant = models.Tenant{ID: 1, Slug: "acme", Name: "Acme", CreatedAt: time.Now()}
+
+func TestMain(m *testing.M) {
+	logging.SetDefault(logging.New(ioutil.Discard, logging.LevelError))
+	os.Exit(m.Run())
+}
+
+// newTestCtl returns a ctl on a mocked database printing JSON to out
+func newTestCtl(t *testing.T) (*ctl, sqlmock.Sqlmock, *bytes.Buffer) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	out := &bytes.Buffer{}
+	c := &ctl{
+		keys:   tokens.NewKeys(testSecret, nil),
+		output: "json",
+		out:    out,
+		in:     strings.NewReader(""),
+		conn:   db,
+		db:     repository.NewRepo(db),
+	}
+	return c, mock, out
+}
+
+// expectUser expects GetUserById to find the user
+func expectUser(mock sqlmock.Sqlmock, u models.User) {
+	mock.ExpectQuery(`FROM users where id`).WithArgs(u.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "name", "email", "username", "role", "status",
+			"status_reason", "suspended_until", "created_at", "updated_at", "phone", "phone_verified_at", "sms_mfa"}).
+			AddRow(u.ID, u.TenantID, u.Name, u.Email, u.UserName, u.Role, u.Status,
+				u.StatusReason, nil, u.CreatedAt, u.UpdatedAt, u.Phone, nil, u.SMSMFA))
+}
+
+// expectTenant expects GetTenant to find the tenant
+func expectTenant(mock sqlmock.Sqlmock, tenant models.Tenant) {
+	mock.ExpectQuery(`FROM tenants where id`).WithArgs(tenant.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "name", "host", "created_at"}).
+			AddRow(tenant.ID, tenant.Slug, tenant.Name, tenant.Host, tenant.CreatedAt))
+}
+
+// expectAudit expects the operator action to be recorded for the user
+func expectAudit(mock sqlmock.Sqlmock, u models.User, action, outcome string) {
+	expectUser(mock, u)
+	mock.ExpectBegin()
+	mock.ExpectExec(`pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`select hash from audit_events`).WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+	mock.ExpectQuery(`nextval`).WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(1))
+	mock.ExpectExec(`INSERT INTO audit_events`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), int64(u.TenantID), nil, int64(u.ID), action, outcome,
+			"", "authctl", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestRunUsage(t *testing.T) {
+	c, _, _ := newTestCtl(t)
+
+	for _, args := range [][]string{nil, {"users"}, {"users", "delete"}, {"users", "suspend", "-id", "7"}, {"users", "list", "extra"}} {
+		if err := c.run(args); !errors.Is(err, errUsage) {
+			t.Errorf("%q: got %v, want the usage", args, err)
+		}
+	}
+
+	c.output = "yaml"
+	if err := c.run([]string{"users", "list"}); err == nil || errors.Is(err, errUsage) {
+		t.Errorf("got %v for an unknown output format", err)
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	c, _, out := newTestCtl(t)
+	c.keys = tokens.NewKeys(testSecret, []string{"previous-secret-of-at-least-32-bytes", "oldest-secret-of-at-least-32-bytes"})
+
+	if err := c.run([]string{"keys", "rotate"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Secret   string   `json:"jwt-secret"`
+		Previous []string `json:"jwt-previous-secrets"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Secret) != 64 || result.Secret == testSecret {
+		t.Errorf("got new secret %q", result.Secret)
+	}
+	// the current secret is kept, the oldest dropped
+	want := []string{testSecret, "previous-secret-of-at-least-32-bytes"}
+	if strings.Join(result.Previous, ",") != strings.Join(want, ",") {
+		t.Errorf("got previous secrets %v, want %v", result.Previous, want)
+	}
+}
+
+func TestCreateTenant(t *testing.T) {
+	c, mock, out := newTestCtl(t)
+
+	if err := c.run([]string{"tenants", "create", "-slug", "Acme Corp", "-name", "Acme"}); err == nil {
+		t.Error("a slug with spaces and capitals was accepted")
+	}
+
+	mock.ExpectQuery(`INSERT INTO tenants`).WithArgs("acme", "Acme", "auth.acme.test").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	if err := c.run([]string{"tenants", "create", "-slug", "acme", "-name", "Acme", "-host", "Auth.Acme.Test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tenant models.Tenant
+	if err := json.Unmarshal(out.Bytes(), &tenant); err != nil {
+		t.Fatal(err)
+	}
+	if tenant.ID != 3 || tenant.Host != "auth.acme.test" {
+		t.Errorf("got %+v", tenant)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadPassword(t *testing.T) {
+	c, _, _ := newTestCtl(t)
+
+	if p, err := c.readPassword("from-flag"); err != nil || p != "from-flag" {
+		t.Errorf("got %q, %v", p, err)
+	}
+
+	c.in = strings.NewReader("from-stdin\r\nignored\n")
+	if p, err := c.readPassword(""); err != nil || p != "from-stdin" {
+		t.Errorf("got %q, %v", p, err)
+	}
+
+	c.in = strings.NewReader("\n")
+	if _, err := c.readPassword(""); err == nil {
+		t.Error("an empty password was accepted")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"auth/api/models"
+	"context"
+	"errors"
+	"flag"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// validSlug keeps tenant slugs usable in paths, headers and host names
+var validSlug = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+func (c *ctl) listTenants(args []string) error {
+	if err := c.parseCommand(flag.NewFlagSet("tenants list", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	tenants, err := c.db.DB.AllTenants(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(tenants))
+	for _, t := range tenants {
+		rows = append(rows, []string{strconv.Itoa(t.ID), t.Slug, t.Name, t.Host, formatTime(t.CreatedAt)})
+	}
+
+	return c.print(tenants, []string{"ID", "SLUG", "NAME", "HOST", "CREATED"}, rows)
+}
+
+func (c *ctl) createTenant(args []string) error {
+	var t models.Tenant
+	fs := flag.NewFlagSet("tenants create", flag.ContinueOnError)
+	fs.StringVar(&t.Slug, "slug", "", "")
+	fs.StringVar(&t.Name, "name", "", "")
+	fs.StringVar(&t.Host, "host", "", "")
+	if err := c.parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	if t.Slug == "" || t.Name == "" {
+		return errUsage
+	}
+	if !validSlug.MatchString(t.Slug) {
+		return errors.New("slug may only hold lower case letters, digits and dashes")
+	}
+	t.Host = strings.ToLower(t.Host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	var err error
+	if t.ID, err = c.db.DB.InsertTenant(ctx, t); err != nil {
+		return err
+	}
+
+	return c.print(t, []string{"ID", "SLUG", "NAME", "HOST"}, [][]string{{strconv.Itoa(t.ID), t.Slug, t.Name, t.Host}})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/tokens"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (c *ctl) issueToken(args []string) error {
+	fs := flag.NewFlagSet("tokens issue", flag.ContinueOnError)
+	userID := fs.Int("user", 0, "")
+	ttl := fs.Duration("ttl", time.Hour, "")
+	device := fs.String("device", "authctl", "")
+	if err := c.parseCommand(fs, args); err != nil {
+		return err
+	}
+	if *userID <= 0 || *ttl <= 0 {
+		return errUsage
+	}
+	if len(c.keys.Current) == 0 {
+		return errors.New("no secret, set -jwt-secret or AUTH_JWT_SECRET")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	u, err := c.db.DB.GetUserById(ctx, *userID)
+	if err != nil {
+		return noUser(err)
+	}
+	if err = repository.CheckAccountStatus(u); err != nil {
+		return fmt.Errorf("account is %s", u.Status)
+	}
+	tenant, err := c.db.DB.GetTenant(ctx, u.TenantID)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(*ttl)
+	sessionID, err := c.db.DB.CreateSession(ctx, models.Session{
+		UserID:    u.ID,
+		Device:    *device,
+		UserAgent: "authctl",
+		ExpiresAt: expires,
+	})
+	if err != nil {
+		return err
+	}
+
+	token, err := tokens.Sign(c.keys, tokens.Grant{
+		UserID:    u.ID,
+		Tenant:    tenant.Slug,
+		SessionID: sessionID,
+		Expires:   expires,
+	})
+	c.audit(ctx, "token.issue", u.ID, err, map[string]interface{}{"session": sessionID, "ttl": ttl.String()})
+	if err != nil {
+		return err
+	}
+
+	result := map[string]interface{}{"token": string(token), "session": sessionID, "expires": expires}
+	return c.print(result, []string{"SESSION", "EXPIRES", "TOKEN"}, [][]string{{sessionID, formatTime(expires), string(token)}})
+}
+
+// tokenInfo is what decode and verify report about a token
+type tokenInfo struct {
+	Valid     bool       `json:"valid"`
+	Reason    string     `json:"reason,omitempty"`
+	Subject   string     `json:"subject"`
+	Tenant    string     `json:"tenant"`
+	Session   string     `json:"session"`
+	Actor     string     `json:"actor,omitempty"`
+	Issuer    string     `json:"issuer"`
+	Audiences []string   `json:"audiences"`
+	Issued    *time.Time `json:"issued,omitempty"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+func (t tokenInfo) rows() [][]string {
+	opt := func(tm *time.Time) string {
+		if tm == nil {
+			return ""
+		}
+		return formatTime(*tm)
+	}
+	rows := [][]string{
+		{"subject", t.Subject},
+		{"tenant", t.Tenant},
+		{"session", t.Session},
+		{"actor", t.Actor},
+		{"issuer", t.Issuer},
+		{"audiences", strings.Join(t.Audiences, ",")},
+		{"issued", opt(t.Issued)},
+		{"not before", opt(t.NotBefore)},
+		{"expires", opt(t.Expires)},
+	}
+	return rows
+}
+
+// actorSubject returns who the actor claim says acts as the subject, empty
+// when the token has none
+func actorSubject(set map[string]interface{}) string {
+	act, _ := set[tokens.ActorClaim].(map[string]interface{})
+	sub, _ := act["sub"].(string)
+	return sub
+}
+
+// tokenArg returns the one token argument
+func tokenArg(args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	return []byte(strings.TrimPrefix(args[0], "Bearer ")), nil
+}
+
+// decodeToken prints the claims of a token without checking anything
+func (c *ctl) decodeToken(args []string) error {
+	token, err := tokenArg(args)
+	if err != nil {
+		return err
+	}
+
+	claims, err := tokens.Decode(token)
+	if err != nil {
+		return fmt.Errorf("not a JWT: %v", err)
+	}
+
+	tenant, _ := claims.String(tokens.TenantClaim)
+	info := tokenInfo{
+		Subject:   claims.Subject,
+		Tenant:    tenant,
+		Session:   claims.ID,
+		Actor:     actorSubject(claims.Set),
+		Issuer:    claims.Issuer,
+		Audiences: claims.Audiences,
+	}
+	if claims.Issued != nil {
+		t := claims.Issued.Time()
+		info.Issued = &t
+	}
+	if claims.NotBefore != nil {
+		t := claims.NotBefore.Time()
+		info.NotBefore = &t
+	}
+	if claims.Expires != nil {
+		t := claims.Expires.Time()
+		info.Expires = &t
+	}
+
+	return c.print(info, []string{"CLAIM", "VALUE"}, info.rows())
+}
+
+// verifyToken checks a token the way the server does: signature, registered
+// claims, user status and session. It fails when the token would be refused.
+func (c *ctl) verifyToken(args []string) error {
+	token, err := tokenArg(args)
+	if err != nil {
+		return err
+	}
+	if len(c.keys.Current) == 0 {
+		return errors.New("no secret, set -jwt-secret or AUTH_JWT_SECRET")
+	}
+
+	info := tokenInfo{Valid: true}
+	claims, grant, err := tokens.Check(c.keys, token)
+	if claims != nil {
+		info.Subject, info.Session, info.Issuer, info.Audiences = claims.Subject, claims.ID, claims.Issuer, claims.Audiences
+		info.Tenant, _ = claims.String(tokens.TenantClaim)
+		info.Actor = actorSubject(claims.Set)
+		if claims.Expires != nil {
+			t := claims.Expires.Time()
+			info.Expires = &t
+		}
+	}
+	if err != nil {
+		info.Valid, info.Reason = false, err.Error()
+	} else if info.Reason = c.checkTokenSession(grant); info.Reason != "" {
+		info.Valid = false
+	}
+
+	rows := append([][]string{{"valid", strconv.FormatBool(info.Valid)}, {"reason", info.Reason}}, info.rows()...)
+	if err = c.print(info, []string{"CHECK", "VALUE"}, rows); err != nil {
+		return err
+	}
+	if !info.Valid {
+		return errors.New("token is not valid")
+	}
+	return nil
+}
+
+// checkTokenSession returns why the user or session would be refused, empty when they are fine
+func (c *ctl) checkTokenSession(g tokens.Grant) string {
+	if err := c.openDB(); err != nil {
+		return "cannot check user and session: " + err.Error()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	u, err := c.db.DB.GetUserById(ctx, g.UserID)
+	if err != nil {
+		return "no user with this id"
+	}
+	if tenant, err := c.db.DB.GetTenant(ctx, u.TenantID); err != nil || tenant.Slug != g.Tenant {
+		return "user is not in the token's tenant"
+	}
+	if err = repository.CheckAccountStatus(u); err != nil {
+		return "account is " + u.Status
+	}
+
+	s, err := c.db.DB.GetSession(ctx, g.SessionID)
+	switch {
+	case err != nil || s.UserID != u.ID || s.ActorID != g.ActorID:
+		return "unknown session"
+	case !s.RevokedAt.IsZero():
+		return "session revoked"
+	case time.Now().After(s.ExpiresAt):
+		return "session expired"
+	}
+
+	if g.ActorID != 0 {
+		actor, err := c.db.DB.GetUserById(ctx, g.ActorID)
+		if err != nil || repository.CheckImpersonation(actor, u) != nil {
+			return "impersonation no longer allowed"
+		}
+	}
+	return ""
+}
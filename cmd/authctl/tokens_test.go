@@ -0,0 +1,111 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/tokens"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestVerifyToken(t *testing.T) {
+	user := models.User{ID: 7, TenantID: testTenant.ID, Name: "Ada", Email: "ada@example.com", Role: models.RoleUser, Status: models.StatusActive}
+	token, err := tokens.Sign(tokens.NewKeys(testSecret, nil), tokens.Grant{
+		UserID: user.ID, Tenant: testTenant.Slug, SessionID: "s1", Expires: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		revoked interface{}
+		expires time.Time
+		reason  string
+	}{
+		{name: "valid", expires: time.Now().Add(time.Hour)},
+		{name: "revoked", revoked: time.Now(), expires: time.Now().Add(time.Hour), reason: "session revoked"},
+		{name: "expired", expires: time.Now().Add(-time.Minute), reason: "session expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mock, out := newTestCtl(t)
+			expectUser(mock, user)
+			expectTenant(mock, testTenant)
+			mock.ExpectQuery(`FROM sessions where id`).WithArgs("s1").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "device", "user_agent", "ip", "created_at",
+					"last_seen_at", "expires_at", "revoked_at", "actor_id"}).
+					AddRow("s1", user.ID, "authctl", "", "", time.Now(), time.Now(), tt.expires, tt.revoked, nil))
+
+			err := c.run([]string{"tokens", "verify", "Bearer " + string(token)})
+			if (err == nil) != (tt.reason == "") {
+				t.Errorf("got %v", err)
+			}
+
+			var info tokenInfo
+			if err = json.Unmarshal(out.Bytes(), &info); err != nil {
+				t.Fatal(err)
+			}
+			if info.Valid != (tt.reason == "") || info.Reason != tt.reason || info.Subject != "7" || info.Tenant != "acme" {
+				t.Errorf("got %+v", info)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenSignature(t *testing.T) {
+	c, mock, out := newTestCtl(t)
+	token, err := tokens.Sign(tokens.NewKeys("another-secret-of-at-least-32-bytes", nil), tokens.Grant{
+		UserID: 7, Tenant: testTenant.Slug, SessionID: "s1", Expires: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is looked up for a token signed with another key
+	if err = c.run([]string{"tokens", "verify", string(token)}); err == nil {
+		t.Error("a token signed with another key was valid")
+	}
+	var info tokenInfo
+	if err = json.Unmarshal(out.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Valid || info.Reason != tokens.ErrSignature.Error() {
+		t.Errorf("got %+v", info)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeToken(t *testing.T) {
+	c, _, out := newTestCtl(t)
+	// decoding needs no key
+	token, err := tokens.Sign(tokens.NewKeys("another-secret-of-at-least-32-bytes", nil), tokens.Grant{
+		UserID: 7, Tenant: testTenant.Slug, SessionID: "s1", Expires: time.Now().Add(time.Hour), ActorID: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.run([]string{"tokens", "decode", string(token)}); err != nil {
+		t.Fatal(err)
+	}
+	var info tokenInfo
+	if err = json.Unmarshal(out.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Subject != "7" || info.Tenant != "acme" || info.Session != "s1" || info.Actor != "2" || info.Expires == nil {
+		t.Errorf("got %+v", info)
+	}
+
+	if err = c.run([]string{"tokens", "decode", "not-a-token"}); err == nil {
+		t.Error("a malformed token was decoded")
+	}
+}
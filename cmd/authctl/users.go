@@ -0,0 +1,268 @@
+package main
+
+import (
+	"auth/api/models"
+	"auth/api/repository"
+	"auth/api/tokens"
+	"auth/api/webhooks"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// commandTimeout bounds every command's database work
+const commandTimeout = 30 * time.Second
+
+// parseCommand parses a command's flags and opens the database
+func (c *ctl) parseCommand(fs *flag.FlagSet, args []string) error {
+	fs.Usage = func() {}
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	return c.openDB()
+}
+
+func (c *ctl) listUsers(args []string) error {
+	if err := c.parseCommand(flag.NewFlagSet("users list", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	users, err := c.db.DB.AllUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if users == nil {
+		users = []*models.User{}
+	}
+
+	rows := make([][]string, 0, len(users))
+	for _, u := range users {
+		rows = append(rows, []string{
+			strconv.Itoa(u.ID), strconv.Itoa(u.TenantID), u.UserName, u.Email, u.Name, u.Role, u.Status,
+			formatTime(u.SuspendedUntil), formatTime(u.CreatedAt),
+		})
+	}
+
+	return c.print(users, []string{"ID", "TENANT", "USERNAME", "EMAIL", "NAME", "ROLE", "STATUS", "SUSPENDED UNTIL", "CREATED"}, rows)
+}
+
+func (c *ctl) createUser(args []string) error {
+	var u models.User
+	fs := flag.NewFlagSet("users create", flag.ContinueOnError)
+	fs.StringVar(&u.Name, "name", "", "")
+	fs.StringVar(&u.Email, "email", "", "")
+	fs.StringVar(&u.UserName, "username", "", "")
+	password := fs.String("password", "", "")
+	role := fs.String("role", models.RoleUser, "")
+	tenant := fs.String("tenant", tokens.DefaultTenant, "")
+	if err := c.parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	if u.Name == "" || u.Email == "" || u.UserName == "" {
+		return errUsage
+	}
+	if *role != models.RoleUser && *role != models.RoleAdmin {
+		return fmt.Errorf("unknown role %q", *role)
+	}
+
+	var err error
+	if u.Password, err = c.readPassword(*password); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	t, err := c.db.DB.GetTenantBySlug(ctx, *tenant)
+	if err != nil {
+		return fmt.Errorf("no tenant %q", *tenant)
+	}
+	u.TenantID = t.ID
+
+	// the role the user is left with once the command is done
+	u.Role = *role
+	registered := c.outboxEvent(ctx, t.ID, models.EventUserRegistered, map[string]interface{}{"user": webhooks.UserData(u), "method": "authctl"})
+
+	u.ID, err = c.db.DB.InsertUser(ctx, u, registered...)
+	if err != nil {
+		return err
+	}
+	c.audit(ctx, "auth.register", u.ID, nil, nil)
+
+	if *role != models.RoleUser {
+		_, err = c.db.DB.SetUserRole(ctx, u.ID, *role)
+		c.audit(ctx, "user.role_change", u.ID, err, map[string]interface{}{"from": models.RoleUser, "to": *role})
+		if err != nil {
+			return err
+		}
+	}
+
+	if u, err = c.db.DB.GetUserById(ctx, u.ID); err != nil {
+		return err
+	}
+	return c.print(u, []string{"ID", "TENANT", "USERNAME", "ROLE"}, [][]string{{strconv.Itoa(u.ID), t.Slug, u.UserName, u.Role}})
+}
+
+func (c *ctl) setPassword(args []string) error {
+	fs := flag.NewFlagSet("users passwd", flag.ContinueOnError)
+	id := fs.Int("id", 0, "")
+	password := fs.String("password", "", "")
+	keepSessions := fs.Bool("keep-sessions", false, "")
+	if err := c.parseCommand(fs, args); err != nil {
+		return err
+	}
+	if *id <= 0 {
+		return errUsage
+	}
+
+	newPassword, err := c.readPassword(*password)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	u, err := c.db.DB.GetUserById(ctx, *id)
+	if err != nil {
+		return noUser(err)
+	}
+
+	err = c.db.DB.ChangePassword(ctx, *id, newPassword,
+		c.outboxEvent(ctx, u.TenantID, models.EventUserPasswordChanged, map[string]interface{}{"user": webhooks.UserData(u), "method": "authctl"})...)
+	c.audit(ctx, "user.password_set", *id, err, nil)
+	if err != nil {
+		return err
+	}
+
+	var revoked int64
+	if !*keepSessions {
+		// nobody is signed in through authctl, so every session goes
+		if revoked, err = c.db.DB.RevokeOtherSessions(ctx, *id, ""); err != nil {
+			return err
+		}
+	}
+
+	result := map[string]interface{}{"userId": *id, "revokedSessions": revoked}
+	return c.print(result, []string{"ID", "REVOKED SESSIONS"}, [][]string{{strconv.Itoa(*id), strconv.FormatInt(revoked, 10)}})
+}
+
+func (c *ctl) setRole(args []string) error {
+	fs := flag.NewFlagSet("users role", flag.ContinueOnError)
+	id := fs.Int("id", 0, "")
+	role := fs.String("role", "", "")
+	if err := c.parseCommand(fs, args); err != nil {
+		return err
+	}
+	if *id <= 0 || *role == "" {
+		return errUsage
+	}
+	if *role != models.RoleUser && *role != models.RoleAdmin {
+		return fmt.Errorf("unknown role %q", *role)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	from, err := c.db.DB.SetUserRole(ctx, *id, *role)
+	c.audit(ctx, "user.role_change", *id, err, map[string]interface{}{"from": from, "to": *role})
+	if err != nil {
+		return noUser(err)
+	}
+
+	return c.printStatusChange(*id, "role", from, *role)
+}
+
+func (c *ctl) suspendUser(args []string) error {
+	fs := flag.NewFlagSet("users suspend", flag.ContinueOnError)
+	id := fs.Int("id", 0, "")
+	reason := fs.String("reason", "", "")
+	until := fs.String("until", "", "")
+	duration := fs.Duration("for", 0, "")
+	if err := c.parseCommand(fs, args); err != nil {
+		return err
+	}
+	if *id <= 0 || *reason == "" || (*until != "" && *duration != 0) {
+		return errUsage
+	}
+
+	var end time.Time
+	switch {
+	case *until != "":
+		var err error
+		if end, err = time.Parse(time.RFC3339, *until); err != nil {
+			return fmt.Errorf("until must be an RFC 3339 time: %v", err)
+		}
+	case *duration > 0:
+		end = time.Now().Add(*duration)
+	}
+
+	return c.changeStatus(*id, models.StatusSuspended, *reason, end)
+}
+
+func (c *ctl) restoreUser(args []string) error {
+	fs := flag.NewFlagSet("users restore", flag.ContinueOnError)
+	id := fs.Int("id", 0, "")
+	reason := fs.String("reason", "restored with authctl", "")
+	if err := c.parseCommand(fs, args); err != nil {
+		return err
+	}
+	if *id <= 0 {
+		return errUsage
+	}
+
+	return c.changeStatus(*id, models.StatusActive, *reason, time.Time{})
+}
+
+func (c *ctl) changeStatus(id int, status, reason string, until time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	metadata := map[string]interface{}{"to": status, "reason": reason}
+	if !until.IsZero() {
+		metadata["until"] = until
+	}
+
+	u, err := c.db.DB.GetUserById(ctx, id)
+	if err != nil {
+		return noUser(err)
+	}
+	event := map[string]interface{}{"user": webhooks.UserData(models.User{ID: id}), "to": status, "reason": reason}
+	if !until.IsZero() {
+		event["until"] = until
+	}
+
+	from, err := c.db.DB.SetUserStatus(ctx, id, status, reason, until,
+		c.outboxEvent(ctx, u.TenantID, webhooks.StatusEvent(status), event)...)
+	metadata["from"] = from
+	c.audit(ctx, "user.status_change", id, err, metadata)
+	if errors.Is(err, repository.ErrInvalidTransition) {
+		return fmt.Errorf("cannot change account from %s to %s", from, status)
+	}
+	if err != nil {
+		return noUser(err)
+	}
+
+	return c.printStatusChange(id, "status", from, status)
+}
+
+func (c *ctl) printStatusChange(id int, field, from, to string) error {
+	result := map[string]interface{}{"userId": id, "field": field, "from": from, "to": to}
+	return c.print(result, []string{"ID", "FIELD", "FROM", "TO"}, [][]string{{strconv.Itoa(id), field, from, to}})
+}
+
+// noUser turns a missing row into a readable error
+func noUser(err error) error {
+	if errors.Is(err, repository.ErrNoRecord) || errors.Is(err, sql.ErrNoRows) {
+		return errors.New("no user with this id")
+	}
+	return err
+}
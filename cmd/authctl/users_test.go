@@ -0,0 +1,73 @@
+package main
+
+import (
+	"auth/api/models"
+	"encoding/json"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSuspendUser(t *testing.T) {
+	c, mock, out := newTestCtl(t)
+	user := models.User{ID: 7, TenantID: testTenant.ID, Name: "Ada", Email: "ada@example.com", Role: models.RoleUser, Status: models.StatusActive}
+
+	expectUser(mock, user)
+	expectTenant(mock, testTenant)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select status, erased_at is not null from users where id = \$1`).WithArgs(user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "erased"}).AddRow(models.StatusActive, false))
+	mock.ExpectExec(`update\s+users\s+set\s+status = \$1`).
+		WithArgs(models.StatusSuspended, "chargeback", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), user.ID, models.StatusActive).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// the webhook event is queued with the change
+	mock.ExpectExec(`INSERT INTO outbox`).WithArgs("event", int64(testTenant.ID), sqlmock.AnyArg(), int64(0), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectAudit(mock, user, "user.status_change", "success")
+
+	if err := c.run([]string{"users", "suspend", "-id", "7", "-reason", "chargeback", "-for", "24h"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result["from"] != models.StatusActive || result["to"] != models.StatusSuspended {
+		t.Errorf("got %v", result)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRestoreErasedUser(t *testing.T) {
+	c, mock, _ := newTestCtl(t)
+	user := models.User{ID: 7, TenantID: testTenant.ID, Role: models.RoleUser, Status: models.StatusDeleted}
+
+	expectUser(mock, user)
+	expectTenant(mock, testTenant)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select status, erased_at is not null from users`).WithArgs(user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "erased"}).AddRow(models.StatusDeleted, true))
+	mock.ExpectRollback()
+	expectAudit(mock, user, "user.status_change", "failure")
+
+	if err := c.run([]string{"users", "restore", "-id", "7"}); err == nil {
+		t.Error("an erased account was restored")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnknownUser(t *testing.T) {
+	c, mock, _ := newTestCtl(t)
+	mock.ExpectQuery(`FROM users where id`).WithArgs(9).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	err := c.run([]string{"users", "restore", "-id", "9"})
+	if err == nil || err.Error() != "no user with this id" {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+ALTER TABLE users
+	DROP CONSTRAINT IF EXISTS users_status_check,
+	DROP COLUMN IF EXISTS status_changed_at,
+	DROP COLUMN IF EXISTS suspended_until,
+	DROP COLUMN IF EXISTS status_reason,
+	DROP COLUMN IF EXISTS status,
+	DROP COLUMN IF EXISTS role;
@@ -0,0 +1,12 @@
+ALTER TABLE users
+	ADD COLUMN role varchar NOT NULL DEFAULT 'user',
+	ADD COLUMN status varchar NOT NULL DEFAULT 'active',
+	ADD COLUMN status_reason varchar NOT NULL DEFAULT '',
+	ADD COLUMN suspended_until timestamptz DEFAULT NULL,
+	ADD COLUMN status_changed_at timestamptz DEFAULT NULL;
+
+UPDATE users SET status = 'deleted' WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE users
+	ADD CONSTRAINT users_status_check
+	CHECK (status IN ('active', 'suspended', 'deactivated', 'deleted'));
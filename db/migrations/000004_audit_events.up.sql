@@ -0,0 +1,31 @@
+CREATE TABLE audit_events (
+	id bigserial PRIMARY KEY,
+	occurred_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	actor_id bigint REFERENCES users (id),
+	subject_id bigint REFERENCES users (id),
+	action varchar NOT NULL,
+	outcome varchar NOT NULL,
+	ip varchar NOT NULL DEFAULT '',
+	user_agent varchar NOT NULL DEFAULT '',
+	metadata jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX audit_events_occurred_at_idx ON audit_events (occurred_at);
+CREATE INDEX audit_events_actor_id_idx ON audit_events (actor_id);
+CREATE INDEX audit_events_subject_id_idx ON audit_events (subject_id);
+CREATE INDEX audit_events_action_idx ON audit_events (action);
+
+-- The audit trail is append only
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_events is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_no_update
+	BEFORE UPDATE OR DELETE ON audit_events
+	FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate
+	BEFORE TRUNCATE ON audit_events
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
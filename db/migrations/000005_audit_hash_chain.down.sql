@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS audit_checkpoints;
+
+ALTER TABLE audit_events DISABLE TRIGGER audit_events_no_update;
+ALTER TABLE audit_events
+	DROP COLUMN IF EXISTS hash,
+	DROP COLUMN IF EXISTS prev_hash;
+ALTER TABLE audit_events ENABLE TRIGGER audit_events_no_update;
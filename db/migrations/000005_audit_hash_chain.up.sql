@@ -0,0 +1,20 @@
+-- Events written before hash chaining keep an empty hash
+ALTER TABLE audit_events
+	ADD COLUMN prev_hash varchar NOT NULL DEFAULT '',
+	ADD COLUMN hash varchar NOT NULL DEFAULT '';
+
+CREATE TABLE audit_checkpoints (
+	id bigserial PRIMARY KEY,
+	event_id bigint NOT NULL REFERENCES audit_events (id),
+	event_hash varchar NOT NULL,
+	signature varchar NOT NULL,
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE TRIGGER audit_checkpoints_no_update
+	BEFORE UPDATE OR DELETE ON audit_checkpoints
+	FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+CREATE TRIGGER audit_checkpoints_no_truncate
+	BEFORE TRUNCATE ON audit_checkpoints
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
@@ -0,0 +1,13 @@
+CREATE TABLE sessions (
+	id varchar PRIMARY KEY,
+	user_id bigint NOT NULL REFERENCES users (id),
+	device varchar NOT NULL DEFAULT '',
+	user_agent varchar NOT NULL DEFAULT '',
+	ip varchar NOT NULL DEFAULT '',
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	last_seen_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	expires_at timestamptz NOT NULL,
+	revoked_at timestamptz DEFAULT NULL
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
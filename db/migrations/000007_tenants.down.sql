@@ -0,0 +1,10 @@
+-- Fails when two tenants share an email or username, merge them first
+ALTER TABLE users
+	DROP CONSTRAINT users_tenant_email_key,
+	DROP CONSTRAINT users_tenant_username_key,
+	ADD CONSTRAINT users_email_key UNIQUE (email),
+	ADD CONSTRAINT users_username_key UNIQUE (username);
+
+ALTER TABLE users DROP COLUMN tenant_id;
+
+DROP TABLE tenants;
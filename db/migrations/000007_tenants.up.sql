@@ -0,0 +1,21 @@
+CREATE TABLE tenants (
+	id bigserial PRIMARY KEY,
+	slug varchar NOT NULL UNIQUE,
+	name varchar NOT NULL,
+	host varchar UNIQUE,
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+-- Everything that exists today belongs to the default tenant
+INSERT INTO tenants (slug, name) VALUES ('default', 'Default');
+
+ALTER TABLE users ADD COLUMN tenant_id bigint REFERENCES tenants (id);
+UPDATE users SET tenant_id = (SELECT id FROM tenants WHERE slug = 'default');
+ALTER TABLE users ALTER COLUMN tenant_id SET NOT NULL;
+
+-- Emails and usernames are only unique within a tenant
+ALTER TABLE users
+	DROP CONSTRAINT users_email_key,
+	DROP CONSTRAINT users_username_key,
+	ADD CONSTRAINT users_tenant_email_key UNIQUE (tenant_id, email),
+	ADD CONSTRAINT users_tenant_username_key UNIQUE (tenant_id, username);
@@ -0,0 +1,17 @@
+CREATE TABLE personal_access_tokens (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL REFERENCES users (id),
+	name varchar NOT NULL,
+	-- the start of the token, so users can tell their tokens apart
+	prefix varchar NOT NULL,
+	-- sha256 of the token, the token itself is never stored
+	token_hash bytea NOT NULL UNIQUE,
+	scopes varchar[] NOT NULL DEFAULT '{}',
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	expires_at timestamptz DEFAULT NULL,
+	last_used_at timestamptz DEFAULT NULL,
+	last_used_ip varchar NOT NULL DEFAULT '',
+	revoked_at timestamptz DEFAULT NULL
+);
+
+CREATE INDEX personal_access_tokens_user_id_idx ON personal_access_tokens (user_id);
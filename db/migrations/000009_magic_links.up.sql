@@ -0,0 +1,12 @@
+CREATE TABLE magic_links (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL REFERENCES users (id),
+	-- sha256 of the random part of the link, the link itself is never stored
+	token_hash bytea NOT NULL UNIQUE,
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	expires_at timestamptz NOT NULL,
+	used_at timestamptz DEFAULT NULL,
+	used_ip varchar NOT NULL DEFAULT ''
+);
+
+CREATE INDEX magic_links_user_id_idx ON magic_links (user_id, created_at);
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS otp_codes;
+
+DROP INDEX IF EXISTS users_tenant_phone_key;
+
+ALTER TABLE users
+	DROP COLUMN IF EXISTS sms_mfa,
+	DROP COLUMN IF EXISTS phone_verified_at,
+	DROP COLUMN IF EXISTS phone;
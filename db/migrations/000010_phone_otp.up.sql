@@ -0,0 +1,27 @@
+-- phone is E.164 and only set once the user proved they own it
+ALTER TABLE users
+	ADD COLUMN phone varchar NOT NULL DEFAULT '',
+	ADD COLUMN phone_verified_at timestamptz DEFAULT NULL,
+	ADD COLUMN sms_mfa boolean NOT NULL DEFAULT false;
+
+-- a phone signs in to one account per tenant
+CREATE UNIQUE INDEX users_tenant_phone_key ON users (tenant_id, phone) WHERE phone <> '';
+
+CREATE TABLE otp_codes (
+	id bigserial PRIMARY KEY,
+	-- null when a code was asked for a number without an account, nothing is sent then
+	user_id bigint REFERENCES users (id),
+	phone varchar NOT NULL,
+	purpose varchar NOT NULL,
+	channel varchar NOT NULL,
+	-- sha256 of the random part of the challenge the client holds
+	challenge_hash bytea NOT NULL UNIQUE,
+	-- sha256 of challenge and code, neither is stored
+	code_hash bytea NOT NULL,
+	attempts int NOT NULL DEFAULT 0,
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	expires_at timestamptz NOT NULL,
+	used_at timestamptz DEFAULT NULL
+);
+
+CREATE INDEX otp_codes_phone_idx ON otp_codes (phone, created_at);
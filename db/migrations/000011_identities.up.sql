@@ -0,0 +1,15 @@
+-- accounts at upstream identity providers that sign in as a local user
+CREATE TABLE identities (
+	id bigserial PRIMARY KEY,
+	tenant_id bigint NOT NULL REFERENCES tenants (id),
+	user_id bigint NOT NULL REFERENCES users (id),
+	provider varchar NOT NULL,
+	-- the sub claim, only unique per provider
+	subject varchar NOT NULL,
+	email varchar NOT NULL DEFAULT '',
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	last_login_at timestamptz DEFAULT NULL,
+	CONSTRAINT identities_tenant_provider_subject_key UNIQUE (tenant_id, provider, subject)
+);
+
+CREATE INDEX identities_user_id_idx ON identities (user_id);
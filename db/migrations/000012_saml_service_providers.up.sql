@@ -0,0 +1,14 @@
+-- apps that sign users in through us as a SAML identity provider
+CREATE TABLE saml_service_providers (
+	id bigserial PRIMARY KEY,
+	tenant_id bigint NOT NULL REFERENCES tenants (id),
+	entity_id varchar NOT NULL,
+	name varchar NOT NULL,
+	-- the SP's EntityDescriptor as registered
+	metadata text NOT NULL,
+	name_id_format varchar NOT NULL DEFAULT 'persistent',
+	-- SAML attribute name to user field
+	attributes jsonb NOT NULL DEFAULT '{}',
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT saml_service_providers_tenant_entity_key UNIQUE (tenant_id, entity_id)
+);
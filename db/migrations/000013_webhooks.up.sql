@@ -0,0 +1,34 @@
+-- URLs of a tenant that are posted the user events they subscribe to
+CREATE TABLE webhook_endpoints (
+	id bigserial PRIMARY KEY,
+	tenant_id bigint NOT NULL REFERENCES tenants (id),
+	url varchar NOT NULL,
+	-- kept in the clear, deliveries are signed with it
+	secret varchar NOT NULL,
+	events varchar[] NOT NULL DEFAULT '{}',
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE INDEX webhook_endpoints_tenant_id_idx ON webhook_endpoints (tenant_id);
+
+-- one row per event and endpoint, kept as the delivery log
+CREATE TABLE webhook_deliveries (
+	id bigserial PRIMARY KEY,
+	endpoint_id bigint NOT NULL REFERENCES webhook_endpoints (id) ON DELETE CASCADE,
+	event_id varchar NOT NULL,
+	event varchar NOT NULL,
+	payload jsonb NOT NULL,
+	-- pending, delivered or dead
+	status varchar NOT NULL DEFAULT 'pending',
+	attempts integer NOT NULL DEFAULT 0,
+	next_attempt_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	last_attempt_at timestamptz DEFAULT NULL,
+	response_status integer NOT NULL DEFAULT 0,
+	last_error varchar NOT NULL DEFAULT '',
+	replay_of bigint DEFAULT NULL REFERENCES webhook_deliveries (id) ON DELETE SET NULL,
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	delivered_at timestamptz DEFAULT NULL
+);
+
+CREATE INDEX webhook_deliveries_endpoint_id_idx ON webhook_deliveries (endpoint_id);
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
@@ -0,0 +1,17 @@
+-- emails and events written with the change they are about, sent after it commits
+CREATE TABLE outbox (
+	id bigserial PRIMARY KEY,
+	-- email or event
+	kind varchar NOT NULL,
+	tenant_id bigint NOT NULL REFERENCES tenants (id),
+	payload jsonb NOT NULL,
+	-- pending, sent or dead
+	status varchar NOT NULL DEFAULT 'pending',
+	attempts integer NOT NULL DEFAULT 0,
+	next_attempt_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	last_error varchar NOT NULL DEFAULT '',
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	sent_at timestamptz DEFAULT NULL
+);
+
+CREATE INDEX outbox_due_idx ON outbox (next_attempt_at) WHERE status = 'pending';
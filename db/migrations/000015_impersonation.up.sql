@@ -0,0 +1,3 @@
+-- the admin acting as the user, set on sessions started by impersonation only
+ALTER TABLE sessions
+	ADD COLUMN actor_id bigint REFERENCES users (id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS audit_events_tenant_id_idx;
+
+ALTER TABLE audit_events
+	DROP COLUMN IF EXISTS tenant_id;
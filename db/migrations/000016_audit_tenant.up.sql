@@ -0,0 +1,6 @@
+-- the tenant an event happened in. Events from before keep NULL, the trail is
+-- append only and their hashes cover what they were written with.
+ALTER TABLE audit_events
+	ADD COLUMN tenant_id bigint REFERENCES tenants (id);
+
+CREATE INDEX audit_events_tenant_id_idx ON audit_events (tenant_id, id);
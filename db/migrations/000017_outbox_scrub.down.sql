@@ -0,0 +1 @@
+-- the scrubbed links and codes are gone, there is nothing to put back
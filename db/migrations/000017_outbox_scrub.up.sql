@@ -0,0 +1,7 @@
+-- emails that are sent or dead keep who they were for, not the sign-in link or
+-- reset code they carried
+UPDATE outbox
+SET payload = jsonb_build_object(
+	'source', coalesce(payload->>'source', ''),
+	'destination', coalesce(payload->>'destination', ''))
+WHERE kind = 'email' AND status <> 'pending';
@@ -0,0 +1,277 @@
+// Package migrations embeds the SQL schema migrations and applies them.
+//
+// Applied versions are tracked in a schema_migrations table laid out like the
+// one the migrate CLI keeps, so databases migrated with the CLI carry on from
+// where they are.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// lockKey is the advisory lock held while migrating so replicas starting
+// together take turns
+const lockKey = 7_351_024_001
+
+// ErrDirty is returned when a migration failed part way under the migrate CLI
+var ErrDirty = errors.New("migrations: database is dirty, fix the schema and the schema_migrations row by hand")
+
+// Migration is one numbered schema change
+type Migration struct {
+	Version uint64
+	Name    string
+	up      string
+	down    string
+}
+
+// Status is a migration and whether it has been applied
+type Status struct {
+	Migration
+	Applied bool
+}
+
+// All returns the embedded migrations in version order
+func All() ([]Migration, error) {
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[uint64]*Migration{}
+	for _, e := range entries {
+		name := e.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		i := strings.IndexByte(base, '_')
+		if i < 0 {
+			return nil, fmt.Errorf("migrations: %s: name must look like 000001_title.up.sql", name)
+		}
+		version, err := strconv.ParseUint(base[:i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrations: %s: bad version: %v", name, err)
+		}
+
+		body, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: base[i+1:]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	all := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migrations: %06d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		all = append(all, *m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+
+	return all, nil
+}
+
+// Migrator applies the embedded migrations to a database
+type Migrator struct {
+	DB *sql.DB
+	// Logf reports each migration as it runs, may be nil
+	Logf func(format string, args ...interface{})
+}
+
+func (m *Migrator) logf(format string, args ...interface{}) {
+	if m.Logf != nil {
+		m.Logf(format, args...)
+	}
+}
+
+// Version returns the current schema version, 0 when nothing is applied
+func (m *Migrator) Version(ctx context.Context) (uint64, bool, error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+
+	if err = ensureTable(ctx, conn); err != nil {
+		return 0, false, err
+	}
+	return version(ctx, conn)
+}
+
+// Status lists every migration and whether it is applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	all, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	current, _, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]Status, len(all))
+	for i, mig := range all {
+		status[i] = Status{Migration: mig, Applied: mig.Version <= current}
+	}
+	return status, nil
+}
+
+// Up applies every pending migration and returns how many ran
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	all, err := All()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	err = m.locked(ctx, func(conn *sql.Conn, current uint64) error {
+		for _, mig := range all {
+			if mig.Version <= current {
+				continue
+			}
+			m.logf("applying %06d_%s", mig.Version, mig.Name)
+			if err := apply(ctx, conn, mig.up, mig.Version); err != nil {
+				return fmt.Errorf("migrations: %06d_%s up: %w", mig.Version, mig.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down reverts the latest steps migrations and returns how many ran
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	all, err := All()
+	if err != nil {
+		return 0, err
+	}
+
+	reverted := 0
+	err = m.locked(ctx, func(conn *sql.Conn, current uint64) error {
+		for i := len(all) - 1; i >= 0 && reverted < steps; i-- {
+			mig := all[i]
+			if mig.Version > current {
+				continue
+			}
+			var previous uint64
+			if i > 0 {
+				previous = all[i-1].Version
+			}
+			m.logf("reverting %06d_%s", mig.Version, mig.Name)
+			if err := apply(ctx, conn, mig.down, previous); err != nil {
+				return fmt.Errorf("migrations: %06d_%s down: %w", mig.Version, mig.Name, err)
+			}
+			reverted++
+		}
+		return nil
+	})
+
+	return reverted, err
+}
+
+// locked runs fn holding the migration advisory lock on one connection.
+// Advisory locks belong to a session, so everything has to use conn.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn, current uint64) error) (err error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, lockKey); err != nil {
+		return fmt.Errorf("migrations: taking lock: %w", err)
+	}
+	defer func() {
+		// the unlock must run even when ctx is done, or the lock outlives us on a pooled conn
+		if _, unlockErr := conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, lockKey); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}()
+
+	if err = ensureTable(ctx, conn); err != nil {
+		return err
+	}
+
+	current, dirty, err := version(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return ErrDirty
+	}
+
+	return fn(conn, current)
+}
+
+func ensureTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `create table if not exists schema_migrations
+		(version bigint not null primary key, dirty boolean not null)`)
+	return err
+}
+
+func version(ctx context.Context, conn *sql.Conn) (uint64, bool, error) {
+	var v uint64
+	var dirty bool
+
+	err := conn.QueryRowContext(ctx, `select version, dirty from schema_migrations limit 1`).Scan(&v, &dirty)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return v, dirty, err
+}
+
+// apply runs one migration file and records the new version in the same
+// transaction, so a failed migration leaves nothing behind
+func apply(ctx context.Context, conn *sql.Conn, body string, newVersion uint64) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, body); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `delete from schema_migrations`); err != nil {
+		return err
+	}
+	if newVersion > 0 {
+		if _, err = tx.ExecContext(ctx, `insert into schema_migrations (version, dirty) values ($1, false)`, newVersion); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,224 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAll(t *testing.T) {
+	all, err := All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range all {
+		if m.Version != uint64(i+1) {
+			t.Errorf("migration %d has version %d, versions must count up from 1", i, m.Version)
+		}
+		if m.Name == "" || m.up == "" || m.down == "" {
+			t.Errorf("%06d_%s is incomplete", m.Version, m.Name)
+		}
+	}
+}
+
+// expectLocked expects the lock to be taken and the version to be read
+func expectLocked(mock sqlmock.Sqlmock, current uint64, dirty bool) {
+	mock.ExpectExec(`select pg_advisory_lock\(\$1\)`).WithArgs(int64(lockKey)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`create table if not exists schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version", "dirty"})
+	if current > 0 {
+		rows.AddRow(current, dirty)
+	}
+	mock.ExpectQuery(`select version, dirty from schema_migrations`).WillReturnRows(rows)
+}
+
+// expectApply expects a migration file to run and the version to move to newVersion
+func expectApply(mock sqlmock.Sqlmock, body string, newVersion uint64) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(body)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`delete from schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 1))
+	if newVersion > 0 {
+		mock.ExpectExec(`insert into schema_migrations`).WithArgs(int64(newVersion)).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+}
+
+func expectUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(`select pg_advisory_unlock\(\$1\)`).WithArgs(int64(lockKey)).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestUp(t *testing.T) {
+	all, err := All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(all)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the last two are pending
+	expectLocked(mock, all[n-3].Version, false)
+	expectApply(mock, all[n-2].up, all[n-2].Version)
+	expectApply(mock, all[n-1].up, all[n-1].Version)
+	expectUnlock(mock)
+
+	m := &Migrator{DB: db}
+	applied, err := m.Up(context.Background())
+	if err != nil || applied != 2 {
+		t.Errorf("got %d, %v; want 2 applied", applied, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpToDate(t *testing.T) {
+	all, err := All()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectLocked(mock, all[len(all)-1].Version, false)
+	expectUnlock(mock)
+
+	m := &Migrator{DB: db}
+	if applied, err := m.Up(context.Background()); err != nil || applied != 0 {
+		t.Errorf("got %d, %v; want nothing applied", applied, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDown(t *testing.T) {
+	all, err := All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(all)
+
+	tests := []struct {
+		name    string
+		current uint64
+		steps   int
+		// reverted are the indexes into all reverted, in order
+		reverted []int
+	}{
+		{name: "latest two", current: all[n-1].Version, steps: 2, reverted: []int{n - 1, n - 2}},
+		// the first migration leaves no version behind
+		{name: "past the first", current: all[0].Version, steps: 3, reverted: []int{0}},
+		{name: "nothing applied", current: 0, steps: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			expectLocked(mock, tt.current, false)
+			for _, i := range tt.reverted {
+				var previous uint64
+				if i > 0 {
+					previous = all[i-1].Version
+				}
+				expectApply(mock, all[i].down, previous)
+			}
+			expectUnlock(mock)
+
+			m := &Migrator{DB: db}
+			reverted, err := m.Down(context.Background(), tt.steps)
+			if err != nil || reverted != len(tt.reverted) {
+				t.Errorf("got %d, %v; want %d reverted", reverted, err, len(tt.reverted))
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUpDirty(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectLocked(mock, 3, true)
+	expectUnlock(mock)
+
+	m := &Migrator{DB: db}
+	if _, err = m.Up(context.Background()); !errors.Is(err, ErrDirty) {
+		t.Errorf("got %v, want %v", err, ErrDirty)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpFailure(t *testing.T) {
+	all, err := All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(all)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the failed migration is rolled back with its version, and the lock released
+	expectLocked(mock, all[n-2].Version, false)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(all[n-1].up)).WillReturnError(errors.New("relation already exists"))
+	mock.ExpectRollback()
+	expectUnlock(mock)
+
+	m := &Migrator{DB: db}
+	applied, err := m.Up(context.Background())
+	if err == nil || applied != 0 {
+		t.Errorf("got %d, %v; want an error", applied, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`select pg_advisory_lock`).WillReturnError(context.DeadlineExceeded)
+
+	m := &Migrator{DB: db}
+	if _, err = m.Up(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the lock error", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
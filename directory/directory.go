@@ -0,0 +1,201 @@
+// Package directory checks passwords against an LDAP or Active Directory
+// server: it finds the user with a service account, then binds as them.
+package directory
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// defaultTimeout bounds a whole check when the context has no deadline
+const defaultTimeout = 10 * time.Second
+
+var (
+	// ErrInvalidCredentials no such user or wrong password error
+	ErrInvalidCredentials = errors.New("directory: invalid credentials")
+	// ErrAmbiguous the filter matches more than one entry error
+	ErrAmbiguous = errors.New("directory: filter matches more than one user")
+)
+
+// Config is how to reach the directory and read its users
+type Config struct {
+	// URL is ldap://host:389 or ldaps://host:636
+	URL string
+	// StartTLS upgrades an ldap:// connection before anything is sent
+	StartTLS bool
+	// InsecureSkipVerify accepts any server certificate, for testing only
+	InsecureSkipVerify bool
+	// BindDN and BindPassword are the service account searches run as,
+	// searches are anonymous when BindDN is empty
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds a user, %s is replaced by the escaped username
+	UserFilter string
+	// Attributes read from the user's entry
+	IDAttribute       string
+	UsernameAttribute string
+	NameAttribute     string
+	EmailAttribute    string
+	GroupAttribute    string
+}
+
+// Entry is what the directory says about a user whose password checked out
+type Entry struct {
+	DN string
+	// ID stays the same when the user is renamed or moved
+	ID       string
+	Username string
+	Name     string
+	Email    string
+	// Groups are the DNs of the groups the user is a member of
+	Groups []string
+}
+
+// Client checks passwords against one directory. Every check opens its own
+// connection, so a directory that is down does not stop the server.
+type Client struct {
+	cfg Config
+}
+
+// New returns a client for the directory
+func New(cfg Config) *Client {
+	return &Client{cfg: cfg}
+}
+
+// Authenticate finds the user with the filter and binds as them with the
+// password. ErrInvalidCredentials means the user does not exist or the
+// password is wrong, any other error that the directory could not be asked.
+func (c *Client) Authenticate(ctx context.Context, username, password string) (Entry, error) {
+	// an empty password makes an unauthenticated bind, which always succeeds
+	if username == "" || password == "" {
+		return Entry{}, ErrInvalidCredentials
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer conn.Close()
+
+	if c.cfg.BindDN != "" {
+		if err = conn.Bind(c.cfg.BindDN, c.cfg.BindPassword); err != nil {
+			return Entry{}, fmt.Errorf("directory: service account bind: %v", err)
+		}
+	}
+
+	attributes := []string{c.cfg.IDAttribute, c.cfg.UsernameAttribute, c.cfg.NameAttribute, c.cfg.EmailAttribute, c.cfg.GroupAttribute}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		c.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 0, false,
+		strings.ReplaceAll(c.cfg.UserFilter, "%s", ldap.EscapeFilter(username)),
+		attributes, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return Entry{}, ErrAmbiguous
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("directory: search: %v", err)
+	}
+	switch len(res.Entries) {
+	case 0:
+		return Entry{}, ErrInvalidCredentials
+	case 1:
+	default:
+		return Entry{}, ErrAmbiguous
+	}
+	e := res.Entries[0]
+
+	err = conn.Bind(e.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return Entry{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("directory: user bind: %v", err)
+	}
+
+	entry := Entry{
+		DN:       e.DN,
+		ID:       attributeString(e.GetRawAttributeValue(c.cfg.IDAttribute)),
+		Username: e.GetAttributeValue(c.cfg.UsernameAttribute),
+		Name:     e.GetAttributeValue(c.cfg.NameAttribute),
+		Email:    e.GetAttributeValue(c.cfg.EmailAttribute),
+		Groups:   e.GetAttributeValues(c.cfg.GroupAttribute),
+	}
+	if entry.ID == "" {
+		entry.ID = e.DN
+	}
+	if entry.Username == "" {
+		entry.Username = username
+	}
+	return entry, nil
+}
+
+// dial connects, upgrades to TLS when asked and applies the context deadline
+// to every request, as the LDAP client takes no context
+func (c *Client) dial(ctx context.Context) (*ldap.Conn, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.cfg.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if u, err := url.Parse(c.cfg.URL); err == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	conn, err := ldap.DialURL(c.cfg.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("directory: dial: %v", err)
+	}
+	conn.SetTimeout(timeout)
+
+	if c.cfg.StartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("directory: starttls: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// attributeString returns a text attribute as is and a binary one, such as
+// Active Directory's objectGUID, hex encoded
+func attributeString(raw []byte) string {
+	if !utf8.Valid(raw) {
+		return hex.EncodeToString(raw)
+	}
+	for _, b := range raw {
+		if b < 0x20 || b == 0x7f {
+			return hex.EncodeToString(raw)
+		}
+	}
+	return string(raw)
+}
+
+// GroupName returns the value of the first part of a group's DN, admins for
+// cn=admins,ou=groups,dc=example,dc=com, or the DN when it cannot be parsed
+func GroupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
@@ -0,0 +1,217 @@
+package directory
+
+import (
+	"auth/api/directory/directorytest"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const (
+	serviceDN = "cn=svc,dc=example,dc=com"
+	aliceDN   = "uid=alice,ou=people,dc=example,dc=com"
+	adminsDN  = "cn=admins,ou=groups,dc=example,dc=com"
+	staffDN   = "cn=staff,ou=groups,dc=example,dc=com"
+)
+
+func person(uid, password string, attributes map[string][]string) directorytest.Entry {
+	attributes["objectClass"] = []string{"person"}
+	attributes["uid"] = []string{uid}
+	return directorytest.Entry{DN: "uid=" + uid + ",ou=people,dc=example,dc=com", Password: password, Attributes: attributes}
+}
+
+func newTestDirectory(t *testing.T) *directorytest.Server {
+	t.Helper()
+
+	s, err := directorytest.NewServer(
+		directorytest.Entry{DN: serviceDN, Password: "svc-pass"},
+		person("alice", "alice-pass", map[string][]string{
+			"entryUUID": {"0f7a3c1e-0000-4000-8000-000000000001"},
+			"cn":        {"Alice Liddell"},
+			"mail":      {"alice@example.com"},
+			"memberOf":  {adminsDN, staffDN},
+		}),
+		// no id or name, the DN and username stand in
+		person("carol", "carol-pass", map[string][]string{"mail": {"carol@example.com"}}),
+		person("twin1", "twin-pass", map[string][]string{"mail": {"twins@example.com"}}),
+		person("twin2", "twin-pass", map[string][]string{"mail": {"twins@example.com"}}),
+		person("many1", "many-pass", map[string][]string{"mail": {"many@example.com"}}),
+		person("many2", "many-pass", map[string][]string{"mail": {"many@example.com"}}),
+		person("many3", "many-pass", map[string][]string{"mail": {"many@example.com"}}),
+		// not a person, the filter leaves it out
+		directorytest.Entry{DN: "cn=printer,dc=example,dc=com", Password: "printer-pass",
+			Attributes: map[string][]string{"uid": {"printer"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testConfig(url string) Config {
+	return Config{
+		URL:               url,
+		BindDN:            serviceDN,
+		BindPassword:      "svc-pass",
+		BaseDN:            "dc=example,dc=com",
+		UserFilter:        "(&(objectClass=person)(|(uid=%s)(mail=%s)))",
+		IDAttribute:       "entryUUID",
+		UsernameAttribute: "uid",
+		NameAttribute:     "cn",
+		EmailAttribute:    "mail",
+		GroupAttribute:    "memberOf",
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	alice := Entry{
+		DN:       aliceDN,
+		ID:       "0f7a3c1e-0000-4000-8000-000000000001",
+		Username: "alice",
+		Name:     "Alice Liddell",
+		Email:    "alice@example.com",
+		Groups:   []string{adminsDN, staffDN},
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     Entry
+		wantErr  error
+		// filter is what the directory is searched with
+		filter string
+	}{
+		{
+			name:     "username",
+			username: "alice",
+			password: "alice-pass",
+			want:     alice,
+			filter:   "(&(objectClass=person)(|(uid=alice)(mail=alice)))",
+		},
+		{
+			name:     "email",
+			username: "alice@example.com",
+			password: "alice-pass",
+			want:     alice,
+		},
+		{
+			name:     "no id or name",
+			username: "carol",
+			password: "carol-pass",
+			want: Entry{
+				DN:       "uid=carol,ou=people,dc=example,dc=com",
+				ID:       "uid=carol,ou=people,dc=example,dc=com",
+				Username: "carol",
+				Email:    "carol@example.com",
+				Groups:   []string{},
+			},
+		},
+		{name: "wrong password", username: "alice", password: "wrong", wantErr: ErrInvalidCredentials},
+		{name: "no such user", username: "mallory", password: "alice-pass", wantErr: ErrInvalidCredentials},
+		{name: "not matched by the filter", username: "printer", password: "printer-pass", wantErr: ErrInvalidCredentials},
+		{name: "empty password", username: "alice", password: "", wantErr: ErrInvalidCredentials},
+		{name: "two hits", username: "twins@example.com", password: "twin-pass", wantErr: ErrAmbiguous},
+		{name: "more hits than the size limit", username: "many@example.com", password: "many-pass", wantErr: ErrAmbiguous},
+		{
+			name:     "filter characters are escaped",
+			username: "*",
+			password: "alice-pass",
+			wantErr:  ErrInvalidCredentials,
+			filter:   `(&(objectClass=person)(|(uid=\2a)(mail=\2a)))`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestDirectory(t)
+			c := New(testConfig(s.URL()))
+
+			got, err := c.Authenticate(context.Background(), tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got entry %+v, want %+v", got, tt.want)
+			}
+
+			if tt.filter != "" {
+				if filters := s.Filters(); len(filters) != 1 || filters[0] != tt.filter {
+					t.Errorf("searched with %q, want %q", filters, tt.filter)
+				}
+			}
+			// searches run as the service account, then the password is
+			// checked by binding as the user
+			if tt.wantErr == nil {
+				want := []string{serviceDN, tt.want.DN}
+				if binds := s.Binds(); !reflect.DeepEqual(binds, want) {
+					t.Errorf("bound as %q, want %q", binds, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticateServiceAccountRefused(t *testing.T) {
+	s := newTestDirectory(t)
+	cfg := testConfig(s.URL())
+	cfg.BindPassword = "wrong"
+
+	_, err := New(cfg).Authenticate(context.Background(), "alice", "alice-pass")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("got %v, want an error that is not about the user's credentials", err)
+	}
+	if len(s.Filters()) != 0 {
+		t.Error("searched without the service account")
+	}
+}
+
+func TestAuthenticateDirectoryDown(t *testing.T) {
+	s := newTestDirectory(t)
+	url := s.URL()
+	s.Close()
+
+	_, err := New(testConfig(url)).Authenticate(context.Background(), "alice", "alice-pass")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("got %v, want an error that is not about the user's credentials", err)
+	}
+}
+
+func TestGroupName(t *testing.T) {
+	tests := []struct {
+		dn   string
+		want string
+	}{
+		{adminsDN, "admins"},
+		{"CN=Domain Admins,CN=Users,DC=corp,DC=example", "Domain Admins"},
+		{`cn=a\,b,dc=example`, "a,b"},
+		{"admins", "admins"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := GroupName(tt.dn); got != tt.want {
+			t.Errorf("GroupName(%q) = %q, want %q", tt.dn, got, tt.want)
+		}
+	}
+}
+
+func TestAttributeString(t *testing.T) {
+	tests := []struct {
+		raw  []byte
+		want string
+	}{
+		{[]byte("0f7a3c1e"), "0f7a3c1e"},
+		{[]byte{0x01, 0x02, 0xab, 0xff}, "0102abff"},
+		{[]byte{'a', 0x00, 'b'}, "610062"},
+		{nil, ""},
+	}
+
+	for _, tt := range tests {
+		if got := attributeString(tt.raw); got != tt.want {
+			t.Errorf("attributeString(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package logging writes leveled JSON log lines. Values under sensitive keys and
+// anything that looks like a token or password hash are redacted before writing.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel reads a level name such as info
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are field names whose values are never written, keys containing
+// one of them are redacted. sensitiveExactKeys must match the whole key.
+var (
+	sensitiveKeys      = []string{"password", "token", "secret", "authorization", "cookie", "resetcode", "apikey", "privatekey", "dsn"}
+	sensitiveExactKeys = []string{"code", "key", "otp"}
+)
+
+// sensitiveValues catch secrets passed under an innocent key or inside a message:
+// JWTs, bcrypt hashes, credentials in connection strings, personal access tokens,
+// webhook secrets, signed sign-in link and passcode challenge tokens, and reset
+// codes, which look like any other word and are only found by their name
+var sensitiveValues = []struct {
+	re *regexp.Regexp
+	// replace is what a match becomes, $1 keeps the text around the secret
+	replace string
+}{
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), redacted},
+	{regexp.MustCompile(`\$2[abxy]?\$\d{2}\$[./A-Za-z0-9]{53}`), redacted},
+	{regexp.MustCompile(`(://[^:/@\s]+:)[^@\s]+@`), "${1}" + redacted + "@"},
+	{regexp.MustCompile(`gat_[0-9a-fA-F]{8,}`), redacted},
+	{regexp.MustCompile(`whsec_[0-9a-fA-F]{8,}`), redacted},
+	{regexp.MustCompile(`[A-Za-z0-9_-]{43}\.[A-Za-z0-9_-]{43}`), redacted},
+	{regexp.MustCompile(`(?i)(reset_?code\W{1,3})[A-Za-z0-9_-]+`), "${1}" + redacted},
+}
+
+// Logger writes JSON lines carrying its fields
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	fields []interface{}
+}
+
+// New returns a logger writing lines at or above level to out
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{
+		mu:    &sync.Mutex{},
+		out:   out,
+		level: level,
+	}
+}
+
+// With returns a logger adding the key value pairs to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	return &Logger{
+		mu:     l.mu,
+		out:    l.out,
+		level:  l.level,
+		fields: fields,
+	}
+}
+
+// Debug logs at debug level
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.write(LevelDebug, msg, kv)
+}
+
+// Info logs at info level
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.write(LevelInfo, msg, kv)
+}
+
+// Warn logs at warn level
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.write(LevelWarn, msg, kv)
+}
+
+// Error logs at error level
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.write(LevelError, msg, kv)
+}
+
+// Fatal logs at error level and exits
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.write(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+// Writer returns an io.Writer logging each write as a line at the level, for
+// libraries that want a *log.Logger
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		l.write(level, strings.TrimRight(string(p), "\n"), nil)
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (l *Logger) write(level Level, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeField(&buf, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeField(&buf, "level", level.String())
+	buf.WriteByte(',')
+	writeField(&buf, "msg", redactString(msg))
+
+	pairs := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i < len(pairs); i += 2 {
+		key := fmt.Sprint(pairs[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(pairs) {
+			value = redact(key, pairs[i+1])
+		}
+		buf.WriteByte(',')
+		writeField(&buf, key, value)
+	}
+	buf.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+func writeField(buf *bytes.Buffer, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(k)
+	buf.WriteByte(':')
+	buf.Write(v)
+}
+
+// redact hides the value when the key is sensitive and scrubs secrets out of text
+func redact(key string, value interface{}) interface{} {
+	normalized := strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' || r == '.' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(key))
+	for _, s := range sensitiveKeys {
+		if strings.Contains(normalized, s) {
+			return redacted
+		}
+	}
+	for _, s := range sensitiveExactKeys {
+		if normalized == s {
+			return redacted
+		}
+	}
+
+	switch v := value.(type) {
+	case error:
+		return redactString(v.Error())
+	case string:
+		return redactString(v)
+	case []byte:
+		return redactString(string(v))
+	case fmt.Stringer:
+		return redactString(v.String())
+	}
+	return value
+}
+
+func redactString(s string) string {
+	for _, v := range sensitiveValues {
+		s = v.re.ReplaceAllString(s, v.replace)
+	}
+	return s
+}
+
+type contextKey struct{}
+
+var defaultLogger = New(os.Stdout, LevelInfo)
+
+// SetDefault replaces the logger used when a context carries none
+func SetDefault(l *Logger) {
+	defaultLogger = l
+}
+
+// Default returns the logger used when a context carries none
+func Default() *Logger {
+	return defaultLogger
+}
+
+// NewContext returns a context carrying the logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger stored in the context, or the default logger
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return defaultLogger
+}
@@ -0,0 +1,86 @@
+// Package metrics keeps counters, histograms and gauges with the Prometheus
+// client and serves them in the Prometheus exposition format.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefBuckets are latency buckets in seconds suited to HTTP requests
+var DefBuckets = prometheus.DefBuckets
+
+// Registry holds the metrics exposed together on one endpoint
+type Registry struct {
+	reg *prometheus.Registry
+}
+
+// NewRegistry returns a registry with the Go runtime and process metrics
+func NewRegistry() *Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return &Registry{reg: reg}
+}
+
+// Default is the registry the New functions register with
+var Default = NewRegistry()
+
+// Handler serves every metric of the registry
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.reg, promhttp.HandlerOpts{})
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+// NewCounterVec registers a counter with the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)}
+	Default.reg.MustRegister(c.vec)
+	return c
+}
+
+// Inc adds one to the series with the label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Inc()
+}
+
+// Add adds n to the series with the label values
+func (c *CounterVec) Add(n float64, labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Add(n)
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+// NewHistogramVec registers a histogram with the default registry
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)}
+	Default.reg.MustRegister(h.vec)
+	return h
+}
+
+// Observe records a value in the series with the label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.vec.WithLabelValues(labelValues...).Observe(v)
+}
+
+// NewGaugeFunc registers a gauge read from a function at scrape time with the
+// default registry
+func NewGaugeFunc(name, help string, value func() float64) {
+	Default.reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, value))
+}
+
+// NewCounterFunc registers a counter read from a function, for totals kept elsewhere
+func NewCounterFunc(name, help string, value func() float64) {
+	Default.reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, value))
+}
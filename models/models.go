@@ -1,17 +1,302 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
+
+// Account statuses a user can be in
+const (
+	StatusActive      = "active"
+	StatusSuspended   = "suspended"
+	StatusDeactivated = "deactivated"
+	StatusDeleted     = "deleted"
+)
+
+// Roles a user can hold
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Tenant is an organization with its own users, resolved per request from
+// the host, a header or the path
+type Tenant struct {
+	ID        int       `json:"id"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	Host      string    `json:"host,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
 
 type User struct {
 	ID                int       `json:"id"`
+	TenantID          int       `json:"tenantId"`
 	Email             string    `json:"email"`
 	Password          string    `json:"password"`
 	UserName          string    `json:"username"`
 	Name              string    `json:"name"`
+	Role              string    `json:"role"`
+	Status            string    `json:"status"`
+	StatusReason      string    `json:"statusReason,omitempty"`
+	SuspendedUntil    time.Time `json:"suspendedUntil"`
 	CreatedAt         time.Time `json:"createdAt"`
 	UpdatedAt         time.Time `json:"updatedAt"`
 	DeletedAt         time.Time `json:"-"`
 	PasswordResetCode string    `json:"passwordResetCode,omitempty"`
+	Phone             string    `json:"phone,omitempty"`
+	PhoneVerifiedAt   time.Time `json:"phoneVerifiedAt"`
+	SMSMFA            bool      `json:"smsMfa"`
+}
+
+// Session is a sign-in on one device, tokens carry its id
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"userId"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	RevokedAt  time.Time `json:"revokedAt"`
+	// ActorID is the admin acting as the user in a session started by
+	// impersonation, 0 otherwise
+	ActorID int  `json:"actorId,omitempty"`
+	Current bool `json:"current"`
+}
+
+// Scopes a personal access token can be given
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// What a one-time passcode was sent for
+const (
+	OTPVerifyPhone = "verify_phone"
+	OTPMFA         = "mfa"
+	OTPLogin       = "login"
+)
+
+// PersonalAccessToken is a long lived token a user creates for scripts. The
+// secret is only known when it is created.
+type PersonalAccessToken struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"userId"`
+	Name       string    `json:"name"`
+	Prefix     string    `json:"prefix"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	LastUsedIP string    `json:"lastUsedIp"`
+	RevokedAt  time.Time `json:"revokedAt"`
+}
+
+// HasScope reports whether the token was given a scope
+func (t PersonalAccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// OTPChallenge is a one-time passcode sent to a phone, waiting to be entered
+type OTPChallenge struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"userId"`
+	Phone     string    `json:"phone"`
+	Purpose   string    `json:"purpose"`
+	Channel   string    `json:"channel"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	UsedAt    time.Time `json:"usedAt"`
+}
+
+// Identity links an account at an upstream identity provider to a user
+type Identity struct {
+	ID          int       `json:"id"`
+	TenantID    int       `json:"tenantId"`
+	UserID      int       `json:"userId"`
+	Provider    string    `json:"provider"`
+	Subject     string    `json:"subject"`
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastLoginAt time.Time `json:"lastLoginAt"`
+}
+
+// NameID formats a SAML service provider can be sent
+const (
+	// NameIDPersistent is the user id, which never changes
+	NameIDPersistent = "persistent"
+	NameIDEmail      = "email"
+	NameIDUsername   = "username"
+)
+
+// ServiceProvider is an app that signs users in through us with SAML
+type ServiceProvider struct {
+	ID           int    `json:"id"`
+	TenantID     int    `json:"tenantId"`
+	EntityID     string `json:"entityId"`
+	Name         string `json:"name"`
+	Metadata     string `json:"metadata"`
+	NameIDFormat string `json:"nameIdFormat"`
+	// Attributes maps SAML attribute names to the user field sent in them
+	Attributes map[string]string `json:"attributes"`
+	CreatedAt  time.Time         `json:"createdAt"`
+}
+
+// Webhook events sent about users
+const (
+	EventUserRegistered      = "user.registered"
+	EventUserPasswordChanged = "user.password_changed"
+	EventUserStatusChanged   = "user.status_changed"
+	EventUserDeleted         = "user.deleted"
+)
+
+// WebhookEvents lists every event an endpoint can subscribe to
+var WebhookEvents = []string{EventUserRegistered, EventUserPasswordChanged, EventUserStatusChanged, EventUserDeleted}
+
+// States of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryDead gave up after the last retry, admins can replay it
+	DeliveryDead = "dead"
+)
+
+// Kinds of outbox messages
+const (
+	OutboxEmail = "email"
+	// OutboxEvent is a webhook event, fanned out to the subscribed endpoints
+	OutboxEvent = "event"
+)
+
+// OutboxMessage is an email or event written in the same transaction as the
+// change it is about, and sent by the dispatcher once that has committed
+type OutboxMessage struct {
+	ID       int64           `json:"id"`
+	Kind     string          `json:"kind"`
+	TenantID int             `json:"tenantId"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+}
+
+// WebhookEndpoint is a URL of a tenant that is sent the events it subscribes to
+type WebhookEndpoint struct {
+	ID       int      `json:"id"`
+	TenantID int      `json:"tenantId"`
+	URL      string   `json:"url"`
+	Events   []string `json:"events"`
+	// Secret signs the deliveries, it is only shown when the endpoint is created
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebhookDelivery is one event on its way to one endpoint
+type WebhookDelivery struct {
+	ID         int64           `json:"id"`
+	EndpointID int             `json:"endpointId"`
+	EventID    string          `json:"eventId"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Status     string          `json:"status"`
+	Attempts   int             `json:"attempts"`
+	// NextAttemptAt is when a pending delivery is tried next
+	NextAttemptAt  time.Time `json:"nextAttemptAt"`
+	LastAttemptAt  time.Time `json:"lastAttemptAt"`
+	ResponseStatus int       `json:"responseStatus,omitempty"`
+	LastError      string    `json:"lastError,omitempty"`
+	// ReplayOf is the delivery this one was replayed from
+	ReplayOf    int64     `json:"replayOf,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	DeliveredAt time.Time `json:"deliveredAt"`
+	// URL and Secret of the endpoint, only set for the dispatcher
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// WebhookDeliveryFilter narrows down a delivery log query, zero values are ignored
+type WebhookDeliveryFilter struct {
+	TenantID   int
+	EndpointID int
+	Event      string
+	Status     string
+	// Before returns deliveries older than this delivery id, used for paging
+	Before int64
+	Limit  int
+}
+
+// AuditEvent is a security relevant action recorded in the audit trail
+type AuditEvent struct {
+	ID         int64                  `json:"id"`
+	OccurredAt time.Time              `json:"occurredAt"`
+	TenantID   int                    `json:"tenantId,omitempty"`
+	ActorID    int                    `json:"actorId,omitempty"`
+	SubjectID  int                    `json:"subjectId,omitempty"`
+	Action     string                 `json:"action"`
+	Outcome    string                 `json:"outcome"`
+	IP         string                 `json:"ip"`
+	UserAgent  string                 `json:"userAgent"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	PrevHash   string                 `json:"prevHash,omitempty"`
+	Hash       string                 `json:"hash,omitempty"`
+}
+
+// AuditCheckpoint is a signed statement of the audit chain head at a point in time
+type AuditCheckpoint struct {
+	ID        int64     `json:"id"`
+	EventID   int64     `json:"eventId"`
+	EventHash string    `json:"eventHash"`
+	Signature string    `json:"signature"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AuditBreak is a place where the audit chain does not verify
+type AuditBreak struct {
+	EventID      int64  `json:"eventId,omitempty"`
+	CheckpointID int64  `json:"checkpointId,omitempty"`
+	Reason       string `json:"reason"`
+}
+
+// AuditVerification is the result of walking the audit chain
+type AuditVerification struct {
+	Events      int          `json:"events"`
+	Unchained   int          `json:"unchained"`
+	Checkpoints int          `json:"checkpoints"`
+	Breaks      []AuditBreak `json:"breaks"`
+}
+
+// AuditFilter narrows down an audit trail query, zero values are ignored
+type AuditFilter struct {
+	// TenantID limits events to those of the tenant. Events stored before they
+	// carried a tenant go by their actor and subject.
+	TenantID  int
+	ActorID   int
+	SubjectID int
+	Action    string
+	Outcome   string
+	IP        string
+	From      time.Time
+	To        time.Time
+	// Before returns events older than this event id, used for paging
+	Before int64
+	Limit  int
+}
+
+// UserExport is the archive of personal data handed out for data subject requests
+type UserExport struct {
+	GeneratedAt  time.Time    `json:"generatedAt"`
+	Profile      User         `json:"profile"`
+	Sessions     []Session    `json:"sessions"`
+	Identities   []Identity   `json:"identities"`
+	LoginHistory []AuditEvent `json:"loginHistory"`
+	AuditEvents  []AuditEvent `json:"auditEvents"`
 }
 
 type ForgotPasswordEmailPayload struct {
@@ -19,3 +304,11 @@ type ForgotPasswordEmailPayload struct {
 	Destination       string `json:"destination"`
 	PasswordResetCode string `json:"passwordResetCode,omitempty"`
 }
+
+// MagicLinkEmailPayload asks the email gateway to send a sign-in link
+type MagicLinkEmailPayload struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	MagicLink   string    `json:"magicLink"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
@@ -0,0 +1,337 @@
+// Package oidc signs users in through upstream OpenID Connect providers: it
+// discovers a provider's endpoints, runs the authorization code flow with PKCE
+// and validates the ID token that comes back.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+const (
+	// discoveryTTL is how long discovered endpoints and keys are used before
+	// they are fetched again
+	discoveryTTL = time.Hour
+	// keyRefreshInterval limits fetching keys again for tokens signed with a key
+	// we do not know, so forged key ids cannot make us hammer the provider
+	keyRefreshInterval = time.Minute
+	// clockSkew is how far the provider's clock may be off from ours
+	clockSkew = time.Minute
+	// maxResponse bounds what is read from the provider
+	maxResponse = 1 << 20
+)
+
+var (
+	// ErrDiscovery provider metadata could not be fetched or is wrong error
+	ErrDiscovery = errors.New("oidc: discovery failed")
+	// ErrExchange authorization code not exchanged for tokens error
+	ErrExchange = errors.New("oidc: code exchange failed")
+	// ErrIDToken ID token not valid error
+	ErrIDToken = errors.New("oidc: ID token not valid")
+)
+
+// Config is an upstream provider as registered with it
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Identity is who the provider says signed in
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Username      string
+}
+
+// metadata is the part of the discovery document we use
+type metadata struct {
+	Issuer        string `json:"issuer"`
+	AuthEndpoint  string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+}
+
+// Provider talks to one upstream provider. Its endpoints and keys are fetched
+// on first use and cached, so a provider that is down does not stop the server.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu       sync.Mutex
+	meta     metadata
+	metaAt   time.Time
+	keys     *jwt.KeyRegister
+	keysAt   time.Time
+	keysNext time.Time
+}
+
+// New returns a provider using client for its requests
+func New(cfg Config, client *http.Client) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{cfg: cfg, client: client}
+}
+
+// NewVerifier returns a PKCE code verifier, kept by us until the code comes
+// back. It is random enough to use as state and nonce too.
+func NewVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// challengeS256 is the PKCE code challenge of a verifier
+func challengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns where to send the user to sign in at the provider
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(meta.AuthEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: bad authorization endpoint", ErrDiscovery)
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", challengeS256(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange trades an authorization code for the ID token
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	status, err := p.do(req, &tokens)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("%w: provider answered %d %s", ErrExchange, status, tokens.Error)
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("%w: no id_token in the response", ErrExchange)
+	}
+
+	return tokens.IDToken, nil
+}
+
+// Verify checks an ID token was signed by the provider for us, is current and
+// carries the nonce of our request, and returns who it is about
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string) (Identity, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	claims, err := p.check(ctx, []byte(idToken))
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrIDToken, err)
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != meta.Issuer:
+		return Identity{}, fmt.Errorf("%w: issued by %q", ErrIDToken, claims.Issuer)
+	case !claims.AcceptAudience(p.cfg.ClientID):
+		return Identity{}, fmt.Errorf("%w: not for this client", ErrIDToken)
+	case len(claims.Audiences) > 1 && claimString(claims, "azp") != p.cfg.ClientID:
+		return Identity{}, fmt.Errorf("%w: authorized party is not this client", ErrIDToken)
+	case claims.Expires == nil || now.After(claims.Expires.Time().Add(clockSkew)):
+		return Identity{}, fmt.Errorf("%w: expired", ErrIDToken)
+	case claims.NotBefore != nil && now.Add(clockSkew).Before(claims.NotBefore.Time()):
+		return Identity{}, fmt.Errorf("%w: not yet valid", ErrIDToken)
+	case claims.Issued != nil && now.Add(clockSkew).Before(claims.Issued.Time()):
+		return Identity{}, fmt.Errorf("%w: issued in the future", ErrIDToken)
+	case claims.Subject == "":
+		return Identity{}, fmt.Errorf("%w: no subject", ErrIDToken)
+	case nonce == "" || claimString(claims, "nonce") != nonce:
+		return Identity{}, fmt.Errorf("%w: nonce does not match", ErrIDToken)
+	}
+
+	id := Identity{
+		Subject:  claims.Subject,
+		Email:    claimString(claims, "email"),
+		Name:     claimString(claims, "name"),
+		Username: claimString(claims, "preferred_username"),
+	}
+	// some providers send email_verified as a string
+	switch v := claims.Set["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified = v == "true"
+	}
+
+	return id, nil
+}
+
+// check verifies the token signature, fetching the keys again once when it is
+// signed with a key we have not seen, as happens after the provider rotates
+func (p *Provider) check(ctx context.Context, token []byte) (*jwt.Claims, error) {
+	keys, err := p.keySet(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := keys.Check(token)
+	if err == nil {
+		return claims, nil
+	}
+
+	fresh, refreshErr := p.keySet(ctx, true)
+	if refreshErr != nil || fresh == keys {
+		return nil, err
+	}
+	return fresh.Check(token)
+}
+
+// metadata returns the discovery document, fetching it when it is missing or old
+func (p *Provider) metadata(ctx context.Context) (metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.metaAt.IsZero() && time.Since(p.metaAt) < discoveryTTL {
+		return p.meta, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return metadata{}, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+
+	var meta metadata
+	status, err := p.do(req, &meta)
+	switch {
+	case err != nil:
+		return metadata{}, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	case status != http.StatusOK:
+		return metadata{}, fmt.Errorf("%w: provider answered %d", ErrDiscovery, status)
+	case meta.Issuer != p.cfg.Issuer:
+		// a document naming another issuer could make us trust its tokens
+		return metadata{}, fmt.Errorf("%w: document is for issuer %q", ErrDiscovery, meta.Issuer)
+	case meta.AuthEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "":
+		return metadata{}, fmt.Errorf("%w: document lacks endpoints", ErrDiscovery)
+	}
+
+	p.meta, p.metaAt = meta, time.Now()
+	return meta, nil
+}
+
+// keySet returns the provider's signing keys. refresh fetches them again when
+// the last fetch is older than keyRefreshInterval.
+func (p *Provider) keySet(ctx context.Context, refresh bool) (*jwt.KeyRegister, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fetch := p.keys == nil || time.Since(p.keysAt) > discoveryTTL || (refresh && time.Now().After(p.keysNext))
+	if !fetch {
+		return p.keys, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, meta.JWKSURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	var raw json.RawMessage
+	status, err := p.do(req, &raw)
+	if err != nil || status != http.StatusOK {
+		return nil, fmt.Errorf("%w: fetching keys: %v (status %d)", ErrDiscovery, err, status)
+	}
+
+	keys := new(jwt.KeyRegister)
+	if _, err = keys.LoadJWK(raw); err != nil {
+		return nil, fmt.Errorf("%w: reading keys: %v", ErrDiscovery, err)
+	}
+	// a published symmetric key would let anyone sign tokens
+	keys.Secrets, keys.SecretIDs, keys.HMACs, keys.HMACIDs = nil, nil, nil, nil
+
+	p.keys, p.keysAt, p.keysNext = keys, time.Now(), time.Now().Add(keyRefreshInterval)
+	return keys, nil
+}
+
+// do sends the request and decodes the JSON answer into v, whatever the status
+func (p *Provider) do(req *http.Request, v interface{}) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err = json.Unmarshal(body, v); err != nil && resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, nil
+}
+
+func claimString(c *jwt.Claims, name string) string {
+	s, _ := c.String(name)
+	return s
+}
@@ -0,0 +1,275 @@
+package oidc
+
+import (
+	"auth/api/oidc/oidctest"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+var alice = oidctest.User{Subject: "alice-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+
+func newTestProvider(t *testing.T) (*oidctest.Provider, *Provider) {
+	t.Helper()
+
+	idp, err := oidctest.NewProvider("client-1", "s3cret:&")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+
+	p := New(Config{
+		Issuer:       idp.Issuer(),
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		RedirectURL:  "https://auth.example.com/v1/oidc/test/callback",
+	}, idp.Client())
+	return idp, p
+}
+
+// authorize follows AuthCodeURL at the provider and returns the code it sends back
+func authorize(t *testing.T, idp *oidctest.Provider, p *Provider, state, nonce, verifier string) string {
+	t.Helper()
+
+	authURL, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := idp.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize answered %d", resp.StatusCode)
+	}
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := back.Query().Get("state"); got != state {
+		t.Fatalf("state came back as %q, want %q", got, state)
+	}
+	return back.Query().Get("code")
+}
+
+func TestCodeExchange(t *testing.T) {
+	idp, p := newTestProvider(t)
+	idp.SetUser(alice)
+	ctx := context.Background()
+
+	verifier, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := authorize(t, idp, p, "state-1", "nonce-1", verifier)
+	idToken, err := p.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+
+	id, err := p.Verify(ctx, idToken, "nonce-1")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	want := Identity{Subject: alice.Subject, Email: alice.Email, EmailVerified: true, Name: alice.Name}
+	if id != want {
+		t.Errorf("got identity %+v, want %+v", id, want)
+	}
+
+	// codes are single use
+	if _, err = p.Exchange(ctx, code, verifier); !errors.Is(err, ErrExchange) {
+		t.Errorf("second exchange of a code: got %v, want ErrExchange", err)
+	}
+}
+
+func TestCodeExchangeWrongVerifier(t *testing.T) {
+	idp, p := newTestProvider(t)
+	idp.SetUser(alice)
+
+	verifier, _ := NewVerifier()
+	other, _ := NewVerifier()
+
+	code := authorize(t, idp, p, "state-1", "nonce-1", verifier)
+	if _, err := p.Exchange(context.Background(), code, other); !errors.Is(err, ErrExchange) {
+		t.Errorf("got %v, want ErrExchange", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	idp, p := newTestProvider(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(*jwt.Claims)
+		nonce  string
+		sign   func(*jwt.Claims) (string, error)
+	}{
+		{name: "wrong nonce", nonce: "nonce-2"},
+		{name: "nonce missing", tamper: func(c *jwt.Claims) { delete(c.Set, "nonce") }},
+		{name: "wrong audience", tamper: func(c *jwt.Claims) { c.Audiences = []string{"client-2"} }},
+		{name: "other party", tamper: func(c *jwt.Claims) {
+			c.Audiences = []string{idp.ClientID, "client-2"}
+			c.Set["azp"] = "client-2"
+		}},
+		{name: "wrong issuer", tamper: func(c *jwt.Claims) { c.Issuer = "https://evil.example.com" }},
+		{name: "expired", tamper: func(c *jwt.Claims) { c.Expires = jwt.NewNumericTime(time.Now().Add(-2 * time.Minute)) }},
+		{name: "no expiry", tamper: func(c *jwt.Claims) { c.Expires = nil }},
+		{name: "not yet valid", tamper: func(c *jwt.Claims) { c.NotBefore = jwt.NewNumericTime(time.Now().Add(5 * time.Minute)) }},
+		{name: "issued in the future", tamper: func(c *jwt.Claims) { c.Issued = jwt.NewNumericTime(time.Now().Add(5 * time.Minute)) }},
+		{name: "no subject", tamper: func(c *jwt.Claims) { c.Subject = "" }},
+		{name: "unknown key", sign: func(c *jwt.Claims) (string, error) {
+			c.KeyID = oidctest.KeyID
+			token, err := c.RSASign(jwt.RS256, otherKey)
+			return string(token), err
+		}},
+		{name: "symmetric key", sign: func(c *jwt.Claims) (string, error) {
+			token, err := c.HMACSign(jwt.HS256, []byte(idp.ClientSecret))
+			return string(token), err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.Claims(alice, "nonce-1")
+			if tt.tamper != nil {
+				tt.tamper(claims)
+			}
+			sign := idp.Sign
+			if tt.sign != nil {
+				sign = tt.sign
+			}
+			idToken, err := sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			nonce := tt.nonce
+			if nonce == "" {
+				nonce = "nonce-1"
+			}
+			if _, err = p.Verify(context.Background(), idToken, nonce); !errors.Is(err, ErrIDToken) {
+				t.Errorf("got %v, want ErrIDToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyAccepts(t *testing.T) {
+	idp, p := newTestProvider(t)
+
+	tests := []struct {
+		name   string
+		tamper func(*jwt.Claims)
+		want   Identity
+	}{
+		{
+			name: "plain",
+			want: Identity{Subject: alice.Subject, Email: alice.Email, EmailVerified: true, Name: alice.Name},
+		},
+		{
+			name:   "within clock skew",
+			tamper: func(c *jwt.Claims) { c.Expires = jwt.NewNumericTime(time.Now().Add(-30 * time.Second)) },
+			want:   Identity{Subject: alice.Subject, Email: alice.Email, EmailVerified: true, Name: alice.Name},
+		},
+		{
+			name: "several audiences with us as authorized party",
+			tamper: func(c *jwt.Claims) {
+				c.Audiences = []string{idp.ClientID, "client-2"}
+				c.Set["azp"] = idp.ClientID
+			},
+			want: Identity{Subject: alice.Subject, Email: alice.Email, EmailVerified: true, Name: alice.Name},
+		},
+		{
+			name: "email_verified as a string",
+			tamper: func(c *jwt.Claims) {
+				c.Set["email_verified"] = "true"
+				c.Set["preferred_username"] = "alice"
+			},
+			want: Identity{Subject: alice.Subject, Email: alice.Email, EmailVerified: true, Name: alice.Name, Username: "alice"},
+		},
+		{
+			name:   "email not verified",
+			tamper: func(c *jwt.Claims) { c.Set["email_verified"] = false },
+			want:   Identity{Subject: alice.Subject, Email: alice.Email, Name: alice.Name},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.Claims(alice, "nonce-1")
+			if tt.tamper != nil {
+				tt.tamper(claims)
+			}
+			idToken, err := idp.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := p.Verify(context.Background(), idToken, "nonce-1")
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if id != tt.want {
+				t.Errorf("got identity %+v, want %+v", id, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp, _ := newTestProvider(t)
+
+	// the document names the issuer without the slash
+	p := New(Config{Issuer: idp.Issuer() + "/", ClientID: idp.ClientID}, idp.Client())
+	_, err := p.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if !errors.Is(err, ErrDiscovery) || !strings.Contains(err.Error(), "issuer") {
+		t.Errorf("got %v, want ErrDiscovery for the issuer", err)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp, p := newTestProvider(t)
+
+	authURL, err := p.AuthCodeURL(context.Background(), "state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             idp.ClientID,
+		"redirect_uri":          "https://auth.example.com/v1/oidc/test/callback",
+		"scope":                 "openid email profile",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        challengeS256("verifier-1"),
+		"code_challenge_method": "S256",
+	}
+	for name, v := range want {
+		if got := u.Query().Get(name); got != v {
+			t.Errorf("%s = %q, want %q", name, got, v)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"database/sql"
+	"time"
+)
+
+// statusTransitions lists the account statuses each status may move to
+var statusTransitions = map[string][]string{
+	models.StatusActive:      {models.StatusSuspended, models.StatusDeactivated, models.StatusDeleted},
+	models.StatusSuspended:   {models.StatusActive, models.StatusSuspended, models.StatusDeleted},
+	models.StatusDeactivated: {models.StatusActive, models.StatusDeleted},
+	models.StatusDeleted:     {models.StatusActive},
+}
+
+// CanTransition reports whether an account may move from one status to another
+func CanTransition(from, to string) bool {
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAccountStatus returns an error when the user is not allowed to use their account.
+// A suspension whose expiry has passed counts as active.
+func CheckAccountStatus(u models.User) error {
+	switch u.Status {
+	case models.StatusActive:
+		return nil
+	case models.StatusSuspended:
+		if !u.SuspendedUntil.IsZero() && time.Now().After(u.SuspendedUntil) {
+			return nil
+		}
+		return ErrSuspendedAccount
+	default:
+		return ErrInactiveAccount
+	}
+}
+
+// CheckImpersonation returns an error unless actor may act as user: an active
+// admin of the user's tenant acting as someone else, who is not an admin.
+// The user's own status is checked with CheckAccountStatus.
+func CheckImpersonation(actor, user models.User) error {
+	switch {
+	case actor.ID == user.ID, user.Role == models.RoleAdmin:
+		return ErrImpersonation
+	case actor.Role != models.RoleAdmin, actor.TenantID != user.TenantID:
+		return ErrImpersonation
+	}
+	return CheckAccountStatus(actor)
+}
+
+// SetUserStatus moves a user to a new account status, with the outbox messages
+// about it, and returns the previous status
+func (m *DBRepo) SetUserStatus(ctx context.Context, id int, status, reason string, until time.Time, outbox ...models.OutboxMessage) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.SetUserStatus")
+	defer span.End()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, "SetUserStatus", err)
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var current string
+	var erased bool
+	err = tx.QueryRowContext(ctx, `select status, erased_at is not null from users where id = $1`, id).Scan(&current, &erased)
+	if err == sql.ErrNoRows {
+		return "", ErrNoRecord
+	} else if err != nil {
+		logError(ctx, "SetUserStatus", err)
+		return "", err
+	}
+
+	// an erased account has nothing left to come back to
+	if erased || !CanTransition(current, status) {
+		return current, ErrInvalidTransition
+	}
+
+	var suspendedUntil sql.NullTime
+	if status == models.StatusSuspended && !until.IsZero() {
+		suspendedUntil = sql.NullTime{Time: until, Valid: true}
+	}
+
+	var deletedAt sql.NullTime
+	if status == models.StatusDeleted {
+		deletedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+
+	stmt := `
+		update
+			users
+		set
+			status = $1,
+			status_reason = $2,
+			suspended_until = $3,
+			deleted_at = $4,
+			status_changed_at = $5,
+			updated_at = $5
+		where
+			id = $6 and status = $7`
+
+	res, err := tx.ExecContext(ctx, stmt,
+		status,
+		reason,
+		suspendedUntil,
+		deletedAt,
+		time.Now(),
+		id,
+		current,
+	)
+	if err != nil {
+		logError(ctx, "SetUserStatus", err)
+		return current, err
+	}
+
+	// the status changed underneath us, let the caller retry with fresh data
+	if n, _ := res.RowsAffected(); n == 0 {
+		return current, ErrInvalidTransition
+	}
+
+	if err = insertOutbox(ctx, tx, 0, outbox); err != nil {
+		logError(ctx, "SetUserStatus", err)
+		return current, err
+	}
+
+	return current, tx.Commit()
+}
+
+// SetUserRole gives a user a new role and returns the previous role
+func (m *DBRepo) SetUserRole(ctx context.Context, id int, role string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.SetUserRole")
+	defer span.End()
+
+	stmt := `
+		update
+			users u
+		set
+			role = $1,
+			updated_at = $2
+		from
+			users old
+		where
+			u.id = $3 and old.id = u.id
+		returning old.role`
+
+	var previous string
+	err := m.DB.QueryRowContext(ctx, stmt, role, time.Now(), id).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return "", ErrNoRecord
+	} else if err != nil {
+		logError(ctx, "SetUserRole", err)
+		return "", err
+	}
+
+	return previous, nil
+}
@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"auth/api/models"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCanTransition(t *testing.T) {
+	statuses := []string{models.StatusActive, models.StatusSuspended, models.StatusDeactivated, models.StatusDeleted}
+	// allowed lists every move that may be made, anything else is refused
+	allowed := map[[2]string]bool{
+		{models.StatusActive, models.StatusSuspended}:      true,
+		{models.StatusActive, models.StatusDeactivated}:    true,
+		{models.StatusActive, models.StatusDeleted}:        true,
+		{models.StatusSuspended, models.StatusActive}:      true,
+		{models.StatusSuspended, models.StatusSuspended}:   true,
+		{models.StatusSuspended, models.StatusDeleted}:     true,
+		{models.StatusDeactivated, models.StatusActive}:    true,
+		{models.StatusDeactivated, models.StatusDeleted}:   true,
+		{models.StatusDeleted, models.StatusActive}:        true,
+		{models.StatusDeactivated, models.StatusSuspended}: false,
+		{models.StatusDeleted, models.StatusSuspended}:     false,
+	}
+
+	for _, from := range statuses {
+		for _, to := range append(statuses, "banned") {
+			want := allowed[[2]string{from, to}]
+			if got := CanTransition(from, to); got != want {
+				t.Errorf("CanTransition(%q, %q) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+	if CanTransition("banned", models.StatusActive) {
+		t.Error("an unknown status may be left")
+	}
+}
+
+func TestCheckAccountStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    models.User
+		wantErr error
+	}{
+		{"active", models.User{Status: models.StatusActive}, nil},
+		{"suspended", models.User{Status: models.StatusSuspended}, ErrSuspendedAccount},
+		{"suspended until later", models.User{Status: models.StatusSuspended, SuspendedUntil: time.Now().Add(time.Hour)}, ErrSuspendedAccount},
+		{"suspension over", models.User{Status: models.StatusSuspended, SuspendedUntil: time.Now().Add(-time.Minute)}, nil},
+		{"deactivated", models.User{Status: models.StatusDeactivated}, ErrInactiveAccount},
+		{"deleted", models.User{Status: models.StatusDeleted}, ErrInactiveAccount},
+		{"unknown", models.User{Status: "banned"}, ErrInactiveAccount},
+	}
+
+	for _, tt := range tests {
+		if err := CheckAccountStatus(tt.user); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSetUserStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		to      string
+		erased  bool
+		// changed is whether the update found the user still in the current status
+		changed bool
+		wantErr error
+	}{
+		{name: "allowed", current: models.StatusActive, to: models.StatusSuspended, changed: true},
+		{name: "not allowed", current: models.StatusDeactivated, to: models.StatusSuspended, wantErr: ErrInvalidTransition},
+		{name: "changed underneath", current: models.StatusActive, to: models.StatusDeleted, wantErr: ErrInvalidTransition},
+		{name: "restore deleted", current: models.StatusDeleted, to: models.StatusActive, changed: true},
+		{name: "restore erased", current: models.StatusDeleted, to: models.StatusActive, erased: true, wantErr: ErrInvalidTransition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`select status, erased_at is not null from users`).WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"status", "erased"}).AddRow(tt.current, tt.erased))
+			if !tt.erased && CanTransition(tt.current, tt.to) {
+				var n int64
+				if tt.changed {
+					n = 1
+				}
+				mock.ExpectExec(`update\s+users`).
+					WithArgs(tt.to, "reason", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 7, tt.current).
+					WillReturnResult(sqlmock.NewResult(0, n))
+			}
+			if tt.wantErr == nil {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			repo := NewRepo(db)
+			from, err := repo.DB.SetUserStatus(context.Background(), 7, tt.to, "reason", time.Time{})
+			if !errors.Is(err, tt.wantErr) || from != tt.current {
+				t.Errorf("got %q, %v; want %q, %v", from, err, tt.current, tt.wantErr)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCheckImpersonation(t *testing.T) {
+	admin := models.User{ID: 1, TenantID: 1, Role: models.RoleAdmin, Status: models.StatusActive}
+	user := models.User{ID: 7, TenantID: 1, Role: models.RoleUser, Status: models.StatusActive}
+
+	with := func(u models.User, change func(u *models.User)) models.User {
+		change(&u)
+		return u
+	}
+
+	tests := []struct {
+		name    string
+		actor   models.User
+		user    models.User
+		wantErr error
+	}{
+		{"admin as a user of the tenant", admin, user, nil},
+		{"themselves", admin, admin, ErrImpersonation},
+		{"another admin", admin, with(admin, func(u *models.User) { u.ID = 2 }), ErrImpersonation},
+		{"not an admin", with(user, func(u *models.User) { u.ID = 8 }), user, ErrImpersonation},
+		{"user of another tenant", admin, with(user, func(u *models.User) { u.TenantID = 2 }), ErrImpersonation},
+		{"suspended admin", with(admin, func(u *models.User) { u.Status = models.StatusSuspended }), user, ErrSuspendedAccount},
+		{"deactivated admin", with(admin, func(u *models.User) { u.Status = models.StatusDeactivated }), user, ErrInactiveAccount},
+		// the user's own status is checked by the caller
+		{"suspended user", admin, with(user, func(u *models.User) { u.Status = models.StatusSuspended }), nil},
+	}
+
+	for _, tt := range tests {
+		if err := CheckImpersonation(tt.actor, tt.user); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
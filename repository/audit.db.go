@@ -0,0 +1,280 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+// InsertAuditEvent appends an event to the audit trail, chained to the event before it
+func (m *DBRepo) InsertAuditEvent(ctx context.Context, e models.AuditEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.InsertAuditEvent")
+	defer span.End()
+
+	if e.Metadata == nil {
+		e.Metadata = map[string]interface{}{}
+	}
+	raw, err := json.Marshal(e.Metadata)
+	if err != nil {
+		return err
+	}
+	metadata, err := canonicalMetadata(raw)
+	if err != nil {
+		return err
+	}
+
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = time.Now()
+	}
+	// postgres keeps microseconds, hash what will be read back
+	e.OccurredAt = e.OccurredAt.Truncate(time.Microsecond)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, "InsertAuditEvent", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// only one writer may extend the chain at a time
+	if _, err = tx.ExecContext(ctx, `select pg_advisory_xact_lock($1)`, auditChainLock); err != nil {
+		logError(ctx, "InsertAuditEvent", err)
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `select hash from audit_events order by id desc limit 1`).Scan(&e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		logError(ctx, "InsertAuditEvent", err)
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `select nextval(pg_get_serial_sequence('audit_events', 'id'))`).Scan(&e.ID)
+	if err != nil {
+		logError(ctx, "InsertAuditEvent", err)
+		return err
+	}
+	e.Hash = auditHash(e, metadata)
+
+	stmt := `
+	INSERT INTO audit_events
+	    (
+		id,
+		occurred_at,
+		tenant_id,
+		actor_id,
+		subject_id,
+		action,
+		outcome,
+		ip,
+		user_agent,
+		metadata,
+		prev_hash,
+		hash
+		)
+    VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		e.ID,
+		e.OccurredAt,
+		nullID(e.TenantID),
+		nullID(e.ActorID),
+		nullID(e.SubjectID),
+		e.Action,
+		e.Outcome,
+		e.IP,
+		e.UserAgent,
+		metadata,
+		e.PrevHash,
+		e.Hash,
+	)
+	if err != nil {
+		logError(ctx, "InsertAuditEvent", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AuditEvents returns audit events matching the filter, newest first
+func (m *DBRepo) AuditEvents(ctx context.Context, f models.AuditFilter) ([]models.AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.AuditEvents")
+	defer span.End()
+
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.TenantID != 0 {
+		// events written before the tenant was stored go by their users
+		add(`(tenant_id = $%[1]d or (tenant_id is null and
+			(actor_id in (select id from users where tenant_id = $%[1]d)
+			or subject_id in (select id from users where tenant_id = $%[1]d))))`, f.TenantID)
+	}
+	if f.ActorID != 0 {
+		add("actor_id = $%d", f.ActorID)
+	}
+	if f.SubjectID != 0 {
+		add("subject_id = $%d", f.SubjectID)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.Outcome != "" {
+		add("outcome = $%d", f.Outcome)
+	}
+	if f.IP != "" {
+		add("ip = $%d", f.IP)
+	}
+	if !f.From.IsZero() {
+		add("occurred_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("occurred_at < $%d", f.To)
+	}
+	if f.Before != 0 {
+		add("id < $%d", f.Before)
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+
+	stmt := `SELECT id, occurred_at, tenant_id, actor_id, subject_id, action, outcome,
+		ip, user_agent, metadata, prev_hash, hash FROM audit_events`
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, limit)
+	stmt += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		logError(ctx, "AuditEvents", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "AuditEvents", err)
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// AuditEventsForUser returns the events a user took part in as actor or subject
+func (m *DBRepo) AuditEventsForUser(ctx context.Context, id int, actionPrefix string) ([]models.AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.AuditEventsForUser")
+	defer span.End()
+
+	stmt := `SELECT id, occurred_at, tenant_id, actor_id, subject_id, action, outcome,
+		ip, user_agent, metadata, prev_hash, hash FROM audit_events
+		WHERE (actor_id = $1 OR subject_id = $1) AND action LIKE $2
+		ORDER BY id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, id, actionPrefix+"%")
+	if err != nil {
+		logError(ctx, "AuditEventsForUser", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "AuditEventsForUser", err)
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func scanAuditEvent(rows *sql.Rows) (models.AuditEvent, error) {
+	e, metadata, err := scanRawAuditEvent(rows)
+	if err != nil {
+		return e, err
+	}
+
+	if err = json.Unmarshal(metadata, &e.Metadata); err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
+
+// nullID stores a zero id as NULL so foreign keys are not violated
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// scanRawAuditEvent scans an audit row leaving the metadata as stored
+func scanRawAuditEvent(rows *sql.Rows) (models.AuditEvent, []byte, error) {
+	var e models.AuditEvent
+	var tenantID, actorID, subjectID sql.NullInt64
+	var metadata []byte
+
+	err := rows.Scan(
+		&e.ID,
+		&e.OccurredAt,
+		&tenantID,
+		&actorID,
+		&subjectID,
+		&e.Action,
+		&e.Outcome,
+		&e.IP,
+		&e.UserAgent,
+		&metadata,
+		&e.PrevHash,
+		&e.Hash,
+	)
+	if err != nil {
+		return e, nil, err
+	}
+
+	e.TenantID = int(tenantID.Int64)
+	e.ActorID = int(actorID.Int64)
+	e.SubjectID = int(subjectID.Int64)
+	return e, metadata, nil
+}
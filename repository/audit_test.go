@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"auth/api/models"
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestInsertAuditEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	e := models.AuditEvent{
+		OccurredAt: time.Date(2024, 3, 1, 12, 0, 0, 123456789, time.UTC),
+		TenantID:   3,
+		SubjectID:  7,
+		Action:     "user.status_change",
+		Outcome:    "success",
+		IP:         "192.0.2.1",
+		UserAgent:  "test",
+		Metadata:   map[string]interface{}{"to": "suspended", "from": "active"},
+	}
+
+	// the event is chained to the last one, hashed as it will be read back
+	stored := e
+	stored.ID = 5
+	stored.OccurredAt = e.OccurredAt.Truncate(time.Microsecond)
+	stored.PrevHash = "prev"
+	metadata := []byte(`{"from":"active","to":"suspended"}`)
+	stored.Hash = auditHash(stored, metadata)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WithArgs(auditChainLock).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`select hash from audit_events order by id desc limit 1`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow("prev"))
+	mock.ExpectQuery(`nextval`).WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(5))
+	mock.ExpectExec(`INSERT INTO audit_events`).
+		WithArgs(int64(5), stored.OccurredAt, int64(3), nil, int64(7), e.Action, e.Outcome,
+			e.IP, e.UserAgent, metadata, "prev", stored.Hash).
+		WillReturnResult(sqlmock.NewResult(5, 1))
+	mock.ExpectCommit()
+
+	repo := NewRepo(db)
+	if err = repo.DB.InsertAuditEvent(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInsertFirstAuditEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WithArgs(auditChainLock).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`select hash from audit_events`).WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+	mock.ExpectQuery(`nextval`).WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(1))
+	mock.ExpectExec(`INSERT INTO audit_events`).
+		WithArgs(int64(1), sqlmock.AnyArg(), nil, nil, nil, "auth.signin", "failure",
+			"", "", []byte(`{}`), "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	repo := NewRepo(db)
+	err = repo.DB.InsertAuditEvent(context.Background(), models.AuditEvent{Action: "auth.signin", Outcome: "failure"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter models.AuditFilter
+		query  string
+		args   []driver.Value
+	}{
+		{
+			name:  "no filter",
+			query: `FROM audit_events ORDER BY id DESC LIMIT \$1`,
+			args:  []driver.Value{defaultAuditLimit},
+		},
+		{
+			name:   "tenant",
+			filter: models.AuditFilter{TenantID: 3, Limit: 10},
+			query: `FROM audit_events WHERE \(tenant_id = \$1 or \(tenant_id is null and ` +
+				`\(actor_id in \(select id from users where tenant_id = \$1\) ` +
+				`or subject_id in \(select id from users where tenant_id = \$1\)\)\)\) ORDER BY id DESC LIMIT \$2`,
+			args: []driver.Value{3, 10},
+		},
+		{
+			name:   "every filter",
+			filter: models.AuditFilter{TenantID: 3, Action: "auth.signin", Outcome: "failure", Before: 90, Limit: 5000},
+			query:  `WHERE \(tenant_id = \$1 .*\) AND action = \$2 AND outcome = \$3 AND id < \$4 ORDER BY id DESC LIMIT \$5`,
+			args:   []driver.Value{3, "auth.signin", "failure", int64(90), maxAuditLimit},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery(tt.query).WithArgs(tt.args...).WillReturnRows(auditRows(testChain(2)))
+
+			repo := NewRepo(db)
+			events, err := repo.DB.AuditEvents(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 2 || events[1].TenantID != 1 {
+				t.Errorf("got %+v", events)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
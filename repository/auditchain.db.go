@@ -0,0 +1,230 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditChainLock is the advisory lock key serialising writes to the audit chain
+const auditChainLock = 7270029
+
+// canonicalMetadata rewrites metadata json into the single form that is hashed.
+// Postgres reorders jsonb keys and whitespace, so hashes never use the stored bytes.
+func canonicalMetadata(raw []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// auditHash hashes the content of an event together with the hash of the event before it
+func auditHash(e models.AuditEvent, metadata []byte) string {
+	fields := []string{
+		e.PrevHash,
+		strconv.FormatInt(e.ID, 10),
+		e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(e.ActorID),
+		strconv.Itoa(e.SubjectID),
+		e.Action,
+		e.Outcome,
+		e.IP,
+		e.UserAgent,
+		string(metadata),
+	}
+	// events from before tenants were stored hash without one
+	if e.TenantID != 0 {
+		fields = append(fields, strconv.Itoa(e.TenantID))
+	}
+
+	h := sha256.New()
+	for _, f := range fields {
+		// length prefix every field so values can't bleed into each other
+		fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkpointMessage is the statement signed by a checkpoint
+func checkpointMessage(eventID int64, eventHash string) []byte {
+	return []byte(fmt.Sprintf("audit-checkpoint:%d:%s", eventID, eventHash))
+}
+
+// CreateAuditCheckpoint signs the current head of the audit chain. No checkpoint
+// is written when nothing was added since the last one.
+func (m *DBRepo) CreateAuditCheckpoint(ctx context.Context, key ed25519.PrivateKey) (models.AuditCheckpoint, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.CreateAuditCheckpoint")
+	defer span.End()
+
+	var c models.AuditCheckpoint
+
+	err := m.DB.QueryRowContext(ctx, `select id, hash from audit_events
+		where hash <> '' order by id desc limit 1`).Scan(&c.EventID, &c.EventHash)
+	if err == sql.ErrNoRows {
+		return c, false, nil
+	} else if err != nil {
+		logError(ctx, "CreateAuditCheckpoint", err)
+		return c, false, err
+	}
+
+	var last int64
+	err = m.DB.QueryRowContext(ctx, `select coalesce(max(event_id), 0) from audit_checkpoints`).Scan(&last)
+	if err != nil {
+		logError(ctx, "CreateAuditCheckpoint", err)
+		return c, false, err
+	}
+	if last >= c.EventID {
+		return c, false, nil
+	}
+
+	c.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, checkpointMessage(c.EventID, c.EventHash)))
+	c.CreatedAt = time.Now()
+
+	stmt := `insert into audit_checkpoints (event_id, event_hash, signature, created_at)
+		values ($1, $2, $3, $4) returning id`
+	err = m.DB.QueryRowContext(ctx, stmt, c.EventID, c.EventHash, c.Signature, c.CreatedAt).Scan(&c.ID)
+	if err != nil {
+		logError(ctx, "CreateAuditCheckpoint", err)
+		return c, false, err
+	}
+
+	return c, true, nil
+}
+
+// VerifyAuditChain walks the whole audit trail recomputing every hash and checks
+// each checkpoint signature against the chain. Every break found is reported.
+func (m *DBRepo) VerifyAuditChain(ctx context.Context, pub ed25519.PublicKey) (models.AuditVerification, error) {
+	ctx, span := tracing.Start(ctx, "DBRepo.VerifyAuditChain")
+	defer span.End()
+
+	result := models.AuditVerification{Breaks: []models.AuditBreak{}}
+	broken := func(eventID, checkpointID int64, format string, args ...interface{}) {
+		result.Breaks = append(result.Breaks, models.AuditBreak{
+			EventID:      eventID,
+			CheckpointID: checkpointID,
+			Reason:       fmt.Sprintf(format, args...),
+		})
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, occurred_at, tenant_id, actor_id, subject_id, action, outcome,
+		ip, user_agent, metadata, prev_hash, hash FROM audit_events ORDER BY id`)
+	if err != nil {
+		logError(ctx, "VerifyAuditChain", err)
+		return result, err
+	}
+	defer rows.Close()
+
+	// hashes of chained events, used to check the checkpoints afterwards
+	hashes := map[int64]string{}
+	chained := false
+	prevHash := ""
+
+	for rows.Next() {
+		e, raw, err := scanRawAuditEvent(rows)
+		if err != nil {
+			return result, err
+		}
+		result.Events++
+
+		if e.Hash == "" {
+			if chained {
+				broken(e.ID, 0, "event has no hash inside the chain")
+			} else {
+				result.Unchained++
+			}
+			continue
+		}
+		chained = true
+
+		if e.PrevHash != prevHash {
+			broken(e.ID, 0, "previous hash %s does not match the preceding event %s, events were removed or inserted", short(e.PrevHash), short(prevHash))
+		}
+
+		metadata, err := canonicalMetadata(raw)
+		if err != nil {
+			broken(e.ID, 0, "metadata is not valid json: %v", err)
+		} else if h := auditHash(e, metadata); h != e.Hash {
+			broken(e.ID, 0, "content does not match its hash, the event was modified")
+		}
+
+		hashes[e.ID] = e.Hash
+		prevHash = e.Hash
+	}
+	if err = rows.Err(); err != nil {
+		logError(ctx, "VerifyAuditChain", err)
+		return result, err
+	}
+
+	checkpoints, err := m.DB.QueryContext(ctx, `SELECT id, event_id, event_hash, signature, created_at
+		FROM audit_checkpoints ORDER BY id`)
+	if err != nil {
+		logError(ctx, "VerifyAuditChain", err)
+		return result, err
+	}
+	defer checkpoints.Close()
+
+	for checkpoints.Next() {
+		var c models.AuditCheckpoint
+		if err = checkpoints.Scan(&c.ID, &c.EventID, &c.EventHash, &c.Signature, &c.CreatedAt); err != nil {
+			logError(ctx, "VerifyAuditChain", err)
+			return result, err
+		}
+		result.Checkpoints++
+
+		sig, err := base64.StdEncoding.DecodeString(c.Signature)
+		if err != nil || !ed25519.Verify(pub, checkpointMessage(c.EventID, c.EventHash), sig) {
+			broken(c.EventID, c.ID, "checkpoint signature is invalid")
+			continue
+		}
+
+		h, ok := hashes[c.EventID]
+		switch {
+		case !ok:
+			broken(c.EventID, c.ID, "signed checkpoint refers to an event that is missing from the chain")
+		case h != c.EventHash:
+			broken(c.EventID, c.ID, "event hash %s differs from the signed checkpoint %s, the chain was rewritten", short(h), short(c.EventHash))
+		}
+	}
+	if err = checkpoints.Err(); err != nil {
+		logError(ctx, "VerifyAuditChain", err)
+		return result, err
+	}
+
+	return result, nil
+}
+
+func short(hash string) string {
+	if hash == "" {
+		return "(none)"
+	}
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// ParseAuditKey reads a hex encoded ed25519 seed
+func ParseAuditKey(seed string) (ed25519.PrivateKey, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(seed))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.SeedSize {
+		return nil, fmt.Errorf("audit key must be %d bytes, got %d", ed25519.SeedSize, len(b))
+	}
+	return ed25519.NewKeyFromSeed(b), nil
+}
@@ -0,0 +1,325 @@
+package repository
+
+import (
+	"auth/api/models"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var auditColumns = []string{"id", "occurred_at", "tenant_id", "actor_id", "subject_id", "action", "outcome",
+	"ip", "user_agent", "metadata", "prev_hash", "hash"}
+
+// storedEvent is an audit row as postgres returns it
+type storedEvent struct {
+	models.AuditEvent
+	// metadata is the stored jsonb, which postgres may have reordered
+	metadata string
+}
+
+// testChain returns n chained events, the first of them with a tenant
+func testChain(n int) []storedEvent {
+	var events []storedEvent
+	prev := ""
+	for i := 1; i <= n; i++ {
+		e := models.AuditEvent{
+			ID:         int64(i),
+			OccurredAt: time.Date(2024, 3, 1, 12, 0, i, 123456000, time.UTC),
+			ActorID:    1,
+			SubjectID:  i,
+			Action:     "auth.signin",
+			Outcome:    "success",
+			IP:         "192.0.2.1",
+			UserAgent:  "test",
+			PrevHash:   prev,
+		}
+		if i > 1 {
+			e.TenantID = 1
+		}
+		e.Hash = auditHash(e, []byte(`{"a":1,"b":"x"}`))
+		prev = e.Hash
+		events = append(events, storedEvent{AuditEvent: e, metadata: `{"b": "x", "a": 1}`})
+	}
+	return events
+}
+
+func auditRows(events []storedEvent) *sqlmock.Rows {
+	rows := sqlmock.NewRows(auditColumns)
+	for _, e := range events {
+		var tenantID interface{}
+		if e.TenantID != 0 {
+			tenantID = e.TenantID
+		}
+		rows.AddRow(e.ID, e.OccurredAt, tenantID, e.ActorID, e.SubjectID, e.Action, e.Outcome,
+			e.IP, e.UserAgent, []byte(e.metadata), e.PrevHash, e.Hash)
+	}
+	return rows
+}
+
+func testCheckpoint(key ed25519.PrivateKey, id, eventID int64, eventHash string) []interface{} {
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, checkpointMessage(eventID, eventHash)))
+	return []interface{}{id, eventID, eventHash, sig, time.Now()}
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	otherKey := ed25519.NewKeyFromSeed([]byte(strings.Repeat("k", ed25519.SeedSize)))
+
+	tests := []struct {
+		name string
+		// alter tampers with the stored chain
+		alter       func(events []storedEvent) []storedEvent
+		checkpoints func(events []storedEvent) [][]interface{}
+		unchained   int
+		// breaks are the event ids reported broken, in order
+		breaks []int64
+		reason string
+	}{
+		{
+			name: "intact",
+			checkpoints: func(events []storedEvent) [][]interface{} {
+				return [][]interface{}{testCheckpoint(key, 1, 2, events[1].Hash), testCheckpoint(key, 2, 4, events[3].Hash)}
+			},
+		},
+		{
+			name: "events from before the chain",
+			alter: func(events []storedEvent) []storedEvent {
+				legacy := storedEvent{AuditEvent: models.AuditEvent{ID: 0, OccurredAt: time.Now(), Action: "auth.signin"}, metadata: "{}"}
+				return append([]storedEvent{legacy}, events...)
+			},
+			unchained: 1,
+		},
+		{
+			name: "content modified",
+			alter: func(events []storedEvent) []storedEvent {
+				events[2].Outcome = "failure"
+				return events
+			},
+			breaks: []int64{3},
+			reason: "modified",
+		},
+		{
+			name: "metadata modified",
+			alter: func(events []storedEvent) []storedEvent {
+				events[1].metadata = `{"a": 2, "b": "x"}`
+				return events
+			},
+			breaks: []int64{2},
+			reason: "modified",
+		},
+		{
+			name: "tenant removed",
+			alter: func(events []storedEvent) []storedEvent {
+				events[3].TenantID = 0
+				return events
+			},
+			breaks: []int64{4},
+			reason: "modified",
+		},
+		{
+			name: "event removed",
+			alter: func(events []storedEvent) []storedEvent {
+				return append(events[:1], events[2:]...)
+			},
+			breaks: []int64{3},
+			reason: "removed or inserted",
+		},
+		{
+			name: "hash removed inside the chain",
+			alter: func(events []storedEvent) []storedEvent {
+				events[1].Hash = ""
+				return events
+			},
+			// the event after it no longer follows on either
+			breaks: []int64{2, 3},
+		},
+		{
+			name: "checkpoint signed with another key",
+			checkpoints: func(events []storedEvent) [][]interface{} {
+				return [][]interface{}{testCheckpoint(otherKey, 1, 2, events[1].Hash)}
+			},
+			breaks: []int64{2},
+			reason: "signature is invalid",
+		},
+		{
+			name: "chain rewritten after a checkpoint",
+			alter: func(events []storedEvent) []storedEvent {
+				// rehashing from event 2 on hides the change from the chain itself
+				events[1].SubjectID = 99
+				for i := 1; i < len(events); i++ {
+					events[i].PrevHash = events[i-1].Hash
+					events[i].Hash = auditHash(events[i].AuditEvent, []byte(`{"a":1,"b":"x"}`))
+				}
+				return events
+			},
+			checkpoints: func(events []storedEvent) [][]interface{} {
+				return [][]interface{}{testCheckpoint(key, 1, 3, testChain(4)[2].Hash)}
+			},
+			breaks: []int64{3},
+			reason: "the chain was rewritten",
+		},
+		{
+			name: "checkpointed event missing",
+			alter: func(events []storedEvent) []storedEvent {
+				return events[:3]
+			},
+			checkpoints: func(events []storedEvent) [][]interface{} {
+				return [][]interface{}{testCheckpoint(key, 1, 4, testChain(4)[3].Hash)}
+			},
+			breaks: []int64{4},
+			reason: "missing from the chain",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			events := testChain(4)
+			if tt.alter != nil {
+				events = tt.alter(events)
+			}
+			checkpoints := sqlmock.NewRows([]string{"id", "event_id", "event_hash", "signature", "created_at"})
+			if tt.checkpoints != nil {
+				for _, c := range tt.checkpoints(events) {
+					checkpoints.AddRow(c[0], c[1], c[2], c[3], c[4])
+				}
+			}
+			mock.ExpectQuery(`FROM audit_events ORDER BY id`).WillReturnRows(auditRows(events))
+			mock.ExpectQuery(`FROM audit_checkpoints ORDER BY id`).WillReturnRows(checkpoints)
+
+			repo := NewRepo(db)
+			got, err := repo.DB.VerifyAuditChain(context.Background(), key.Public().(ed25519.PublicKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Events != len(events) || got.Unchained != tt.unchained {
+				t.Errorf("got %d events, %d unchained; want %d, %d", got.Events, got.Unchained, len(events), tt.unchained)
+			}
+			var breaks []int64
+			for _, b := range got.Breaks {
+				breaks = append(breaks, b.EventID)
+			}
+			if len(breaks) != len(tt.breaks) {
+				t.Fatalf("got breaks %+v, want events %v", got.Breaks, tt.breaks)
+			}
+			for i := range breaks {
+				if breaks[i] != tt.breaks[i] {
+					t.Errorf("got breaks %+v, want events %v", got.Breaks, tt.breaks)
+				}
+			}
+			if tt.reason != "" && !strings.Contains(got.Breaks[0].Reason, tt.reason) {
+				t.Errorf("got reason %q, want it to mention %q", got.Breaks[0].Reason, tt.reason)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCreateAuditCheckpoint(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	head := testChain(3)[2]
+
+	tests := []struct {
+		name string
+		// last is the event id of the latest checkpoint
+		last    int64
+		empty   bool
+		written bool
+	}{
+		{name: "new events", last: 2, written: true},
+		{name: "first checkpoint", last: 0, written: true},
+		{name: "nothing new", last: 3},
+		{name: "empty trail", empty: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			rows := sqlmock.NewRows([]string{"id", "hash"})
+			if !tt.empty {
+				rows.AddRow(head.ID, head.Hash)
+			}
+			mock.ExpectQuery(`select id, hash from audit_events`).WillReturnRows(rows)
+			if !tt.empty {
+				mock.ExpectQuery(`from audit_checkpoints`).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(tt.last))
+			}
+			if tt.written {
+				mock.ExpectQuery(`insert into audit_checkpoints`).
+					WithArgs(head.ID, head.Hash, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+			}
+
+			repo := NewRepo(db)
+			c, written, err := repo.DB.CreateAuditCheckpoint(context.Background(), key)
+			if err != nil || written != tt.written {
+				t.Fatalf("got written %v, %v; want %v", written, err, tt.written)
+			}
+			if written {
+				sig, err := base64.StdEncoding.DecodeString(c.Signature)
+				if err != nil || !ed25519.Verify(key.Public().(ed25519.PublicKey), checkpointMessage(head.ID, head.Hash), sig) {
+					t.Errorf("signature %q does not verify for event %d", c.Signature, head.ID)
+				}
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestAuditHashFields(t *testing.T) {
+	e := testChain(1)[0].AuditEvent
+	metadata := []byte(`{"a":1,"b":"x"}`)
+	h := auditHash(e, metadata)
+
+	// values moved between fields hash differently
+	moved := e
+	moved.IP, moved.UserAgent = e.IP+e.UserAgent, ""
+	if auditHash(moved, metadata) == h {
+		t.Error("moving a value into the next field kept the hash")
+	}
+
+	with := e
+	with.TenantID = 1
+	if auditHash(with, metadata) == h {
+		t.Error("the tenant is not hashed")
+	}
+}
+
+func TestParseAuditKey(t *testing.T) {
+	tests := []struct {
+		seed    string
+		wantErr bool
+	}{
+		{strings.Repeat("ab", ed25519.SeedSize), false},
+		{" " + strings.Repeat("00", ed25519.SeedSize) + "\n", false},
+		{strings.Repeat("ab", ed25519.SeedSize-1), true},
+		{strings.Repeat("zz", ed25519.SeedSize), true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseAuditKey(tt.seed)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAuditKey(%q) error %v, want error %v", tt.seed, err, tt.wantErr)
+		}
+	}
+}
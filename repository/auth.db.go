@@ -1,26 +1,32 @@
 package repository
 
 import (
+	"auth/api/logging"
 	"auth/api/models"
+	"auth/api/tracing"
 	"context"
 	"database/sql"
 
-	"log"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 // AllUsers returns all users
-func (m *DBRepo) AllUsers() ([]*models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBRepo) AllUsers(ctx context.Context) ([]*models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	stmt := `SELECT id, name, email, username, updated_at FROM users
-		where deleted_at is null`
+	ctx, span := tracing.Start(ctx, "DBRepo.AllUsers")
+	defer span.End()
+
+	stmt := `SELECT id, tenant_id, name, email, username, role, status, status_reason,
+			suspended_until, created_at, updated_at FROM users
+		where deleted_at is null order by id`
 
 	rows, err := m.DB.QueryContext(ctx, stmt)
 	if err != nil {
+		logError(ctx, "AllUsers", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -29,16 +35,20 @@ func (m *DBRepo) AllUsers() ([]*models.User, error) {
 
 	for rows.Next() {
 		s := &models.User{}
-		err = rows.Scan(&s.ID, &s.Name, &s.Email, &s.UserName, &s.CreatedAt, &s.UpdatedAt)
+		var suspendedUntil sql.NullTime
+		err = rows.Scan(&s.ID, &s.TenantID, &s.Name, &s.Email, &s.UserName, &s.Role, &s.Status,
+			&s.StatusReason, &suspendedUntil, &s.CreatedAt, &s.UpdatedAt)
 		if err != nil {
+			logError(ctx, "AllUsers", err)
 			return nil, err
 		}
+		s.SuspendedUntil = suspendedUntil.Time
 		// Append it to the slice
 		users = append(users, s)
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Println(err)
+		logError(ctx, "AllUsers", err)
 		return nil, err
 	}
 
@@ -46,98 +56,142 @@ func (m *DBRepo) AllUsers() ([]*models.User, error) {
 }
 
 // GetUserById returns a user by id
-func (m *DBRepo) GetUserById(id int) (models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBRepo) GetUserById(ctx context.Context, id int) (models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	stmt := `SELECT id, name, email, username,
-			created_at, updated_at
+	ctx, span := tracing.Start(ctx, "DBRepo.GetUserById")
+	defer span.End()
+
+	stmt := `SELECT id, tenant_id, name, email, username, role, status,
+			status_reason, suspended_until, created_at, updated_at,
+			phone, phone_verified_at, sms_mfa
 			FROM users where id = $1`
 	row := m.DB.QueryRowContext(ctx, stmt, id)
 
 	var u models.User
+	var suspendedUntil, phoneVerifiedAt sql.NullTime
 
 	err := row.Scan(
 		&u.ID,
+		&u.TenantID,
 		&u.Name,
 		&u.Email,
 		&u.UserName,
+		&u.Role,
+		&u.Status,
+		&u.StatusReason,
+		&suspendedUntil,
 		&u.CreatedAt,
 		&u.UpdatedAt,
+		&u.Phone,
+		&phoneVerifiedAt,
+		&u.SMSMFA,
 	)
 
 	if err != nil {
-		log.Println("DB can't get user info ", err)
+		logError(ctx, "GetUserById", err)
 		return u, err
 	}
+	u.SuspendedUntil = suspendedUntil.Time
+	u.PhoneVerifiedAt = phoneVerifiedAt.Time
 
 	return u, nil
 }
 
-// GetUserById returns a user by id
-func (m *DBRepo) GetUserByEmail(email string) (models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetUserByEmail returns a user of a tenant by email for password resets.
+// Users whose account is not active are refused.
+func (m *DBRepo) GetUserByEmail(ctx context.Context, tenantID int, email string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	stmt := `SELECT id, name, email, username,
+	ctx, span := tracing.Start(ctx, "DBRepo.GetUserByEmail")
+	defer span.End()
+
+	stmt := `SELECT id, tenant_id, name, email, username, role, status, suspended_until,
 			created_at, updated_at, password_reset_code
-			FROM users where email = $1`
-	row := m.DB.QueryRowContext(ctx, stmt, email)
+			FROM users where tenant_id = $1 and email = $2`
+	row := m.DB.QueryRowContext(ctx, stmt, tenantID, email)
 
 	var u models.User
+	var suspendedUntil sql.NullTime
 
 	err := row.Scan(
 		&u.ID,
+		&u.TenantID,
 		&u.Name,
 		&u.Email,
 		&u.UserName,
+		&u.Role,
+		&u.Status,
+		&suspendedUntil,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 		&u.PasswordResetCode,
 	)
 
 	if err != nil {
-		log.Println("DB can't get user info ", err)
+		logError(ctx, "GetUserByEmail", err)
+		return u, err
+	}
+	u.SuspendedUntil = suspendedUntil.Time
+
+	if err = CheckAccountStatus(u); err != nil {
 		return u, err
 	}
 
 	return u, nil
 }
 
-// Authenticate authenticates
-func (m *DBRepo) Authenticate(username, testPassword string) (int, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// Authenticate checks the password of a user of a tenant
+func (m *DBRepo) Authenticate(ctx context.Context, tenantID int, username, testPassword string) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	ctx, span := tracing.Start(ctx, "DBRepo.Authenticate")
+	defer span.End()
+
 	var id int
 	var hashedPassword string
-	//var userActive int
+	var u models.User
+	var suspendedUntil sql.NullTime
 
 	query := `
 		select 
-		    id, password 
+		    id, password, status, suspended_until
 		from 
 			users 
 		where 
-			username = $1
+			tenant_id = $1 and username = $2
 	and deleted_at is null`
 
-	row := m.DB.QueryRowContext(ctx, query, username)
-	err := row.Scan(&id, &hashedPassword)
+	row := m.DB.QueryRowContext(ctx, query, tenantID, username)
+	err := row.Scan(&id, &hashedPassword, &u.Status, &suspendedUntil)
 
 	if err == sql.ErrNoRows {
 		return 0, "", ErrInvalidCredentials
 	} else if err != nil {
-		log.Println(err)
+		logError(ctx, "Authenticate", err)
 		return 0, "", err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	// users created by an identity provider have no password here
+	if hashedPassword == "" {
+		return 0, "", ErrInvalidCredentials
+	}
+
+	err = ComparePassword(ctx, hashedPassword, testPassword)
 	if err == bcrypt.ErrMismatchedHashAndPassword {
-		log.Print(err)
+		logging.FromContext(ctx).Info("password mismatch", "op", "Authenticate")
 		return 0, "", ErrInvalidCredentials
 	} else if err != nil {
-		log.Println(err)
+		logError(ctx, "Authenticate", err)
+		return 0, "", err
+	}
+
+	// The password is correct, only tell the caller about the account status now
+	u.SuspendedUntil = suspendedUntil.Time
+	if err = CheckAccountStatus(u); err != nil {
 		return 0, "", err
 	}
 
@@ -145,23 +199,33 @@ func (m *DBRepo) Authenticate(username, testPassword string) (int, string, error
 	return id, hashedPassword, nil
 }
 
-// Insert method to add a new record to the users table.
-func (m *DBRepo) InsertUser(u models.User) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// Insert method to add a new record to the users table, with the outbox
+// messages about it. The new id is set as the user id of events.
+func (m *DBRepo) InsertUser(ctx context.Context, u models.User, outbox ...models.OutboxMessage) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	password := []byte(u.Password)
+	ctx, span := tracing.Start(ctx, "DBRepo.InsertUser")
+	defer span.End()
 
 	// Create a bcrypt hash of the plain-text password.
-	hashedPassword, err := bcrypt.GenerateFromPassword(password, 12)
+	hashedPassword, err := HashPassword(ctx, u.Password)
 	if err != nil {
-		log.Print(err)
+		logError(ctx, "InsertUser", err)
 		return 0, err
 	}
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, "InsertUser", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
 	stmt := `
 	INSERT INTO users 
 	    (
+		tenant_id,
 		name,  
 		email,
 		username, 
@@ -169,10 +233,11 @@ func (m *DBRepo) InsertUser(u models.User) (int, error) {
 		created_at,
 		updated_at
 		)
-    VALUES($1, $2, $3, $4, $5, $6) returning id `
+    VALUES($1, $2, $3, $4, $5, $6, $7) returning id `
 
 	var newId int
-	err = m.DB.QueryRowContext(ctx, stmt,
+	err = tx.QueryRowContext(ctx, stmt,
+		u.TenantID,
 		u.Name,
 		u.Email,
 		u.UserName,
@@ -182,18 +247,26 @@ func (m *DBRepo) InsertUser(u models.User) (int, error) {
 	).Scan(&newId)
 
 	if err != nil {
-		log.Print(err)
+		logError(ctx, "InsertUser", err)
 		return 0, err
 	}
 
-	return newId, err
+	if err = insertOutbox(ctx, tx, newId, outbox); err != nil {
+		logError(ctx, "InsertUser", err)
+		return 0, err
+	}
+
+	return newId, tx.Commit()
 }
 
 // UpdateUser updates a user by id
-func (m *DBRepo) UpdateUser(u models.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	ctx, span := tracing.Start(ctx, "DBRepo.UpdateUser")
+	defer span.End()
+
 	stmt := `
 		update 
 			users 
@@ -213,18 +286,29 @@ func (m *DBRepo) UpdateUser(u models.User) error {
 		u.ID,
 	)
 	if err != nil {
-		log.Println(err)
+		logError(ctx, "UpdateUser", err)
 		return err
 	}
 
 	return nil
 }
 
-// UpdateUserPassword updates a user by id
-func (m *DBRepo) UpdateUserPassword(u models.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// UpdateUserPassword sets the password of the user holding the reset code,
+// with the outbox messages about it. ErrNoRecord means the code was not valid.
+func (m *DBRepo) UpdateUserPassword(ctx context.Context, u models.User, outbox ...models.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	ctx, span := tracing.Start(ctx, "DBRepo.UpdateUserPassword")
+	defer span.End()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, "UpdateUserPassword", err)
+		return err
+	}
+	defer tx.Rollback()
+
 	stmt := `
 		update 
 			users 
@@ -232,25 +316,23 @@ func (m *DBRepo) UpdateUserPassword(u models.User) error {
 			password = $1,
 			updated_at = $2
 		where
-			email = $3 and password_reset_code = $4
+			email = $3 and password_reset_code = $4 and tenant_id = $5
 			`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
+	res, err := tx.ExecContext(ctx, stmt,
 		u.Password,
 		time.Now(),
 		u.Email,
 		u.PasswordResetCode,
+		u.TenantID,
 	)
-	log.Println(u.Email)
-
-	if err == sql.ErrNoRows {
-		log.Println("User not in DB")
-		return err
-	}
 	if err != nil {
-		log.Println(err)
+		logError(ctx, "UpdateUserPassword", err)
 		return err
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRecord
+	}
 	u.PasswordResetCode = ""
 	newStmt := `
 		update 
@@ -258,81 +340,122 @@ func (m *DBRepo) UpdateUserPassword(u models.User) error {
 		set 
 			password_reset_code = $1
 		where
-			email = $2 and password = $3
+			email = $2 and password = $3 and tenant_id = $4
 			`
 
-	_, err = m.DB.ExecContext(ctx, newStmt,
+	_, err = tx.ExecContext(ctx, newStmt,
 		"",
 		u.Email,
 		u.Password,
+		u.TenantID,
 	)
 	if err != nil {
-		log.Println(err)
+		logError(ctx, "UpdateUserPassword", err)
 		return err
 	}
 
-	return nil
+	if err = insertOutbox(ctx, tx, 0, outbox); err != nil {
+		logError(ctx, "UpdateUserPassword", err)
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// UpdateUser updates a user by id
-func (m *DBRepo) AddResetPasswordCodeToUser(u models.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// AddResetPasswordCodeToUser stores a reset code for the user, with the
+// outbox messages sending it
+func (m *DBRepo) AddResetPasswordCodeToUser(ctx context.Context, u models.User, outbox ...models.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	ctx, span := tracing.Start(ctx, "DBRepo.AddResetPasswordCodeToUser")
+	defer span.End()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, "AddResetPasswordCodeToUser", err)
+		return err
+	}
+	defer tx.Rollback()
+
 	stmt := `
 		update 
 			users 
 		set 
 			password_reset_code = $1
 		where
-			email = $2`
+			email = $2 and tenant_id = $3`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
+	_, err = tx.ExecContext(ctx, stmt,
 		u.PasswordResetCode,
 		u.Email,
+		u.TenantID,
 	)
 	if err != nil {
-		log.Println(err)
+		logError(ctx, "AddResetPasswordCodeToUser", err)
 		return err
 	}
 
-	return nil
+	if err = insertOutbox(ctx, tx, 0, outbox); err != nil {
+		logError(ctx, "AddResetPasswordCodeToUser", err)
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // DeleteUser sets a user to deleted by populating deleted_at value
-func (m *DBRepo) DeleteUser(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBRepo) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	stmt := `update users set deleted_at = $1 where id = $2`
+	ctx, span := tracing.Start(ctx, "DBRepo.DeleteUser")
+	defer span.End()
+
+	stmt := `update users set deleted_at = $1, status = 'deleted', status_changed_at = $1 where id = $2`
 
 	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
 	if err != nil {
-		log.Println(err)
+		logError(ctx, "DeleteUser", err)
 		return err
 	}
 
 	return nil
 }
 
-// ChangePassword resets a password
-func (m *DBRepo) ChangePassword(id int, newPassword string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// ChangePassword resets a password, with the outbox messages about it
+func (m *DBRepo) ChangePassword(ctx context.Context, id int, newPassword string, outbox ...models.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	ctx, span := tracing.Start(ctx, "DBRepo.ChangePassword")
+	defer span.End()
+
 	// Create a bcrypt hash of the plain-text password.
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), 12)
+	hashedPassword, err := HashPassword(ctx, newPassword)
+	if err != nil {
+		logError(ctx, "ChangePassword", err)
+		return err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
-		log.Println(err)
+		logError(ctx, "ChangePassword", err)
 		return err
 	}
+	defer tx.Rollback()
 
 	stmt := `update users set password = $1 where id = $2`
-	_, err = m.DB.ExecContext(ctx, stmt, hashedPassword, id)
+	_, err = tx.ExecContext(ctx, stmt, hashedPassword, id)
 	if err != nil {
-		log.Println(err)
+		logError(ctx, "ChangePassword", err)
 		return err
 	}
 
-	return nil
+	if err = insertOutbox(ctx, tx, 0, outbox); err != nil {
+		logError(ctx, "ChangePassword", err)
+		return err
+	}
+
+	return tx.Commit()
 }
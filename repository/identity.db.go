@@ -0,0 +1,259 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// GetIdentity returns the identity a provider's subject signs in as
+func (m *DBRepo) GetIdentity(ctx context.Context, tenantID int, provider, subject string) (models.Identity, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.GetIdentity")
+	defer span.End()
+
+	stmt := `SELECT id, tenant_id, user_id, provider, subject, email, created_at, last_login_at
+			FROM identities where tenant_id = $1 and provider = $2 and subject = $3`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, tenantID, provider, subject)
+	if err != nil {
+		logError(ctx, "GetIdentity", err)
+		return models.Identity{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return models.Identity{}, err
+		}
+		return models.Identity{}, ErrNoRecord
+	}
+
+	return scanIdentity(rows)
+}
+
+// UserIdentities returns the provider accounts linked to a user
+func (m *DBRepo) UserIdentities(ctx context.Context, userID int) ([]models.Identity, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.UserIdentities")
+	defer span.End()
+
+	stmt := `SELECT id, tenant_id, user_id, provider, subject, email, created_at, last_login_at
+			FROM identities where user_id = $1 order by created_at`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		logError(ctx, "UserIdentities", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []models.Identity{}
+	for rows.Next() {
+		i, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "UserIdentities", err)
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// InsertIdentity links a provider account to an existing user
+func (m *DBRepo) InsertIdentity(ctx context.Context, i models.Identity) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.InsertIdentity")
+	defer span.End()
+
+	id, err := insertIdentity(ctx, m.DB, i)
+	if err != nil {
+		logError(ctx, "InsertIdentity", err)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// ProvisionUser creates a user for a provider account that signed in for the
+// first time, together with the identity linking them. The user gets no
+// password, so they can only sign in through the provider. ErrDuplicateEmail
+// and ErrDuplicateUsername say which one is taken in the tenant. The outbox
+// messages are written with them, the new id set as the user id of events.
+func (m *DBRepo) ProvisionUser(ctx context.Context, u models.User, i models.Identity, outbox ...models.OutboxMessage) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.ProvisionUser")
+	defer span.End()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, "ProvisionUser", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+	INSERT INTO users
+	    (
+		tenant_id,
+		name,
+		email,
+		username,
+		password,
+		role,
+		created_at,
+		updated_at
+		)
+    VALUES($1, $2, $3, $4, '', $5, $6, $6) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		u.TenantID,
+		u.Name,
+		u.Email,
+		u.UserName,
+		u.Role,
+		time.Now(),
+	).Scan(&i.UserID)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		switch pqErr.Constraint {
+		case "users_tenant_email_key":
+			return 0, ErrDuplicateEmail
+		case "users_tenant_username_key":
+			return 0, ErrDuplicateUsername
+		}
+	}
+	if err != nil {
+		logError(ctx, "ProvisionUser", err)
+		return 0, err
+	}
+
+	if _, err = insertIdentity(ctx, tx, i); err != nil {
+		logError(ctx, "ProvisionUser", err)
+		return 0, err
+	}
+
+	if err = insertOutbox(ctx, tx, i.UserID, outbox); err != nil {
+		logError(ctx, "ProvisionUser", err)
+		return 0, err
+	}
+
+	return i.UserID, tx.Commit()
+}
+
+// TouchIdentity records a sign-in through the identity and the email the provider gave
+func (m *DBRepo) TouchIdentity(ctx context.Context, id int, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.TouchIdentity")
+	defer span.End()
+
+	stmt := `update identities set last_login_at = $1, email = $2 where id = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), email, id)
+	if err != nil {
+		logError(ctx, "TouchIdentity", err)
+		return err
+	}
+
+	return nil
+}
+
+// SyncUserAttributes sets the name and email of a user to what their provider
+// says. ErrDuplicateEmail means another user of the tenant has the email.
+func (m *DBRepo) SyncUserAttributes(ctx context.Context, id int, name, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.SyncUserAttributes")
+	defer span.End()
+
+	stmt := `update users set name = $1, email = $2, updated_at = $3
+			where id = $4 and (name <> $1 or email <> $2)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, name, email, time.Now(), id)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "users_tenant_email_key" {
+		return ErrDuplicateEmail
+	}
+	if err != nil {
+		logError(ctx, "SyncUserAttributes", err)
+		return err
+	}
+
+	return nil
+}
+
+// execQuerier is what inserts need from a database or a transaction
+type execQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func insertIdentity(ctx context.Context, db execQuerier, i models.Identity) (int, error) {
+	stmt := `
+	INSERT INTO identities
+	    (
+		tenant_id,
+		user_id,
+		provider,
+		subject,
+		email,
+		created_at,
+		last_login_at
+		)
+    VALUES($1, $2, $3, $4, $5, $6, $6) returning id`
+
+	var id int
+	err := db.QueryRowContext(ctx, stmt,
+		i.TenantID,
+		i.UserID,
+		i.Provider,
+		i.Subject,
+		i.Email,
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
+}
+
+func scanIdentity(rows *sql.Rows) (models.Identity, error) {
+	var i models.Identity
+	var lastLoginAt sql.NullTime
+
+	err := rows.Scan(
+		&i.ID,
+		&i.TenantID,
+		&i.UserID,
+		&i.Provider,
+		&i.Subject,
+		&i.Email,
+		&i.CreatedAt,
+		&lastLoginAt,
+	)
+	if err != nil {
+		return i, err
+	}
+	i.LastLoginAt = lastLoginAt.Time
+
+	return i, nil
+}
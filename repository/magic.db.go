@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"time"
+)
+
+// InsertMagicLink stores a sign-in link for the user by its hash, with the
+// outbox messages sending it
+func (m *DBRepo) InsertMagicLink(ctx context.Context, userID int, hash []byte, expires time.Time, outbox ...models.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.InsertMagicLink")
+	defer span.End()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, "InsertMagicLink", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO magic_links (user_id, token_hash, created_at, expires_at)
+		VALUES($1, $2, $3, $4)`
+
+	_, err = tx.ExecContext(ctx, stmt, userID, hash, time.Now(), expires)
+	if err != nil {
+		logError(ctx, "InsertMagicLink", err)
+		return err
+	}
+
+	if err = insertOutbox(ctx, tx, 0, outbox); err != nil {
+		logError(ctx, "InsertMagicLink", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MagicLinkSentSince reports whether the user was sent a sign-in link after since
+func (m *DBRepo) MagicLinkSentSince(ctx context.Context, userID int, since time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.MagicLinkSentSince")
+	defer span.End()
+
+	stmt := `SELECT EXISTS (SELECT 1 FROM magic_links where user_id = $1 and created_at > $2)`
+
+	var sent bool
+	err := m.DB.QueryRowContext(ctx, stmt, userID, since).Scan(&sent)
+	if err != nil {
+		logError(ctx, "MagicLinkSentSince", err)
+		return false, err
+	}
+
+	return sent, nil
+}
+
+// UseMagicLink marks an unused, unexpired sign-in link of a user of the tenant
+// as used and returns its user. Marking it in the same statement that finds it
+// means a link can only ever sign in once, however many requests race for it,
+// and a link sent to another address is never spent.
+func (m *DBRepo) UseMagicLink(ctx context.Context, tenantID int, hash []byte, ip string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.UseMagicLink")
+	defer span.End()
+
+	stmt := `update magic_links l set used_at = $1, used_ip = $2
+		from users u
+		where l.token_hash = $3 and l.used_at is null and l.expires_at > $1
+			and u.id = l.user_id and u.tenant_id = $4
+		returning l.user_id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, time.Now(), ip, hash, tenantID)
+	if err != nil {
+		logError(ctx, "UseMagicLink", err)
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, ErrNoRecord
+	}
+
+	var userID int
+	if err = rows.Scan(&userID); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
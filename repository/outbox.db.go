@@ -0,0 +1,173 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"database/sql"
+	"time"
+)
+
+// insertOutbox writes messages in the transaction making the change they are
+// about, so they are sent if and only if it commits. A userID other than 0
+// is set as the user id of events, for users the transaction has created.
+func insertOutbox(ctx context.Context, tx *sql.Tx, userID int, msgs []models.OutboxMessage) error {
+	stmt := `
+	INSERT INTO outbox (kind, tenant_id, payload, next_attempt_at, created_at)
+	VALUES($1, $2,
+		CASE WHEN $1 = 'event' AND $4::bigint <> 0
+			THEN jsonb_set($3::jsonb, '{data,user,id}', to_jsonb($4::bigint))
+			ELSE $3::jsonb END,
+		$5, $5)`
+
+	for _, msg := range msgs {
+		_, err := tx.ExecContext(ctx, stmt, msg.Kind, msg.TenantID, []byte(msg.Payload), userID, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimOutbox returns up to limit pending messages that are due, oldest first,
+// and holds them for lease. Other replicas skip them until the lease runs out.
+func (m *DBRepo) ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.ClaimOutbox")
+	defer span.End()
+
+	stmt := `
+	WITH due AS (
+		SELECT id FROM outbox
+		WHERE status = 'pending' AND next_attempt_at <= $1
+		ORDER BY next_attempt_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	)
+	UPDATE outbox o SET next_attempt_at = $3
+	FROM due WHERE o.id = due.id
+	RETURNING o.id, o.kind, o.tenant_id, o.payload, o.attempts`
+
+	now := time.Now()
+	rows, err := m.DB.QueryContext(ctx, stmt, now, limit, now.Add(lease))
+	if err != nil {
+		logError(ctx, "ClaimOutbox", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []models.OutboxMessage
+	for rows.Next() {
+		var msg models.OutboxMessage
+		var payload []byte
+		err = rows.Scan(&msg.ID, &msg.Kind, &msg.TenantID, &payload, &msg.Attempts)
+		if err != nil {
+			logError(ctx, "ClaimOutbox", err)
+			return nil, err
+		}
+		msg.Payload = payload
+		list = append(list, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "ClaimOutbox", err)
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// RecordOutboxAttempt stores the outcome of sending a message. A message with
+// an empty error is sent; otherwise it is tried again at next, or marked dead
+// when next is zero. A payload other than nil replaces the stored one.
+func (m *DBRepo) RecordOutboxAttempt(ctx context.Context, id int64, attemptErr string, next time.Time, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.RecordOutboxAttempt")
+	defer span.End()
+
+	now := time.Now()
+	status := "sent"
+	var sentAt sql.NullTime
+	switch {
+	case attemptErr == "":
+		sentAt = sql.NullTime{Time: now, Valid: true}
+		next = now
+	case next.IsZero():
+		status = "dead"
+		next = now
+	default:
+		status = "pending"
+	}
+
+	stmt := `
+	update outbox set
+		status = $2,
+		attempts = attempts + 1,
+		next_attempt_at = $3,
+		last_error = $4,
+		sent_at = $5,
+		payload = coalesce($6::jsonb, payload)
+	where id = $1`
+
+	replaced := sql.NullString{String: string(payload), Valid: payload != nil}
+
+	_, err := m.DB.ExecContext(ctx, stmt, id, status, next, attemptErr, sentAt, replaced)
+	if err != nil {
+		logError(ctx, "RecordOutboxAttempt", err)
+		return err
+	}
+
+	return nil
+}
+
+// ForwardOutboxEvent queues a delivery of an event message to every endpoint
+// of its tenant subscribed to it and marks the message sent, in one
+// transaction so a retry cannot deliver it twice. It returns how many
+// deliveries were queued.
+func (m *DBRepo) ForwardOutboxEvent(ctx context.Context, id int64) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.ForwardOutboxEvent")
+	defer span.End()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, "ForwardOutboxEvent", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	stmt := `
+	INSERT INTO webhook_deliveries (endpoint_id, event_id, event, payload, next_attempt_at, created_at)
+	SELECT e.id, o.payload->>'id', o.payload->>'type', o.payload, $2, $2
+	FROM outbox o JOIN webhook_endpoints e
+		ON e.tenant_id = o.tenant_id AND o.payload->>'type' = ANY(e.events)
+	WHERE o.id = $1 AND o.kind = 'event' AND o.status = 'pending'`
+
+	res, err := tx.ExecContext(ctx, stmt, id, now)
+	if err != nil {
+		logError(ctx, "ForwardOutboxEvent", err)
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+
+	stmt = `update outbox set status = 'sent', attempts = attempts + 1, last_error = '', sent_at = $2
+			where id = $1 and status = 'pending'`
+
+	res, err = tx.ExecContext(ctx, stmt, id, now)
+	if err != nil {
+		logError(ctx, "ForwardOutboxEvent", err)
+		return 0, err
+	}
+	if sent, _ := res.RowsAffected(); sent == 0 {
+		return 0, ErrNoRecord
+	}
+
+	return int(n), tx.Commit()
+}
@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"auth/api/metrics"
+	"auth/api/tracing"
+	"context"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptCost is the work factor for stored password hashes
+const bcryptCost = 12
+
+var bcryptDuration = metrics.NewHistogramVec(
+	"auth_bcrypt_duration_seconds",
+	"Time spent hashing and comparing passwords with bcrypt.",
+	[]float64{.05, .1, .2, .3, .5, .75, 1, 2},
+	"op",
+)
+
+// HashPassword returns the bcrypt hash of a plain-text password
+func HashPassword(ctx context.Context, password string) ([]byte, error) {
+	_, span := tracing.Start(ctx, "bcrypt.hash")
+	defer span.End()
+
+	start := time.Now()
+	defer func() {
+		bcryptDuration.Observe(time.Since(start).Seconds(), "hash")
+	}()
+
+	return bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+}
+
+// ComparePassword checks a plain-text password against its bcrypt hash
+func ComparePassword(ctx context.Context, hash, password string) error {
+	_, span := tracing.Start(ctx, "bcrypt.compare")
+	defer span.End()
+
+	start := time.Now()
+	defer func() {
+		bcryptDuration.Observe(time.Since(start).Seconds(), "compare")
+	}()
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
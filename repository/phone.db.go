@@ -0,0 +1,217 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// GetUserByPhone returns the user of a tenant with the verified phone number
+func (m *DBRepo) GetUserByPhone(ctx context.Context, tenantID int, phone string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.GetUserByPhone")
+	defer span.End()
+
+	var id int
+	stmt := `SELECT id FROM users where tenant_id = $1 and phone = $2 and phone <> ''`
+	err := m.DB.QueryRowContext(ctx, stmt, tenantID, phone).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, ErrNoRecord
+	}
+	if err != nil {
+		logError(ctx, "GetUserByPhone", err)
+		return models.User{}, err
+	}
+
+	return m.GetUserById(ctx, id)
+}
+
+// SetUserPhone stores a phone number the user has proved they own
+func (m *DBRepo) SetUserPhone(ctx context.Context, userID int, phone string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.SetUserPhone")
+	defer span.End()
+
+	stmt := `update users set phone = $1, phone_verified_at = $2, updated_at = $2 where id = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, phone, time.Now(), userID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrDuplicatePhone
+	}
+	if err != nil {
+		logError(ctx, "SetUserPhone", err)
+		return err
+	}
+
+	return nil
+}
+
+// ClearUserPhone removes the user's phone number, which also turns SMS MFA off
+func (m *DBRepo) ClearUserPhone(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.ClearUserPhone")
+	defer span.End()
+
+	stmt := `update users set phone = '', phone_verified_at = null, sms_mfa = false, updated_at = $1
+		where id = $2`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		logError(ctx, "ClearUserPhone", err)
+		return err
+	}
+
+	return nil
+}
+
+// SetSMSMFA turns the SMS second factor on or off. It can only be turned on
+// with a verified phone number, ErrNoRecord is returned otherwise.
+func (m *DBRepo) SetSMSMFA(ctx context.Context, userID int, enabled bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.SetSMSMFA")
+	defer span.End()
+
+	stmt := `update users set sms_mfa = $1, updated_at = $2
+		where id = $3 and (not $1 or phone_verified_at is not null)`
+
+	res, err := m.DB.ExecContext(ctx, stmt, enabled, time.Now(), userID)
+	if err != nil {
+		logError(ctx, "SetSMSMFA", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
+
+// InsertOTP stores a one-time passcode by the hashes of its challenge and code
+func (m *DBRepo) InsertOTP(ctx context.Context, o models.OTPChallenge, challengeHash, codeHash []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.InsertOTP")
+	defer span.End()
+
+	var userID sql.NullInt64
+	if o.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(o.UserID), Valid: true}
+	}
+
+	stmt := `
+	INSERT INTO otp_codes
+	    (
+		user_id,
+		phone,
+		purpose,
+		channel,
+		challenge_hash,
+		code_hash,
+		created_at,
+		expires_at
+		)
+    VALUES($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		userID,
+		o.Phone,
+		o.Purpose,
+		o.Channel,
+		challengeHash,
+		codeHash,
+		time.Now(),
+		o.ExpiresAt,
+	)
+	if err != nil {
+		logError(ctx, "InsertOTP", err)
+		return err
+	}
+
+	return nil
+}
+
+// OTPsSentSince counts the passcodes asked for a phone number after since
+func (m *DBRepo) OTPsSentSince(ctx context.Context, phone string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.OTPsSentSince")
+	defer span.End()
+
+	var n int
+	stmt := `SELECT count(*) FROM otp_codes where phone = $1 and created_at > $2`
+	err := m.DB.QueryRowContext(ctx, stmt, phone, since).Scan(&n)
+	if err != nil {
+		logError(ctx, "OTPsSentSince", err)
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// UseOTP spends an attempt on the passcode of a challenge. The challenge is
+// marked used when the code matches, and ErrWrongCode is returned when it does
+// not. Challenges that are unknown, used, expired, out of attempts or for
+// none of the purposes give ErrNoRecord. Counting and using in one statement means
+// parallel guesses cannot get more than maxAttempts tries.
+func (m *DBRepo) UseOTP(ctx context.Context, challengeHash, codeHash []byte, purposes []string, maxAttempts int) (models.OTPChallenge, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.UseOTP")
+	defer span.End()
+
+	stmt := `update otp_codes set
+			attempts = attempts + 1,
+			used_at = case when code_hash = $1 then $2::timestamptz end
+		where challenge_hash = $3 and purpose = any($4) and used_at is null
+			and expires_at > $2 and attempts < $5
+		returning id, user_id, phone, purpose, channel, attempts, created_at, expires_at, used_at`
+
+	var o models.OTPChallenge
+	var userID sql.NullInt64
+	var usedAt sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, stmt, codeHash, time.Now(), challengeHash, pq.Array(purposes), maxAttempts).Scan(
+		&o.ID,
+		&userID,
+		&o.Phone,
+		&o.Purpose,
+		&o.Channel,
+		&o.Attempts,
+		&o.CreatedAt,
+		&o.ExpiresAt,
+		&usedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return o, ErrNoRecord
+	}
+	if err != nil {
+		logError(ctx, "UseOTP", err)
+		return o, err
+	}
+	o.UserID = int(userID.Int64)
+	o.UsedAt = usedAt.Time
+
+	// a code asked for a number without an account never matches
+	if !usedAt.Valid || !userID.Valid {
+		return o, ErrWrongCode
+	}
+
+	return o, nil
+}
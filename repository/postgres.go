@@ -1,6 +1,9 @@
 package repository
 
 import (
+	"auth/api/logging"
+	"auth/api/tracing"
+	"context"
 	"database/sql"
 	"errors"
 )
@@ -12,8 +15,22 @@ var (
 	ErrInvalidCredentials = errors.New("models: invalid credentials")
 	// ErrDuplicateEmail duplicate email error
 	ErrDuplicateEmail = errors.New("models: duplicate email")
+	// ErrDuplicateUsername duplicate username error
+	ErrDuplicateUsername = errors.New("models: duplicate username")
 	// ErrInactiveAccount inactive account error
 	ErrInactiveAccount = errors.New("models: Inactive Account")
+	// ErrSuspendedAccount suspended account error
+	ErrSuspendedAccount = errors.New("models: suspended account")
+	// ErrInvalidTransition account status change not allowed error
+	ErrInvalidTransition = errors.New("models: invalid account status transition")
+	// ErrDuplicatePhone phone number already used in the tenant error
+	ErrDuplicatePhone = errors.New("models: duplicate phone")
+	// ErrWrongCode one-time passcode does not match error
+	ErrWrongCode = errors.New("models: wrong passcode")
+	// ErrDuplicateEntityID service provider already registered in the tenant error
+	ErrDuplicateEntityID = errors.New("models: duplicate entity id")
+	// ErrImpersonation actor may not act as the user error
+	ErrImpersonation = errors.New("models: impersonation not allowed")
 )
 
 type DBRepo struct {
@@ -42,3 +59,28 @@ func NewTestRepo(db *sql.DB) Repo {
 		DB: DBRepo{DB: db},
 	}
 }
+
+// logError logs a failed database operation with the logger carried by ctx
+// and marks the operation's span as failed
+func logError(ctx context.Context, op string, err error) {
+	logging.FromContext(ctx).Error("database error", "op", op, "err", err)
+	tracing.RecordError(ctx, err)
+}
+
+// PoolStats returns the connection pool statistics of the database handle
+func (m *DBRepo) PoolStats() sql.DBStats {
+	return m.DB.Stats()
+}
+
+// Ping checks that the database answers
+func (m *DBRepo) Ping(ctx context.Context) error {
+	ctx, span := tracing.Start(ctx, "DBRepo.Ping")
+	defer span.End()
+
+	if err := m.DB.PingContext(ctx); err != nil {
+		tracing.RecordError(ctx, err)
+		return err
+	}
+
+	return nil
+}
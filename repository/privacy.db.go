@@ -0,0 +1,198 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ExportUser gathers everything stored about a user for a data subject access request
+func (m *DBRepo) ExportUser(ctx context.Context, id int) (models.UserExport, error) {
+	ctx, span := tracing.Start(ctx, "DBRepo.ExportUser")
+	defer span.End()
+
+	export := models.UserExport{GeneratedAt: time.Now()}
+
+	u, err := m.GetUserById(ctx, id)
+	if err == sql.ErrNoRows {
+		return export, ErrNoRecord
+	} else if err != nil {
+		return export, err
+	}
+	export.Profile = u
+
+	export.Sessions, err = m.UserSessions(ctx, id, true)
+	if err != nil {
+		return export, err
+	}
+
+	export.Identities, err = m.UserIdentities(ctx, id)
+	if err != nil {
+		return export, err
+	}
+
+	export.LoginHistory, err = m.AuditEventsForUser(ctx, id, "auth.signin")
+	if err != nil {
+		return export, err
+	}
+
+	export.AuditEvents, err = m.AuditEventsForUser(ctx, id, "")
+	if err != nil {
+		return export, err
+	}
+
+	return export, nil
+}
+
+// EraseUser scrubs the personal data of a user. The row itself is kept so records
+// pointing at the user id stay valid, only the values identifying a person are replaced.
+// The outbox messages are written with the change.
+func (m *DBRepo) EraseUser(ctx context.Context, id int, outbox ...models.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.EraseUser")
+	defer span.End()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, "EraseUser", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// emails to the user, sent or not, hold their address; read before it is replaced
+	stmt := `
+		delete from
+			outbox
+		where
+			kind = 'email' and payload->>'destination' = (select email from users where id = $1)`
+
+	_, err = tx.ExecContext(ctx, stmt, id)
+	if err != nil {
+		logError(ctx, "EraseUser", err)
+		return err
+	}
+
+	stmt = `
+		update
+			users
+		set
+			name = 'Erased User',
+			email = $1,
+			username = $2,
+			password = '',
+			password_reset_code = '',
+			status = 'deleted',
+			status_reason = '',
+			suspended_until = null,
+			phone = '',
+			phone_verified_at = null,
+			sms_mfa = false,
+			deleted_at = coalesce(deleted_at, $3),
+			status_changed_at = $3,
+			erased_at = $3,
+			updated_at = $3
+		where
+			id = $4 and erased_at is null`
+
+	res, err := tx.ExecContext(ctx, stmt,
+		fmt.Sprintf("erased-%d@erased.invalid", id),
+		fmt.Sprintf("erased-%d", id),
+		time.Now(),
+		id,
+	)
+	if err != nil {
+		logError(ctx, "EraseUser", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRecord
+	}
+
+	stmt = `
+		update
+			sessions
+		set
+			device = '',
+			user_agent = '',
+			ip = '',
+			revoked_at = coalesce(revoked_at, $1)
+		where
+			user_id = $2`
+
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		logError(ctx, "EraseUser", err)
+		return err
+	}
+
+	stmt = `
+		update
+			personal_access_tokens
+		set
+			last_used_ip = '',
+			revoked_at = coalesce(revoked_at, $1)
+		where
+			user_id = $2`
+
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		logError(ctx, "EraseUser", err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update otp_codes set phone = '' where user_id = $1`, id)
+	if err != nil {
+		logError(ctx, "EraseUser", err)
+		return err
+	}
+
+	// provider accounts identify the person, and a new sign-in must not revive the user
+	_, err = tx.ExecContext(ctx, `delete from identities where user_id = $1`, id)
+	if err != nil {
+		logError(ctx, "EraseUser", err)
+		return err
+	}
+
+	// webhook payloads, delivered or not, carry the profile the user had
+	stmt = `
+		update
+			webhook_deliveries
+		set
+			payload = jsonb_set(payload, '{data,user}', jsonb_build_object('id', $1::bigint))
+		where
+			payload #>> '{data,user,id}' = $2`
+
+	_, err = tx.ExecContext(ctx, stmt, id, strconv.Itoa(id))
+	if err != nil {
+		logError(ctx, "EraseUser", err)
+		return err
+	}
+
+	// and so do events about them still in the outbox
+	stmt = `
+		update
+			outbox
+		set
+			payload = jsonb_set(payload, '{data,user}', jsonb_build_object('id', $1::bigint))
+		where
+			kind = 'event' and payload #>> '{data,user,id}' = $2`
+
+	_, err = tx.ExecContext(ctx, stmt, id, strconv.Itoa(id))
+	if err != nil {
+		logError(ctx, "EraseUser", err)
+		return err
+	}
+
+	if err = insertOutbox(ctx, tx, 0, outbox); err != nil {
+		logError(ctx, "EraseUser", err)
+		return err
+	}
+
+	return tx.Commit()
+}
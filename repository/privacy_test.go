@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestEraseUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`delete from\s+outbox\s+where\s+kind = 'email'`).WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`update\s+users\s+set\s+name = 'Erased User'.*password = ''.*phone = ''.*erased_at = \$3.*erased_at is null`).
+		WithArgs("erased-7@erased.invalid", "erased-7", sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`update\s+sessions\s+set\s+device = '',\s+user_agent = '',\s+ip = '',\s+revoked_at = coalesce`).
+		WithArgs(sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`update\s+personal_access_tokens\s+set\s+last_used_ip = '',\s+revoked_at = coalesce`).
+		WithArgs(sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`update otp_codes set phone = ''`).WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`delete from identities`).WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`update\s+webhook_deliveries\s+set\s+payload = jsonb_set`).WithArgs(7, "7").
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec(`update\s+outbox\s+set\s+payload = jsonb_set.*kind = 'event'`).WithArgs(7, "7").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	repo := NewRepo(db)
+	if err = repo.DB.EraseUser(context.Background(), 7); err != nil {
+		t.Fatal(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEraseUserTwice(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`delete from\s+outbox`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`update\s+users`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	repo := NewRepo(db)
+	if err = repo.DB.EraseUser(context.Background(), 7); !errors.Is(err, ErrNoRecord) {
+		t.Errorf("got %v, want %v", err, ErrNoRecord)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,191 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// InsertServiceProvider registers a SAML service provider with a tenant.
+// ErrDuplicateEntityID means the tenant already has one with the entity id.
+func (m *DBRepo) InsertServiceProvider(ctx context.Context, sp models.ServiceProvider) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.InsertServiceProvider")
+	defer span.End()
+
+	attributes, err := json.Marshal(sp.Attributes)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `
+	INSERT INTO saml_service_providers
+	    (
+		tenant_id,
+		entity_id,
+		name,
+		metadata,
+		name_id_format,
+		attributes,
+		created_at
+		)
+    VALUES($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	var id int
+	err = m.DB.QueryRowContext(ctx, stmt,
+		sp.TenantID,
+		sp.EntityID,
+		sp.Name,
+		sp.Metadata,
+		sp.NameIDFormat,
+		attributes,
+		time.Now(),
+	).Scan(&id)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return 0, ErrDuplicateEntityID
+	}
+	if err != nil {
+		logError(ctx, "InsertServiceProvider", err)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetServiceProvider returns the service provider of a tenant with the entity id
+func (m *DBRepo) GetServiceProvider(ctx context.Context, tenantID int, entityID string) (models.ServiceProvider, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.GetServiceProvider")
+	defer span.End()
+
+	stmt := `SELECT id, tenant_id, entity_id, name, metadata, name_id_format, attributes, created_at
+			FROM saml_service_providers where tenant_id = $1 and entity_id = $2`
+
+	sp, err := scanServiceProvider(m.DB.QueryRowContext(ctx, stmt, tenantID, entityID))
+	if err == sql.ErrNoRows {
+		return sp, ErrNoRecord
+	} else if err != nil {
+		logError(ctx, "GetServiceProvider", err)
+		return sp, err
+	}
+
+	return sp, nil
+}
+
+// GetServiceProviderByID returns a service provider of a tenant
+func (m *DBRepo) GetServiceProviderByID(ctx context.Context, tenantID, id int) (models.ServiceProvider, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.GetServiceProviderByID")
+	defer span.End()
+
+	stmt := `SELECT id, tenant_id, entity_id, name, metadata, name_id_format, attributes, created_at
+			FROM saml_service_providers where tenant_id = $1 and id = $2`
+
+	sp, err := scanServiceProvider(m.DB.QueryRowContext(ctx, stmt, tenantID, id))
+	if err == sql.ErrNoRows {
+		return sp, ErrNoRecord
+	} else if err != nil {
+		logError(ctx, "GetServiceProviderByID", err)
+		return sp, err
+	}
+
+	return sp, nil
+}
+
+// TenantServiceProviders returns the service providers registered with a tenant
+func (m *DBRepo) TenantServiceProviders(ctx context.Context, tenantID int) ([]models.ServiceProvider, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.TenantServiceProviders")
+	defer span.End()
+
+	stmt := `SELECT id, tenant_id, entity_id, name, metadata, name_id_format, attributes, created_at
+			FROM saml_service_providers where tenant_id = $1 order by id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, tenantID)
+	if err != nil {
+		logError(ctx, "TenantServiceProviders", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []models.ServiceProvider{}
+	for rows.Next() {
+		sp, err := scanServiceProvider(rows)
+		if err != nil {
+			logError(ctx, "TenantServiceProviders", err)
+			return nil, err
+		}
+		list = append(list, sp)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "TenantServiceProviders", err)
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// DeleteServiceProvider removes a service provider from a tenant
+func (m *DBRepo) DeleteServiceProvider(ctx context.Context, tenantID, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.DeleteServiceProvider")
+	defer span.End()
+
+	stmt := `delete from saml_service_providers where tenant_id = $1 and id = $2`
+
+	res, err := m.DB.ExecContext(ctx, stmt, tenantID, id)
+	if err != nil {
+		logError(ctx, "DeleteServiceProvider", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
+
+// rowScanner is what a single row and a row set have in common
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanServiceProvider(row rowScanner) (models.ServiceProvider, error) {
+	var sp models.ServiceProvider
+	var attributes []byte
+
+	err := row.Scan(
+		&sp.ID,
+		&sp.TenantID,
+		&sp.EntityID,
+		&sp.Name,
+		&sp.Metadata,
+		&sp.NameIDFormat,
+		&attributes,
+		&sp.CreatedAt,
+	)
+	if err != nil {
+		return sp, err
+	}
+
+	return sp, json.Unmarshal(attributes, &sp.Attributes)
+}
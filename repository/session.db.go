@@ -0,0 +1,229 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// sessionTouchInterval limits how often last_seen_at is written for a busy session
+const sessionTouchInterval = time.Minute
+
+// newSessionID returns a random session id
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateSession records a new sign-in and returns the session id
+func (m *DBRepo) CreateSession(ctx context.Context, s models.Session) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.CreateSession")
+	defer span.End()
+
+	id, err := newSessionID()
+	if err != nil {
+		logError(ctx, "CreateSession", err)
+		return "", err
+	}
+
+	stmt := `
+	INSERT INTO sessions
+	    (
+		id,
+		user_id,
+		device,
+		user_agent,
+		ip,
+		created_at,
+		last_seen_at,
+		expires_at,
+		actor_id
+		)
+    VALUES($1, $2, $3, $4, $5, $6, $6, $7, $8)`
+
+	_, err = m.DB.ExecContext(ctx, stmt,
+		id,
+		s.UserID,
+		s.Device,
+		s.UserAgent,
+		s.IP,
+		time.Now(),
+		s.ExpiresAt,
+		sql.NullInt64{Int64: int64(s.ActorID), Valid: s.ActorID != 0},
+	)
+	if err != nil {
+		logError(ctx, "CreateSession", err)
+		return "", err
+	}
+
+	return id, nil
+}
+
+// GetSession returns a session by id
+func (m *DBRepo) GetSession(ctx context.Context, id string) (models.Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.GetSession")
+	defer span.End()
+
+	stmt := `SELECT id, user_id, device, user_agent, ip, created_at,
+			last_seen_at, expires_at, revoked_at, actor_id
+			FROM sessions where id = $1`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, id)
+	if err != nil {
+		logError(ctx, "GetSession", err)
+		return models.Session{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return models.Session{}, err
+		}
+		return models.Session{}, ErrNoRecord
+	}
+
+	return scanSession(rows)
+}
+
+// UserSessions returns the sessions of a user, newest first. Revoked and expired
+// sessions are only included when all is set.
+func (m *DBRepo) UserSessions(ctx context.Context, userID int, all bool) ([]models.Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.UserSessions")
+	defer span.End()
+
+	stmt := `SELECT id, user_id, device, user_agent, ip, created_at,
+			last_seen_at, expires_at, revoked_at, actor_id
+			FROM sessions where user_id = $1`
+	if !all {
+		stmt += ` and revoked_at is null and expires_at > now()`
+	}
+	stmt += ` order by created_at desc`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		logError(ctx, "UserSessions", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "UserSessions", err)
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// TouchSession moves the last seen time of a session forward
+func (m *DBRepo) TouchSession(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.TouchSession")
+	defer span.End()
+
+	stmt := `update sessions set last_seen_at = $1 where id = $2 and last_seen_at < $3`
+
+	now := time.Now()
+	_, err := m.DB.ExecContext(ctx, stmt, now, id, now.Add(-sessionTouchInterval))
+	if err != nil {
+		logError(ctx, "TouchSession", err)
+		return err
+	}
+
+	return nil
+}
+
+// RevokeSession revokes one session belonging to the user
+func (m *DBRepo) RevokeSession(ctx context.Context, userID int, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.RevokeSession")
+	defer span.End()
+
+	stmt := `update sessions set revoked_at = $1
+		where id = $2 and user_id = $3 and revoked_at is null`
+
+	res, err := m.DB.ExecContext(ctx, stmt, time.Now(), id, userID)
+	if err != nil {
+		logError(ctx, "RevokeSession", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
+
+// RevokeOtherSessions revokes every session of the user except keepID and returns how many were revoked
+func (m *DBRepo) RevokeOtherSessions(ctx context.Context, userID int, keepID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.RevokeOtherSessions")
+	defer span.End()
+
+	stmt := `update sessions set revoked_at = $1
+		where user_id = $2 and id <> $3 and revoked_at is null`
+
+	res, err := m.DB.ExecContext(ctx, stmt, time.Now(), userID, keepID)
+	if err != nil {
+		logError(ctx, "RevokeOtherSessions", err)
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func scanSession(rows *sql.Rows) (models.Session, error) {
+	var s models.Session
+	var revokedAt sql.NullTime
+	var actorID sql.NullInt64
+
+	err := rows.Scan(
+		&s.ID,
+		&s.UserID,
+		&s.Device,
+		&s.UserAgent,
+		&s.IP,
+		&s.CreatedAt,
+		&s.LastSeenAt,
+		&s.ExpiresAt,
+		&revokedAt,
+		&actorID,
+	)
+	if err != nil {
+		return s, err
+	}
+	s.RevokedAt = revokedAt.Time
+	s.ActorID = int(actorID.Int64)
+
+	return s, nil
+}
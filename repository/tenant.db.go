@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"database/sql"
+	"time"
+)
+
+// GetTenant returns a tenant by id
+func (m *DBRepo) GetTenant(ctx context.Context, id int) (models.Tenant, error) {
+	return m.getTenant(ctx, "GetTenant", `id = $1`, id)
+}
+
+// GetTenantBySlug returns a tenant by slug
+func (m *DBRepo) GetTenantBySlug(ctx context.Context, slug string) (models.Tenant, error) {
+	return m.getTenant(ctx, "GetTenantBySlug", `slug = $1`, slug)
+}
+
+// GetTenantByHost returns the tenant served on a host name
+func (m *DBRepo) GetTenantByHost(ctx context.Context, host string) (models.Tenant, error) {
+	return m.getTenant(ctx, "GetTenantByHost", `host = $1`, host)
+}
+
+func (m *DBRepo) getTenant(ctx context.Context, op, where string, arg interface{}) (models.Tenant, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo."+op)
+	defer span.End()
+
+	stmt := `SELECT id, slug, name, coalesce(host, ''), created_at FROM tenants where ` + where
+
+	var t models.Tenant
+	err := m.DB.QueryRowContext(ctx, stmt, arg).Scan(&t.ID, &t.Slug, &t.Name, &t.Host, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return t, ErrNoRecord
+	} else if err != nil {
+		logError(ctx, op, err)
+		return t, err
+	}
+
+	return t, nil
+}
+
+// AllTenants returns every tenant
+func (m *DBRepo) AllTenants(ctx context.Context) ([]models.Tenant, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.AllTenants")
+	defer span.End()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, slug, name, coalesce(host, ''), created_at FROM tenants order by id`)
+	if err != nil {
+		logError(ctx, "AllTenants", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := []models.Tenant{}
+	for rows.Next() {
+		var t models.Tenant
+		if err = rows.Scan(&t.ID, &t.Slug, &t.Name, &t.Host, &t.CreatedAt); err != nil {
+			logError(ctx, "AllTenants", err)
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "AllTenants", err)
+		return nil, err
+	}
+
+	return tenants, nil
+}
+
+// InsertTenant adds a tenant and returns its id
+func (m *DBRepo) InsertTenant(ctx context.Context, t models.Tenant) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.InsertTenant")
+	defer span.End()
+
+	var host sql.NullString
+	if t.Host != "" {
+		host = sql.NullString{String: t.Host, Valid: true}
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, `INSERT INTO tenants (slug, name, host) VALUES ($1, $2, $3) returning id`,
+		t.Slug, t.Name, host).Scan(&id)
+	if err != nil {
+		logError(ctx, "InsertTenant", err)
+		return 0, err
+	}
+
+	return id, nil
+}
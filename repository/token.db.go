@@ -0,0 +1,194 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// tokenTouchInterval limits how often last_used_at is written for a busy token
+const tokenTouchInterval = time.Minute
+
+// InsertPersonalAccessToken stores a new token by its hash and returns its id
+func (m *DBRepo) InsertPersonalAccessToken(ctx context.Context, t models.PersonalAccessToken, hash []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.InsertPersonalAccessToken")
+	defer span.End()
+
+	var expiresAt sql.NullTime
+	if !t.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: t.ExpiresAt, Valid: true}
+	}
+
+	stmt := `
+	INSERT INTO personal_access_tokens
+	    (
+		user_id,
+		name,
+		prefix,
+		token_hash,
+		scopes,
+		created_at,
+		expires_at
+		)
+    VALUES($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		t.UserID,
+		t.Name,
+		t.Prefix,
+		hash,
+		pq.Array(t.Scopes),
+		time.Now(),
+		expiresAt,
+	).Scan(&id)
+	if err != nil {
+		logError(ctx, "InsertPersonalAccessToken", err)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetPersonalAccessToken returns the token with the hash, revoked and expired ones included
+func (m *DBRepo) GetPersonalAccessToken(ctx context.Context, hash []byte) (models.PersonalAccessToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.GetPersonalAccessToken")
+	defer span.End()
+
+	stmt := `SELECT id, user_id, name, prefix, scopes, created_at, expires_at,
+			last_used_at, last_used_ip, revoked_at
+			FROM personal_access_tokens where token_hash = $1`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, hash)
+	if err != nil {
+		logError(ctx, "GetPersonalAccessToken", err)
+		return models.PersonalAccessToken{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return models.PersonalAccessToken{}, err
+		}
+		return models.PersonalAccessToken{}, ErrNoRecord
+	}
+
+	return scanPersonalAccessToken(rows)
+}
+
+// UserPersonalAccessTokens returns the tokens of a user that are not revoked, newest first
+func (m *DBRepo) UserPersonalAccessTokens(ctx context.Context, userID int) ([]models.PersonalAccessToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.UserPersonalAccessTokens")
+	defer span.End()
+
+	stmt := `SELECT id, user_id, name, prefix, scopes, created_at, expires_at,
+			last_used_at, last_used_ip, revoked_at
+			FROM personal_access_tokens where user_id = $1 and revoked_at is null
+			order by created_at desc`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		logError(ctx, "UserPersonalAccessTokens", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []models.PersonalAccessToken{}
+	for rows.Next() {
+		t, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "UserPersonalAccessTokens", err)
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// TouchPersonalAccessToken records that a token was just used
+func (m *DBRepo) TouchPersonalAccessToken(ctx context.Context, id int, ip string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.TouchPersonalAccessToken")
+	defer span.End()
+
+	stmt := `update personal_access_tokens set last_used_at = $1, last_used_ip = $2
+		where id = $3 and (last_used_at is null or last_used_at < $4 or last_used_ip <> $2)`
+
+	now := time.Now()
+	_, err := m.DB.ExecContext(ctx, stmt, now, ip, id, now.Add(-tokenTouchInterval))
+	if err != nil {
+		logError(ctx, "TouchPersonalAccessToken", err)
+		return err
+	}
+
+	return nil
+}
+
+// RevokePersonalAccessToken revokes one token belonging to the user
+func (m *DBRepo) RevokePersonalAccessToken(ctx context.Context, userID, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.RevokePersonalAccessToken")
+	defer span.End()
+
+	stmt := `update personal_access_tokens set revoked_at = $1
+		where id = $2 and user_id = $3 and revoked_at is null`
+
+	res, err := m.DB.ExecContext(ctx, stmt, time.Now(), id, userID)
+	if err != nil {
+		logError(ctx, "RevokePersonalAccessToken", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
+
+func scanPersonalAccessToken(rows *sql.Rows) (models.PersonalAccessToken, error) {
+	var t models.PersonalAccessToken
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+
+	err := rows.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.Name,
+		&t.Prefix,
+		pq.Array(&t.Scopes),
+		&t.CreatedAt,
+		&expiresAt,
+		&lastUsedAt,
+		&t.LastUsedIP,
+		&revokedAt,
+	)
+	if err != nil {
+		return t, err
+	}
+	t.ExpiresAt = expiresAt.Time
+	t.LastUsedAt = lastUsedAt.Time
+	t.RevokedAt = revokedAt.Time
+
+	return t, nil
+}
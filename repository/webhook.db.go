@@ -0,0 +1,333 @@
+package repository
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+)
+
+// InsertWebhookEndpoint subscribes a URL of a tenant to events
+func (m *DBRepo) InsertWebhookEndpoint(ctx context.Context, e models.WebhookEndpoint) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.InsertWebhookEndpoint")
+	defer span.End()
+
+	stmt := `
+	INSERT INTO webhook_endpoints
+	    (
+		tenant_id,
+		url,
+		secret,
+		events,
+		created_at
+		)
+    VALUES($1, $2, $3, $4, $5) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		e.TenantID,
+		e.URL,
+		e.Secret,
+		pq.Array(e.Events),
+		time.Now(),
+	).Scan(&id)
+	if err != nil {
+		logError(ctx, "InsertWebhookEndpoint", err)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// TenantWebhookEndpoints returns the endpoints of a tenant, without their secrets
+func (m *DBRepo) TenantWebhookEndpoints(ctx context.Context, tenantID int) ([]models.WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.TenantWebhookEndpoints")
+	defer span.End()
+
+	stmt := `SELECT id, tenant_id, url, events, created_at
+			FROM webhook_endpoints where tenant_id = $1 order by id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, tenantID)
+	if err != nil {
+		logError(ctx, "TenantWebhookEndpoints", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []models.WebhookEndpoint{}
+	for rows.Next() {
+		var e models.WebhookEndpoint
+		err = rows.Scan(&e.ID, &e.TenantID, &e.URL, pq.Array(&e.Events), &e.CreatedAt)
+		if err != nil {
+			logError(ctx, "TenantWebhookEndpoints", err)
+			return nil, err
+		}
+		list = append(list, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "TenantWebhookEndpoints", err)
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// DeleteWebhookEndpoint unsubscribes an endpoint of a tenant, its delivery log goes with it
+func (m *DBRepo) DeleteWebhookEndpoint(ctx context.Context, tenantID, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.DeleteWebhookEndpoint")
+	defer span.End()
+
+	stmt := `delete from webhook_endpoints where tenant_id = $1 and id = $2`
+
+	res, err := m.DB.ExecContext(ctx, stmt, tenantID, id)
+	if err != nil {
+		logError(ctx, "DeleteWebhookEndpoint", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries that are due,
+// with their endpoint's URL and secret, and holds them for lease. Other
+// replicas skip them until the lease runs out, so a dispatcher that dies
+// mid-delivery only delays them.
+func (m *DBRepo) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.ClaimWebhookDeliveries")
+	defer span.End()
+
+	stmt := `
+	WITH due AS (
+		SELECT id FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= $1
+		ORDER BY next_attempt_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	), claimed AS (
+		UPDATE webhook_deliveries d SET next_attempt_at = $3
+		FROM due WHERE d.id = due.id
+		RETURNING d.id, d.endpoint_id, d.event_id, d.event, d.payload, d.attempts
+	)
+	SELECT c.id, c.endpoint_id, c.event_id, c.event, c.payload, c.attempts, e.url, e.secret
+	FROM claimed c JOIN webhook_endpoints e ON e.id = c.endpoint_id`
+
+	now := time.Now()
+	rows, err := m.DB.QueryContext(ctx, stmt, now, limit, now.Add(lease))
+	if err != nil {
+		logError(ctx, "ClaimWebhookDeliveries", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []models.WebhookDelivery
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var payload []byte
+		err = rows.Scan(&d.ID, &d.EndpointID, &d.EventID, &d.Event, &payload, &d.Attempts, &d.URL, &d.Secret)
+		if err != nil {
+			logError(ctx, "ClaimWebhookDeliveries", err)
+			return nil, err
+		}
+		d.Payload = payload
+		list = append(list, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "ClaimWebhookDeliveries", err)
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// RecordWebhookAttempt stores the outcome of delivering. A delivery with an
+// empty error is delivered; otherwise it is tried again at next, or marked
+// dead when next is zero.
+func (m *DBRepo) RecordWebhookAttempt(ctx context.Context, id int64, responseStatus int, attemptErr string, next time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.RecordWebhookAttempt")
+	defer span.End()
+
+	now := time.Now()
+	status := models.DeliveryDelivered
+	var deliveredAt sql.NullTime
+	switch {
+	case attemptErr == "":
+		deliveredAt = sql.NullTime{Time: now, Valid: true}
+		next = now
+	case next.IsZero():
+		status = models.DeliveryDead
+		next = now
+	default:
+		status = models.DeliveryPending
+	}
+
+	stmt := `
+	update webhook_deliveries set
+		status = $2,
+		attempts = attempts + 1,
+		next_attempt_at = $3,
+		last_attempt_at = $4,
+		response_status = $5,
+		last_error = $6,
+		delivered_at = $7
+	where id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, id, status, next, now, responseStatus, attemptErr, deliveredAt)
+	if err != nil {
+		logError(ctx, "RecordWebhookAttempt", err)
+		return err
+	}
+
+	return nil
+}
+
+// WebhookDeliveries returns the delivery log, newest first
+func (m *DBRepo) WebhookDeliveries(ctx context.Context, f models.WebhookDeliveryFilter) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.WebhookDeliveries")
+	defer span.End()
+
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	add("e.tenant_id = $%d", f.TenantID)
+	if f.EndpointID != 0 {
+		add("d.endpoint_id = $%d", f.EndpointID)
+	}
+	if f.Event != "" {
+		add("d.event = $%d", f.Event)
+	}
+	if f.Status != "" {
+		add("d.status = $%d", f.Status)
+	}
+	if f.Before != 0 {
+		add("d.id < $%d", f.Before)
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultDeliveryLimit
+	}
+	if limit > maxDeliveryLimit {
+		limit = maxDeliveryLimit
+	}
+
+	stmt := `SELECT d.id, d.endpoint_id, d.event_id, d.event, d.payload, d.status, d.attempts,
+		d.next_attempt_at, d.last_attempt_at, d.response_status, d.last_error, d.replay_of,
+		d.created_at, d.delivered_at
+		FROM webhook_deliveries d JOIN webhook_endpoints e ON e.id = d.endpoint_id
+		WHERE ` + strings.Join(where, " AND ")
+	args = append(args, limit)
+	stmt += fmt.Sprintf(" ORDER BY d.id DESC LIMIT $%d", len(args))
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		logError(ctx, "WebhookDeliveries", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []models.WebhookDelivery{}
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var payload []byte
+		var lastAttemptAt, deliveredAt sql.NullTime
+		var replayOf sql.NullInt64
+
+		err = rows.Scan(
+			&d.ID,
+			&d.EndpointID,
+			&d.EventID,
+			&d.Event,
+			&payload,
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&lastAttemptAt,
+			&d.ResponseStatus,
+			&d.LastError,
+			&replayOf,
+			&d.CreatedAt,
+			&deliveredAt,
+		)
+		if err != nil {
+			logError(ctx, "WebhookDeliveries", err)
+			return nil, err
+		}
+		d.Payload = payload
+		d.LastAttemptAt = lastAttemptAt.Time
+		d.DeliveredAt = deliveredAt.Time
+		d.ReplayOf = replayOf.Int64
+		list = append(list, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(ctx, "WebhookDeliveries", err)
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// ReplayWebhookDelivery queues a delivery of a tenant again as a new one,
+// with the same event id and payload, and returns the new delivery's id
+func (m *DBRepo) ReplayWebhookDelivery(ctx context.Context, tenantID int, id int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "DBRepo.ReplayWebhookDelivery")
+	defer span.End()
+
+	stmt := `
+	INSERT INTO webhook_deliveries (endpoint_id, event_id, event, payload, replay_of, next_attempt_at, created_at)
+	SELECT d.endpoint_id, d.event_id, d.event, d.payload, d.id, $3, $3
+	FROM webhook_deliveries d JOIN webhook_endpoints e ON e.id = d.endpoint_id
+	WHERE e.tenant_id = $1 AND d.id = $2
+	returning id`
+
+	var newID int64
+	err := m.DB.QueryRowContext(ctx, stmt, tenantID, id, time.Now()).Scan(&newID)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoRecord
+	} else if err != nil {
+		logError(ctx, "ReplayWebhookDelivery", err)
+		return 0, err
+	}
+
+	return newID, nil
+}
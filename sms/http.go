@@ -0,0 +1,75 @@
+package sms
+
+import (
+	"auth/api/tracing"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HTTPSender posts messages as JSON to a provider's endpoint, or to a gateway
+// in front of one: {"to": "+15551234567", "channel": "sms", "body": "..."}.
+// Any 2xx answer means the message was accepted.
+type HTTPSender struct {
+	URL string
+	// Token is sent as a bearer token when set
+	Token  string
+	Client *http.Client
+}
+
+// NewHTTPSender returns a sender posting to url
+func NewHTTPSender(url, token string) *HTTPSender {
+	return &HTTPSender{
+		URL:    url,
+		Token:  token,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Send posts the message to the provider
+func (s *HTTPSender) Send(ctx context.Context, m Message) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := tracing.StartKind(ctx, "HTTP POST sms provider", trace.SpanKindClient,
+		semconv.HTTPMethodKey.String(http.MethodPost),
+		semconv.HTTPURLKey.String(s.URL),
+	)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		tracing.RecordError(ctx, err)
+		return fmt.Errorf("sms: provider unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("sms: provider answered %s", resp.Status)
+		tracing.RecordError(ctx, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSenderRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		wantAuth string
+	}{
+		{name: "with token", token: "t0ken", wantAuth: "Bearer t0ken"},
+		{name: "without token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Message
+			var method, contentType, auth string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method, contentType, auth = r.Method, r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("decoding the body: %v", err)
+				}
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer srv.Close()
+
+			want := Message{To: "+15551234567", Channel: ChannelSMS, Body: "Your verification code is 123456."}
+			if err := NewHTTPSender(srv.URL, tt.token).Send(context.Background(), want); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			if method != http.MethodPost || contentType != "application/json" {
+				t.Errorf("got %s with content type %q, want a JSON POST", method, contentType)
+			}
+			if auth != tt.wantAuth {
+				t.Errorf("got Authorization %q, want %q", auth, tt.wantAuth)
+			}
+			if got != want {
+				t.Errorf("provider got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestHTTPSenderStatus(t *testing.T) {
+	tests := []struct {
+		status  int
+		wantErr bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNoContent, false},
+		{http.StatusMultipleChoices, true},
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusBadGateway, true},
+	}
+
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(`{"error": "nope"}`))
+		}))
+
+		err := NewHTTPSender(srv.URL, "").Send(context.Background(), Message{To: "+15551234567", Channel: ChannelSMS})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("status %d: got error %v, want error %v", tt.status, err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), http.StatusText(tt.status)) {
+			t.Errorf("status %d: error %q does not say what the provider answered", tt.status, err)
+		}
+		srv.Close()
+	}
+}
+
+func TestHTTPSenderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	t.Run("client timeout", func(t *testing.T) {
+		s := NewHTTPSender(srv.URL, "")
+		s.Client.Timeout = 50 * time.Millisecond
+
+		start := time.Now()
+		err := s.Send(context.Background(), Message{To: "+15551234567", Channel: ChannelSMS})
+		if err == nil || !strings.Contains(err.Error(), "unreachable") {
+			t.Errorf("got %v, want the provider unreachable", err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("send took %s", d)
+		}
+	})
+
+	t.Run("context deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := NewHTTPSender(srv.URL, "").Send(ctx, Message{To: "+15551234567", Channel: ChannelSMS})
+		if err == nil || !strings.Contains(err.Error(), "unreachable") {
+			t.Errorf("got %v, want the provider unreachable", err)
+		}
+	})
+}
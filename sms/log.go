@@ -0,0 +1,53 @@
+package sms
+
+import (
+	"auth/api/logging"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogSender writes messages to the log instead of sending them, for development
+type LogSender struct {
+	Logger *logging.Logger
+}
+
+// Send logs the message
+func (s LogSender) Send(ctx context.Context, m Message) error {
+	s.Logger.Info("sms not sent, logged instead", "to", m.To, "channel", m.Channel, "body", m.Body)
+	return nil
+}
+
+// FileSender appends messages as JSON lines to a file instead of sending them,
+// so a development setup or a script can read the codes
+type FileSender struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Send appends the message to the file
+func (s *FileSender) Send(ctx context.Context, m Message) error {
+	line, err := json.Marshal(struct {
+		Message
+		SentAt time.Time `json:"sentAt"`
+	}{m, time.Now()})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
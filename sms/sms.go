@@ -0,0 +1,77 @@
+// Package sms sends one-time passcodes to phones by text message or voice call
+// through a pluggable provider.
+package sms
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Channels a message can be delivered on
+const (
+	ChannelSMS   = "sms"
+	ChannelVoice = "voice"
+)
+
+// ErrNumber the phone number cannot be made E.164 error
+var ErrNumber = errors.New("sms: not a valid phone number")
+
+// Message is one text to deliver
+type Message struct {
+	To      string `json:"to"`
+	Channel string `json:"channel"`
+	Body    string `json:"body"`
+}
+
+// SMSSender delivers messages to phones. Implementations must be safe for
+// concurrent use.
+type SMSSender interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// Normalize returns a phone number in E.164 form, +<country code><number>.
+// Spaces, dashes, dots and parentheses are dropped and a leading 00 is read as
+// +. Numbers without either are taken to be in defaultCountry, a calling code
+// such as 1 or 44; when it is empty they are refused.
+func Normalize(number, defaultCountry string) (string, error) {
+	var b strings.Builder
+	for i, r := range strings.TrimSpace(number) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", ErrNumber
+		}
+	}
+
+	n := b.String()
+	switch {
+	case strings.HasPrefix(n, "+"):
+	case strings.HasPrefix(n, "00"):
+		n = "+" + n[2:]
+	case defaultCountry != "":
+		// a national trunk prefix such as the 0 in 020 goes when dialing from abroad
+		n = "+" + defaultCountry + strings.TrimPrefix(n, "0")
+	default:
+		return "", ErrNumber
+	}
+
+	// E.164 allows at most 15 digits, and no country code starts with 0
+	digits := n[1:]
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return "", ErrNumber
+	}
+	return n, nil
+}
+
+// Mask hides all but the last digits of a number, for showing where a code went
+func Mask(number string) string {
+	if len(number) <= 4 {
+		return number
+	}
+	return strings.Repeat("*", len(number)-4) + number[len(number)-4:]
+}
@@ -0,0 +1,56 @@
+package sms
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		number         string
+		defaultCountry string
+		want           string
+		wantErr        error
+	}{
+		{number: "+15551234567", want: "+15551234567"},
+		{number: "+1 (555) 123-4567", want: "+15551234567"},
+		{number: "  +44 7700 900123 ", want: "+447700900123"},
+		{number: "0044 20 7946 0958", want: "+442079460958"},
+		{number: "020 7946 0958", defaultCountry: "44", want: "+442079460958"},
+		{number: "555.123.4567", defaultCountry: "1", want: "+15551234567"},
+		{number: "+44 20 7946 0958", defaultCountry: "1", want: "+442079460958"},
+		{number: "5551234567", wantErr: ErrNumber},
+		{number: "+1555abc4567", wantErr: ErrNumber},
+		{number: "1+5551234567", wantErr: ErrNumber},
+		{number: "+15551234567;ext=2", wantErr: ErrNumber},
+		{number: "+0123456789", wantErr: ErrNumber},
+		{number: "+1234567", wantErr: ErrNumber},
+		{number: "+1234567890123456", wantErr: ErrNumber},
+		{number: "+", wantErr: ErrNumber},
+		{number: "", defaultCountry: "1", wantErr: ErrNumber},
+	}
+
+	for _, tt := range tests {
+		got, err := Normalize(tt.number, tt.defaultCountry)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("Normalize(%q, %q) = %q, %v; want %q, %v", tt.number, tt.defaultCountry, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"+15551234567", "********4567"},
+		{"1234", "1234"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := Mask(tt.number); got != tt.want {
+			t.Errorf("Mask(%q) = %q, want %q", tt.number, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package tokens
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+// flowAudience keeps flow tokens and session tokens from standing in for each other
+const flowAudience = "federated-sign-in"
+
+// ErrFlow the sign-in flow state is not ours or has expired error
+var ErrFlow = errors.New("tokens: sign-in flow not valid")
+
+// Flow is the state of a sign-in at an upstream identity provider, kept by
+// the browser between leaving for the provider and coming back
+type Flow struct {
+	Provider string
+	Tenant   string
+	State    string
+	Nonce    string
+	Verifier string
+	Expires  time.Time
+}
+
+// SignFlow returns the flow as a signed token
+func SignFlow(keys Keys, f Flow) ([]byte, error) {
+	var claims jwt.Claims
+	claims.Issued = jwt.NewNumericTime(time.Now())
+	claims.Expires = jwt.NewNumericTime(f.Expires)
+	claims.Issuer = Issuer
+	claims.Audiences = []string{flowAudience}
+	claims.Set = map[string]interface{}{
+		"provider":  f.Provider,
+		TenantClaim: f.Tenant,
+		"state":     f.State,
+		"nonce":     f.Nonce,
+		"verifier":  f.Verifier,
+	}
+
+	return claims.HMACSign(jwt.HS256, keys.Current)
+}
+
+// CheckFlow verifies a flow token against every key and returns the flow
+func CheckFlow(keys Keys, token []byte) (Flow, error) {
+	var f Flow
+	register := jwt.KeyRegister{Secrets: append([][]byte{keys.Current}, keys.Previous...)}
+
+	claims, err := register.Check(token)
+	if err != nil || !claims.Valid(time.Now()) || !claims.AcceptAudience(flowAudience) || claims.Issuer != Issuer {
+		return f, ErrFlow
+	}
+
+	f.Provider, _ = claims.String("provider")
+	f.Tenant, _ = claims.String(TenantClaim)
+	f.State, _ = claims.String("state")
+	f.Nonce, _ = claims.String("nonce")
+	f.Verifier, _ = claims.String("verifier")
+	if claims.Expires != nil {
+		f.Expires = claims.Expires.Time()
+	}
+
+	return f, nil
+}
@@ -0,0 +1,42 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// PersonalPrefix starts every personal access token so secret scanners can
+	// recognise one that leaked into a repository or a log
+	PersonalPrefix = "gat_"
+	// personalBytes is the random part of a personal access token
+	personalBytes = 24
+	// personalShown is how much of a token is stored in the clear to tell tokens apart
+	personalShown = len(PersonalPrefix) + 8
+)
+
+// NewPersonal returns a new personal access token, its hash to store and the
+// short prefix that is shown in token lists. The token itself is never stored.
+func NewPersonal() (token string, hash []byte, shown string, err error) {
+	b := make([]byte, personalBytes)
+	if _, err = rand.Read(b); err != nil {
+		return "", nil, "", err
+	}
+
+	token = PersonalPrefix + hex.EncodeToString(b)
+	return token, HashPersonal(token), token[:personalShown], nil
+}
+
+// HashPersonal returns the stored hash of a personal access token. The token
+// is random enough that a plain SHA-256 is safe to look it up by.
+func HashPersonal(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// IsPersonal reports whether a bearer token is a personal access token rather than a JWT
+func IsPersonal(token string) bool {
+	return strings.HasPrefix(token, PersonalPrefix) && len(token) == len(PersonalPrefix)+2*personalBytes
+}
@@ -0,0 +1,64 @@
+package tokens
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckLink(t *testing.T) {
+	old := NewKeys(oldSecret, nil)
+	keys := NewKeys(currentSecret, []string{oldSecret})
+
+	link, hash, err := NewLink(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLink, oldHash, err := NewLink(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, _, err := NewChallenge(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := link[:strings.IndexByte(link, '.')]
+	changed := "A" + link[1:]
+	if link[0] == 'A' {
+		changed = "B" + link[1:]
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		// retired checks with keys that no longer hold the signing one
+		retired bool
+		want    []byte
+		wantErr error
+	}{
+		{name: "current key", token: link, want: hash},
+		{name: "previous key", token: oldLink, want: oldHash},
+		{name: "retired key", token: link, retired: true, wantErr: ErrLink},
+		{name: "passcode challenge", token: challenge, wantErr: ErrLink},
+		{name: "random part changed", token: changed, wantErr: ErrLink},
+		{name: "no signature", token: raw, wantErr: ErrLink},
+		{name: "empty signature", token: raw + ".", wantErr: ErrLink},
+		{name: "no random part", token: link[len(raw):], wantErr: ErrLink},
+		{name: "empty", token: "", wantErr: ErrLink},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := keys
+			if tt.retired {
+				k = NewKeys("a-retired-secret-of-at-least-32-bytes", nil)
+			}
+
+			got, err := CheckLink(k, tt.token)
+			if !errors.Is(err, tt.wantErr) || !bytes.Equal(got, tt.want) {
+				t.Errorf("got %x, %v; want %x, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
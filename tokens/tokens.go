@@ -0,0 +1,160 @@
+// Package tokens signs and checks the JWTs that carry a user's session and
+// makes the personal access tokens used in their place by scripts.
+package tokens
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+// Issuer and Audience are set on every token and required when checking one
+const (
+	Issuer   = "mydomain.com"
+	Audience = "mydomain.com"
+)
+
+const (
+	// TenantClaim names the private claim holding the tenant slug
+	TenantClaim = "tenant"
+	// DefaultTenant is the tenant of tokens without a tenant claim
+	DefaultTenant = "default"
+	// ActorClaim names the claim saying who acts as the subject, see RFC 8693
+	// section 4.1. Only impersonation tokens have it.
+	ActorClaim = "act"
+)
+
+var (
+	// ErrSignature no key verifies the token error
+	ErrSignature = errors.New("tokens: signature not valid")
+	// ErrExpired token outside its validity window error
+	ErrExpired = errors.New("tokens: expired or not yet valid")
+	// ErrAudience token meant for someone else error
+	ErrAudience = errors.New("tokens: wrong audience")
+	// ErrIssuer token signed by someone else error
+	ErrIssuer = errors.New("tokens: wrong issuer")
+	// ErrSubject token subject is not a user id error
+	ErrSubject = errors.New("tokens: subject is not a user id")
+	// ErrActor token actor is not a user id error
+	ErrActor = errors.New("tokens: actor is not a user id")
+)
+
+// Keys holds the secret new tokens are signed with and the secrets of earlier
+// rotations, which are still accepted so tokens already handed out keep working
+type Keys struct {
+	Current  []byte
+	Previous [][]byte
+}
+
+// NewKeys returns keys from the configured secret strings
+func NewKeys(current string, previous []string) Keys {
+	k := Keys{Current: []byte(current)}
+	for _, p := range previous {
+		k.Previous = append(k.Previous, []byte(p))
+	}
+	return k
+}
+
+// Grant is what a token says about its bearer
+type Grant struct {
+	UserID    int
+	Tenant    string
+	SessionID string
+	Expires   time.Time
+	// ActorID is the admin acting as the user, 0 unless impersonating
+	ActorID int
+}
+
+// Sign returns a token for the user tied to a session
+func Sign(keys Keys, g Grant) ([]byte, error) {
+	var claims jwt.Claims
+	claims.Subject = strconv.Itoa(g.UserID)
+	claims.ID = g.SessionID
+	claims.Issued = jwt.NewNumericTime(time.Now())
+	claims.NotBefore = jwt.NewNumericTime(time.Now())
+	claims.Expires = jwt.NewNumericTime(g.Expires)
+	claims.Issuer = Issuer
+	claims.Audiences = []string{Audience}
+	claims.Set = map[string]interface{}{TenantClaim: g.Tenant}
+	if g.ActorID != 0 {
+		claims.Set[ActorClaim] = map[string]interface{}{"sub": strconv.Itoa(g.ActorID)}
+	}
+
+	return claims.HMACSign(jwt.HS256, keys.Current)
+}
+
+// Decode returns the claims of a token without checking its signature,
+// only ever use it to look at a token
+func Decode(token []byte) (*jwt.Claims, error) {
+	return jwt.ParseWithoutCheck(token)
+}
+
+// IsImpersonation reports whether a token says someone acts as its subject,
+// without checking it
+func IsImpersonation(token []byte) bool {
+	claims, err := Decode(token)
+	if err != nil {
+		return false
+	}
+	_, ok := claims.Set[ActorClaim]
+	return ok
+}
+
+// Check verifies a token against every key and its registered claims, and
+// returns the claims with the grant they make. Tokens issued before tenants
+// existed carry no tenant claim and belong to the default tenant. An actor
+// claim must name a user by id.
+func Check(keys Keys, token []byte) (*jwt.Claims, Grant, error) {
+	var g Grant
+	register := jwt.KeyRegister{Secrets: append([][]byte{keys.Current}, keys.Previous...)}
+
+	claims, err := register.Check(token)
+	if err != nil {
+		return nil, g, ErrSignature
+	}
+	if !claims.Valid(time.Now()) {
+		return claims, g, ErrExpired
+	}
+	if !claims.AcceptAudience(Audience) {
+		return claims, g, ErrAudience
+	}
+	if claims.Issuer != Issuer {
+		return claims, g, ErrIssuer
+	}
+
+	g.UserID, err = strconv.Atoi(claims.Subject)
+	if err != nil {
+		return claims, g, ErrSubject
+	}
+	g.SessionID = claims.ID
+	g.Tenant = DefaultTenant
+	if tenant, ok := claims.String(TenantClaim); ok {
+		g.Tenant = tenant
+	}
+	if claims.Expires != nil {
+		g.Expires = claims.Expires.Time()
+	}
+	if act, ok := claims.Set[ActorClaim]; ok {
+		if g.ActorID, err = actorID(act); err != nil {
+			return claims, g, err
+		}
+	}
+
+	return claims, g, nil
+}
+
+// actorID returns the user id an actor claim names
+func actorID(act interface{}) (int, error) {
+	obj, ok := act.(map[string]interface{})
+	if !ok {
+		return 0, ErrActor
+	}
+	sub, _ := obj["sub"].(string)
+	id, err := strconv.Atoi(sub)
+	if err != nil || id <= 0 {
+		return 0, ErrActor
+	}
+	return id, nil
+}
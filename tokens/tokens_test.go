@@ -0,0 +1,209 @@
+package tokens
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+const (
+	oldSecret     = "an-old-secret-of-at-least-32-bytes"
+	currentSecret = "the-current-secret-of-32-bytes-or-more"
+)
+
+// testClaims returns the claims Sign makes for user 7 of acme, to be altered
+func testClaims() *jwt.Claims {
+	var claims jwt.Claims
+	claims.Subject = "7"
+	claims.ID = "session-1"
+	claims.Issued = jwt.NewNumericTime(time.Now())
+	claims.NotBefore = jwt.NewNumericTime(time.Now().Add(-time.Second))
+	claims.Expires = jwt.NewNumericTime(time.Now().Add(time.Hour))
+	claims.Issuer = Issuer
+	claims.Audiences = []string{Audience}
+	claims.Set = map[string]interface{}{TenantClaim: "acme"}
+	return &claims
+}
+
+func signClaims(t *testing.T, claims *jwt.Claims, secret string) []byte {
+	t.Helper()
+
+	token, err := claims.HMACSign(jwt.HS256, []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// sameGrant compares grants, expiry times by the instant they name
+func sameGrant(a, b Grant) bool {
+	expires := a.Expires.Equal(b.Expires)
+	a.Expires, b.Expires = time.Time{}, time.Time{}
+	return expires && a == b
+}
+
+func TestCheck(t *testing.T) {
+	keys := NewKeys(currentSecret, []string{oldSecret})
+
+	tests := []struct {
+		name string
+		// alter changes the claims before they are signed
+		alter   func(c *jwt.Claims)
+		secret  string
+		want    Grant
+		wantErr error
+	}{
+		{
+			name:   "current key",
+			secret: currentSecret,
+			want:   Grant{UserID: 7, Tenant: "acme", SessionID: "session-1"},
+		},
+		{
+			name:   "previous key",
+			secret: oldSecret,
+			want:   Grant{UserID: 7, Tenant: "acme", SessionID: "session-1"},
+		},
+		{
+			name:    "retired key",
+			secret:  "a-retired-secret-of-at-least-32-bytes",
+			wantErr: ErrSignature,
+		},
+		{
+			name:   "no tenant claim is the default tenant",
+			alter:  func(c *jwt.Claims) { delete(c.Set, TenantClaim) },
+			secret: currentSecret,
+			want:   Grant{UserID: 7, Tenant: DefaultTenant, SessionID: "session-1"},
+		},
+		{
+			name:   "other tenant",
+			alter:  func(c *jwt.Claims) { c.Set[TenantClaim] = "globex" },
+			secret: oldSecret,
+			want:   Grant{UserID: 7, Tenant: "globex", SessionID: "session-1"},
+		},
+		{
+			name:    "expired",
+			alter:   func(c *jwt.Claims) { c.Expires = jwt.NewNumericTime(time.Now().Add(-time.Minute)) },
+			secret:  currentSecret,
+			wantErr: ErrExpired,
+		},
+		{
+			name:    "not yet valid",
+			alter:   func(c *jwt.Claims) { c.NotBefore = jwt.NewNumericTime(time.Now().Add(time.Hour)) },
+			secret:  currentSecret,
+			wantErr: ErrExpired,
+		},
+		{
+			name:    "wrong audience",
+			alter:   func(c *jwt.Claims) { c.Audiences = []string{"elsewhere.com"} },
+			secret:  currentSecret,
+			wantErr: ErrAudience,
+		},
+		{
+			name:    "wrong issuer",
+			alter:   func(c *jwt.Claims) { c.Issuer = "elsewhere.com" },
+			secret:  currentSecret,
+			wantErr: ErrIssuer,
+		},
+		{
+			name:    "subject is not a user id",
+			alter:   func(c *jwt.Claims) { c.Subject = "alice" },
+			secret:  currentSecret,
+			wantErr: ErrSubject,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := testClaims()
+			if tt.alter != nil {
+				tt.alter(claims)
+			}
+
+			_, got, err := Check(keys, signClaims(t, claims, tt.secret))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			tt.want.Expires = claims.Expires.Time()
+			if !sameGrant(got, tt.want) {
+				t.Errorf("got grant %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignCheck(t *testing.T) {
+	old := NewKeys(oldSecret, nil)
+	rotated := NewKeys(currentSecret, []string{oldSecret})
+	want := Grant{UserID: 7, Tenant: "acme", SessionID: "session-1", Expires: time.Now().Add(time.Hour).Truncate(time.Second)}
+
+	// tokens handed out before the rotation keep working after it
+	token, err := Sign(old, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keys := range []Keys{old, rotated} {
+		if _, got, err := Check(keys, token); err != nil || !sameGrant(got, want) {
+			t.Errorf("got grant %+v, %v; want %+v", got, err, want)
+		}
+	}
+
+	// and those signed after it are refused by replicas not yet rotated
+	token, err = Sign(rotated, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = Check(old, token); !errors.Is(err, ErrSignature) {
+		t.Errorf("got %v, want ErrSignature", err)
+	}
+}
+
+func TestCheckActor(t *testing.T) {
+	keys := NewKeys(currentSecret, nil)
+
+	tests := []struct {
+		name    string
+		act     interface{}
+		want    int
+		wantErr error
+	}{
+		{name: "admin by id", act: map[string]interface{}{"sub": "1"}, want: 1},
+		{name: "not an object", act: "1", wantErr: ErrActor},
+		{name: "no subject", act: map[string]interface{}{}, wantErr: ErrActor},
+		{name: "subject is a number", act: map[string]interface{}{"sub": 1}, wantErr: ErrActor},
+		{name: "subject is not a user id", act: map[string]interface{}{"sub": "admin"}, wantErr: ErrActor},
+		{name: "user zero", act: map[string]interface{}{"sub": "0"}, wantErr: ErrActor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := testClaims()
+			claims.Set[ActorClaim] = tt.act
+			token := signClaims(t, claims, currentSecret)
+
+			_, got, err := Check(keys, token)
+			if !errors.Is(err, tt.wantErr) || got.ActorID != tt.want {
+				t.Errorf("got actor %d, %v; want %d, %v", got.ActorID, err, tt.want, tt.wantErr)
+			}
+			if !IsImpersonation(token) {
+				t.Error("IsImpersonation is false with an actor claim")
+			}
+		})
+	}
+
+	// Sign sets the claim only when someone acts as the user
+	for _, actorID := range []int{0, 1} {
+		token, err := Sign(keys, Grant{UserID: 7, Tenant: "acme", Expires: time.Now().Add(time.Hour), ActorID: actorID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, g, err := Check(keys, token)
+		if err != nil || g.ActorID != actorID || IsImpersonation(token) != (actorID != 0) {
+			t.Errorf("signed actor %d: got %d, %v, impersonation %v", actorID, g.ActorID, err, IsImpersonation(token))
+		}
+	}
+}
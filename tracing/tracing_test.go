@@ -0,0 +1,119 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+)
+
+// record installs a tracer provider keeping every ended span
+func record(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	if _, err := Setup(context.Background(), Config{Exporter: ExporterNone}); err != nil {
+		t.Fatal(err)
+	}
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return rec
+}
+
+func TestPropagation(t *testing.T) {
+	record(t)
+
+	in := http.Header{}
+	in.Set("traceparent", traceparent)
+	ctx := Extract(context.Background(), in)
+	if got := TraceID(ctx); got != traceID {
+		t.Fatalf("extracted trace %q, want %q", got, traceID)
+	}
+
+	ctx, span := Start(ctx, "child")
+	defer span.End()
+
+	out := http.Header{}
+	Inject(ctx, out)
+	got := out.Get("traceparent")
+	if !strings.HasPrefix(got, "00-"+traceID+"-") || got == traceparent {
+		t.Errorf("injected %q, want the trace continued by the child span", got)
+	}
+
+	if TraceID(context.Background()) != "" {
+		t.Error("a context without a span has a trace id")
+	}
+}
+
+func TestDetach(t *testing.T) {
+	record(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, span := Start(ctx, "request")
+	defer span.End()
+
+	detached := Detach(ctx)
+	cancel()
+
+	if detached.Err() != nil {
+		t.Error("the detached context was cancelled with the request")
+	}
+	if TraceID(detached) != TraceID(ctx) || TraceID(detached) == "" {
+		t.Errorf("got trace %q, want %q", TraceID(detached), TraceID(ctx))
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	rec := record(t)
+
+	ctx, span := Start(context.Background(), "query")
+	RecordError(ctx, errors.New("connection refused"))
+	span.End()
+
+	ended := rec.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d spans", len(ended))
+	}
+	if s := ended[0].Status(); s.Code != codes.Error || s.Description != "connection refused" {
+		t.Errorf("got status %+v", s)
+	}
+	if len(ended[0].Events()) != 1 {
+		t.Error("the error is not recorded as an event")
+	}
+}
+
+func TestSetupStdout(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+
+	var out bytes.Buffer
+	shutdown, err := Setup(context.Background(), Config{Exporter: ExporterStdout, Stdout: &out, SampleRatio: 1, Service: "goauth"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), "DBRepo.GetUserById")
+	span.End()
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "DBRepo.GetUserById") || !strings.Contains(out.String(), "goauth") {
+		t.Errorf("the span was not exported: %s", out.String())
+	}
+
+	if _, err = Setup(context.Background(), Config{Exporter: "zipkin"}); err == nil {
+		t.Error("an unknown exporter was accepted")
+	}
+}
@@ -0,0 +1,295 @@
+// Package webhooks signs and posts event payloads to subscribers' endpoints.
+//
+// Every request carries the event id, a Unix timestamp and an HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the endpoint's secret:
+//
+//	Webhook-Id: 4f1c...
+//	Webhook-Timestamp: 1700000000
+//	Webhook-Signature: v1=9a0b...
+//
+// Receivers recompute the signature with Verify and refuse old timestamps, so a
+// captured request cannot be replayed later.
+package webhooks
+
+import (
+	"auth/api/models"
+	"auth/api/tracing"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers set on every delivery
+const (
+	HeaderID        = "Webhook-Id"
+	HeaderTimestamp = "Webhook-Timestamp"
+	HeaderSignature = "Webhook-Signature"
+)
+
+const (
+	// SecretPrefix starts every endpoint secret
+	SecretPrefix = "whsec_"
+	// signatureVersion names the signing scheme in the signature header
+	signatureVersion = "v1"
+	// firstRetry is the wait before the first retry, doubled for each one after
+	firstRetry = 30 * time.Second
+	// maxRetry caps the wait between retries
+	maxRetry = 6 * time.Hour
+)
+
+var (
+	// ErrSignature no signature in the header matches the body error
+	ErrSignature = errors.New("webhooks: signature not valid")
+	// ErrTimestamp timestamp missing or outside the tolerance error
+	ErrTimestamp = errors.New("webhooks: timestamp too old or not valid")
+	// ErrPrivateAddress endpoint resolves to an internal address error
+	ErrPrivateAddress = errors.New("webhooks: endpoint resolves to a private address")
+)
+
+// privateNets are loopback, link-local, private and shared address ranges,
+// which endpoints may not point at unless the sender allows it
+var privateNets = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "::1/128", "::/128", "fc00::/7", "fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// IsPrivate reports whether an address is one endpoints may not point at
+func IsPrivate(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is the JSON body posted to endpoints
+type Event struct {
+	// ID is the same in every delivery of the event, replays included
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	CreatedAt time.Time              `json:"createdAt"`
+	Tenant    string                 `json:"tenant"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// NewEvent returns an event of a tenant with a new id
+func NewEvent(eventType, tenant string, data map[string]interface{}) (Event, error) {
+	id, err := newEventID()
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{ID: id, Type: eventType, CreatedAt: time.Now().UTC(), Tenant: tenant, Data: data}, nil
+}
+
+// Outbox returns the outbox message queueing the event for the endpoints of
+// the tenant, see models.OutboxMessage
+func (e Event) Outbox(tenantID int) (models.OutboxMessage, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return models.OutboxMessage{}, err
+	}
+	return models.OutboxMessage{Kind: models.OutboxEvent, TenantID: tenantID, Payload: payload}, nil
+}
+
+// UserData is the user object events carry, users that are only known by id
+// get only the id
+func UserData(u models.User) map[string]interface{} {
+	if u.UserName == "" {
+		return map[string]interface{}{"id": u.ID}
+	}
+	return map[string]interface{}{
+		"id":       u.ID,
+		"username": u.UserName,
+		"email":    u.Email,
+		"name":     u.Name,
+		"role":     u.Role,
+	}
+}
+
+// StatusEvent is the event reporting a move to an account status. Deleting an
+// account is reported as user.deleted, the same as erasing it.
+func StatusEvent(status string) string {
+	if status == models.StatusDeleted {
+		return models.EventUserDeleted
+	}
+	return models.EventUserStatusChanged
+}
+
+// NewSecret returns a random endpoint secret
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return SecretPrefix + hex.EncodeToString(b), nil
+}
+
+// newEventID returns a random event id, receivers use it to drop duplicates
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature header value of a body sent at a time
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	return signatureVersion + "=" + hex.EncodeToString(mac(secret, strconv.FormatInt(timestamp.Unix(), 10), body))
+}
+
+// Verify checks the signature and timestamp headers of a delivery. The
+// signature header may hold several space separated signatures, as it does
+// while a receiver rotates secrets; one matching is enough.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	ts := header.Get(HeaderTimestamp)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrTimestamp
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+		return ErrTimestamp
+	}
+
+	want := mac(secret, ts, body)
+	for _, s := range strings.Fields(header.Get(HeaderSignature)) {
+		if !strings.HasPrefix(s, signatureVersion+"=") {
+			continue
+		}
+		got, err := hex.DecodeString(strings.TrimPrefix(s, signatureVersion+"="))
+		if err == nil && hmac.Equal(got, want) {
+			return nil
+		}
+	}
+	return ErrSignature
+}
+
+func mac(secret, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Backoff returns how long to wait before retrying a delivery that failed
+// attempts times: 30s, 1m, 2m, ... up to 6h
+func Backoff(attempts int) time.Duration {
+	wait := firstRetry
+	for i := 1; i < attempts && wait < maxRetry; i++ {
+		wait *= 2
+	}
+	if wait > maxRetry {
+		wait = maxRetry
+	}
+	return wait
+}
+
+// Sender posts signed payloads
+type Sender struct {
+	Client *http.Client
+}
+
+// NewSender returns a sender giving each delivery timeout to be answered.
+// Unless allowPrivate is set it refuses to connect to private addresses, so
+// an endpoint cannot be used to reach services inside the network; the check
+// is made on the address dialed, after DNS, so rebinding does not get past it.
+func NewSender(timeout time.Duration, allowPrivate bool) *Sender {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || IsPrivate(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &Sender{
+		Client: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+			// a redirect would be followed without the signature being checked
+			// against the new URL, subscribers must register the final one
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Send posts the body to url signed with secret. It returns the status the
+// endpoint answered with, 0 when there was no answer, and an error unless the
+// status is 2xx.
+func (s *Sender) Send(ctx context.Context, url, secret, eventID string, body []byte) (int, error) {
+	ctx, span := tracing.StartKind(ctx, "HTTP POST webhook", trace.SpanKindClient,
+		semconv.HTTPMethodKey.String(http.MethodPost),
+		semconv.HTTPURLKey.String(url),
+	)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "goauth-webhooks")
+	req.Header.Set(HeaderID, eventID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(HeaderSignature, Sign(secret, now, body))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		tracing.RecordError(ctx, err)
+		return 0, fmt.Errorf("webhooks: endpoint unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("webhooks: endpoint answered %s", resp.Status)
+		tracing.RecordError(ctx, err)
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, nil
+}
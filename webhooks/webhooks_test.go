@@ -0,0 +1,193 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testSecret = "whsec_test"
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"id":"1","type":"user.created"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		wantErr   error
+	}{
+		{
+			name:      "valid",
+			timestamp: strconv.FormatInt(now.Unix(), 10),
+			signature: Sign(testSecret, now, body),
+		},
+		{
+			name:      "one of several signatures",
+			timestamp: strconv.FormatInt(now.Unix(), 10),
+			signature: Sign("whsec_old", now, body) + " " + Sign(testSecret, now, body),
+		},
+		{
+			name:      "other secret",
+			timestamp: strconv.FormatInt(now.Unix(), 10),
+			signature: Sign("whsec_other", now, body),
+			wantErr:   ErrSignature,
+		},
+		{
+			name:      "signed for another body",
+			timestamp: strconv.FormatInt(now.Unix(), 10),
+			signature: Sign(testSecret, now, []byte(`{}`)),
+			wantErr:   ErrSignature,
+		},
+		{
+			// the timestamp is signed, changing it to pass the age check fails
+			name:      "timestamp moved",
+			timestamp: strconv.FormatInt(now.Unix(), 10),
+			signature: Sign(testSecret, now.Add(-time.Hour), body),
+			wantErr:   ErrSignature,
+		},
+		{
+			name:      "unknown version",
+			timestamp: strconv.FormatInt(now.Unix(), 10),
+			signature: "v2=" + Sign(testSecret, now, body)[len("v1="):],
+			wantErr:   ErrSignature,
+		},
+		{
+			name:      "replayed later",
+			timestamp: strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10),
+			signature: Sign(testSecret, now.Add(-10*time.Minute), body),
+			wantErr:   ErrTimestamp,
+		},
+		{
+			name:      "from the future",
+			timestamp: strconv.FormatInt(now.Add(10*time.Minute).Unix(), 10),
+			signature: Sign(testSecret, now.Add(10*time.Minute), body),
+			wantErr:   ErrTimestamp,
+		},
+		{
+			name:      "no timestamp",
+			signature: Sign(testSecret, now, body),
+			wantErr:   ErrTimestamp,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set(HeaderTimestamp, tt.timestamp)
+			header.Set(HeaderSignature, tt.signature)
+
+			if err := Verify(testSecret, header, body, 5*time.Minute); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsPrivate(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::1", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsPrivate(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("IsPrivate(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	received := make(chan error, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ := ioutil.ReadAll(r.Body)
+		received <- Verify(testSecret, r.Header, got, time.Minute)
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		}
+	}))
+	defer endpoint.Close()
+
+	tests := []struct {
+		name         string
+		allowPrivate bool
+		path         string
+		wantStatus   int
+		wantErr      error
+	}{
+		{name: "private address refused", path: "/hook", wantErr: ErrPrivateAddress},
+		{name: "private address allowed", allowPrivate: true, path: "/hook", wantStatus: http.StatusOK},
+		{name: "redirect not followed", allowPrivate: true, path: "/moved", wantStatus: http.StatusFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSender(time.Second, tt.allowPrivate)
+			status, err := s.Send(context.Background(), endpoint.URL+tt.path, testSecret, "1", body)
+			if status != tt.wantStatus {
+				t.Errorf("got status %d, want %d", status, tt.wantStatus)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+
+			select {
+			case err := <-received:
+				if tt.wantErr != nil {
+					t.Error("the endpoint was reached")
+				} else if err != nil {
+					t.Errorf("delivery does not verify: %v", err)
+				}
+			default:
+				if tt.wantErr == nil {
+					t.Error("the endpoint was not reached")
+				}
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, 6 * time.Hour},
+		{1000, 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}